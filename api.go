@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// apiMaxLimit bounds the documents GET /documents returns at once.
+const apiMaxLimit = 1000
+
+// apiDocument is a saved file, as the JSON API of -web-addr describes it.
+type apiDocument struct {
+	ID       string    `json:"id"`
+	Output   string    `json:"output"`
+	Filename string    `json:"filename"`
+	Mailbox  string    `json:"mailbox"`
+	Source   string    `json:"source"`
+	Part     int       `json:"part"`
+	SHA256   string    `json:"sha256"`
+	SavedAt  time.Time `json:"saved_at"`
+	URL      string    `json:"url,omitempty"` // to download it from, while it can be
+
+	// Of the message, when the state database catalogs them
+	Sender  string     `json:"sender,omitempty"`
+	Subject string     `json:"subject,omitempty"`
+	Date    *time.Time `json:"date,omitempty"`
+}
+
+func newAPIDocument(f webFile) apiDocument {
+	doc := apiDocument{ID: f.ID, Output: f.Output, Filename: f.Name, Mailbox: f.Mailbox, Source: f.Source,
+		Part: f.Part, SHA256: f.SHA256, SavedAt: f.SavedAt, Sender: f.From, Subject: f.Subject}
+	if !f.Date.IsZero() {
+		doc.Date = &f.Date
+	}
+	if f.Kept {
+		doc.URL = "/files/" + f.ID
+	}
+	return doc
+}
+
+// registerAPI adds the JSON API to the web interface: POST /scan to start a
+// run, GET /runs and /runs/{id} to follow them, and GET /documents and
+// /documents/{id} to query the files saved.
+func (ui *webUI) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("POST /scan", ui.apiScan)
+	mux.HandleFunc("GET /runs", ui.apiRuns)
+	mux.HandleFunc("GET /runs/{id}", ui.apiRun)
+	mux.HandleFunc("GET /documents", ui.apiDocuments)
+	mux.HandleFunc("GET /documents/{id}", ui.apiDocument)
+}
+
+func (ui *webUI) apiScan(w http.ResponseWriter, r *http.Request) {
+	id := ui.status.requestRun()
+	slog.Info("Run requested through the API", "run", id, "remote", r.RemoteAddr)
+	w.Header().Set("Location", "/runs/"+strconv.Itoa(id))
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": id, "status": "pending", "url": "/runs/" + strconv.Itoa(id)})
+}
+
+func (ui *webUI) apiRuns(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"runs": ui.status.recentRuns()})
+}
+
+func (ui *webUI) apiRun(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "no such run")
+		return
+	}
+	if run, ok := ui.status.findRun(id); ok {
+		writeJSON(w, http.StatusOK, run)
+		return
+	}
+	if id == ui.status.pendingRun() {
+		writeJSON(w, http.StatusOK, map[string]any{"id": id, "status": "pending"})
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, "no such run")
+}
+
+// apiDocuments lists the files saved, newest first, optionally only those
+// whose output path or mailbox contain all the words of the q parameter,
+// or from the mailbox parameter, limit at a time from offset.
+func (ui *webUI) apiDocuments(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, offset := 100, 0
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > apiMaxLimit {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(apiMaxLimit))
+			return
+		}
+		limit = n
+	}
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be a number of documents")
+			return
+		}
+		offset = n
+	}
+
+	files, total, err := ui.files(extract.RecordedFilter{Words: strings.Fields(query.Get("q")), Mailbox: query.Get("mailbox"),
+		Limit: limit, Offset: offset})
+	if err != nil {
+		slog.Error("Error reading the state database", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error reading the state database")
+		return
+	}
+
+	docs := []apiDocument{}
+	for _, f := range files {
+		docs = append(docs, newAPIDocument(f))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"total": total, "offset": offset, "documents": docs})
+}
+
+func (ui *webUI) apiDocument(w http.ResponseWriter, r *http.Request) {
+	f, found, err := ui.file(r.PathValue("id"))
+	if err != nil {
+		slog.Error("Error reading the state database", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error reading the state database")
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "no such document")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIDocument(f))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
+
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
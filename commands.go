@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// runScan implements "maildir2pdf scan", a dry run of extract: the
+// attachments that would be saved are listed but not written.
+func runScan(args []string) error {
+	var sources sourceFlags
+	fs := newFlagSet("scan", "[FLAGS] [MESSAGE FILES]")
+	sources.register(fs)
+	fs.Parse(args)
+	files := fs.Args()
+	if err := sources.check(files); err != nil {
+		return err
+	}
+
+	x := extract.NewExtractor("")
+	var mu sync.Mutex
+	var count int
+	var total int64
+	x.Handler = func(a *extract.Attachment, content io.Reader) error {
+		size, err := io.Copy(io.Discard, content)
+		if err != nil {
+			return fmt.Errorf("error reading attachment %s: %v", a.Filename, err)
+		}
+		kind := "attachment"
+		if a.MediaType == "application/pdf" {
+			kind = "PDF"
+		}
+		source := a.Email.Path
+		if source == "" {
+			source = "standard input"
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+		total += size
+		fmt.Printf("Found %s: %s (%d bytes, from %s in mailbox %s)\n", kind, a.Filename, size, source, a.Email.Mailbox)
+		return nil
+	}
+	if err := dryRun(&sources, files, x); err != nil {
+		return err
+	}
+	fmt.Printf("%d attachments, %d bytes\n", count, total)
+	return nil
+}
+
+// dryRun scans the sources given to scan or stats, and the message files
+// named as arguments, with x, whose Handler receives the attachments instead
+// of them being saved.
+func dryRun(sources *sourceFlags, files []string, x *extract.Extractor) error {
+	scanner, err := sources.configure(x)
+	if err != nil {
+		return err
+	}
+	imapSource, err := sources.imapSource()
+	if err != nil {
+		return err
+	}
+	if err := sources.scan(scanner, imapSource); err != nil {
+		return fatal("Error scanning", "error", err)
+	}
+	scanner.ScanFiles(files, "INBOX")
+	if sources.stdin {
+		if err := x.ExtractMessage(os.Stdin, "", "INBOX"); err != nil {
+			return fatal("Error processing standard input", "error", err)
+		}
+	}
+	return nil
+}
+
+// openStateFlag adds -state to the flags of a command reading the state
+// database, parses them, and opens it.
+func openStateFlag(fs *flag.FlagSet, args []string) (*extract.StateDB, error) {
+	var statePath string
+	fs.StringVar(&statePath, "state", "", "State database written by extract -state")
+	fs.Parse(args)
+	if statePath == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return nil, exitStatus(2)
+	}
+	// Opening would create an empty database for a mistyped path
+	if _, err := os.Stat(statePath); err != nil {
+		return nil, fatal("Error opening state database", "error", err)
+	}
+	state, err := extract.OpenState(statePath)
+	if err != nil {
+		return nil, fatal("Error opening state database", "error", err)
+	}
+	return state, nil
+}
+
+// listColumns are the fields list prints for each file, in order.
+var listColumns = []string{"date", "sender", "sender_name", "subject", "filename", "size", "mailbox", "output", "source", "saved_at", "sha256"}
+
+// listEntry is a file list prints with -format json.
+type listEntry struct {
+	Date       *time.Time `json:"date,omitempty"`
+	Sender     string     `json:"sender"`
+	SenderName string     `json:"sender_name"`
+	Subject    string     `json:"subject"`
+	Filename   string     `json:"filename"`
+	Size       int64      `json:"size"`
+	Mailbox    string     `json:"mailbox"`
+	Output     string     `json:"output"`
+	Source     string     `json:"source"`
+	SavedAt    time.Time  `json:"saved_at"`
+	SHA256     string     `json:"sha256"`
+}
+
+// runList implements "maildir2pdf list", which queries the catalog of the
+// files saved by earlier runs kept in the state database, and prints those
+// matching its flags, oldest first, as tab- or comma-separated values or
+// JSON.
+func runList(args []string) error {
+	var sender, mailbox, subject, format string
+	var year int
+	fs := newFlagSet("list", "-state FILE [-sender DOMAIN] [-year YEAR] [-format tsv|csv|json]")
+	fs.StringVar(&sender, "sender", "", "Only list files from this sender address, or from addresses in this domain or its subdomains")
+	fs.IntVar(&year, "year", 0, "Only list files from messages sent this year, or saved this year if their date is unknown")
+	fs.StringVar(&mailbox, "mailbox", "", "Only list files from this mailbox")
+	fs.StringVar(&subject, "subject", "", "Only list files from messages whose subject contains this text, ignoring ASCII case")
+	fs.StringVar(&format, "format", "tsv", "Print files as tsv or csv lines, or as a json array")
+	state, err := openStateFlag(fs, args)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	if format != "tsv" && format != "csv" && format != "json" {
+		return fatal("-format must be tsv, csv or json", "format", format)
+	}
+
+	recorded, _, err := state.SearchRecorded(extract.RecordedFilter{Mailbox: mailbox, Sender: sender, Year: year,
+		Subject: subject, OldestFirst: true})
+	if err != nil {
+		return fatal("Error reading state database", "error", err)
+	}
+
+	switch format {
+	case "json":
+		entries := []listEntry{}
+		for _, r := range recorded {
+			entry := listEntry{Sender: r.From, SenderName: r.FromName, Subject: r.Subject, Filename: r.Filename,
+				Size: r.Size, Mailbox: r.Mailbox, Output: r.Output, Source: r.Source, SavedAt: r.SavedAt, SHA256: r.SHA256}
+			if !r.Date.IsZero() {
+				entry.Date = &r.Date
+			}
+			entries = append(entries, entry)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			return fatal("Error writing files", "error", err)
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(listColumns)
+		for _, r := range recorded {
+			w.Write(listRecord(r))
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fatal("Error writing files", "error", err)
+		}
+	default:
+		// Tabs and line breaks in headers would break the columns
+		clean := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+		for _, r := range recorded {
+			fields := listRecord(r)
+			for i := range fields {
+				fields[i] = clean.Replace(fields[i])
+			}
+			fmt.Println(strings.Join(fields, "\t"))
+		}
+	}
+	return nil
+}
+
+// listRecord returns the listColumns of r, with the message date as
+// YYYY-MM-DD, empty if unknown.
+func listRecord(r extract.Recorded) []string {
+	var date, size string
+	if !r.Date.IsZero() {
+		date = r.Date.Format("2006-01-02")
+	}
+	if r.Filename != "" {
+		size = strconv.FormatInt(r.Size, 10)
+	}
+	return []string{date, r.From, r.FromName, r.Subject, r.Filename, size, r.Mailbox, r.Output, r.Source,
+		r.SavedAt.Local().Format("2006-01-02 15:04:05"), r.SHA256}
+}
+
+// runStats implements "maildir2pdf stats". With -state, it summarizes the
+// files saved by earlier runs; otherwise it scans the sources given like
+// scan does, and reports on the attachments extract would save.
+func runStats(args []string) error {
+	var sources sourceFlags
+	var statePath string
+	var top int
+	fs := newFlagSet("stats", "-state FILE | [FLAGS] [MESSAGE FILES]")
+	fs.StringVar(&statePath, "state", "", "Summarize this state database, written by extract -state, instead of scanning")
+	fs.IntVar(&top, "top", 10, "Number of top senders to list")
+	sources.register(fs)
+	fs.Parse(args)
+	files := fs.Args()
+
+	if statePath == "" && !sources.given(files) {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	if statePath == "" {
+		if err := sources.check(files); err != nil {
+			return err
+		}
+		return scanStats(&sources, files, top)
+	}
+	if sources.given(files) {
+		return fatal("-state cannot be combined with message sources")
+	}
+	// Opening would create an empty database for a mistyped path
+	if _, err := os.Stat(statePath); err != nil {
+		return fatal("Error opening state database", "error", err)
+	}
+	state, err := extract.OpenState(statePath)
+	if err != nil {
+		return fatal("Error opening state database", "error", err)
+	}
+	defer state.Close()
+
+	messages, err := state.MessageCount()
+	if err != nil {
+		return fatal("Error reading state database", "error", err)
+	}
+	recorded, err := state.Recorded()
+	if err != nil {
+		return fatal("Error reading state database", "error", err)
+	}
+
+	var size int64
+	var missing, remote int
+	byMailbox := make(map[string]int)
+	for _, r := range recorded {
+		byMailbox[r.Mailbox]++
+		if extract.IsRemoteOutput(r.Output) {
+			remote++
+		} else if info, err := os.Stat(r.Output); err == nil {
+			size += info.Size()
+		} else {
+			missing++
+		}
+	}
+
+	fmt.Printf("Messages scanned: %d\n", messages)
+	fmt.Printf("Files saved: %d (%d bytes on disk, %d missing)\n", len(recorded), size, missing)
+	if remote > 0 {
+		fmt.Printf("Files stored remotely, not checked: %d\n", remote)
+	}
+	if len(recorded) > 0 {
+		fmt.Printf("First saved: %s\n", recorded[0].SavedAt.Local().Format("2006-01-02 15:04:05"))
+		fmt.Printf("Last saved: %s\n", recorded[len(recorded)-1].SavedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+
+	mailboxes := make([]string, 0, len(byMailbox))
+	for mailbox := range byMailbox {
+		mailboxes = append(mailboxes, mailbox)
+	}
+	sort.Strings(mailboxes)
+	if len(mailboxes) > 0 {
+		fmt.Println("Files by mailbox:")
+	}
+	for _, mailbox := range mailboxes {
+		fmt.Printf("  %s: %d\n", mailbox, byMailbox[mailbox])
+	}
+	return nil
+}
+
+// checksum is a file to verify and the SHA-256 it should have, with where
+// it came from for the report.
+type checksum struct {
+	path, sha256, about string
+}
+
+// runVerify implements "maildir2pdf verify", which checks saved files
+// against the SHA-256 recorded when they were written: by a state database,
+// a manifest, or the .sha256 and SHA256SUMS files of -checksums in the
+// directories given. It exits with status 1 if any file is missing or
+// modified.
+func runVerify(args []string) error {
+	var statePath, manifestPath, custodyPath, custodyKeyPath string
+	fs := newFlagSet("verify", "-state FILE | -manifest FILE | -custody FILE | DIRECTORY...")
+	fs.StringVar(&statePath, "state", "", "Check the files recorded in this state database, written by extract -state")
+	fs.StringVar(&manifestPath, "manifest", "", "Check the files listed in this manifest, written by extract -manifest")
+	fs.StringVar(&custodyPath, "custody", "", "Check the files listed in this chain-of-custody manifest, written by extract -custody")
+	fs.StringVar(&custodyKeyPath, "custody-pubkey", "", "First check the signature of the -custody manifest with this Ed25519 public key (PEM)")
+	fs.Parse(args)
+	if statePath == "" && manifestPath == "" && custodyPath == "" && fs.NArg() == 0 {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	if custodyKeyPath != "" && custodyPath == "" {
+		return fatal("-custody-pubkey requires -custody")
+	}
+
+	var sums []checksum
+	if statePath != "" {
+		// Opening would create an empty database for a mistyped path
+		if _, err := os.Stat(statePath); err != nil {
+			return fatal("Error opening state database", "error", err)
+		}
+		state, err := extract.OpenState(statePath)
+		if err != nil {
+			return fatal("Error opening state database", "error", err)
+		}
+		recorded, err := state.Recorded()
+		state.Close()
+		if err != nil {
+			return fatal("Error reading state database", "error", err)
+		}
+		for _, r := range recorded {
+			sums = append(sums, checksum{r.Output, r.SHA256, fmt.Sprintf("from %s in mailbox %s", r.Source, r.Mailbox)})
+		}
+	}
+	if manifestPath != "" {
+		entries, err := readManifest(manifestPath)
+		if err != nil {
+			return fatal("Error reading manifest", "error", err)
+		}
+		for _, e := range entries {
+			// Skipped duplicates were never saved
+			if e.Output != "" {
+				sums = append(sums, checksum{e.Output, e.SHA256, fmt.Sprintf("from %s in mailbox %s", e.Source, e.Mailbox)})
+			}
+		}
+	}
+	if custodyPath != "" {
+		var key ed25519.PublicKey
+		if custodyKeyPath != "" {
+			var err error
+			if key, err = readVerifyingKey(custodyKeyPath); err != nil {
+				return fatal("Error reading -custody-pubkey", "error", err)
+			}
+		}
+		custody, err := readCustody(custodyPath, key)
+		if err != nil {
+			return fatal("Error reading custody manifest", "error", err)
+		}
+		if key != nil {
+			fmt.Printf("Signature of %s is valid\n", custodyPath)
+		}
+		for _, r := range custody.Files {
+			if r.Output != "" {
+				sums = append(sums, checksum{r.Output, r.SHA256, fmt.Sprintf("from %s in mailbox %s", r.Source, r.Mailbox)})
+			}
+		}
+	}
+	for _, dir := range fs.Args() {
+		found, err := readChecksumFiles(dir)
+		if err != nil {
+			return fatal("Error reading checksums", "error", err)
+		}
+		sums = append(sums, found...)
+	}
+
+	var missing, modified, remote int
+	for _, c := range sums {
+		if extract.IsRemoteOutput(c.path) {
+			remote++
+			continue
+		}
+		sum, err := fileSHA256(c.path)
+		switch {
+		case os.IsNotExist(err):
+			missing++
+			fmt.Printf("Missing: %s (%s)\n", c.path, c.about)
+		case err != nil:
+			modified++
+			fmt.Printf("Unreadable: %s: %v\n", c.path, err)
+		case sum != c.sha256:
+			modified++
+			fmt.Printf("Modified: %s (%s)\n", c.path, c.about)
+		}
+	}
+	fmt.Printf("Verified %d files: %d missing, %d modified or unreadable\n", len(sums)-remote, missing, modified)
+	if remote > 0 {
+		fmt.Printf("Skipped %d files stored remotely\n", remote)
+	}
+	if missing > 0 || modified > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// readChecksumFiles finds the .sha256 and SHA256SUMS files written by
+// extract -checksums under dir, and returns the checksums they list.
+func readChecksumFiles(dir string) ([]checksum, error) {
+	var sums []checksum
+	err := filepath.WalkDir(dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || (d.Name() != extract.SumsFile && !strings.HasSuffix(d.Name(), ".sha256")) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for i, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			// sha256sum lines are the hash, a space, and a space or a "*"
+			// for binary mode before the name
+			sum, name, ok := strings.Cut(line, " ")
+			if !ok || len(sum) != sha256.Size*2 || name == "" {
+				return fmt.Errorf("%s:%d: not a sha256sum line", path, i+1)
+			}
+			name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+			sums = append(sums, checksum{filepath.Join(filepath.Dir(path), name), strings.ToLower(sum), "listed in " + path})
+		}
+		return nil
+	})
+	return sums, err
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
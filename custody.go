@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// custodyRecord ties a saved file to the message it was extracted from, for
+// the -custody manifest.
+type custodyRecord struct {
+	Output        string    `json:"output"`
+	SHA256        string    `json:"sha256"`
+	Size          int64     `json:"size"`
+	DecodedSHA256 string    `json:"decoded_sha256"` // of the attachment as decoded from the message
+	OrigName      string    `json:"original_filename"`
+	Attachment    int       `json:"attachment"` // 1-based position among the attachments extracted from the message
+	Source        string    `json:"source"`
+	Mailbox       string    `json:"mailbox"`
+	MessageID     string    `json:"message_id,omitempty"`
+	MessageSHA256 string    `json:"message_sha256"`
+	DKIM          string    `json:"dkim,omitempty"` // with -verify-dkim
+	DKIMDomain    string    `json:"dkim_domain,omitempty"`
+	ExtractedAt   time.Time `json:"extracted_at"`
+	DuplicateOf   string    `json:"duplicate_of,omitempty"`
+}
+
+// custodyManifest is the chain-of-custody manifest written by -custody and
+// checked by "maildir2pdf verify -custody".
+type custodyManifest struct {
+	Tool     string          `json:"tool"`
+	Host     string          `json:"host,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Files    []custodyRecord `json:"files"`
+}
+
+// custodyLog collects the records of a run.
+type custodyLog struct {
+	mu       sync.Mutex
+	manifest custodyManifest
+}
+
+func newCustodyLog() *custodyLog {
+	host, _ := os.Hostname()
+	return &custodyLog{manifest: custodyManifest{Tool: "maildir2pdf", Host: host, Started: time.Now(), Files: []custodyRecord{}}}
+}
+
+func (c *custodyLog) saved(s *extract.Saved) {
+	source := s.Email.Path
+	if source == "" {
+		source = "standard input"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.manifest.Files = append(c.manifest.Files, custodyRecord{
+		Output:        s.Path,
+		SHA256:        s.SHA256,
+		Size:          s.Size,
+		DecodedSHA256: s.ContentSHA256,
+		OrigName:      s.Filename,
+		Attachment:    s.Index,
+		Source:        source,
+		Mailbox:       s.Email.Mailbox,
+		MessageID:     s.Email.MessageID,
+		MessageSHA256: s.Email.SHA256,
+		DKIM:          s.Email.DKIM,
+		DKIMDomain:    s.Email.DKIMDomain,
+		ExtractedAt:   s.Time.UTC(),
+		DuplicateOf:   s.DuplicateOf,
+	})
+}
+
+// write saves the manifest to path, and with key, an Ed25519 signature of
+// it to path.sig, as the 64 raw bytes that "openssl pkeyutl -verify -rawin"
+// checks.
+func (c *custodyLog) write(path string, key ed25519.PrivateKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.manifest.Finished = time.Now()
+	data, err := json.MarshalIndent(&c.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	return os.WriteFile(path+".sig", ed25519.Sign(key, data), 0644)
+}
+
+// readSigningKey reads an Ed25519 private key in PKCS #8 PEM form, as made
+// by "openssl genpkey -algorithm ed25519".
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return ed, nil
+}
+
+// readVerifyingKey reads an Ed25519 public key in PEM form, as made by
+// "openssl pkey -pubout".
+func readVerifyingKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ed, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return ed, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
+
+// readCustody reads a manifest written by -custody, checking its signature
+// with key if that is set.
+func readCustody(path string, key ed25519.PublicKey) (*custodyManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		sig, err := os.ReadFile(path + ".sig")
+		if err != nil {
+			return nil, fmt.Errorf("reading signature: %v", err)
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return nil, errors.New("the signature does not match: the manifest was altered or signed with another key")
+		}
+	}
+	var m custodyManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// runCounts tallies the outcome of scans.
+type runCounts struct {
+	Saved      int `json:"saved"`
+	Duplicates int `json:"duplicates"`
+	Errors     int `json:"errors"`
+}
+
+// maxDaemonRuns and maxRunErrors bound the runs, and the errors of each,
+// that the daemon remembers for -web-addr.
+const (
+	maxDaemonRuns = 100
+	maxRunErrors  = 100
+)
+
+// daemonRun is a run of the daemon.
+type daemonRun struct {
+	ID      int        `json:"id"`
+	Trigger string     `json:"trigger"` // "schedule", or "manual" when asked for through -web-addr
+	Status  string     `json:"status"`  // "running" or "finished"
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+	runCounts
+	ErrorMessages []string `json:"error_messages,omitempty"` // the first maxRunErrors
+}
+
+// daemonStatus is what the -status-addr endpoint reports.
+type daemonStatus struct {
+	mu sync.Mutex
+
+	Started      time.Time  `json:"started"`
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	LastRunStart *time.Time `json:"last_run_start,omitempty"`
+	LastRunEnd   *time.Time `json:"last_run_end,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	LastRun      runCounts  `json:"last_run"`
+	Total        runCounts  `json:"total"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastErrorAt  *time.Time `json:"last_error_at,omitempty"`
+
+	run  *daemonRun   // in progress, if any
+	runs []*daemonRun // the last maxDaemonRuns, oldest first
+	wake chan struct{}
+}
+
+func newDaemonStatus() *daemonStatus {
+	return &daemonStatus{Started: time.Now(), wake: make(chan struct{}, 1)}
+}
+
+func (st *daemonStatus) recordSaved(duplicate bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	counts := &runCounts{}
+	if st.run != nil {
+		counts = &st.run.runCounts
+	}
+	if duplicate {
+		counts.Duplicates++
+		st.Total.Duplicates++
+	} else {
+		counts.Saved++
+		st.Total.Saved++
+	}
+}
+
+func (st *daemonStatus) recordError(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	if st.run != nil {
+		st.run.Errors++
+		if len(st.run.ErrorMessages) < maxRunErrors {
+			st.run.ErrorMessages = append(st.run.ErrorMessages, err.Error())
+		}
+	}
+	st.Total.Errors++
+	st.LastError = err.Error()
+	st.LastErrorAt = &now
+}
+
+func (st *daemonStatus) startRun(trigger string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	st.Running = true
+	st.LastRunStart = &now
+	st.NextRun = nil
+	st.run = &daemonRun{ID: st.Runs + 1, Trigger: trigger, Status: "running", Start: now}
+	st.runs = append(st.runs, st.run)
+	if len(st.runs) > maxDaemonRuns {
+		st.runs = slices.Delete(st.runs, 0, len(st.runs)-maxDaemonRuns)
+	}
+}
+
+func (st *daemonStatus) endRun(next time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	st.Running = false
+	st.Runs++
+	st.LastRunEnd = &now
+	st.NextRun = &next
+	st.run.End = &now
+	st.run.Status = "finished"
+	st.LastRun = st.run.runCounts
+	st.run = nil
+}
+
+// requestRun asks for a run to start now, or once the one in progress
+// ends, and returns the ID it will have. Asking again before it starts
+// asks for the same run.
+func (st *daemonStatus) requestRun() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	select {
+	case st.wake <- struct{}{}:
+	default:
+	}
+	if st.Running {
+		return st.Runs + 2
+	}
+	return st.Runs + 1
+}
+
+// pendingRun returns the ID of the run requested to start once the one in
+// progress ends, or when the daemon next looks, or 0 if there is none.
+func (st *daemonStatus) pendingRun() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.wake) == 0 {
+		return 0
+	}
+	if st.Running {
+		return st.Runs + 2
+	}
+	return st.Runs + 1
+}
+
+// findRun returns a copy of the run with the given ID, if it is still
+// remembered.
+func (st *daemonStatus) findRun(id int) (daemonRun, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, run := range st.runs {
+		if run.ID == id {
+			found := *run
+			found.ErrorMessages = slices.Clone(found.ErrorMessages)
+			return found, true
+		}
+	}
+	return daemonRun{}, false
+}
+
+// recentRuns returns copies of the runs remembered, newest first.
+func (st *daemonStatus) recentRuns() []daemonRun {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	runs := make([]daemonRun, 0, len(st.runs))
+	for i := len(st.runs) - 1; i >= 0; i-- {
+		run := *st.runs[i]
+		run.ErrorMessages = slices.Clone(run.ErrorMessages)
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func (st *daemonStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st.mu.Lock()
+	data, err := json.MarshalIndent(st, "", "  ")
+	st.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// runDaemon calls scan immediately and then every interval, or when a run
+// is requested, until ctx is cancelled. A run in progress stops once the
+// messages being processed are finished.
+func runDaemon(ctx context.Context, interval time.Duration, status *daemonStatus, scan func() error) {
+	trigger := "schedule"
+	for {
+		// This run answers requests made before it starts
+		select {
+		case <-status.wake:
+		default:
+		}
+		status.startRun(trigger)
+		if err := scan(); err != nil {
+			slog.Error("Error scanning", "error", err)
+			status.recordError(err)
+		}
+		next := time.Now().Add(interval)
+		status.endRun(next)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			trigger = "schedule"
+		case <-status.wake:
+			trigger = "manual"
+		}
+	}
+}
+
+// serveStatus serves the status endpoint on addr until ctx is cancelled.
+func serveStatus(ctx context.Context, addr string, status *daemonStatus) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", status)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Error serving status", "addr", addr, "error", err)
+	}
+}
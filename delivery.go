@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionTimeout is how long an LMTP or milter session may wait on the MTA,
+// or on the server messages are passed on to, before it is dropped.
+const sessionTimeout = 10 * time.Minute
+
+// socketAddress returns the network and address of a socket flag such as
+// -lmtp or -milter: a Unix socket for unix:PATH or a path with a slash,
+// otherwise a TCP HOST:PORT, which may be written inet:HOST:PORT as in
+// Postfix's milter settings.
+func socketAddress(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	if strings.Contains(addr, "/") {
+		return "unix", addr
+	}
+	return "tcp", strings.TrimPrefix(addr, "inet:")
+}
+
+// serveSessions accepts connections on addr until ctx is cancelled, running
+// session on each in its own goroutine, then closes them and waits for the
+// sessions to return, which lets the messages being processed finish. It
+// returns an error if addr cannot be listened on, or stops being accepted
+// on before ctx is cancelled.
+func serveSessions(ctx context.Context, protocol, addr string, session func(conn net.Conn) error) error {
+	network, address := socketAddress(addr)
+	if network == "unix" {
+		// A socket left behind by an earlier run would make Listen fail
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	slog.Info("Accepting deliveries", "protocol", protocol, "addr", addr)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error accepting connection", "protocol", protocol, "error", err)
+			}
+			break
+		}
+		mu.Lock()
+		conns[conn] = true
+		mu.Unlock()
+		if ctx.Err() != nil {
+			conn.Close()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+			if err := session(conn); err != nil && ctx.Err() == nil {
+				slog.Warn("Session failed", "protocol", protocol, "remote", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() == nil {
+		return fmt.Errorf("no longer accepting %s connections on %s", protocol, addr)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// Event is one line of the -events stream. Event is "message" once a
+// message has been processed, "saved", "duplicate" or "quarantined" for each
+// attachment written or set aside, "skipped" for each message or attachment
+// left out, and "error" for messages that could not be processed.
+type Event struct {
+	Time        time.Time  `json:"time"`
+	Event       string     `json:"event"`
+	Source      string     `json:"source,omitempty"`
+	Mailbox     string     `json:"mailbox,omitempty"`
+	MessageID   string     `json:"message_id,omitempty"`
+	From        string     `json:"from,omitempty"`
+	Subject     string     `json:"subject,omitempty"`
+	Date        *time.Time `json:"date,omitempty"`
+	OrigName    string     `json:"original_filename,omitempty"`
+	Output      string     `json:"output,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	SHA256      string     `json:"sha256,omitempty"`
+	DuplicateOf string     `json:"duplicate_of,omitempty"`
+	Reason      string     `json:"reason,omitempty"` // why it was skipped or quarantined
+	Error       string     `json:"error,omitempty"`
+}
+
+// eventStream writes events as JSON lines, flushing each as it happens.
+type eventStream struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File // nil for standard output
+	err  error
+}
+
+// openEventStream creates the -events file, or writes to w for "-".
+func openEventStream(path string, w io.Writer) (*eventStream, error) {
+	if path == "-" {
+		return &eventStream{w: w}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &eventStream{w: file, file: file}, nil
+}
+
+// emit writes an event. After a write error, such as a closed pipe, further
+// events are dropped; Close reports the error.
+func (e *eventStream) emit(ev Event) {
+	ev.Time = time.Now()
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		_, e.err = e.w.Write(append(line, '\n'))
+	}
+}
+
+func (e *eventStream) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file != nil {
+		if err := e.file.Close(); e.err == nil {
+			e.err = err
+		}
+	}
+	return e.err
+}
+
+// emailEvent returns an event of the given kind describing email.
+func emailEvent(kind string, email *extract.Email) Event {
+	ev := Event{
+		Event:     kind,
+		Source:    email.Path,
+		Mailbox:   email.Mailbox,
+		MessageID: email.MessageID,
+		From:      email.From,
+		Subject:   email.Subject,
+	}
+	if !email.Date.IsZero() {
+		ev.Date = &email.Date
+	}
+	return ev
+}
+
+func (e *eventStream) message(email *extract.Email) {
+	e.emit(emailEvent("message", email))
+}
+
+func (e *eventStream) saved(s *extract.Saved) {
+	kind := "saved"
+	switch {
+	case s.DuplicateOf != "":
+		kind = "duplicate"
+	case s.Quarantined != "":
+		kind = "quarantined"
+	}
+	ev := emailEvent(kind, s.Email)
+	ev.OrigName = s.Filename
+	ev.Output = s.Path
+	ev.Size = s.Size
+	ev.SHA256 = s.SHA256
+	ev.DuplicateOf = s.DuplicateOf
+	ev.Reason = s.Quarantined
+	e.emit(ev)
+}
+
+func (e *eventStream) skipped(s *extract.Skipped) {
+	ev := emailEvent("skipped", s.Email)
+	if s.Attachment != nil {
+		ev.OrigName = s.Attachment.Filename
+	}
+	ev.Reason = s.Reason
+	e.emit(ev)
+}
+
+func (e *eventStream) scanError(err error) {
+	e.emit(Event{Event: "error", Error: err.Error()})
+}
@@ -0,0 +1,126 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+)
+
+// Magic numbers of the AppleSingle and AppleDouble formats of RFC 1740, in
+// which old Mac mail clients send the resource fork and Finder information
+// of files, and for AppleSingle the file itself.
+const (
+	appleSingleMagic = 0x00051600
+	appleDoubleMagic = 0x00051607
+)
+
+// Entries of AppleSingle and AppleDouble files.
+const (
+	appleDataFork = 1
+	appleRealName = 3
+)
+
+// appleDouble tracks the parts of a multipart/appledouble entity: an
+// application/applefile part holding the resource fork of a file, which is
+// of no use, followed by a part holding its data fork, the file itself.
+// It is nil for other multipart entities.
+type appleDouble struct {
+	name string // of the file, from the applefile part
+}
+
+// newAppleDouble returns an appleDouble for a multipart entity of the given
+// media type, or nil if it is not multipart/appledouble.
+func newAppleDouble(mediaType string) *appleDouble {
+	if mediaType != "multipart/appledouble" {
+		return nil
+	}
+	return &appleDouble{}
+}
+
+// skip reports whether part is the applefile part of a multipart/appledouble
+// entity, to be left out. The filename it carries is given to the part
+// after it, the data fork, if that has none of its own, as is often the
+// case.
+func (a *appleDouble) skip(part *multipart.Part) bool {
+	if a == nil {
+		return false
+	}
+	contentType := part.Header.Get("Content-Type")
+	if partMediaType(contentType) == "application/applefile" {
+		a.name = extractFilename(part.Header.Get("Content-Disposition"), contentType)
+		if a.name == "" {
+			data, _ := io.ReadAll(decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+			a.name = string(appleEntries(data)[appleRealName])
+		}
+		return true
+	}
+	if a.name != "" && extractFilename(part.Header.Get("Content-Disposition"), contentType) == "" {
+		disposition, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil {
+			disposition, params = "attachment", map[string]string{}
+		}
+		params["filename"] = a.name
+		part.Header.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+	}
+	return false
+}
+
+// processAppleSingle extracts the file an application/applefile attachment
+// named filename holds when it is in the AppleSingle format. AppleDouble
+// ones, outside a multipart/appledouble entity, only have a resource fork.
+func (x *Extractor) processAppleSingle(body io.Reader, filename string, email *Email) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != appleSingleMagic {
+		return nil
+	}
+	entries := appleEntries(data)
+	content, ok := entries[appleDataFork]
+	if !ok {
+		return nil
+	}
+	if name := string(entries[appleRealName]); name != "" {
+		filename = name
+	}
+
+	mediaType, reader := x.resolveType("application/octet-stream", filename, bytes.NewReader(content))
+	if !x.wanted(mediaType, filename) {
+		return nil
+	}
+	slog.Debug("Found file in AppleSingle attachment", "source", email.Path, "filename", filename)
+	return x.saveAttachment(reader, filename, mediaType, email)
+}
+
+// appleEntries returns the entries of an AppleSingle or AppleDouble file by
+// their ID, or none if it is malformed.
+func appleEntries(data []byte) map[uint32][]byte {
+	// A magic number, a version, 16 bytes of filler and the number of
+	// entries, each described by its ID, offset and length
+	if len(data) < 26 {
+		return nil
+	}
+	if magic := binary.BigEndian.Uint32(data); magic != appleSingleMagic && magic != appleDoubleMagic {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(data[24:]))
+	if len(data) < 26+12*n {
+		return nil
+	}
+	entries := make(map[uint32][]byte, n)
+	for i := range n {
+		entry := data[26+12*i:]
+		id := binary.BigEndian.Uint32(entry)
+		offset := uint64(binary.BigEndian.Uint32(entry[4:]))
+		length := uint64(binary.BigEndian.Uint32(entry[8:]))
+		if offset+length > uint64(len(data)) {
+			return nil
+		}
+		entries[id] = data[offset : offset+length]
+	}
+	return entries
+}
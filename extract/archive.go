@@ -0,0 +1,220 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Magic bytes of the archive formats Archives reads.
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	sevenZipMagic = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+	rarMagic      = []byte("Rar!\x1a\x07")
+)
+
+// archiveTypes are the media types of the archive formats Archives reads.
+var archiveTypes = map[string]bool{
+	"application/zip":              true,
+	"application/x-zip":            true,
+	"application/x-zip-compressed": true,
+	"application/x-7z-compressed":  true,
+	"application/vnd.rar":          true,
+	"application/x-rar":            true,
+	"application/x-rar-compressed": true,
+}
+
+// maxArchiveSize bounds how much is unpacked from each archive, against
+// archives built to fill the disk.
+const maxArchiveSize = 1 << 30
+
+// isArchive reports whether an attachment with the given media type and
+// filename is a zip, 7z or RAR archive.
+func isArchive(mediaType, filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".zip", ".7z", ".rar":
+		return true
+	}
+	return archiveTypes[mediaType]
+}
+
+// processArchive extracts the wanted files of an archive attachment named
+// filename. Zip archives are read directly; 7z and RAR ones are unpacked by
+// SevenZip in a temporary directory. Archives within archives are not
+// opened.
+func (x *Extractor) processArchive(body io.Reader, filename string, email *Email) error {
+	data, err := io.ReadAll(io.LimitReader(body, maxArchiveSize+1))
+	if err != nil {
+		return fmt.Errorf("error reading archive %s: %v", filename, err)
+	}
+	if len(data) > maxArchiveSize {
+		return fmt.Errorf("archive %s is larger than %d bytes", filename, maxArchiveSize)
+	}
+	switch {
+	case bytes.HasPrefix(data, zipMagic):
+		return x.processZip(data, filename, email)
+	case bytes.HasPrefix(data, sevenZipMagic), bytes.HasPrefix(data, rarMagic):
+		if x.SevenZip == "" {
+			slog.Warn("Skipping archive, as reading 7z and RAR archives requires 7z", "source", email.Path, "filename", filename)
+			return nil
+		}
+		return x.processUnpacked(data, filename, email)
+	}
+	slog.Warn("Skipping archive in an unknown format", "source", email.Path, "filename", filename)
+	return nil
+}
+
+// processZip extracts the wanted files of a zip archive.
+func (x *Extractor) processZip(data []byte, filename string, email *Email) error {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("error reading archive %s: %v", filename, err)
+	}
+	var total int64
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Base(f.Name)
+		total += int64(f.UncompressedSize64)
+		if total > maxArchiveSize {
+			return fmt.Errorf("archive %s unpacks to more than %d bytes", filename, maxArchiveSize)
+		}
+		if err := x.saveArchived(name, filename, email, func() (io.ReadCloser, error) { return f.Open() }); err != nil {
+			x.partError(err, email)
+		}
+	}
+	return nil
+}
+
+// processUnpacked extracts the wanted files of a 7z or RAR archive, which
+// SevenZip unpacks into a temporary directory. Encrypted archives fail, as
+// no password is given and none can be typed.
+func (x *Extractor) processUnpacked(data []byte, filename string, email *Email) error {
+	dir, err := os.MkdirTemp("", "maildir2pdf-archive-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive"+strings.ToLower(filepath.Ext(filename)))
+	if err := os.WriteFile(archivePath, data, 0600); err != nil {
+		return err
+	}
+	outDir := filepath.Join(dir, "out")
+
+	// The sizes are checked before unpacking, so that nothing is written
+	// for archives that would unpack to too much
+	list := exec.Command(x.SevenZip, "l", "-slt", "-p", archivePath)
+	var stderr bytes.Buffer
+	list.Stderr = &stderr
+	listing, err := list.Output()
+	if err != nil {
+		return fmt.Errorf("error listing archive %s: %v: %s", filename, err, strings.TrimSpace(stderr.String()))
+	}
+	size, err := unpackedSize(string(listing))
+	if err != nil {
+		return fmt.Errorf("error listing archive %s: %v", filename, err)
+	}
+	if size > maxArchiveSize {
+		return fmt.Errorf("archive %s unpacks to more than %d bytes", filename, maxArchiveSize)
+	}
+
+	// -y answers yes to any question, -bd leaves out progress, and an
+	// empty -p password makes encrypted archives fail rather than prompt
+	cmd := exec.Command(x.SevenZip, "x", "-y", "-bd", "-p", "-o"+outDir, archivePath)
+	stderr.Reset()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error unpacking archive %s: %v: %s", filename, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// The listing could understate what is unpacked, so the files are
+	// counted again
+	var total int64
+	return filepath.WalkDir(outDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Only regular files: links could point outside the directory
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if total += info.Size(); total > maxArchiveSize {
+			return fmt.Errorf("archive %s unpacks to more than %d bytes", filename, maxArchiveSize)
+		}
+		if err := x.saveArchived(d.Name(), filename, email, func() (io.ReadCloser, error) { return os.Open(p) }); err != nil {
+			x.partError(err, email)
+		}
+		return nil
+	})
+}
+
+// unpackedSize adds up the sizes of the files of an archive, from its
+// listing by "7z l -slt": blocks of "Name = value" lines, one per file
+// after a line of dashes, each with a Size. Files without a size are taken
+// as a reason to refuse the archive, as what they unpack to is not known.
+func unpackedSize(listing string) (int64, error) {
+	listing = strings.ReplaceAll(listing, "\r\n", "\n")
+	_, entries, ok := strings.Cut(listing, "\n----------\n")
+	if !ok {
+		return 0, fmt.Errorf("no files listed")
+	}
+	var total int64
+	for _, block := range strings.Split(entries, "\n\n") {
+		fields := make(map[string]string)
+		for _, line := range strings.Split(block, "\n") {
+			if name, value, ok := strings.Cut(line, " = "); ok {
+				fields[name] = value
+			}
+		}
+		path, ok := fields["Path"]
+		if !ok || fields["Folder"] == "+" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields["Size"], 10, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("no size listed for %s", path)
+		}
+		if total += size; total > maxArchiveSize {
+			return total, nil
+		}
+	}
+	return total, nil
+}
+
+// saveArchived saves a file named name from the archive attachment named
+// archive, if it is wanted.
+func (x *Extractor) saveArchived(name, archive string, email *Email, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("error reading %s from archive %s: %v", name, archive, err)
+	}
+	defer r.Close()
+	mediaType, _, _ := strings.Cut(mime.TypeByExtension(strings.ToLower(filepath.Ext(name))), ";")
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	mediaType, body := x.resolveType(mediaType, name, r)
+	if !x.wanted(mediaType, name) {
+		return nil
+	}
+	slog.Debug("Found file in archive", "source", email.Path, "archive", archive, "filename", name)
+	if err := x.saveAttachment(body, name, mediaType, email); err != nil {
+		return fmt.Errorf("saving %s from archive %s: %v", name, archive, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package extract
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// base64Reader decodes base64 leniently. Well-formed input decodes as with
+// base64.StdEncoding, but where that would fail, it repairs what mailers get
+// wrong: characters outside the alphabet are dropped, "=" padding in the
+// middle of the data, left by encoding line by line, ends a group early, a
+// "=" followed by a line break where no padding can go is taken for a
+// quoted-printable soft line break, and missing padding at the end is
+// supplied. Input that is mostly not base64 is still rejected.
+type base64Reader struct {
+	r   io.Reader
+	buf []byte
+
+	clean []byte // alphabet characters not decoded yet
+	out   []byte // decoded bytes not returned yet
+	err   error
+
+	equals  bool // a "=" after two characters of a group, which may be padding or a soft line break
+	padded  bool // padding ended a group, so more data means padding in the middle
+	valid   int  // alphabet characters
+	stray   int  // other characters dropped, except whitespace
+	midPad  int  // groups padded in the middle of the data
+	softEOL int  // "=" soft line breaks
+	unpad   bool // the last group was not padded
+
+	// onRepair, if set, is called at the end of the data if it needed
+	// repairs, with a description of them.
+	onRepair func(repairs string)
+}
+
+func newBase64Reader(r io.Reader) *base64Reader {
+	return &base64Reader{r: r, buf: make([]byte, 32*1024)}
+}
+
+func isBase64Char(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '/'
+}
+
+func (d *base64Reader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		n, err := d.r.Read(d.buf)
+		for _, c := range d.buf[:n] {
+			d.add(c)
+		}
+		// Decode whole groups, keeping the rest for the next read
+		whole := len(d.clean) / 4 * 4
+		if whole > 0 {
+			d.decode(d.clean[:whole])
+			d.clean = append(d.clean[:0], d.clean[whole:]...)
+		}
+		if err == io.EOF {
+			d.finish()
+		} else if err != nil {
+			d.err = err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *base64Reader) add(c byte) {
+	if d.equals {
+		d.equals = false
+		if c == '=' {
+			d.pad()
+			return
+		}
+		// "==" is the only padding after two characters
+		d.softEOL++
+	}
+	switch {
+	case isBase64Char(c):
+		if d.padded {
+			d.midPad++
+			d.padded = false
+		}
+		d.clean = append(d.clean, c)
+		d.valid++
+	case c == '=':
+		switch len(d.clean) % 4 {
+		case 2:
+			d.equals = true
+		case 3:
+			d.pad()
+		case 1:
+			// A lone character cannot be decoded
+			d.clean = d.clean[:len(d.clean)-1]
+			d.stray++
+			d.pad()
+		case 0:
+			// More "=" after padding are ignored, but one between whole
+			// groups can only be a soft line break
+			if !d.padded {
+				d.softEOL++
+			}
+		}
+	case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+	default:
+		d.stray++
+	}
+}
+
+// pad ends the group in progress, as padding does.
+func (d *base64Reader) pad() {
+	d.decode(d.clean)
+	d.clean = d.clean[:0]
+	d.padded = true
+}
+
+func (d *base64Reader) decode(chars []byte) {
+	if len(chars) == 0 {
+		return
+	}
+	out := make([]byte, base64.RawStdEncoding.DecodedLen(len(chars)))
+	// Only whole groups and partial ones of two or three characters get
+	// here, which always decode
+	n, _ := base64.RawStdEncoding.Decode(out, chars)
+	d.out = append(d.out, out[:n]...)
+}
+
+func (d *base64Reader) finish() {
+	d.err = io.EOF
+	if d.equals {
+		d.equals = false
+		d.pad()
+		d.unpad = true
+	}
+	switch len(d.clean) % 4 {
+	case 1:
+		d.clean = d.clean[:len(d.clean)-1]
+		d.stray++
+		d.unpad = true
+	case 2, 3:
+		d.unpad = true
+	}
+	d.decode(d.clean)
+	d.clean = nil
+
+	// A stray character here and there is damage; many are not base64
+	if d.stray*10 > d.valid {
+		d.out = nil
+		d.err = fmt.Errorf("not base64: %d of %d characters are outside the alphabet", d.stray, d.stray+d.valid)
+		return
+	}
+
+	var repairs []string
+	if d.stray > 0 {
+		repairs = append(repairs, fmt.Sprintf("dropped characters outside the alphabet (%d)", d.stray))
+	}
+	if d.midPad > 0 {
+		repairs = append(repairs, fmt.Sprintf("decoded past padding (%d)", d.midPad))
+	}
+	if d.softEOL > 0 {
+		repairs = append(repairs, fmt.Sprintf("removed soft line breaks (%d)", d.softEOL))
+	}
+	if d.unpad {
+		repairs = append(repairs, "added missing padding")
+	}
+	if len(repairs) > 0 && d.onRepair != nil {
+		d.onRepair(strings.Join(repairs, ", "))
+	}
+}
@@ -0,0 +1,219 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// wordDecoder decodes RFC 2047 encoded words, including the legacy 8-bit
+// charsets still common in mail from Western European senders.
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeCharset(charset, data)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(decoded), nil
+}
+
+// windows1252 maps the 0x80-0x9F range, where Windows-1252 differs from
+// ISO-8859-1. Unassigned code points are left as their Latin-1 value.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// iso885915 lists where ISO-8859-15 differs from ISO-8859-1.
+var iso885915 = map[byte]rune{
+	0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+}
+
+// decodeCharset converts text in the named charset to UTF-8.
+func decodeCharset(charset string, data []byte) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("invalid UTF-8 data")
+		}
+		return string(data), nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return mapBytes(data, nil, nil), nil
+	case "windows-1252", "cp1252":
+		return mapBytes(data, &windows1252, nil), nil
+	case "iso-8859-15", "iso8859-15", "latin9":
+		return mapBytes(data, nil, iso885915), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+func mapBytes(data []byte, high *[32]rune, overrides map[byte]rune) string {
+	var b strings.Builder
+	for _, c := range data {
+		switch r, ok := overrides[c]; {
+		case ok:
+			b.WriteRune(r)
+		case high != nil && c >= 0x80 && c < 0xA0:
+			b.WriteRune(high[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// headerParam returns the decoded value of a parameter of a structured
+// header such as Content-Disposition. RFC 2231 extended values are decoded
+// even in charsets mime.ParseMediaType rejects, and RFC 2047 encoded words,
+// which many mailers put in quoted filenames, are decoded too.
+func headerParam(header, name string) string {
+	if header == "" {
+		return ""
+	}
+
+	var value string
+	if _, params, err := mime.ParseMediaType(header); err == nil {
+		value = params[name]
+	}
+	if value == "" {
+		value = rawHeaderParam(header, name)
+	}
+	return strings.TrimSpace(decodeHeader(value))
+}
+
+// rawHeaderParam is a forgiving parameter parser used when
+// mime.ParseMediaType fails or drops the parameter.
+func rawHeaderParam(header, name string) string {
+	var plain, extended string
+	pieces := make(map[int]string)
+	encoded := make(map[int]bool)
+
+	for _, param := range splitParams(header) {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = unquote(strings.TrimSpace(value))
+
+		switch {
+		case key == name:
+			plain = value
+		case key == name+"*":
+			extended = value
+		case strings.HasPrefix(key, name+"*"):
+			index := strings.TrimPrefix(key, name+"*")
+			isEncoded := strings.HasSuffix(index, "*")
+			n, err := strconv.Atoi(strings.TrimSuffix(index, "*"))
+			if err != nil {
+				continue
+			}
+			pieces[n] = value
+			encoded[n] = isEncoded
+		}
+	}
+
+	if extended != "" {
+		if decoded, ok := decodeExtendedValue(extended); ok {
+			return decoded
+		}
+	}
+
+	if len(pieces) > 0 {
+		indexes := make([]int, 0, len(pieces))
+		for n := range pieces {
+			indexes = append(indexes, n)
+		}
+		sort.Ints(indexes)
+
+		// Only the first piece carries the charset'language' prefix;
+		// percent-decode every encoded piece and convert the charset once.
+		var charset string
+		var raw []byte
+		for i, n := range indexes {
+			piece := pieces[n]
+			if !encoded[n] {
+				raw = append(raw, piece...)
+				continue
+			}
+			if i == 0 {
+				parts := strings.SplitN(piece, "'", 3)
+				if len(parts) == 3 {
+					charset, piece = parts[0], parts[2]
+				}
+			}
+			unescaped, err := url.PathUnescape(piece)
+			if err != nil {
+				unescaped = piece
+			}
+			raw = append(raw, unescaped...)
+		}
+		if decoded, err := decodeCharset(charset, raw); err == nil {
+			return decoded
+		}
+		return string(raw)
+	}
+
+	return plain
+}
+
+// decodeExtendedValue decodes an RFC 2231 charset'language'percent-encoded value.
+func decodeExtendedValue(value string) (string, bool) {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	raw, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return "", false
+	}
+	decoded, err := decodeCharset(parts[0], []byte(raw))
+	if err != nil {
+		return "", false
+	}
+	return decoded, true
+}
+
+// splitParams splits the parameters of a structured header on semicolons
+// that are not inside quoted strings. The leading value is dropped.
+func splitParams(header string) []string {
+	var params []string
+	var current strings.Builder
+	inQuotes, escaped := false, false
+	for _, r := range header {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inQuotes:
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ';' && !inQuotes:
+			params = append(params, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	params = append(params, current.String())
+	return params[1:]
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+		value = strings.ReplaceAll(value, `\"`, `"`)
+		value = strings.ReplaceAll(value, `\\`, `\`)
+	}
+	return value
+}
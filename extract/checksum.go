@@ -0,0 +1,44 @@
+package extract
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Values of Extractor.Checksums.
+const (
+	ChecksumFile = "file" // a .sha256 file beside each saved file
+	ChecksumSums = "sums" // a SHA256SUMS file in each directory saved to
+)
+
+// SumsFile is the name of the file listing the checksums of the files saved
+// to a directory, with Checksums set to ChecksumSums.
+const SumsFile = "SHA256SUMS"
+
+// writeChecksum records the SHA-256 of a saved file as Checksums selects,
+// in the format of sha256sum, so that "sha256sum -c" run in the directory
+// of the file checks it as well as "maildir2pdf verify" does.
+func (x *Extractor) writeChecksum(s *Saved) error {
+	dir, name := filepath.Split(s.Path)
+	line := fmt.Sprintf("%s  %s\n", s.SHA256, name)
+	switch x.Checksums {
+	case ChecksumFile:
+		return os.WriteFile(s.Path+".sha256", []byte(line), 0644)
+	case ChecksumSums:
+		// One write per line, under the lock, keeps concurrent workers
+		// from interleaving lines
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		file, err := os.OpenFile(filepath.Join(dir, SumsFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString(line)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Magic bytes of the formats Dovecot's zlib plugin, or mail_compress in
+// Dovecot 2.4, may store messages in.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic   = []byte("Dovecot-LZ4\r\x2a\x9b\xc5")
+)
+
+// decompressMessage returns a reader of the message read from r,
+// decompressing it if it starts with the magic bytes of gzip or bzip2, so
+// that messages Dovecot stores compressed read like any other. None of
+// these can start a message, whose first line is a header.
+func decompressMessage(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len(lz4Magic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, bzip2Magic) && len(magic) > 3 && '1' <= magic[3] && magic[3] <= '9':
+		return bzip2.NewReader(buffered), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		return nil, fmt.Errorf("compressed with xz, which is not supported")
+	case bytes.HasPrefix(magic, zstdMagic):
+		return nil, fmt.Errorf("compressed with zstd, which is not supported")
+	case bytes.HasPrefix(magic, lz4Magic):
+		return nil, fmt.Errorf("compressed with lz4, which is not supported")
+	}
+	return buffered, nil
+}
+
+// isCompressed reports whether a message file starts with the magic bytes
+// of any of the formats Dovecot may compress messages with.
+func isCompressed(data []byte) bool {
+	for _, magic := range [][]byte{gzipMagic, bzip2Magic, xzMagic, zstdMagic, lz4Magic} {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipTypes are the media types of files compressed with gzip.
+var gzipTypes = map[string]bool{
+	"application/gzip":    true,
+	"application/x-gzip":  true,
+	"application/gzipped": true,
+}
+
+// gunzipPart decompresses an attachment compressed with gzip, either as a
+// file such as document.pdf.gz or with a Content-Encoding: gzip header,
+// returning the media type, filename and content of the file inside, whose
+// type resolveType then works out from its name or content. The content
+// fails to read past maxArchiveSize bytes, as archives do. Attachments whose
+// content is not gzip, and .gz files asked for by Types or Exts, are
+// returned as they are.
+func (x *Extractor) gunzipPart(mediaType, filename, contentEncoding string, body io.Reader, email *Email) (string, string, io.Reader) {
+	named := strings.HasSuffix(strings.ToLower(filename), ".gz")
+	encoded := strings.EqualFold(strings.TrimSpace(contentEncoding), "gzip") || strings.EqualFold(strings.TrimSpace(contentEncoding), "x-gzip")
+	if !named && !encoded && !gzipTypes[mediaType] {
+		return mediaType, filename, body
+	}
+	if gzipTypes[mediaType] && x.Types[mediaType] || named && x.Exts[".gz"] {
+		return mediaType, filename, body
+	}
+
+	buffered := bufio.NewReader(body)
+	if magic, _ := buffered.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return mediaType, filename, buffered
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		slog.Warn("Not decompressing a damaged gzip attachment", "source", email.Path, "filename", filename, "error", err)
+		return mediaType, filename, buffered
+	}
+	slog.Debug("Decompressing gzip attachment", "source", email.Path, "filename", filename)
+	if named {
+		filename = filename[:len(filename)-len(".gz")]
+	} else if filename == "" && gz.Name != "" {
+		filename = gz.Name
+	}
+	if gzipTypes[mediaType] || genericTypes[mediaType] {
+		mediaType = "application/octet-stream"
+	}
+	return mediaType, filename, &limitedReader{r: gz, max: maxArchiveSize, name: filename}
+}
+
+// limitedReader reads from r, failing once more than max bytes were read,
+// against compressed files built to fill the disk.
+type limitedReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+	name string // of the file read, for the error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if left := l.max - l.read + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := l.r.Read(p)
+	if l.read += int64(n); l.read > l.max {
+		return 0, fmt.Errorf("%s decompresses to more than %d bytes", l.name, l.max)
+	}
+	return n, err
+}
@@ -0,0 +1,301 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rootPart identifies the body of a message that is not multipart, as
+// opposed to the parts of one, numbered "1", "2", "2.1" and so on in the
+// order extractAttachments and processPart go through them.
+const rootPart = "TEXT"
+
+// detachedPart is an attachment saved from a MIME part of a message, which
+// Detach replaces with a placeholder.
+type detachedPart struct {
+	filename  string
+	mediaType string
+	size      int64
+	savedAs   string // the file it was saved as, or the earlier copy for duplicates
+}
+
+// savedPart records that the attachment of the MIME part being processed
+// was saved, for MoveTo and Detach. Attachments found inside others, such
+// as TNEF ones, and rendered messages, are not in a part of their own.
+func (x *Extractor) savedPart(s *Saved) {
+	email := s.Email
+	if s.Quarantined != "" {
+		return
+	}
+	email.saved++
+	if !x.Detach || email.part == "" || email.unwrapped {
+		return
+	}
+	savedAs := s.Path
+	if savedAs == "" {
+		savedAs = s.DuplicateOf
+	}
+	if email.detached == nil {
+		email.detached = make(map[string]detachedPart)
+	}
+	email.detached[email.part] = detachedPart{filename: s.Filename, mediaType: s.MediaType, size: s.Size, savedAs: savedAs}
+}
+
+// detach rewrites the maildir message file of email with the attachments
+// it saved replaced by short text placeholders saying where they went. The
+// new message is written to the tmp directory of the maildir, then renamed
+// over the old one, keeping its flags and modification time; the sizes
+// Dovecot records in filenames, as S= and W=, are updated.
+func (x *Extractor) detach(email *Email) error {
+	path := email.Path
+	if dir := filepath.Base(filepath.Dir(path)); dir != "cur" && dir != "new" {
+		slog.Debug("Not detaching attachments from a message outside a maildir", "source", path)
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if isCompressed(data) {
+		slog.Warn("Not detaching attachments from a compressed message", "source", path)
+		return nil
+	}
+
+	detached, n := detachParts(data, email.detached, time.Now())
+	if n == 0 {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(filepath.Dir(filepath.Dir(path)), "tmp"), ".maildir2pdf-detach-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(detached)
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	// A message changed since it was read, e.g. by a mail client, is left
+	// alone rather than losing the change
+	if now, err := os.Stat(path); err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		return fmt.Errorf("%s changed while its attachments were being extracted", path)
+	}
+	newPath := maildirSizes(path, detached)
+	if err := os.Rename(tmp.Name(), newPath); err != nil {
+		return err
+	}
+	if newPath != path {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	syncDir(filepath.Dir(newPath))
+
+	slog.Debug("Detached attachments", "source", path, "path", newPath, "parts", n, "before", len(data), "after", len(detached))
+	email.Path = newPath
+	email.Detached = n
+	return nil
+}
+
+// detachParts returns message with the parts in detached replaced by
+// placeholders, and how many were.
+func detachParts(message []byte, detached map[string]detachedPart, now time.Time) ([]byte, int) {
+	nl := "\n"
+	if bytes.Contains(message[:min(len(message), 1024)], []byte("\r\n")) {
+		nl = "\r\n"
+	}
+	return detachEntity(message, "", detached, now, nl)
+}
+
+// detachEntity rewrites a message, or a part of one whose number is part.
+func detachEntity(entity []byte, part string, detached map[string]detachedPart, now time.Time, nl string) ([]byte, int) {
+	header, body := splitEntity(entity)
+	mediaType, params, _ := mime.ParseMediaType(entityHeader(header).Get("Content-Type"))
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		prefix := ""
+		if part != "" {
+			prefix = part + "."
+		}
+		newBody, n := detachMultipart(body, params["boundary"], prefix, detached, now, nl)
+		if n == 0 {
+			return entity, 0
+		}
+		return append(entity[:len(entity)-len(body):len(entity)-len(body)], newBody...), n
+	}
+
+	if part == "" {
+		part = rootPart
+	}
+	d, ok := detached[part]
+	if !ok {
+		return entity, 0
+	}
+	return placeholder(header, d, now, nl), 1
+}
+
+// detachMultipart rewrites the body of a multipart entity, whose parts are
+// numbered from prefix+"1".
+func detachMultipart(body []byte, boundary, prefix string, detached map[string]detachedPart, now time.Time, nl string) ([]byte, int) {
+	delimiter := []byte("--" + boundary)
+	var out []byte
+	count := 0
+	n := 0
+	partStart := -1 // start of the part being read, after its delimiter line
+	for lineStart := 0; lineStart < len(body); {
+		lineEnd := bytes.IndexByte(body[lineStart:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(body)
+		} else {
+			lineEnd += lineStart + 1
+		}
+		line := bytes.TrimRight(body[lineStart:lineEnd], " \t\r\n")
+		if bytes.HasPrefix(line, delimiter) && (len(line) == len(delimiter) || string(line[len(delimiter):]) == "--") {
+			if partStart >= 0 {
+				// The line break before a delimiter is part of it
+				partEnd := lineStart
+				if partEnd > partStart && body[partEnd-1] == '\n' {
+					partEnd--
+					if partEnd > partStart && body[partEnd-1] == '\r' {
+						partEnd--
+					}
+				}
+				count++
+				rewritten, m := detachEntity(body[partStart:partEnd], prefix+strconv.Itoa(count), detached, now, nl)
+				out = append(out, rewritten...)
+				out = append(out, body[partEnd:lineEnd]...)
+				n += m
+			} else {
+				out = append(out, body[:lineEnd]...)
+			}
+			if len(line) > len(delimiter) {
+				// The closing delimiter; the epilogue follows unchanged
+				return append(out, body[lineEnd:]...), n
+			}
+			partStart = lineEnd
+		}
+		lineStart = lineEnd
+	}
+	if partStart >= 0 {
+		// No closing delimiter: keep whatever follows the last one
+		out = append(out, body[partStart:]...)
+	}
+	if n == 0 {
+		return body, 0
+	}
+	return out, n
+}
+
+// splitEntity splits a message, or a part of one, into its header, with
+// the blank line ending it, and its body.
+func splitEntity(entity []byte) (header, body []byte) {
+	if bytes.HasPrefix(entity, []byte("\n")) || bytes.HasPrefix(entity, []byte("\r\n")) {
+		i := bytes.IndexByte(entity, '\n') + 1
+		return entity[:i], entity[i:]
+	}
+	end := -1
+	for _, sep := range []string{"\n\n", "\n\r\n"} {
+		if i := bytes.Index(entity, []byte(sep)); i >= 0 && (end < 0 || i+len(sep) < end) {
+			end = i + len(sep)
+		}
+	}
+	if end < 0 {
+		return entity, nil
+	}
+	return entity[:end], entity[end:]
+}
+
+// entityHeader parses the header of a message or part.
+func entityHeader(header []byte) textproto.MIMEHeader {
+	text := bytes.Join([][]byte{bytes.TrimRight(header, "\r\n"), []byte("\r\n\r\n")}, nil)
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(text))).ReadMIMEHeader()
+	return h
+}
+
+// placeholder returns the part, or message, with the given header, with its
+// content replaced by a note saying where it was saved. Its other headers,
+// such as Content-ID, are kept.
+func placeholder(header []byte, d detachedPart, now time.Time, nl string) []byte {
+	var out bytes.Buffer
+	skipping := false
+	for _, line := range strings.SplitAfter(strings.TrimRight(string(header), "\r\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := strings.Cut(line, ":")
+			switch textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) {
+			case "Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-Length":
+				skipping = true
+			default:
+				skipping = false
+			}
+		}
+		if !skipping {
+			out.WriteString(strings.TrimRight(line, "\r\n") + nl)
+		}
+	}
+	filename := mime.QEncoding.Encode("utf-8", d.filename)
+	fmt.Fprintf(&out, "Content-Type: text/plain; charset=utf-8%s", nl)
+	fmt.Fprintf(&out, "Content-Transfer-Encoding: 8bit%s", nl)
+	fmt.Fprintf(&out, "Content-Disposition: inline%s", nl)
+	fmt.Fprintf(&out, "X-Maildir2pdf-Detached: %s; filename=\"%s\"; size=%d%s", now.UTC().Format(time.RFC3339), filename, d.size, nl)
+	out.WriteString(nl)
+	fmt.Fprintf(&out, "The attachment %s (%s, %d bytes) was removed from this message by%s", d.filename, d.mediaType, d.size, nl)
+	fmt.Fprintf(&out, "maildir2pdf on %s, having been saved as:%s", now.Format("2006-01-02"), nl)
+	out.WriteString(nl)
+	out.WriteString(d.savedAs)
+	return out.Bytes()
+}
+
+var maildirSizePattern = regexp.MustCompile(`,([SW])=\d+`)
+
+// maildirSizes returns the path of a maildir message file renamed for its
+// new content, updating the size (S=) and size with CRLF line endings (W=)
+// Dovecot records in the names of the files it delivers.
+func maildirSizes(path string, data []byte) string {
+	name := filepath.Base(path)
+	base, info := name, ""
+	for _, sep := range []string{":2,", "!2,"} {
+		if i := strings.LastIndex(name, sep); i >= 0 {
+			base, info = name[:i], name[i:]
+			break
+		}
+	}
+	size := len(data)
+	vsize := size + bytes.Count(data, []byte("\n")) - bytes.Count(data, []byte("\r\n"))
+	base = maildirSizePattern.ReplaceAllStringFunc(base, func(field string) string {
+		if field[1] == 'S' {
+			return ",S=" + strconv.Itoa(size)
+		}
+		return ",W=" + strconv.Itoa(vsize)
+	})
+	return filepath.Join(filepath.Dir(path), base+info)
+}
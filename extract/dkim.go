@@ -0,0 +1,419 @@
+package extract
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDKIMSignatures bounds the DKIM-Signature headers checked per message,
+// each of which may cost a DNS lookup.
+const maxDKIMSignatures = 5
+
+// dkimResult is the outcome of checking one DKIM signature, as in the
+// Authentication-Results header of RFC 8601: "pass", "fail", "permerror"
+// (the signature or key is malformed, or the key missing) or "temperror"
+// (the key could not be looked up).
+type dkimResult struct {
+	result string
+	domain string
+	err    error // why it did not pass
+}
+
+// dkimKey is a public key published in DNS, or why it could not be had.
+type dkimKey struct {
+	key    crypto.PublicKey
+	failed dkimResult
+}
+
+// Keys looked up are kept for dkimKeyTTL, so that long-running modes such
+// as the daemon notice keys rotated or fixed, and at most maxDKIMKeys of
+// them.
+const (
+	dkimKeyTTL  = time.Hour
+	maxDKIMKeys = 1000
+)
+
+// cachedDKIMKey is a key looked up, kept until expires.
+type cachedDKIMKey struct {
+	dkimKey
+	expires time.Time
+}
+
+// verifyDKIM checks the DKIM signatures of a message, as read, recording in
+// email whether any passes, and the domain that signed it: that of the
+// first signature to pass or, if none does, of the first signature.
+// Messages without a signature are recorded as "none".
+func (x *Extractor) verifyDKIM(data []byte, email *Email) {
+	// Signatures are made over CRLF line breaks, as sent, which maildirs
+	// store as LF
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	fields, body := splitHeaderFields(data)
+
+	var first *dkimResult
+	checked := 0
+	for i, field := range fields {
+		if !strings.EqualFold(headerFieldName(field), "DKIM-Signature") {
+			continue
+		}
+		if checked++; checked > maxDKIMSignatures {
+			break
+		}
+		r := x.checkDKIMSignature(fields, i, body)
+		if r.result == "pass" {
+			email.DKIM, email.DKIMDomain = r.result, r.domain
+			slog.Debug("DKIM signature passed", "source", email.Path, "domain", r.domain)
+			return
+		}
+		if first == nil {
+			first = &r
+		}
+	}
+	if first == nil {
+		email.DKIM = "none"
+		return
+	}
+	email.DKIM, email.DKIMDomain = first.result, first.domain
+	slog.Debug("DKIM signature did not pass", "source", email.Path, "domain", first.domain, "result", first.result, "error", first.err)
+}
+
+// checkDKIMSignature checks the DKIM-Signature header fields[n] of a message
+// with the given header fields and body, as in RFC 6376 section 6.
+func (x *Extractor) checkDKIMSignature(fields []string, n int, body []byte) dkimResult {
+	permerror := func(format string, args ...any) dkimResult {
+		return dkimResult{result: "permerror", err: fmt.Errorf(format, args...)}
+	}
+	tags, err := parseDKIMTags(headerFieldValue(fields[n]))
+	if err != nil {
+		return permerror("%v", err)
+	}
+	domain := strings.ToLower(tags["d"])
+	withDomain := func(r dkimResult) dkimResult {
+		r.domain = domain
+		return r
+	}
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return withDomain(permerror("missing %s= tag", tag))
+		}
+	}
+	if tags["v"] != "1" {
+		return withDomain(permerror("unsupported version %s", tags["v"]))
+	}
+	signed := strings.Split(tags["h"], ":")
+	for i := range signed {
+		signed[i] = strings.TrimSpace(signed[i])
+	}
+	if !slices.ContainsFunc(signed, func(name string) bool { return strings.EqualFold(name, "From") }) {
+		return withDomain(permerror("From is not signed"))
+	}
+	if identity := strings.ToLower(tags["i"]); identity != "" {
+		_, identityDomain, _ := strings.Cut(identity, "@")
+		if identityDomain != domain && !strings.HasSuffix(identityDomain, "."+domain) {
+			return withDomain(permerror("i= is not within d="))
+		}
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	algorithm := strings.ToLower(tags["a"])
+	switch algorithm {
+	case "rsa-sha256", "ed25519-sha256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "rsa-sha1":
+		newHash, cryptoHash = sha1.New, crypto.SHA1
+	default:
+		return withDomain(permerror("unsupported algorithm %s", algorithm))
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(strings.ToLower(tags["c"]), "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	if headerCanon != "simple" && headerCanon != "relaxed" || bodyCanon != "simple" && bodyCanon != "relaxed" {
+		return withDomain(permerror("unsupported canonicalization %s", tags["c"]))
+	}
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return withDomain(permerror("malformed b= tag"))
+	}
+	bodyHash, err := base64.StdEncoding.DecodeString(tags["bh"])
+	if err != nil {
+		return withDomain(permerror("malformed bh= tag"))
+	}
+
+	canonical := canonicalizeBody(body, bodyCanon == "relaxed")
+	if tags["l"] != "" {
+		length, err := strconv.Atoi(tags["l"])
+		if err != nil || length < 0 {
+			return withDomain(permerror("malformed l= tag"))
+		}
+		if length > len(canonical) {
+			return dkimResult{result: "fail", domain: domain, err: errors.New("the body is shorter than l=")}
+		}
+		canonical = canonical[:length]
+	}
+	h := newHash()
+	h.Write(canonical)
+	if !bytes.Equal(h.Sum(nil), bodyHash) {
+		return dkimResult{result: "fail", domain: domain, err: errors.New("the body hash does not match")}
+	}
+
+	// The signed header fields, each taken from the bottom up, then the
+	// signature's own field, without the signature
+	relaxed := headerCanon == "relaxed"
+	h = newHash()
+	used := make(map[int]bool)
+	for _, name := range signed {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headerFieldName(fields[i]), name) {
+				used[i] = true
+				h.Write([]byte(canonicalizeHeaderField(fields[i], relaxed)))
+				break
+			}
+		}
+	}
+	self := canonicalizeHeaderField(dkimSignatureValue.ReplaceAllString(fields[n], "${1}"), relaxed)
+	h.Write([]byte(strings.TrimSuffix(self, "\r\n")))
+	digest := h.Sum(nil)
+
+	key := x.dkimKey(tags["s"], domain)
+	if key.key == nil {
+		return withDomain(key.failed)
+	}
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		if algorithm == "ed25519-sha256" {
+			return withDomain(permerror("the key does not match the algorithm"))
+		}
+		err = rsa.VerifyPKCS1v15(pub, cryptoHash, digest, signature)
+	case ed25519.PublicKey:
+		if algorithm != "ed25519-sha256" {
+			return withDomain(permerror("the key does not match the algorithm"))
+		}
+		if !ed25519.Verify(pub, digest, signature) {
+			err = errors.New("verification error")
+		}
+	}
+	if err != nil {
+		return dkimResult{result: "fail", domain: domain, err: fmt.Errorf("the signature does not match: %v", err)}
+	}
+	return dkimResult{result: "pass", domain: domain}
+}
+
+// dkimSignatureValue matches the value of the b= tag of a DKIM-Signature
+// header field, left empty when checking the field itself.
+var dkimSignatureValue = regexp.MustCompile(`((?:^[^:]*:|;)[ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// dkimKey returns the public key published by domain for selector,
+// looking it up at most once per dkimKeyTTL. Lookups that failed with a
+// temperror are not kept, so that they are tried again with the next
+// message.
+func (x *Extractor) dkimKey(selector, domain string) dkimKey {
+	name := selector + "._domainkey." + domain
+	now := time.Now()
+	x.mu.Lock()
+	cached, ok := x.dkimKeys[name]
+	x.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.dkimKey
+	}
+
+	key := lookupDKIMKey(name, x.DKIMLookup)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if key.failed.result == "temperror" {
+		delete(x.dkimKeys, name)
+		return key
+	}
+	if x.dkimKeys == nil {
+		x.dkimKeys = make(map[string]cachedDKIMKey)
+	}
+	if len(x.dkimKeys) >= maxDKIMKeys {
+		for cachedName, cached := range x.dkimKeys {
+			if !now.Before(cached.expires) {
+				delete(x.dkimKeys, cachedName)
+			}
+		}
+	}
+	// Still full of live keys: make room for this one, whichever goes
+	for cachedName := range x.dkimKeys {
+		if len(x.dkimKeys) < maxDKIMKeys {
+			break
+		}
+		delete(x.dkimKeys, cachedName)
+	}
+	x.dkimKeys[name] = cachedDKIMKey{dkimKey: key, expires: now.Add(dkimKeyTTL)}
+	return key
+}
+
+// lookupDKIMKey looks up the key record of RFC 6376 section 3.6.1 at name.
+func lookupDKIMKey(name string, lookup func(name string) ([]string, error)) dkimKey {
+	if lookup == nil {
+		lookup = net.LookupTXT
+	}
+	fail := func(result string, err error) dkimKey {
+		return dkimKey{failed: dkimResult{result: result, err: err}}
+	}
+	records, err := lookup(name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return fail("permerror", fmt.Errorf("no key at %s", name))
+		}
+		return fail("temperror", fmt.Errorf("looking up %s: %v", name, err))
+	}
+	if len(records) != 1 {
+		return fail("permerror", fmt.Errorf("%d key records at %s", len(records), name))
+	}
+	tags, err := parseDKIMTags(records[0])
+	if err != nil {
+		return fail("permerror", fmt.Errorf("key record at %s: %v", name, err))
+	}
+	if v := tags["v"]; v != "" && v != "DKIM1" {
+		return fail("permerror", fmt.Errorf("key record at %s has version %s", name, v))
+	}
+	if tags["p"] == "" {
+		return fail("permerror", fmt.Errorf("the key at %s is revoked", name))
+	}
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return fail("permerror", fmt.Errorf("malformed key at %s", name))
+	}
+	switch strings.ToLower(tags["k"]) {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return dkimKey{key: rsaKey}
+			}
+		}
+		// Some publish the bare RSAPublicKey rather than SubjectPublicKeyInfo
+		if key, err := x509.ParsePKCS1PublicKey(data); err == nil {
+			return dkimKey{key: key}
+		}
+		return fail("permerror", fmt.Errorf("malformed RSA key at %s", name))
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return fail("permerror", fmt.Errorf("malformed Ed25519 key at %s", name))
+		}
+		return dkimKey{key: ed25519.PublicKey(data)}
+	}
+	return fail("permerror", fmt.Errorf("unsupported key type %s at %s", tags["k"], name))
+}
+
+// parseDKIMTags parses a tag list of RFC 6376 section 3.2, as in
+// DKIM-Signature headers and key records. Whitespace is removed from the
+// values, which only base64 and lists may contain.
+func parseDKIMTags(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(list, ";") {
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			if name == "" {
+				continue
+			}
+			return nil, fmt.Errorf("malformed tag %q", strings.TrimSpace(spec))
+		}
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("%s= tag given twice", name)
+		}
+		tags[name] = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, value)
+	}
+	return tags, nil
+}
+
+// splitHeaderFields returns the header fields of a message with CRLF line
+// breaks, each with its continuation lines and final CRLF, and its body.
+func splitHeaderFields(data []byte) ([]string, []byte) {
+	var fields []string
+	for len(data) > 0 {
+		line, rest, found := bytes.Cut(data, []byte("\r\n"))
+		if len(line) == 0 {
+			return fields, rest
+		}
+		if !found {
+			rest = nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += string(line) + "\r\n"
+		} else {
+			fields = append(fields, string(line)+"\r\n")
+		}
+		data = rest
+	}
+	return fields, nil
+}
+
+func headerFieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+func headerFieldValue(field string) string {
+	_, value, _ := strings.Cut(field, ":")
+	return value
+}
+
+// wsp matches the runs of whitespace the relaxed canonicalization reduces
+// to a single space.
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// canonicalizeHeaderField canonicalizes a header field, with its CRLF, as
+// in RFC 6376 section 3.4: the simple way leaves it as it is; the relaxed
+// way lowercases its name, unfolds it and reduces its whitespace.
+func canonicalizeHeaderField(field string, relaxed bool) string {
+	if !relaxed {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// canonicalizeBody canonicalizes a message body with CRLF line breaks, as in
+// RFC 6376 section 3.4: both ways remove empty lines at its end, and the
+// relaxed way reduces whitespace in each line too. An empty body is a CRLF
+// the simple way, and empty the relaxed way.
+func canonicalizeBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i := range lines {
+		if relaxed {
+			lines[i] = strings.TrimRight(wsp.ReplaceAllString(lines[i], " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
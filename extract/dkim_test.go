@@ -0,0 +1,272 @@
+package extract
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// rfc8463Message is the message signed with Ed25519 in RFC 8463 appendix A,
+// with its key record.
+const (
+	rfc8463Message = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+	rfc8463Key = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+)
+
+// testDKIMLookup returns a DKIMLookup serving records, with an error
+// for the other names, counting the lookups in *count.
+func testDKIMLookup(records map[string]string, err error, count *int) func(string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		*count++
+		if record, ok := records[name]; ok {
+			return []string{record}, nil
+		}
+		return nil, err
+	}
+}
+
+// rsaSigned signs a message with key as rsa-sha256 with the simple
+// canonicalizations, as example.org with selector "rsa", returning it with
+// the signature. The body must end with a single line break.
+func rsaSigned(t *testing.T, key *rsa.PrivateKey, header, body, extraTags string) string {
+	header = strings.ReplaceAll(header, "\n", "\r\n")
+	bodyHash := sha256.Sum256([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	field := "DKIM-Signature: v=1; a=rsa-sha256; c=simple/simple; d=example.org; s=rsa; h=From:Subject;" + extraTags +
+		" bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	var signed string
+	for _, name := range []string{"From", "Subject"} {
+		for _, line := range strings.SplitAfter(header, "\r\n") {
+			if strings.HasPrefix(line, name+":") {
+				signed += line
+			}
+		}
+	}
+	digest := sha256.Sum256([]byte(signed + field))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return field + base64.StdEncoding.EncodeToString(signature) + "\n" + strings.ReplaceAll(header, "\r\n", "\n") + "\n\n" + body
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]string{
+		"brisbane._domainkey.football.example.com": rfc8463Key,
+		"rsa._domainkey.example.org":               "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(der),
+		"revoked._domainkey.example.org":           "v=DKIM1; p=",
+		"wrong._domainkey.football.example.com":    "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(der),
+	}
+	const header = "From: Alice <alice@example.org>\nSubject: Invoice\nTo: bob@example.net"
+	const body = "Please find the invoice attached.\n"
+
+	tests := []struct {
+		name    string
+		message string
+		result  string
+		domain  string
+	}{
+		{name: "RFC 8463 example", message: rfc8463Message, result: "pass", domain: "football.example.com"},
+		{
+			name:    "RFC 8463 example, body changed",
+			message: strings.Replace(rfc8463Message, "lost", "won", 1),
+			result:  "fail",
+			domain:  "football.example.com",
+		},
+		{
+			name:    "RFC 8463 example, signed header changed",
+			message: strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1),
+			result:  "fail",
+			domain:  "football.example.com",
+		},
+		{
+			name:    "RFC 8463 example, relaxed whitespace",
+			message: strings.Replace(strings.Replace(rfc8463Message, "Subject: Is", "Subject:   Is", 1), "Joe.\n", "Joe.  \n\n\n", 1),
+			result:  "pass",
+			domain:  "football.example.com",
+		},
+		{
+			name:    "RSA key for Ed25519 signature",
+			message: strings.Replace(rfc8463Message, "s=brisbane", "s=wrong", 1),
+			result:  "permerror",
+			domain:  "football.example.com",
+		},
+		{name: "RSA", message: rsaSigned(t, rsaKey, header, body, ""), result: "pass", domain: "example.org"},
+		{
+			name:    "RSA, unsigned header changed",
+			message: strings.Replace(rsaSigned(t, rsaKey, header, body, ""), "bob@", "carol@", 1),
+			result:  "pass",
+			domain:  "example.org",
+		},
+		{
+			name:    "RSA, simple canonicalization of header",
+			message: strings.Replace(rsaSigned(t, rsaKey, header, body, ""), "Subject: Invoice", "Subject:  Invoice", 1),
+			result:  "fail",
+			domain:  "example.org",
+		},
+		{
+			name:    "RSA, body length",
+			message: rsaSigned(t, rsaKey, header, body, " l=35;") + "Appended by a mailing list\n",
+			result:  "pass",
+			domain:  "example.org",
+		},
+		{
+			name:    "revoked key",
+			message: strings.Replace(rsaSigned(t, rsaKey, header, body, ""), "s=rsa", "s=revoked", 1),
+			result:  "permerror",
+			domain:  "example.org",
+		},
+		{
+			name:    "missing key",
+			message: strings.Replace(rsaSigned(t, rsaKey, header, body, ""), "s=rsa", "s=missing", 1),
+			result:  "permerror",
+			domain:  "example.org",
+		},
+		{
+			name:    "From not signed",
+			message: strings.Replace(rsaSigned(t, rsaKey, header, body, ""), "h=From:Subject", "h=Subject", 1),
+			result:  "permerror",
+			domain:  "example.org",
+		},
+		{
+			name:    "identity outside domain",
+			message: rsaSigned(t, rsaKey, header, body, " i=@example.com;"),
+			result:  "permerror",
+			domain:  "example.org",
+		},
+		{
+			name:    "second signature passes",
+			message: "DKIM-Signature: v=1; a=rsa-sha256; d=example.net; s=rsa; h=From; bh=AAAA; b=AAAA\n" + rsaSigned(t, rsaKey, header, body, ""),
+			result:  "pass",
+			domain:  "example.org",
+		},
+		{name: "unsigned", message: header + "\n\n" + body, result: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lookups int
+			notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+			x := &Extractor{DKIMLookup: testDKIMLookup(records, notFound, &lookups)}
+			email := &Email{}
+			x.verifyDKIM([]byte(tt.message), email)
+			if email.DKIM != tt.result || email.DKIMDomain != tt.domain {
+				t.Errorf("got %s for %q, want %s for %q", email.DKIM, email.DKIMDomain, tt.result, tt.domain)
+			}
+		})
+	}
+}
+
+func TestDKIMKeyCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		result  string
+		lookups int
+	}{
+		{name: "key found", result: "pass", lookups: 1},
+		{name: "no key", err: &net.DNSError{Err: "no such host", IsNotFound: true}, result: "permerror", lookups: 1},
+		{name: "lookup failed", err: errors.New("timeout"), result: "temperror", lookups: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := map[string]string{"brisbane._domainkey.football.example.com": rfc8463Key}
+			if tt.err != nil {
+				records = nil
+			}
+			var lookups int
+			x := &Extractor{DKIMLookup: testDKIMLookup(records, tt.err, &lookups)}
+			for i := 0; i < 2; i++ {
+				email := &Email{}
+				x.verifyDKIM([]byte(rfc8463Message), email)
+				if email.DKIM != tt.result {
+					t.Errorf("got %s, want %s", email.DKIM, tt.result)
+				}
+			}
+			if lookups != tt.lookups {
+				t.Errorf("looked up %d times, want %d", lookups, tt.lookups)
+			}
+		})
+	}
+}
+
+func TestParseDKIMTags(t *testing.T) {
+	tests := []struct {
+		list string
+		want map[string]string
+		err  string
+	}{
+		{list: "v=1; a=rsa-sha256;\r\n b=ab cd\r\n\tef==;", want: map[string]string{"v": "1", "a": "rsa-sha256", "b": "abcdef=="}},
+		{list: "p=", want: map[string]string{"p": ""}},
+		{list: "v=1; v=2", err: "v= tag given twice"},
+		{list: "v=1; junk", err: `malformed tag "junk"`},
+	}
+	for _, tt := range tests {
+		got, err := parseDKIMTags(tt.list)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseDKIMTags(%q): got error %v, want %q", tt.list, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("parseDKIMTags(%q) = %v, %v, want %v", tt.list, got, err, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("parseDKIMTags(%q)[%s] = %q, want %q", tt.list, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestCanonicalizeBody(t *testing.T) {
+	tests := []struct {
+		body, simple, relaxed string
+	}{
+		{"", "\r\n", ""},
+		{"\r\n\r\n", "\r\n", ""},
+		{"a  b \t\r\nc\r\n\r\n", "a  b \t\r\nc\r\n", "a b\r\nc\r\n"},
+		{"no break", "no break\r\n", "no break\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(canonicalizeBody([]byte(tt.body), false)); got != tt.simple {
+			t.Errorf("simple canonicalization of %q = %q, want %q", tt.body, got, tt.simple)
+		}
+		if got := string(canonicalizeBody([]byte(tt.body), true)); got != tt.relaxed {
+			t.Errorf("relaxed canonicalization of %q = %q, want %q", tt.body, got, tt.relaxed)
+		}
+	}
+}
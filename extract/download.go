@@ -0,0 +1,175 @@
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxDownloadLinks bounds the links downloaded from one message, so that a
+// pattern matching too much does not fetch a whole newsletter.
+const maxDownloadLinks = 10
+
+// Downloader fetches the PDFs that messages matching download rules link to,
+// for senders that never attach them. Only HTTPS links to its Domains are
+// followed, redirects included.
+type Downloader struct {
+	Domains []string // lowercased; each allows itself and its subdomains
+	MaxSize int64    // in bytes, beyond which downloads are abandoned
+	Client  *http.Client
+}
+
+// NewDownloader returns a Downloader for links to domains, allowing 50 MB
+// and a minute for each download.
+func NewDownloader(domains []string) *Downloader {
+	d := &Downloader{MaxSize: 50 << 20}
+	for _, domain := range domains {
+		d.Domains = append(d.Domains, strings.ToLower(strings.TrimSuffix(domain, ".")))
+	}
+	d.Client = &http.Client{
+		Timeout: time.Minute,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			return d.check(req.URL)
+		},
+	}
+	return d
+}
+
+// check returns an error unless u is an HTTPS URL on one of the Domains.
+func (d *Downloader) check(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("%s is not an HTTPS link", u.Redacted())
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, domain := range d.Domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in an allowed domain", host)
+}
+
+// download fetches link, returning the PDF and its filename.
+func (d *Downloader) download(link string) ([]byte, string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := d.check(u); err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/pdf")
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New(resp.Status)
+	}
+	if resp.ContentLength > d.MaxSize {
+		return nil, "", fmt.Errorf("larger than %d bytes", d.MaxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, d.MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > d.MaxSize {
+		return nil, "", fmt.Errorf("larger than %d bytes", d.MaxSize)
+	}
+	// Expired links often lead to a login page instead
+	if !bytes.Contains(data[:min(len(data), pdfMagicWindow)], []byte("%PDF-")) {
+		return nil, "", fmt.Errorf("not a PDF (Content-Type %q)", resp.Header.Get("Content-Type"))
+	}
+
+	filename := extractFilename(resp.Header.Get("Content-Disposition"), "")
+	if filename == "" {
+		// Named after the last link followed
+		if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+			filename = name
+		}
+	}
+	return data, filename, nil
+}
+
+// downloadRule returns the first of x.Rules downloading links that matches
+// email, or nil.
+func (x *Extractor) downloadRule(email *Email) *Rule {
+	for _, rule := range x.Rules {
+		if rule.Download != nil && rule.matches(&Attachment{Email: email}) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// downloadLinks saves the PDFs the body of a message links to with links
+// matching pattern, with Downloader. Links that fail are reported as part
+// errors, the others still being downloaded.
+func (x *Extractor) downloadLinks(data []byte, pattern *regexp.Regexp, email *Email) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var body messageBody
+	body.collect(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Disposition"),
+		decodeTransferEncoding(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+
+	links := bodyLinks(body.plain+"\n"+body.html, pattern)
+	if len(links) > maxDownloadLinks {
+		slog.Warn("Downloading only the first links", "source", email.Path, "links", len(links), "downloaded", maxDownloadLinks)
+		links = links[:maxDownloadLinks]
+	}
+	for _, link := range links {
+		pdf, filename, err := x.Downloader.download(link)
+		if err != nil {
+			x.partError(fmt.Errorf("error downloading %s: %v", link, err), email)
+			continue
+		}
+		slog.Debug("Downloaded linked PDF", "source", email.Path, "url", link)
+		email.downloadURL = link
+		err = x.saveAttachment(bytes.NewReader(pdf), filename, "application/pdf", email)
+		email.downloadURL = ""
+		if err != nil {
+			x.partError(err, email)
+		}
+	}
+	return nil
+}
+
+// bodyURL matches the HTTPS links of text and HTML bodies.
+var bodyURL = regexp.MustCompile(`https://[^\s"'<>]+`)
+
+// bodyLinks returns the distinct HTTPS links in text matching pattern, in
+// order.
+func bodyLinks(text string, pattern *regexp.Regexp) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, link := range bodyURL.FindAllString(text, -1) {
+		// As in href attributes; trailing punctuation ends a sentence
+		link = strings.TrimRight(html.UnescapeString(link), ".,;:!?)]")
+		if seen[link] || !pattern.MatchString(link) {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+	}
+	return links
+}
@@ -0,0 +1,187 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// invoiceXMLNames are the names, lowercased, e-invoice standards give the
+// XML embedded in their PDFs.
+var invoiceXMLNames = map[string]bool{
+	"factur-x.xml":        true, // Factur-X, and ZUGFeRD from 2.1
+	"zugferd-invoice.xml": true, // ZUGFeRD 1 and 2.0
+	"xrechnung.xml":       true, // XRechnung, in ZUGFeRD 2.1 PDFs
+}
+
+// invoiceFormat returns the format of an e-invoice XML document: "cii" for
+// the UN/CEFACT Cross Industry Invoice of ZUGFeRD 2, Factur-X and
+// XRechnung, "ubl" for the UBL invoices and credit notes of XRechnung and
+// Peppol, "zugferd-1" for the Cross Industry Document of ZUGFeRD 1, or ""
+// if it is not an invoice.
+func invoiceFormat(data []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	// Only the names of the root element, which are ASCII, are needed
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) { return input, nil }
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		root, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case root.Name.Local == "CrossIndustryInvoice" && strings.Contains(root.Name.Space, "uncefact"):
+			return "cii"
+		case root.Name.Local == "CrossIndustryDocument" && strings.Contains(root.Name.Space, "uncefact"):
+			return "zugferd-1"
+		case (root.Name.Local == "Invoice" || root.Name.Local == "CreditNote") && strings.HasPrefix(root.Name.Space, "urn:oasis:names:specification:ubl:schema:xsd:"):
+			return "ubl"
+		}
+		return ""
+	}
+}
+
+// isXML reports whether an attachment with the given media type and
+// filename is an XML document.
+func isXML(mediaType, filename string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.EqualFold(filepath.Ext(filename), ".xml")
+}
+
+// sniffInvoice reads an XML attachment, returning its e-invoice format, if
+// any, and its content to be read again.
+func sniffInvoice(body io.Reader) (string, io.Reader, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return invoiceFormat(data), bytes.NewReader(data), nil
+}
+
+// embeddedInvoiceXML returns the e-invoice XML embedded in a PDF, as
+// ZUGFeRD and Factur-X invoices carry it, and its format. The files
+// associated with the document, as PDF/A-3 requires them to be, are looked
+// at first, then the embedded files; those with the names of the standards
+// are taken first, then any XML file that is an invoice.
+func embeddedInvoiceXML(data []byte, passwords []string) ([]byte, string, error) {
+	f, err := openPDF(data, passwords)
+	if err != nil {
+		return nil, "", err
+	}
+	root, ok := f.resolve(f.trailer["Root"]).(pdfDict)
+	if !ok {
+		return nil, "", errors.New("no document catalog")
+	}
+
+	var specs []pdfDict
+	if associated, ok := f.resolve(root["AF"]).(pdfArray); ok {
+		for _, spec := range associated {
+			if spec, ok := f.resolve(spec).(pdfDict); ok {
+				specs = append(specs, spec)
+			}
+		}
+	}
+	if names, ok := f.resolve(root["Names"]).(pdfDict); ok {
+		specs = append(specs, f.nameTreeDicts(names["EmbeddedFiles"], 0)...)
+	}
+
+	var fallback []byte
+	var fallbackFormat string
+	for _, spec := range specs {
+		name := strings.ToLower(pdfFilespecName(spec))
+		if !invoiceXMLNames[name] && (fallback != nil || filepath.Ext(name) != ".xml") {
+			continue
+		}
+		ef, ok := f.resolve(spec["EF"]).(pdfDict)
+		if !ok {
+			continue
+		}
+		stream, ok := f.resolve(ef["F"]).(pdfStream)
+		if !ok {
+			if stream, ok = f.resolve(ef["UF"]).(pdfStream); !ok {
+				continue
+			}
+		}
+		content, err := f.decodeStream(stream)
+		if err != nil {
+			continue
+		}
+		format := invoiceFormat(content)
+		if format == "" {
+			continue
+		}
+		if invoiceXMLNames[name] {
+			return content, format, nil
+		}
+		fallback, fallbackFormat = content, format
+	}
+	return fallback, fallbackFormat, nil
+}
+
+// nameTreeDicts returns the dictionaries a name tree maps names to.
+func (f *pdfFile) nameTreeDicts(node any, depth int) []pdfDict {
+	dict, ok := f.resolve(node).(pdfDict)
+	if !ok || depth > 32 {
+		return nil
+	}
+	var dicts []pdfDict
+	if names, ok := f.resolve(dict["Names"]).(pdfArray); ok {
+		// Alternating names and values
+		for i := 1; i < len(names); i += 2 {
+			if value, ok := f.resolve(names[i]).(pdfDict); ok {
+				dicts = append(dicts, value)
+			}
+		}
+	}
+	if kids, ok := f.resolve(dict["Kids"]).(pdfArray); ok {
+		for _, kid := range kids {
+			dicts = append(dicts, f.nameTreeDicts(kid, depth+1)...)
+		}
+	}
+	return dicts
+}
+
+// pdfFilespecName returns the filename of a file specification, preferring
+// the Unicode one.
+func pdfFilespecName(spec pdfDict) string {
+	for _, key := range []pdfName{"UF", "F"} {
+		if s, ok := spec[key].(pdfString); ok && len(s) > 0 {
+			if strings.HasPrefix(string(s), "\xfe\xff") {
+				return utf16Text([]byte(s[2:]))
+			}
+			return string(s)
+		}
+	}
+	return ""
+}
+
+// linkInvoice records, with EInvoices, which PDF and e-invoice XML
+// attachments of a message go together: each saved PDF is linked to the
+// first invoice XML attached before it, unless it has one embedded, and each
+// invoice XML to the first such PDF before it. Whichever of the two is saved
+// second carries the link.
+func (x *Extractor) linkInvoice(saved *Saved, email *Email) {
+	switch {
+	case saved.MediaType == "application/pdf":
+		if saved.InvoiceXML != "" {
+			return
+		}
+		if len(email.invoiceXMLs) > 0 {
+			saved.InvoiceXML, saved.InvoiceFormat = email.invoiceXMLs[0].Path, email.invoiceXMLs[0].InvoiceFormat
+			return
+		}
+		email.invoicePDFs = append(email.invoicePDFs, saved)
+	case email.invoice != "":
+		saved.InvoiceFormat = email.invoice
+		if len(email.invoicePDFs) > 0 {
+			saved.InvoicePDF = email.invoicePDFs[0].Path
+			return
+		}
+		email.invoiceXMLs = append(email.invoiceXMLs, saved)
+	}
+}
@@ -0,0 +1,200 @@
+package extract
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ScanEmlx extracts attachments from every .emlx message file under
+// emlxPath, such as Apple Mail's store in ~/Library/Mail. Messages are
+// attributed to the mailbox named after the .mbox directories they are in,
+// without the extension, e.g. Archive/2023 for Archive.mbox/2023.mbox, or
+// INBOX if there are none. SkipTrashed, SkipDrafts and SeenOnly apply to
+// the flags Apple Mail records after each message.
+func (s *Scanner) ScanEmlx(emlxPath string) error {
+	var files []emailJob
+	err := filepath.Walk(emlxPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip symlinks
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ".emlx") {
+			relPath, err := filepath.Rel(emlxPath, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, emailJob{path: path, mailbox: emlxMailbox(relPath)})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error discovering emlx files: %v", err)
+	}
+
+	var mailboxes []Mailbox
+	seen := make(map[string]bool)
+	for _, job := range files {
+		if !seen[job.mailbox] {
+			seen[job.mailbox] = true
+			mailboxes = append(mailboxes, Mailbox{Name: job.mailbox, Path: filepath.Join(emlxPath, job.mailbox)})
+		}
+	}
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+	selected := make(map[string]bool)
+	for _, mailbox := range mailboxes {
+		selected[mailbox.Name] = true
+	}
+
+	var queue []emailJob
+	for _, job := range files {
+		if !selected[job.mailbox] {
+			continue
+		}
+		if s.SkipTrashed || s.SkipDrafts || s.SeenOnly {
+			flags, err := emlxFlags(job.path)
+			if err != nil {
+				s.logError(fmt.Errorf("processing %s: %v", job.path, err))
+				continue
+			}
+			if !s.wantedEmlxFlags(flags) {
+				continue
+			}
+		}
+		queue = append(queue, job)
+	}
+	s.queued(len(queue))
+
+	s.run(func(jobs chan<- emailJob) {
+		for _, job := range queue {
+			if !s.send(jobs, job) {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// emlxMailbox returns the name of the mailbox of the .emlx file at relPath.
+func emlxMailbox(relPath string) string {
+	var levels []string
+	for _, component := range strings.Split(filepath.ToSlash(filepath.Dir(relPath)), "/") {
+		if name, ok := strings.CutSuffix(component, ".mbox"); ok {
+			levels = append(levels, name)
+		}
+	}
+	if len(levels) == 0 {
+		return "INBOX"
+	}
+	return strings.Join(levels, "/")
+}
+
+// Flags in the property list of an .emlx file.
+const (
+	emlxRead    = 1 << 0
+	emlxDeleted = 1 << 1
+	emlxDraft   = 1 << 6
+)
+
+// wantedEmlxFlags applies SkipTrashed, SkipDrafts and SeenOnly to the flags
+// of an .emlx file.
+func (s *Scanner) wantedEmlxFlags(flags int64) bool {
+	if s.SkipTrashed && flags&emlxDeleted != 0 {
+		return false
+	}
+	if s.SkipDrafts && flags&emlxDraft != 0 {
+		return false
+	}
+	if s.SeenOnly && flags&emlxRead == 0 {
+		return false
+	}
+	return true
+}
+
+// emlxMessage returns a reader of the message in an .emlx file, which
+// starts with a line giving its length in bytes, and is followed by an XML
+// property list.
+func emlxMessage(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	line, err := buffered.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("not an emlx file: %v", err)
+	}
+	length, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("not an emlx file: no message length")
+	}
+	return io.LimitReader(buffered, length), nil
+}
+
+// emlxAttachment opens the file holding an attachment of a message stored
+// in a .partial.emlx file, which Apple Mail keeps without the content of
+// attachments, marking their parts with an X-Apple-Content-Length header.
+// They are stored as Attachments/N/PART/FILENAME beside the Messages
+// directory holding N.partial.emlx. It returns nil, and no error, for
+// other parts.
+func emlxAttachment(header textproto.MIMEHeader, filename, messagePath string) (*os.File, error) {
+	number, ok := strings.CutSuffix(filepath.Base(messagePath), ".partial.emlx")
+	if !ok || header.Get("X-Apple-Content-Length") == "" {
+		return nil, nil
+	}
+	dir := filepath.Join(filepath.Dir(filepath.Dir(messagePath)), "Attachments", number)
+	if parts, err := os.ReadDir(dir); err == nil && filename != "" {
+		for _, part := range parts {
+			if file, err := os.Open(filepath.Join(dir, part.Name(), filename)); err == nil {
+				return file, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("attachment %s is not in the message, nor in %s, where Apple Mail stores attachments separately", filename, dir)
+}
+
+var emlxFlagsPattern = regexp.MustCompile(`<key>flags</key>\s*<integer>(\d+)</integer>`)
+
+// emlxFlags returns the flags recorded in the property list of an .emlx
+// file, or 0 if it has none.
+func emlxFlags(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	line, err := buffered.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("not an emlx file: %v", err)
+	}
+	length, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("not an emlx file: no message length")
+	}
+	if _, err := file.Seek(int64(len(line))+length, io.SeekStart); err != nil {
+		return 0, err
+	}
+	plist, err := io.ReadAll(io.LimitReader(file, 64*1024))
+	if err != nil {
+		return 0, err
+	}
+	match := emlxFlagsPattern.FindSubmatch(plist)
+	if match == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(match[1]), 10, 64)
+}
@@ -0,0 +1,522 @@
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FilterExpr is a compiled filter expression, a small subset of CEL over the
+// fields of an attachment and its email:
+//
+//	from.domain == "acme.com" && size > 100000 && date.year >= 2022
+//
+// Fields are from (the sender address), from.domain, from.name, subject,
+// mailbox, filename, ext (lowercase, with the dot), type (the MIME type),
+// size (in bytes), index, and date, with date.year, date.month and
+// date.day. Dates compare with "YYYY-MM-DD" strings. Strings have the
+// contains, startsWith, endsWith and matches (a regular expression) methods,
+// and lower and upper. Operators are ==, !=, <, <=, >, >=, in (with a
+// [list]), &&, || and !. Expressions are type-checked when parsed.
+type FilterExpr struct {
+	root     *exprNode
+	usesSize bool
+}
+
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprInt
+	exprString
+	exprTime
+	exprList
+)
+
+func (t exprType) String() string {
+	return [...]string{"bool", "int", "string", "date", "list"}[t]
+}
+
+// exprNode is a type-checked subexpression.
+type exprNode struct {
+	typ     exprType
+	elem    exprType // of lists
+	eval    func(env *exprEnv) any
+	literal bool
+}
+
+// exprEnv holds the values of the fields for one attachment.
+type exprEnv struct {
+	a    *Attachment
+	size int64
+}
+
+// ParseFilterExpr parses and type-checks a filter expression, which must be
+// boolean.
+func ParseFilterExpr(src string) (*FilterExpr, error) {
+	p := &exprParser{}
+	if err := p.tokenize(src); err != nil {
+		return nil, err
+	}
+	e := &FilterExpr{}
+	p.expr = e
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if root.typ != exprBool {
+		return nil, fmt.Errorf("expression must be a bool, not %s", root.typ)
+	}
+	e.root = root
+	return e, nil
+}
+
+// UsesSize reports whether the expression needs the size of attachments,
+// which is only known once they are decoded.
+func (e *FilterExpr) UsesSize() bool {
+	return e.usesSize
+}
+
+// Match evaluates the expression for an attachment of the given size.
+func (e *FilterExpr) Match(a *Attachment, size int64) bool {
+	return e.root.eval(&exprEnv{a: a, size: size}).(bool)
+}
+
+type exprToken struct {
+	kind byte // 'i'dentifier, 'n'umber, 's'tring or 'o'perator
+	text string
+	str  string // value of strings
+	num  int64
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	expr   *FilterExpr
+}
+
+func (p *exprParser) tokenize(src string) error {
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return errors.New("unterminated string")
+			}
+			text := src[i : j+1]
+			quoted := text
+			if c == '\'' {
+				quoted = `"` + strings.ReplaceAll(strings.ReplaceAll(text[1:len(text)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return fmt.Errorf("invalid string %s", text)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: 's', text: text, str: value})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			n, err := strconv.ParseInt(src[i:j], 10, 64)
+			if err != nil {
+				return err
+			}
+			p.tokens = append(p.tokens, exprToken{kind: 'n', text: src[i:j], num: n})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: 'i', text: src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected %q", c)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: 'o', text: op})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind != 's' && p.tokens[p.pos].text == text
+}
+
+func (p *exprParser) accept(text string) bool {
+	if p.peek(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(text) {
+		if p.pos < len(p.tokens) {
+			return fmt.Errorf("expected %q, found %q", text, p.tokens[p.pos].text)
+		}
+		return fmt.Errorf("expected %q at end of expression", text)
+	}
+	return nil
+}
+
+func (p *exprParser) or() (*exprNode, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right *exprNode
+		if right, err = p.and(); err == nil {
+			left, err = logical("||", left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) and() (*exprNode, error) {
+	left, err := p.unary()
+	for err == nil && p.accept("&&") {
+		var right *exprNode
+		if right, err = p.unary(); err == nil {
+			left, err = logical("&&", left, right)
+		}
+	}
+	return left, err
+}
+
+func logical(op string, left, right *exprNode) (*exprNode, error) {
+	if left.typ != exprBool || right.typ != exprBool {
+		return nil, fmt.Errorf("%s needs bools, not %s and %s", op, left.typ, right.typ)
+	}
+	if op == "&&" {
+		return &exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+			return left.eval(env).(bool) && right.eval(env).(bool)
+		}}, nil
+	}
+	return &exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+		return left.eval(env).(bool) || right.eval(env).(bool)
+	}}, nil
+}
+
+func (p *exprParser) unary() (*exprNode, error) {
+	if p.accept("!") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if operand.typ != exprBool {
+			return nil, fmt.Errorf("! needs a bool, not %s", operand.typ)
+		}
+		return &exprNode{typ: exprBool, eval: func(env *exprEnv) any { return !operand.eval(env).(bool) }}, nil
+	}
+	return p.comparison()
+}
+
+func (p *exprParser) comparison() (*exprNode, error) {
+	left, err := p.postfix()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			right, err := p.postfix()
+			if err != nil {
+				return nil, err
+			}
+			return compare(op, left, right)
+		}
+	}
+	return left, nil
+}
+
+// compare type-checks a comparison. A string literal compared with a date
+// is parsed as a date.
+func compare(op string, left, right *exprNode) (*exprNode, error) {
+	var err error
+	if left.typ == exprTime && right.typ == exprString && right.literal {
+		right, err = dateLiteral(right)
+	} else if right.typ == exprTime && left.typ == exprString && left.literal {
+		left, err = dateLiteral(left)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "in" {
+		if right.typ != exprList || right.elem != left.typ {
+			return nil, fmt.Errorf("in needs a list of %s on its right", left.typ)
+		}
+		return &exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+			v := left.eval(env)
+			for _, item := range right.eval(env).([]any) {
+				if item == v {
+					return true
+				}
+			}
+			return false
+		}}, nil
+	}
+
+	if left.typ != right.typ || left.typ == exprList || (left.typ == exprBool && op != "==" && op != "!=") {
+		return nil, fmt.Errorf("cannot compare %s %s %s", left.typ, op, right.typ)
+	}
+	cmp := func(a, b any) int {
+		switch a := a.(type) {
+		case int64:
+			return compareOrdered(a, b.(int64))
+		case string:
+			return strings.Compare(a, b.(string))
+		case time.Time:
+			return a.Compare(b.(time.Time))
+		case bool:
+			if a == b.(bool) {
+				return 0
+			}
+			return 1
+		}
+		return 0
+	}
+	test := map[string]func(int) bool{
+		"==": func(c int) bool { return c == 0 },
+		"!=": func(c int) bool { return c != 0 },
+		"<":  func(c int) bool { return c < 0 },
+		"<=": func(c int) bool { return c <= 0 },
+		">":  func(c int) bool { return c > 0 },
+		">=": func(c int) bool { return c >= 0 },
+	}[op]
+	return &exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+		return test(cmp(left.eval(env), right.eval(env)))
+	}}, nil
+}
+
+func compareOrdered(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func dateLiteral(n *exprNode) (*exprNode, error) {
+	s := n.eval(nil).(string)
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s)
+		}
+	}
+	return &exprNode{typ: exprTime, literal: true, eval: func(*exprEnv) any { return t }}, nil
+}
+
+// postfix parses a primary expression followed by method calls.
+func (p *exprParser) postfix() (*exprNode, error) {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'i' && p.tokens[p.pos].text != "in" {
+		return p.field()
+	}
+	node, err := p.primary()
+	for err == nil && p.accept(".") {
+		node, err = p.method(node)
+	}
+	return node, err
+}
+
+func (p *exprParser) primary() (*exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch {
+	case tok.kind == 's':
+		return &exprNode{typ: exprString, literal: true, eval: func(*exprEnv) any { return tok.str }}, nil
+	case tok.kind == 'n':
+		return &exprNode{typ: exprInt, literal: true, eval: func(*exprEnv) any { return tok.num }}, nil
+	case tok.text == "(":
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case tok.text == "[":
+		var items []any
+		elem := exprString
+		for !p.accept("]") {
+			if len(items) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			item, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			if !item.literal || (len(items) > 0 && item.typ != elem) {
+				return nil, errors.New("lists must hold literals of a single type")
+			}
+			elem = item.typ
+			items = append(items, item.eval(nil))
+		}
+		return &exprNode{typ: exprList, elem: elem, eval: func(*exprEnv) any { return items }}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+// field parses a field name, possibly with subfields, and method calls.
+func (p *exprParser) field() (*exprNode, error) {
+	name := p.tokens[p.pos].text
+	p.pos++
+	for p.peek(".") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == 'i' {
+		// Subfields such as from.domain, unless they are method calls
+		if p.pos+2 < len(p.tokens) && p.tokens[p.pos+2].text == "(" && p.tokens[p.pos+2].kind == 'o' {
+			break
+		}
+		name += "." + p.tokens[p.pos+1].text
+		p.pos += 2
+	}
+
+	var node *exprNode
+	switch name {
+	case "true", "false":
+		value := name == "true"
+		node = &exprNode{typ: exprBool, literal: true, eval: func(*exprEnv) any { return value }}
+	case "size":
+		p.expr.usesSize = true
+		node = &exprNode{typ: exprInt, eval: func(env *exprEnv) any { return env.size }}
+	case "index":
+		node = &exprNode{typ: exprInt, eval: func(env *exprEnv) any { return int64(env.a.Email.attachments + 1) }}
+	case "date":
+		node = &exprNode{typ: exprTime, eval: func(env *exprEnv) any { return env.a.Email.Date }}
+	case "date.year", "date.month", "date.day":
+		part := name
+		node = &exprNode{typ: exprInt, eval: func(env *exprEnv) any {
+			t := env.a.Email.Date
+			if t.IsZero() {
+				return int64(0)
+			}
+			switch part {
+			case "date.year":
+				return int64(t.Year())
+			case "date.month":
+				return int64(t.Month())
+			}
+			return int64(t.Day())
+		}}
+	default:
+		get, ok := stringFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		node = &exprNode{typ: exprString, eval: func(env *exprEnv) any { return get(env.a) }}
+	}
+
+	var err error
+	for err == nil && p.accept(".") {
+		node, err = p.method(node)
+	}
+	return node, err
+}
+
+var stringFields = map[string]func(a *Attachment) string{
+	"from": func(a *Attachment) string { return strings.ToLower(a.Email.From) },
+	"from.domain": func(a *Attachment) string {
+		_, domain, _ := strings.Cut(strings.ToLower(a.Email.From), "@")
+		return domain
+	},
+	"from.name": func(a *Attachment) string { return a.Email.FromName },
+	"subject":   func(a *Attachment) string { return a.Email.Subject },
+	"mailbox":   func(a *Attachment) string { return a.Email.Mailbox },
+	"filename":  func(a *Attachment) string { return a.Filename },
+	"ext": func(a *Attachment) string {
+		i := strings.LastIndexByte(a.Filename, '.')
+		if i < 0 {
+			return ""
+		}
+		return strings.ToLower(a.Filename[i:])
+	},
+	"type": func(a *Attachment) string { return a.MediaType },
+}
+
+// method parses a method call on a string, after its dot.
+func (p *exprParser) method(target *exprNode) (*exprNode, error) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != 'i' {
+		return nil, errors.New("expected a method name after .")
+	}
+	name := p.tokens[p.pos].text
+	p.pos++
+	if target.typ != exprString {
+		return nil, fmt.Errorf("%s is not a method of %s", name, target.typ)
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "lower", "upper":
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		f := strings.ToLower
+		if name == "upper" {
+			f = strings.ToUpper
+		}
+		return &exprNode{typ: exprString, eval: func(env *exprEnv) any { return f(target.eval(env).(string)) }}, nil
+	case "contains", "startsWith", "endsWith", "matches":
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if arg.typ != exprString {
+			return nil, fmt.Errorf("%s needs a string, not %s", name, arg.typ)
+		}
+		if name == "matches" {
+			if !arg.literal {
+				return nil, errors.New("matches needs a literal regular expression")
+			}
+			re, err := regexp.Compile(arg.eval(nil).(string))
+			if err != nil {
+				return nil, err
+			}
+			return &exprNode{typ: exprBool, eval: func(env *exprEnv) any { return re.MatchString(target.eval(env).(string)) }}, nil
+		}
+		f := map[string]func(string, string) bool{
+			"contains":   strings.Contains,
+			"startsWith": strings.HasPrefix,
+			"endsWith":   strings.HasSuffix,
+		}[name]
+		return &exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+			return f(target.eval(env).(string), arg.eval(env).(string))
+		}}, nil
+	}
+	return nil, fmt.Errorf("unknown method %s", name)
+}
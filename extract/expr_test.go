@@ -0,0 +1,119 @@
+package extract
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilterExpr(t *testing.T) {
+	email := &Email{
+		Mailbox:     "Archive/2023",
+		Date:        time.Date(2023, 3, 14, 9, 30, 0, 0, time.Local),
+		From:        "Billing@ACME.com",
+		FromName:    "ACME Billing",
+		Subject:     "Invoice 1042 for March",
+		attachments: 1,
+	}
+	a := &Attachment{Email: email, Filename: "Invoice-1042.PDF", MediaType: "application/pdf"}
+	const size = 120000
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// && binds tighter than ||, and ! tighter than both
+		{"false && false || true", true},
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"!!true", true},
+		// ! applies to a whole comparison
+		{"!size > 200000", true},
+		{"from.domain == 'acme.com' && size > 100000 && date.year >= 2022", true},
+		{"from == \"billing@acme.com\"", true},
+		{"from.name.lower() == 'acme billing'", true},
+		{"subject.contains('Invoice') && !subject.contains('Reminder')", true},
+		{"filename.startsWith(\"Invoice-\") && filename.endsWith('.PDF')", true},
+		{"filename.upper().endsWith('.pdf')", false},
+		{"subject.matches('^Invoice [0-9]+ ')", true},
+		{"ext == '.pdf' && type == 'application/pdf'", true},
+		{"ext in ['.doc', '.pdf']", true},
+		{"date.month in [1, 2]", false},
+		{"date.day == 14 && date.month == 3", true},
+		{"index == 2", true},
+		{"mailbox.startsWith('Archive/')", true},
+		{"date >= '2023-03-01' && date < '2023-04-01'", true},
+		{"'2023-03-15' <= date", false},
+		{"date > '2023-03-12T00:00:00Z' && date < '2023-03-16T00:00:00Z'", true},
+		{"size != 120000", false},
+		{"true == (size > 1)", true},
+		{`subject == "Invoice 1042 for \"March\""`, false},
+		{`'it\'s' == "it's"`, true},
+	}
+	for _, tt := range tests {
+		e, err := ParseFilterExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := e.Match(a, size); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestFilterExprErrors(t *testing.T) {
+	tests := []struct {
+		expr, err string
+	}{
+		{"", "unexpected end of expression"},
+		{"subject", "expression must be a bool, not string"},
+		{"size > 'big'", "cannot compare int > string"},
+		{"true < false", "cannot compare bool < bool"},
+		{"size && true", "&& needs bools, not int and bool"},
+		{"!subject", "! needs a bool, not string"},
+		{"sender == 'x'", "unknown field sender"},
+		{"subject == 'open", "unterminated string"},
+		{"subject == @", `unexpected '@'`},
+		{"size >", "unexpected end of expression"},
+		{"(size > 1", `expected ")" at end of expression`},
+		{"size > 1 2", `unexpected "2"`},
+		{"date > '2023-13-01'", `invalid date "2023-13-01", expected YYYY-MM-DD`},
+		{"ext in ['.pdf', 1]", "lists must hold literals of a single type"},
+		{"ext in [from]", `unexpected "from"`},
+		{"size in ['.pdf']", "in needs a list of int on its right"},
+		{"size.lower() == 'x'", "lower is not a method of int"},
+		{"subject.title() == 'x'", "unknown method title"},
+		{"subject.contains(1)", "contains needs a string, not int"},
+		{"subject.matches(from)", "matches needs a literal regular expression"},
+		{"subject.matches('(')", "error parsing regexp: missing closing ): `(`"},
+		{"subject.contains('x'", `expected ")" at end of expression`},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilterExpr(tt.expr)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestFilterExprUsesSize(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"size > 100", true},
+		{"ext == '.pdf' || size < 10", true},
+		{"ext == '.pdf'", false},
+	}
+	for _, tt := range tests {
+		e, err := ParseFilterExpr(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.UsesSize(); got != tt.want {
+			t.Errorf("%s: UsesSize() = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
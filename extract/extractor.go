@@ -0,0 +1,1155 @@
+// Package extract finds attachments in email messages, typically PDFs in a
+// maildir, and saves them to disk.
+//
+// A Scanner walks a maildir and feeds every message to an Extractor, which
+// decodes the attachments it selects and writes them to its OutputDir. The
+// Filter, Handler and OnSaved hooks let callers take over any step.
+package extract
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultTypes lists the MIME types extracted when none are configured.
+var DefaultTypes = []string{"application/pdf"}
+
+// Extractor selects attachments from messages and saves them. Its exported
+// fields must not be changed once extraction has started; an Extractor is
+// otherwise safe for use by several goroutines.
+type Extractor struct {
+	OutputDir        string
+	PreserveFolders  bool               // save into subdirectories named after the mailbox
+	NameTemplate     *template.Template // see ParseNameTemplate
+	DatePrefix       bool               // start filenames with the email date, as YYYY-MM-DD_
+	Dedup            bool               // skip content already saved by this Extractor
+	Fsync            bool               // flush files to disk before naming them
+	Render           bool               // also save each message itself as a PDF
+	Combine          bool               // save each message as one PDF, followed by its PDF attachments
+	Metadata         bool               // record the email's subject, sender, date and Message-ID in saved PDFs
+	PDFA             bool               // convert saved PDFs to PDF/A-3 with the email embedded
+	OCR              bool               // add a text layer to PDFs without one
+	OCRLanguage      string             // Tesseract languages for OCR, e.g. "eng+fra"; "eng" if empty
+	Ghostscript      string             // command used for PDFA and OCR; "gs" if empty
+	QuarantineDir    string             // where to save PDFs that fail validation, if set
+	PDFPasswords     []string           // tried on encrypted PDFs, after the empty password
+	DecryptPDFs      bool               // save encrypted PDFs that can be opened decrypted
+	ExtractText      bool               // write the text of each saved PDF to a .txt file beside it
+	RawErrorDir      string             // where to save attachments that fail to decode, as received, if set
+	Xattrs           bool               // record the email's Message-ID, source, sender and subject in extended attributes
+	SaveSourceEML    bool               // save the whole message beside each saved file, as a .eml file
+	SaveBody         bool               // save the body of the message beside each saved file, as a .md file
+	Checksums        string             // ChecksumFile or ChecksumSums to record the SHA-256 of saved files; none if empty
+	HashMessages     bool               // record the SHA-256 of each message in Email.SHA256
+	Store            bool               // save each distinct file once under its SHA-256, linked into StoreViews; see storeFile
+	StoreViews       []string           // ViewMailbox, ViewDate or ViewSender
+	StoreSymlinks    bool               // link views to the store with symbolic links rather than hard links
+	Organize         []string           // OrganizeBySender or OrganizeByYear, to link saved files into directories by each
+	Remote           Remote             // store saved files here, under their path relative to OutputDir, which only stages them
+	Detach           bool               // replace the attachments saved from maildir messages with placeholders in the messages; see detach
+	Mark             string             // flag letter or Dovecot keyword to add to maildir messages once processed, and skip them by; see mark
+	MoveTo           string             // maildir folder to move messages attachments were saved from to; see move
+	SMIME            *SMIMEKey          // decrypt S/MIME encrypted messages with it, if set
+	Archives         bool               // also extract from zip, 7z and RAR archives attached to messages; see processArchive
+	SevenZip         string             // command unpacking 7z and RAR archives, such as 7z; they are skipped if empty
+	VerifySignatures bool               // check the signatures of signed messages, recorded in Email.Signature; see openSigned
+	OpenSSL          string             // command checking S/MIME signatures, such as openssl; they are unverified if empty
+	GPG              string             // command checking PGP signatures, such as gpg; they are unverified if empty
+	VerifyDKIM       bool               // check the DKIM signatures of messages, recorded in Email.DKIM; see verifyDKIM
+	ImagesToPDF      bool               // save JPEG, PNG and TIFF attachments as PDFs; see processImage
+	TIFF2PDF         string             // command converting TIFF images to PDF, such as tiff2pdf; they are skipped if empty
+	Office           OfficeConverter    // save office documents as PDFs converted with it, if set; see processOffice
+	OfficeCache      string             // directory keeping the PDFs converted by Office, by the SHA-256 of their documents, if set
+	EInvoices        bool               // save the invoice XML embedded in saved PDFs beside them, and extract invoice XML attachments; see linkInvoice
+
+	Types map[string]bool // MIME types to extract
+	Exts  map[string]bool // filename extensions (with the dot) to extract
+
+	// Content-Disposition types of the MIME parts to extract from, "attachment"
+	// and "inline"; all of them if empty. Parts without one, or with another,
+	// count as attachments.
+	Dispositions map[string]bool
+	// Lower-case globs, such as "invoice*.pdf", one of which the filename of
+	// an attachment must match to be extracted, if set. Attachments without
+	// a filename match none.
+	NameGlobs []string
+
+	// Message filters
+	Since        time.Time // skip messages dated before this
+	Until        time.Time // skip messages dated at or after this
+	FromRegex    *regexp.Regexp
+	SubjectRegex *regexp.Regexp
+	Headers      []HeaderMatch   // all must match for a message to be extracted from
+	SkipIDs      map[string]bool // Message-IDs, without angle brackets, of messages to skip
+
+	FilterExpr *FilterExpr // skip attachments for which it is false
+	Rules      []*Rule     // the first matching rule skips or renames an attachment; see ParseRules
+
+	State *StateDB // skip messages recorded by earlier runs, if set
+	Force bool     // extract from messages the state database has already seen
+
+	Index        *SearchIndex // index saved files for searching, if set
+	Paperless    *Paperless   // upload saved PDFs to paperless-ngx, if set
+	HTMLRenderer HTMLRenderer // renders the HTML bodies of messages matching render Rules, which need it
+	Downloader   *Downloader  // downloads the links of messages matching download Rules, which need it
+
+	// Filter, if set, is consulted for every attachment matching Types or
+	// Exts; returning false skips it.
+	Filter func(a *Attachment) bool
+	// Handler, if set, receives the decoded content of each selected
+	// attachment instead of it being written to OutputDir.
+	Handler func(a *Attachment, content io.Reader) error
+	// OnSaved, if set, is called after an attachment has been written to
+	// OutputDir or skipped as a duplicate. It may be called concurrently.
+	OnSaved func(s *Saved)
+	// OnSkipped, if set, is called for each message, or attachment matching
+	// Types or Exts, that is left out. It may be called concurrently.
+	OnSkipped func(s *Skipped)
+	// OnMessage, if set, is called once the attachments of a message have
+	// been processed. It may be called concurrently.
+	OnMessage func(email *Email)
+	// OnError, if set, is called with errors that lose part of a message
+	// without stopping the rest of it being processed, such as an attachment
+	// that could not be saved. Errors that stop a whole message are returned
+	// instead. It may be called concurrently.
+	OnError func(err error)
+	// DKIMLookup, if set, looks up the DNS TXT records of DKIM keys with
+	// VerifyDKIM instead of net.LookupTXT.
+	DKIMLookup func(name string) ([]string, error)
+
+	mu     sync.Mutex
+	hashes map[string]string // SHA-256 of saved content -> output path
+
+	dkimKeys map[string]cachedDKIMKey // DKIM keys looked up, by DNS name
+
+	xattrOnce sync.Once // warns once that extended attributes are unsupported
+}
+
+// NewExtractor returns an Extractor saving PDFs to outputDir.
+func NewExtractor(outputDir string) *Extractor {
+	x := &Extractor{OutputDir: outputDir, Types: make(map[string]bool), Exts: make(map[string]bool)}
+	for _, t := range DefaultTypes {
+		x.Types[t] = true
+	}
+	return x
+}
+
+// Email describes the message an attachment was found in.
+type Email struct {
+	Path       string
+	Mailbox    string
+	Date       time.Time
+	From       string // bare address
+	FromName   string // display name, if any
+	Subject    string
+	MessageID  string
+	SHA256     string // of the message as read, with HashMessages
+	Detached   int    // attachments replaced by placeholders in the message file, with Detach
+	Signature  string // with VerifySignatures, for signed messages: "valid", "untrusted", "invalid", "unknown-key" or "unverified"
+	Signer     string // the email address, name or key ID of whoever signed the message, with VerifySignatures
+	DKIM       string // with VerifyDKIM: "pass", "fail", "permerror", "temperror", or "none" if unsigned
+	DKIMDomain string // the domain of the DKIM signature DKIM is about
+
+	attachments int // number of attachments selected so far
+
+	// PDF attachments held back to be combined with the rendered message
+	holding bool
+	held    []heldAttachment
+
+	raw  []byte  // the message itself, kept for PDFA, SaveSourceEML and SaveBody
+	body *string // the message as Markdown, once worked out for SaveBody
+
+	failed      bool                    // a part could not be processed, so Mark is not added, the message not moved nor recorded in State
+	saved       int                     // attachments saved, for MoveTo
+	part        string                  // number of the MIME part being saved, for Detach
+	unwrapped   bool                    // the parts being saved are inside S/MIME encrypted or signed data, so cannot be detached
+	inline      bool                    // the MIME part being saved has an inline disposition, for Dispositions
+	invoice     string                  // format of the e-invoice XML part being saved, for EInvoices
+	quarantine  string                  // why the part being saved goes to QuarantineDir, if it does
+	downloadURL string                  // the link the PDF being saved was downloaded from, for Downloader
+	detached    map[string]detachedPart // attachments saved, by MIME part, for Detach
+
+	// PDFs and e-invoice XML saved, not yet linked to each other, for
+	// EInvoices
+	invoicePDFs []*Saved
+	invoiceXMLs []*Saved
+}
+
+type heldAttachment struct {
+	filename string
+	data     []byte
+}
+
+// Attachment is an attachment selected for extraction.
+type Attachment struct {
+	Email     *Email
+	Filename  string // decoded original filename, or a default one
+	MediaType string
+	Index     int // 1-based position among the selected attachments of Email
+}
+
+// Saved describes an attachment written to OutputDir.
+type Saved struct {
+	*Attachment
+	Path          string // output file; empty if skipped as a duplicate
+	Size          int64
+	SHA256        string
+	ContentSHA256 string    // of the attachment as decoded from the message, before any post-processing
+	Time          time.Time // when it was saved
+	DuplicateOf   string    // the earlier output with the same content, for duplicates
+	Quarantined   string    // why the PDF failed validation, if it was saved to QuarantineDir
+	Encryption    string    // for encrypted PDFs: "unlocked", "decrypted" or "locked"; see unlockPDF
+	TextPath      string    // the text extracted from the PDF, with ExtractText
+	EMLPath       string    // the copy of the message, with SaveSourceEML
+	BodyPath      string    // the body of the message as Markdown, with SaveBody
+	PaperlessTask string    // the paperless-ngx task consuming the file, with Paperless
+	InvoiceXML    string    // for PDFs, with EInvoices: the e-invoice XML embedded in it, saved beside it, or attached with it
+	InvoicePDF    string    // for e-invoice XML attachments, with EInvoices: the PDF attached with it
+	InvoiceFormat string    // of the e-invoice XML, with EInvoices: "cii", "ubl" or "zugferd-1"; see invoiceFormat
+	DownloadURL   string    // the link in the message the PDF was downloaded from, with Downloader
+}
+
+// Skipped describes a message or attachment that was left out, and why:
+// "date" (outside Since and Until), "headers" (FromRegex, SubjectRegex or
+// Headers), "message-id" (in SkipIDs), "state" (recorded by an earlier
+// run), "disposition" (not in Dispositions), "name" (matching no
+// NameGlobs), "filter" (Filter or FilterExpr) or "rule" (a skip rule).
+type Skipped struct {
+	Email      *Email
+	Attachment *Attachment // nil when the whole message was skipped
+	Reason     string
+}
+
+func (x *Extractor) skipped(email *Email, attachment *Attachment, reason string) {
+	if x.OnSkipped != nil {
+		x.OnSkipped(&Skipped{Email: email, Attachment: attachment, Reason: reason})
+	}
+}
+
+// ExtractFile extracts the attachments of the message stored in path, which
+// belongs to the named mailbox. Files named .emlx are read as Apple Mail
+// stores messages.
+func (x *Extractor) ExtractFile(path, mailboxName string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".emlx") {
+		if r, err = emlxMessage(file); err != nil {
+			return fmt.Errorf("error reading file %s: %v", path, err)
+		}
+	}
+	return x.ExtractMessage(r, path, mailboxName)
+}
+
+// ExtractMessage extracts the attachments of the message read from r, which
+// may be compressed with gzip or bzip2, as by Dovecot's zlib plugin. The
+// path is used to identify the message in output and state; it is empty for
+// messages without a location, such as one piped to standard input.
+func (x *Extractor) ExtractMessage(r io.Reader, path, mailboxName string) error {
+	r, err := decompressMessage(r)
+	if err != nil {
+		return fmt.Errorf("error decompressing email %s: %v", path, err)
+	}
+
+	// Rendering parses the message a second time, so keep it in memory
+	var data []byte
+	if x.Render || x.Combine || x.PDFA || x.SaveSourceEML || x.SaveBody || x.HashMessages || x.VerifyDKIM || x.HTMLRenderer != nil || x.Downloader != nil {
+		if data, err = io.ReadAll(r); err != nil {
+			return fmt.Errorf("error reading email %s: %v", path, err)
+		}
+		r = bytes.NewReader(data)
+	}
+
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return fmt.Errorf("error parsing email %s: %v", path, err)
+	}
+
+	email := newEmail(msg.Header, path, mailboxName)
+	if x.PDFA || x.SaveSourceEML || x.SaveBody {
+		email.raw = data
+	}
+	if x.HashMessages {
+		sum := sha256.Sum256(data)
+		email.SHA256 = hex.EncodeToString(sum[:])
+	}
+	if !x.inDateRange(email.Date) {
+		x.skipped(email, nil, "date")
+		return nil
+	}
+	if !x.matchesHeaders(email, msg.Header) {
+		x.skipped(email, nil, "headers")
+		return nil
+	}
+	if email.MessageID != "" && x.SkipIDs[email.MessageID] {
+		slog.Debug("Skipping message by Message-ID", "source", path, "message_id", email.MessageID)
+		x.skipped(email, nil, "message-id")
+		return nil
+	}
+
+	if x.State != nil && !x.Force {
+		seen, err := x.State.Seen(email)
+		if err != nil {
+			return fmt.Errorf("error checking state for %s: %v", path, err)
+		}
+		if seen {
+			slog.Debug("Skipping message recorded in state database", "source", path)
+			x.skipped(email, nil, "state")
+			return nil
+		}
+	}
+
+	if x.VerifyDKIM {
+		x.verifyDKIM(data, email)
+	}
+
+	// Messages matching a render rule are rendered from their HTML instead
+	if x.HTMLRenderer != nil && x.renderRule(email) != nil {
+		if err := x.renderHTMLMessage(data, email); err != nil {
+			x.partError(fmt.Errorf("error rendering HTML body: %v", err), email)
+		}
+	} else if x.Render && !x.Combine {
+		if err := x.renderMessage(data, email); err != nil {
+			return fmt.Errorf("error rendering email %s: %v", path, err)
+		}
+	}
+
+	if x.Downloader != nil {
+		if rule := x.downloadRule(email); rule != nil {
+			if err := x.downloadLinks(data, rule.Download, email); err != nil {
+				x.partError(fmt.Errorf("error reading links: %v", err), email)
+			}
+		}
+	}
+
+	if x.SMIME != nil && isSMIMEEncrypted(msg.Header.Get("Content-Type")) {
+		inner, err := x.decryptSMIME(msg)
+		if err != nil {
+			return fmt.Errorf("error decrypting email %s: %v", path, err)
+		}
+		msg, email.unwrapped = inner, true
+	}
+	if msg, err = x.openSigned(msg, email); err != nil {
+		return fmt.Errorf("error reading signed email %s: %v", path, err)
+	}
+
+	email.holding = x.Combine
+	if err := x.extractAttachments(msg, email); err != nil {
+		return err
+	}
+
+	if x.Combine {
+		if err := x.combineMessage(data, email); err != nil {
+			return fmt.Errorf("error combining email %s: %v", path, err)
+		}
+	}
+
+	if x.Detach && len(email.detached) > 0 {
+		if err := x.detach(email); err != nil {
+			x.partError(fmt.Errorf("error detaching attachments: %v", err), email)
+		}
+	}
+	if x.MoveTo != "" && email.saved > 0 && !email.failed {
+		if err := x.move(email); err != nil {
+			x.partError(fmt.Errorf("error moving message: %v", err), email)
+		}
+	}
+	if x.Mark != "" && !email.failed {
+		if err := x.mark(email); err != nil {
+			x.partError(fmt.Errorf("error marking message: %v", err), email)
+		}
+	}
+
+	// A message with a part that failed is left unrecorded, so that later
+	// runs try it again
+	if x.State != nil && !email.failed {
+		if err := x.State.markScanned(email); err != nil {
+			return fmt.Errorf("error recording state for %s: %v", path, err)
+		}
+	}
+	if x.OnMessage != nil {
+		x.OnMessage(email)
+	}
+	return nil
+}
+
+func newEmail(header mail.Header, path, mailboxName string) *Email {
+	email := &Email{
+		Path:      path,
+		Mailbox:   mailboxName,
+		Subject:   decodeHeader(header.Get("Subject")),
+		MessageID: strings.Trim(strings.TrimSpace(header.Get("Message-ID")), "<>"),
+	}
+
+	email.Date = messageDate(header, path)
+
+	if addr, err := mail.ParseAddress(header.Get("From")); err == nil {
+		email.From = addr.Address
+		email.FromName = addr.Name
+	} else {
+		email.From = decodeHeader(header.Get("From"))
+	}
+
+	return email
+}
+
+// messageDate returns when the message was sent, from its Date header. If
+// that is missing or cannot be parsed, it falls back to when it was received:
+// the date the most recent Received header ends with, then the Unix time at
+// the start of a maildir filename. It returns the zero time if none is found.
+func messageDate(header mail.Header, path string) time.Time {
+	if date, err := mail.ParseDate(header.Get("Date")); err == nil {
+		return date
+	}
+	// Each relay prepends its own Received header, so the first is the
+	// last hop, closest to when the message was delivered
+	if received := header["Received"]; len(received) > 0 {
+		if i := strings.LastIndex(received[0], ";"); i >= 0 {
+			if date, err := mail.ParseDate(strings.TrimSpace(received[0][i+1:])); err == nil {
+				slog.Debug("Using the Received header for the date", "source", path)
+				return date
+			}
+		}
+	}
+	if date, ok := maildirTime(path); ok {
+		slog.Debug("Using the maildir filename for the date", "source", path)
+		return date
+	}
+	return time.Time{}
+}
+
+// maildirTime returns the delivery time at the start of a maildir filename,
+// e.g. 1680000001 in "1680000001.M1P1.host:2,S".
+func maildirTime(path string) (time.Time, bool) {
+	name := filepath.Base(path)
+	digits, _, ok := strings.Cut(name, ".")
+	// Nine digits or more is September 1973 onward, which rules out names
+	// such as 1.eml
+	if !ok || len(digits) < 9 || len(digits) > 10 {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// decodeHeader decodes RFC 2047 encoded words, returning the raw value if it
+// cannot be decoded.
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func (x *Extractor) extractAttachments(msg *mail.Message, email *Email) error {
+	contentType := msg.Header.Get("Content-Type")
+	if contentType == "" {
+		// The default of RFC 2045, as for messages from before MIME
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary := params["boundary"]
+		if boundary == "" {
+			return nil
+		}
+
+		reader := multipart.NewReader(msg.Body, boundary)
+		apple := newAppleDouble(mediaType)
+
+		for n := 1; ; n++ {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading multipart: %v", err)
+			}
+			if apple.skip(part) {
+				part.Close()
+				continue
+			}
+
+			if err := x.processPart(part, strconv.Itoa(n), email); err != nil {
+				x.partError(err, email)
+			}
+			part.Close()
+		}
+	} else {
+		filename := extractFilename(msg.Header.Get("Content-Disposition"), msg.Header.Get("Content-Type"))
+		body, raw := x.decodePart(msg.Body, msg.Header.Get("Content-Transfer-Encoding"), filename, email)
+		mediaType, filename, body = x.gunzipPart(mediaType, filename, msg.Header.Get("Content-Encoding"), body, email)
+		mediaType, body = x.resolveType(mediaType, filename, body)
+		var invoice string
+		if x.EInvoices && isXML(mediaType, filename) {
+			if invoice, body, err = sniffInvoice(body); err != nil {
+				return x.saveRawOnError(err, raw, msg.Header, filename, email)
+			}
+		}
+		if invoice != "" || x.wanted(mediaType, filename) {
+			email.part, email.inline, email.invoice = rootPart, isInline(msg.Header.Get("Content-Disposition")), invoice
+			defer func() { email.part, email.inline, email.invoice = "", false, "" }()
+			return x.saveRawOnError(x.saveAttachment(body, filename, mediaType, email), raw, msg.Header, filename, email)
+		}
+		if x.ImagesToPDF && isConvertibleImage(mediaType, filename) {
+			email.part, email.inline = rootPart, isInline(msg.Header.Get("Content-Disposition"))
+			defer func() { email.part, email.inline = "", false }()
+			return x.saveRawOnError(x.processImage(body, filename, email), raw, msg.Header, filename, email)
+		}
+		if x.Office != nil && isOfficeDocument(mediaType, filename) {
+			email.part, email.inline = rootPart, isInline(msg.Header.Get("Content-Disposition"))
+			defer func() { email.part, email.inline = "", false }()
+			return x.saveRawOnError(x.processOffice(body, filename, mediaType, email), raw, msg.Header, filename, email)
+		}
+		if isTNEF(mediaType, filename) {
+			return x.saveRawOnError(x.processTNEF(body, email), raw, msg.Header, filename, email)
+		}
+		if x.Archives && isArchive(mediaType, filename) {
+			return x.saveRawOnError(x.processArchive(body, filename, email), raw, msg.Header, filename, email)
+		}
+		if mediaType == "text/plain" {
+			return x.saveRawOnError(x.processYEnc(body, email), raw, msg.Header, filename, email)
+		}
+	}
+
+	return nil
+}
+
+// partError logs an error with one part of a message, such as an
+// attachment that could not be saved, and reports it to OnError. The rest of
+// the message is still processed.
+func (x *Extractor) partError(err error, email *Email) {
+	email.failed = true
+	slog.Error("Error processing part", "source", email.Path, "error", err)
+	if x.OnError != nil {
+		x.OnError(fmt.Errorf("processing part of %s: %v", email.Path, err))
+	}
+}
+
+// processPart extracts the attachments of a MIME part, numbered as in
+// IMAP: 1, 2, 2.1 and so on.
+func (x *Extractor) processPart(part *multipart.Part, number string, email *Email) error {
+	contentType := part.Header.Get("Content-Type")
+	contentDisposition := part.Header.Get("Content-Disposition")
+
+	filename := extractFilename(contentDisposition, contentType)
+	var body io.Reader
+	var raw *rawCopy
+	file, err := emlxAttachment(part.Header, filename, email.Path)
+	switch {
+	case file != nil:
+		defer file.Close()
+		body = file
+	case err != nil:
+		if !x.wanted(partMediaType(contentType), filename) {
+			return nil
+		}
+		return err
+	default:
+		body, raw = x.decodePart(part, part.Header.Get("Content-Transfer-Encoding"), filename, email)
+	}
+	mediaType, filename, body := x.gunzipPart(partMediaType(contentType), filename, part.Header.Get("Content-Encoding"), body, email)
+	mediaType, body = x.resolveType(mediaType, filename, body)
+	// The name of an AppleSingle file is that of the file inside
+	if mediaType == "application/applefile" && !x.Types[mediaType] {
+		return x.saveRawOnError(x.processAppleSingle(body, filename, email), raw, part.Header, filename, email)
+	}
+	var invoice string
+	if x.EInvoices && isXML(mediaType, filename) {
+		if invoice, body, err = sniffInvoice(body); err != nil {
+			return x.saveRawOnError(err, raw, part.Header, filename, email)
+		}
+	}
+	if invoice != "" || x.wanted(mediaType, filename) {
+		email.part, email.inline, email.invoice = number, isInline(contentDisposition), invoice
+		defer func() { email.part, email.inline, email.invoice = "", false, "" }()
+		return x.saveRawOnError(x.saveAttachment(body, filename, mediaType, email), raw, part.Header, filename, email)
+	}
+	if x.ImagesToPDF && isConvertibleImage(mediaType, filename) {
+		email.part, email.inline = number, isInline(contentDisposition)
+		defer func() { email.part, email.inline = "", false }()
+		return x.saveRawOnError(x.processImage(body, filename, email), raw, part.Header, filename, email)
+	}
+	if x.Office != nil && isOfficeDocument(mediaType, filename) {
+		email.part, email.inline = number, isInline(contentDisposition)
+		defer func() { email.part, email.inline = "", false }()
+		return x.saveRawOnError(x.processOffice(body, filename, mediaType, email), raw, part.Header, filename, email)
+	}
+	if isTNEF(mediaType, filename) {
+		return x.saveRawOnError(x.processTNEF(body, email), raw, part.Header, filename, email)
+	}
+	if isSMIMESigned(contentType) {
+		return x.saveRawOnError(x.processSMIMESigned(body, email), raw, part.Header, filename, email)
+	}
+	if x.Archives && isArchive(mediaType, filename) {
+		return x.saveRawOnError(x.processArchive(body, filename, email), raw, part.Header, filename, email)
+	}
+	if mediaType == "text/plain" {
+		return x.saveRawOnError(x.processYEnc(body, email), raw, part.Header, filename, email)
+	}
+
+	if strings.HasPrefix(partMediaType(contentType), "multipart/") {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(mediaType, "multipart/") {
+			boundary := params["boundary"]
+			if boundary != "" {
+				reader := multipart.NewReader(part, boundary)
+				apple := newAppleDouble(mediaType)
+				for n := 1; ; n++ {
+					subPart, err := reader.NextPart()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						return err
+					}
+					if apple.skip(subPart) {
+						subPart.Close()
+						continue
+					}
+
+					if err := x.processPart(subPart, number+"."+strconv.Itoa(n), email); err != nil {
+						x.partError(err, email)
+					}
+					subPart.Close()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchName reports whether an attachment filename matches NameGlobs, if
+// set.
+func (x *Extractor) matchName(filename string) bool {
+	if len(x.NameGlobs) == 0 {
+		return true
+	}
+	filename = strings.ToLower(filename)
+	for _, glob := range x.NameGlobs {
+		if ok, _ := path.Match(glob, filename); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isInline reports whether a Content-Disposition header asks for the part
+// to be shown in the body of the message, such as a preview, rather than
+// as an attachment.
+func isInline(contentDisposition string) bool {
+	disposition, _, _ := strings.Cut(contentDisposition, ";")
+	return strings.EqualFold(strings.TrimSpace(disposition), "inline")
+}
+
+func extractFilename(contentDisposition, contentType string) string {
+	if filename := headerParam(contentDisposition, "filename"); filename != "" {
+		return filename
+	}
+
+	if filename := headerParam(contentType, "name"); filename != "" {
+		return filename
+	}
+
+	return ""
+}
+
+func (x *Extractor) saveAttachment(reader io.Reader, filename, mediaType string, email *Email) error {
+	named := x.matchName(filename)
+	if filename == "" {
+		filename = defaultFilename(mediaType)
+	}
+	attachment := &Attachment{Email: email, Filename: filename, MediaType: mediaType}
+	if len(x.Dispositions) > 0 && email.part != "" {
+		disposition := "attachment"
+		if email.inline {
+			disposition = "inline"
+		}
+		if !x.Dispositions[disposition] {
+			slog.Debug("Skipping attachment by disposition", "filename", filename, "disposition", disposition, "source", email.Path)
+			x.skipped(email, attachment, "disposition")
+			return nil
+		}
+	}
+	if !named {
+		slog.Debug("Skipping attachment by name", "filename", filename, "source", email.Path)
+		x.skipped(email, attachment, "name")
+		return nil
+	}
+	if x.Filter != nil && !x.Filter(attachment) {
+		x.skipped(email, attachment, "filter")
+		return nil
+	}
+	if x.FilterExpr != nil {
+		size := int64(-1)
+		if x.FilterExpr.UsesSize() {
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return fmt.Errorf("error reading attachment %s: %v", filename, err)
+			}
+			size = int64(len(data))
+			reader = bytes.NewReader(data)
+		}
+		if !x.FilterExpr.Match(attachment, size) {
+			x.skipped(email, attachment, "filter")
+			return nil
+		}
+	}
+	rule := x.matchRule(attachment)
+	if rule != nil && rule.Skip {
+		slog.Debug("Skipping attachment by rule", "filename", filename, "source", email.Path)
+		x.skipped(email, attachment, "rule")
+		return nil
+	}
+	if email.holding && mediaType == "application/pdf" {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("error reading attachment %s: %v", filename, err)
+		}
+		email.held = append(email.held, heldAttachment{filename: filename, data: data})
+		return nil
+	}
+	email.attachments++
+	attachment.Index = email.attachments
+
+	if x.Handler != nil {
+		return x.Handler(attachment, reader)
+	}
+
+	kind := "attachment"
+	if mediaType == "application/pdf" {
+		kind = "PDF"
+		// Sniffed PDFs often arrive as scan0001.bin or with no extension
+		if !strings.EqualFold(filepath.Ext(filename), ".pdf") {
+			filename += ".pdf"
+		}
+	}
+
+	// Post-processing rewrites PDFs, but duplicates are still recognized by
+	// their original content
+	var contentHash, encryption string
+	quarantined := email.quarantine
+	var data, invoiceXML []byte
+	var invoiceFormat string
+	if mediaType == "application/pdf" && (x.Metadata || x.PDFA || x.OCR || x.QuarantineDir != "" || x.PDFPasswords != nil || x.DecryptPDFs || x.ExtractText || x.Index != nil || x.EInvoices) {
+		var err error
+		data, err = io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("error reading attachment %s: %v", filename, err)
+		}
+		sum := sha256.Sum256(data)
+		contentHash = hex.EncodeToString(sum[:])
+		if x.QuarantineDir != "" {
+			if err := validatePDF(data); err != nil {
+				quarantined = err.Error()
+			}
+		}
+		if quarantined == "" {
+			// Before post-processing, which may rewrite the PDF without
+			// its embedded files
+			if x.EInvoices {
+				if invoiceXML, invoiceFormat, err = embeddedInvoiceXML(data, x.PDFPasswords); err != nil {
+					slog.Debug("Could not look for invoice XML", "filename", filename, "source", email.Path, "error", err)
+				}
+			}
+			if x.PDFPasswords != nil || x.DecryptPDFs {
+				encryption, data = x.unlockPDF(data, filename, email)
+			}
+			data = x.postProcess(data, filename, email)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	outputDir := x.mailboxOutputDir(email.Mailbox)
+	if x.NameTemplate != nil || (rule != nil && rule.Target != nil) {
+		name, err := x.outputName(filename, email, rule)
+		if err != nil {
+			return err
+		}
+		outputDir = filepath.Join(outputDir, filepath.Dir(name))
+		filename = filepath.Base(name)
+	}
+	if x.DatePrefix {
+		filename = nameDate{email.Date}.String() + "_" + filename
+	}
+	if quarantined != "" {
+		outputDir = x.QuarantineDir
+	} else if x.Store {
+		// Views only use the filename, and the store and views are under
+		// OutputDir, where the temporary file must be to link it
+		outputDir = x.OutputDir
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %v", outputDir, err)
+	}
+
+	filename = sanitizeFilename(filename)
+
+	// Write to a temporary file first, so an interrupted run never leaves a
+	// truncated file under the final name
+	file, err := os.CreateTemp(outputDir, ".maildir2pdf-*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file in %s: %v", outputDir, err)
+	}
+	defer os.Remove(file.Name())
+
+	hash := sha256.New()
+	err = file.Chmod(0644)
+	var size int64
+	if err == nil {
+		size, err = io.Copy(io.MultiWriter(file, hash), reader)
+	}
+	if contentHash == "" {
+		contentHash = hex.EncodeToString(hash.Sum(nil))
+	}
+	if err == nil && x.Fsync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s file %s: %v", kind, filepath.Join(outputDir, filename), err)
+	}
+
+	if x.Xattrs {
+		x.setXattrs(file.Name(), email)
+	}
+
+	// Set file timestamp to email date if available
+	if !email.Date.IsZero() {
+		if err := os.Chtimes(file.Name(), email.Date, email.Date); err != nil {
+			slog.Warn("Could not set timestamp", "path", filepath.Join(outputDir, filename), "error", err)
+		}
+	}
+
+	// Content an earlier run saved is not written again, wherever it went
+	// in the output tree
+	if x.Dedup && x.State != nil && quarantined == "" {
+		original, err := x.State.savedContent(contentHash)
+		if err != nil {
+			slog.Warn("Could not look up content in state database", "filename", filename, "source", email.Path, "error", err)
+		} else if original != "" {
+			saved := &Saved{Attachment: attachment, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil)),
+				ContentSHA256: contentHash, DuplicateOf: original, Time: time.Now()}
+			x.savedPart(saved)
+			if x.OnSaved != nil {
+				x.OnSaved(saved)
+			}
+			return nil
+		}
+	}
+
+	var outputPath string
+	if x.Store && quarantined == "" {
+		outputPath, err = x.storeFile(file.Name(), hex.EncodeToString(hash.Sum(nil)), filename, email)
+	} else {
+		outputPath, err = linkUnique(file.Name(), outputDir, filename)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving %s file %s: %v", kind, filepath.Join(outputDir, filename), err)
+	}
+	if x.Fsync {
+		syncDir(outputDir)
+	}
+
+	// A file for Remote is uploaded as soon as it has its name, so that
+	// duplicates can refer to it, but its sidecars are written locally first
+	location := outputPath
+	var key string
+	if x.Remote != nil && quarantined == "" {
+		if key, err = x.upload(outputPath, mediaType); err != nil {
+			os.Remove(outputPath)
+			return fmt.Errorf("error uploading %s file: %v", kind, err)
+		}
+		location = x.Remote.URL(key)
+	}
+
+	saved := &Saved{Attachment: attachment, Path: outputPath, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil)),
+		ContentSHA256: contentHash, Quarantined: quarantined, Encryption: encryption, DownloadURL: email.downloadURL, Time: time.Now()}
+	if quarantined != "" {
+		// Keep the reason next to the file, for whoever goes through the
+		// quarantine without the manifest
+		reason := fmt.Sprintf("%s\nFrom message %s in mailbox %s\n", quarantined, email.Path, email.Mailbox)
+		if err := os.WriteFile(outputPath+".txt", []byte(reason), 0644); err != nil {
+			slog.Warn("Could not record quarantine reason", "path", outputPath, "error", err)
+		}
+	}
+	if x.Dedup {
+		if original, dup := x.recordHash(contentHash, location); dup {
+			os.Remove(outputPath)
+			if key != "" {
+				if err := x.Remote.Remove(key); err != nil {
+					slog.Warn("Could not remove duplicate", "path", location, "error", err)
+				}
+			}
+			saved.Path = ""
+			saved.DuplicateOf = original
+			x.savedPart(saved)
+			if x.OnSaved != nil {
+				x.OnSaved(saved)
+			}
+			return nil
+		}
+		if x.State != nil && quarantined == "" {
+			if err := x.State.recordContent(contentHash, location); err != nil {
+				slog.Warn("Could not record content in state database", "path", outputPath, "error", err)
+			}
+		}
+	}
+	if len(x.Organize) > 0 && quarantined == "" {
+		x.organize(outputPath, email)
+	}
+	if x.Checksums != "" {
+		if err := x.writeChecksum(saved); err != nil {
+			slog.Warn("Could not save checksum", "path", outputPath, "error", err)
+		}
+	}
+	if x.SaveSourceEML && email.raw != nil {
+		if err := os.WriteFile(outputPath+".eml", email.raw, 0644); err != nil {
+			slog.Warn("Could not save source message", "path", outputPath, "error", err)
+		} else {
+			saved.EMLPath = outputPath + ".eml"
+			if !email.Date.IsZero() {
+				os.Chtimes(saved.EMLPath, email.Date, email.Date)
+			}
+		}
+	}
+	if x.SaveBody && email.raw != nil {
+		if err := os.WriteFile(outputPath+".md", []byte(email.bodyMarkdown()), 0644); err != nil {
+			slog.Warn("Could not save message body", "path", outputPath, "error", err)
+		} else {
+			saved.BodyPath = outputPath + ".md"
+		}
+	}
+	var text string
+	if (x.ExtractText || x.Index != nil) && data != nil && quarantined == "" {
+		var err error
+		if text, err = extractPDFText(data, x.PDFPasswords); err != nil {
+			slog.Warn("Could not extract text", "path", outputPath, "error", err)
+		} else if x.ExtractText {
+			if err := os.WriteFile(outputPath+".txt", []byte(text), 0644); err != nil {
+				slog.Warn("Could not save text", "path", outputPath, "error", err)
+			} else {
+				saved.TextPath = outputPath + ".txt"
+			}
+		}
+	}
+	if invoiceXML != nil {
+		if err := os.WriteFile(outputPath+".xml", invoiceXML, 0644); err != nil {
+			slog.Warn("Could not save invoice XML", "path", outputPath, "error", err)
+		} else {
+			saved.InvoiceXML, saved.InvoiceFormat = outputPath+".xml", invoiceFormat
+		}
+	}
+	if x.Paperless != nil && mediaType == "application/pdf" && quarantined == "" {
+		if saved.PaperlessTask, err = x.Paperless.upload(saved, outputPath); err != nil {
+			slog.Warn("Could not upload file to paperless-ngx", "path", outputPath, "error", err)
+		} else {
+			slog.Debug("Uploaded file to paperless-ngx", "path", outputPath, "task", saved.PaperlessTask)
+		}
+	}
+	if key != "" {
+		x.uploadSidecars(saved, outputPath, key)
+		saved.Path = location
+		os.Remove(outputPath)
+	}
+	if x.EInvoices && quarantined == "" {
+		x.linkInvoice(saved, email)
+	}
+	if x.Index != nil && quarantined == "" {
+		// Attachments without text are still found by their email
+		if err := x.Index.add(saved, text); err != nil {
+			slog.Warn("Could not index file", "path", outputPath, "error", err)
+		}
+	}
+
+	if x.State != nil {
+		if err := x.State.recordAttachment(saved); err != nil {
+			slog.Warn("Could not record file in state database", "path", saved.Path, "error", err)
+		}
+	}
+
+	x.savedPart(saved)
+	if x.OnSaved != nil {
+		x.OnSaved(saved)
+	}
+	return nil
+}
+
+// linkUnique gives the complete file at tmpPath its final name in dir,
+// adding a numeric suffix if the name is taken. Unlike a rename, linking
+// fails instead of replacing an existing file, so concurrent workers can
+// never clobber each other's output.
+func linkUnique(tmpPath, dir, filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	outputPath := filepath.Join(dir, filename)
+
+	for counter := 1; ; counter++ {
+		err := os.Link(tmpPath, outputPath)
+		if err != nil && !os.IsExist(err) {
+			// No hard links on this filesystem: reserve the name, then
+			// rename over the reservation
+			var placeholder *os.File
+			placeholder, err = os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				placeholder.Close()
+				err = os.Rename(tmpPath, outputPath)
+			}
+		}
+		if err == nil {
+			return outputPath, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+
+		outputPath = filepath.Join(dir, fmt.Sprintf("%s_%d%s", name, counter, ext))
+	}
+}
+
+// syncDir flushes directory entries to disk after a file was linked in.
+// Not every platform supports syncing directories, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// recordHash remembers that content with the given SHA-256 was saved to path.
+// If the content was already saved, it returns the earlier path and true.
+func (x *Extractor) recordHash(sum, path string) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if original, ok := x.hashes[sum]; ok {
+		return original, true
+	}
+	if x.hashes == nil {
+		x.hashes = make(map[string]string)
+	}
+	x.hashes[sum] = path
+	return "", false
+}
+
+// decodeTransferEncoding wraps reader with a decoder for the given
+// Content-Transfer-Encoding.
+func decodeTransferEncoding(reader io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// Mailers wrap, indent and sometimes mangle base64, so decode leniently
+		return newBase64Reader(reader)
+	case "quoted-printable":
+		return quotedprintable.NewReader(reader)
+	}
+	return reader
+}
+
+// mailboxOutputDir returns the directory PDFs from the given mailbox are
+// saved to. Nested mailbox names ("Archive/2023") become nested directories.
+func (x *Extractor) mailboxOutputDir(mailboxName string) string {
+	if !x.PreserveFolders {
+		return x.OutputDir
+	}
+
+	dir := x.OutputDir
+	for _, component := range strings.Split(mailboxName, "/") {
+		component = sanitizeFilename(component)
+		if component == "." || component == ".." {
+			component = "_"
+		}
+		dir = filepath.Join(dir, component)
+	}
+	return dir
+}
+
+// maxFilenameBytes bounds the length of the names of saved files, below the
+// 255 bytes most filesystems allow, so that the numeric suffix of
+// linkUnique and the extensions of sidecars still fit.
+const maxFilenameBytes = 200
+
+// sanitizeFilename replaces the characters filesystems reject or treat
+// specially, and control characters, which decoded names may hold and which
+// would break the line-based outputs (checksums, events, manifests) and the
+// remote backends, with underscores. Names longer than maxFilenameBytes are
+// shortened, keeping their extension.
+func sanitizeFilename(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		// C0 and C1 controls and DEL
+		if r < 0x20 || r >= 0x7f && r < 0xa0 {
+			return '_'
+		}
+		return r
+	}, filename)
+	filename = strings.ReplaceAll(filename, "/", "_")
+	filename = strings.ReplaceAll(filename, "\\", "_")
+	filename = strings.ReplaceAll(filename, ":", "_")
+	filename = strings.ReplaceAll(filename, "*", "_")
+	filename = strings.ReplaceAll(filename, "?", "_")
+	filename = strings.ReplaceAll(filename, "\"", "_")
+	filename = strings.ReplaceAll(filename, "<", "_")
+	filename = strings.ReplaceAll(filename, ">", "_")
+	filename = strings.ReplaceAll(filename, "|", "_")
+
+	if filename == "" {
+		filename = "attachment.pdf"
+	}
+
+	return truncateFilename(filename, maxFilenameBytes)
+}
+
+// truncateFilename shortens filename to at most max bytes, without
+// splitting a UTF-8 sequence, keeping its extension unless that is too long
+// to.
+func truncateFilename(filename string, max int) string {
+	if len(filename) <= max {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	if len(ext) > max/4 {
+		ext = ""
+	}
+	name := strings.TrimSuffix(filename, ext)
+	cut := max - len(ext)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + ext
+}
@@ -0,0 +1,150 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// wanted reports whether an attachment with the given media type and
+// filename should be extracted.
+func (x *Extractor) wanted(mediaType, filename string) bool {
+	if x.Types[mediaType] {
+		return true
+	}
+	return filename != "" && x.Exts[strings.ToLower(filepath.Ext(filename))]
+}
+
+// partMediaType returns the lowercased media type of a Content-Type header,
+// tolerating malformed parameters.
+func partMediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// defaultFilename names attachments that do not carry a filename.
+func defaultFilename(mediaType string) string {
+	if mediaType == "application/pdf" {
+		return "attachment.pdf"
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return "attachment" + exts[len(exts)-1]
+	}
+	return "attachment"
+}
+
+// pdfAliases are non-standard media types senders use for PDFs.
+var pdfAliases = map[string]bool{
+	"application/x-pdf":   true,
+	"application/acrobat": true,
+	"application/vnd.pdf": true,
+	"text/pdf":            true,
+	"text/x-pdf":          true,
+}
+
+// genericTypes say nothing about the content of an attachment.
+var genericTypes = map[string]bool{
+	"":                           true,
+	"application/octet-stream":   true,
+	"binary/octet-stream":        true,
+	"application/binary":         true,
+	"application/download":       true,
+	"application/force-download": true,
+	"application/x-download":     true,
+	"application/save":           true,
+	"application/unknown":        true,
+}
+
+// pdfMagicWindow is how far into a file the %PDF- header may appear.
+const pdfMagicWindow = 1024
+
+// resolveType works out the real media type of an attachment declared as
+// mediaType. PDF aliases are normalized, and attachments with a generic type
+// are treated as PDFs if their name ends in .pdf or their decoded content
+// starts with the %PDF- magic. The returned reader must be used in place of
+// body, as sniffing consumes from it.
+func (x *Extractor) resolveType(mediaType, filename string, body io.Reader) (string, io.Reader) {
+	if pdfAliases[mediaType] {
+		return "application/pdf", body
+	}
+	if !genericTypes[mediaType] {
+		return mediaType, body
+	}
+
+	if strings.EqualFold(filepath.Ext(filename), ".pdf") {
+		return "application/pdf", body
+	}
+	if !x.Types["application/pdf"] {
+		return mediaType, body
+	}
+
+	buffered := bufio.NewReaderSize(body, pdfMagicWindow)
+	head, _ := buffered.Peek(pdfMagicWindow)
+	if bytes.Contains(head, []byte("%PDF-")) {
+		return "application/pdf", buffered
+	}
+	return mediaType, buffered
+}
+
+// inDateRange reports whether a message dated date passes Since and Until.
+// Undated messages are excluded whenever a range is set.
+func (x *Extractor) inDateRange(date time.Time) bool {
+	if x.Since.IsZero() && x.Until.IsZero() {
+		return true
+	}
+	if date.IsZero() {
+		return false
+	}
+	if !x.Since.IsZero() && date.Before(x.Since) {
+		return false
+	}
+	if !x.Until.IsZero() && !date.Before(x.Until) {
+		return false
+	}
+	return true
+}
+
+// HeaderMatch selects messages with a header named Name, such as List-Id,
+// matching Regex.
+type HeaderMatch struct {
+	Name  string
+	Regex *regexp.Regexp
+}
+
+// matchesHeaders reports whether a message passes FromRegex, SubjectRegex
+// and Headers. All are matched against the RFC 2047-decoded headers; a
+// header given several times, such as Received, matches if any of its
+// values does.
+func (x *Extractor) matchesHeaders(email *Email, header mail.Header) bool {
+	if x.FromRegex != nil {
+		from := email.From
+		if email.FromName != "" {
+			from = email.FromName + " <" + email.From + ">"
+		}
+		if !x.FromRegex.MatchString(from) {
+			return false
+		}
+	}
+	if x.SubjectRegex != nil && !x.SubjectRegex.MatchString(email.Subject) {
+		return false
+	}
+	for _, h := range x.Headers {
+		if !slices.ContainsFunc(header[textproto.CanonicalMIMEHeaderKey(h.Name)], func(value string) bool {
+			return h.Regex.MatchString(decodeHeader(value))
+		}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HTMLRenderer converts HTML documents to PDF, as a browser prints them.
+type HTMLRenderer interface {
+	RenderHTML(html []byte) ([]byte, error)
+}
+
+// Chrome renders HTML with Chrome or Chromium, run headless.
+type Chrome struct {
+	Command string        // chromium, google-chrome, or the path to either
+	Timeout time.Duration // after which rendering is abandoned
+}
+
+// NewChrome returns a renderer running command, such as chromium.
+func NewChrome(command string) *Chrome {
+	return &Chrome{Command: command, Timeout: 2 * time.Minute}
+}
+
+// RenderHTML prints the document to PDF, with JavaScript disabled. It is
+// served to Chrome over loopback HTTP rather than from a file, so that it
+// cannot show local files.
+func (c *Chrome) RenderHTML(html []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "maildir2pdf-html-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(html)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	out := filepath.Join(dir, "body.pdf")
+	cmd := exec.CommandContext(ctx, c.Command, "--headless", "--disable-gpu", "--no-first-run",
+		"--user-data-dir="+filepath.Join(dir, "profile"), "--blink-settings=scriptEnabled=false",
+		"--no-pdf-header-footer", "--print-to-pdf="+out, "http://"+listener.Addr().String()+"/")
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Chrome timed out after %v", c.Timeout)
+		}
+		return nil, fmt.Errorf("Chrome: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+	return os.ReadFile(out)
+}
+
+// WKHTMLToPDF renders HTML with wkhtmltopdf.
+type WKHTMLToPDF struct {
+	Command string        // wkhtmltopdf, or the path to it
+	Timeout time.Duration // after which rendering is abandoned
+}
+
+// NewWKHTMLToPDF returns a renderer running command, such as wkhtmltopdf.
+func NewWKHTMLToPDF(command string) *WKHTMLToPDF {
+	return &WKHTMLToPDF{Command: command, Timeout: 2 * time.Minute}
+}
+
+// RenderHTML prints the document to PDF on A4 pages, with JavaScript and
+// access to local files disabled.
+func (w *WKHTMLToPDF) RenderHTML(html []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	// Missing images are common in email, and not worth failing for
+	cmd := exec.CommandContext(ctx, w.Command, "--quiet", "--page-size", "A4", "--encoding", "utf-8",
+		"--disable-javascript", "--disable-local-file-access",
+		"--load-error-handling", "ignore", "--load-media-error-handling", "ignore", "-", "-")
+	cmd.Stdin = bytes.NewReader(html)
+	var pdf, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &pdf, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("wkhtmltopdf timed out after %v", w.Timeout)
+		}
+		return nil, fmt.Errorf("wkhtmltopdf: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return pdf.Bytes(), nil
+}
+
+// renderRule returns the first of x.Rules rendering messages that matches
+// email, or nil.
+func (x *Extractor) renderRule(email *Email) *Rule {
+	for _, rule := range x.Rules {
+		if rule.Render && rule.matches(&Attachment{Email: email}) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// renderHTMLMessage saves the HTML body of a message, such as an e-ticket or
+// a receipt that is the document itself, as a PDF rendered by HTMLRenderer
+// and named after the subject like those of Render. Images the body shows
+// from the message itself are embedded in it; messages without an HTML body
+// are rendered as Render does.
+func (x *Extractor) renderHTMLMessage(data []byte, email *Email) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var body htmlBody
+	body.collect(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Disposition"), msg.Header.Get("Content-ID"),
+		decodeTransferEncoding(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+	if body.html == "" {
+		slog.Debug("Rendering message without an HTML body as text", "source", email.Path)
+		return x.renderMessage(data, email)
+	}
+
+	pdf, err := x.HTMLRenderer.RenderHTML(body.document())
+	if err != nil {
+		return err
+	}
+	if err := validatePDF(pdf); err != nil {
+		return fmt.Errorf("unusable PDF: %v", err)
+	}
+	return x.saveAttachment(bytes.NewReader(pdf), renderedFilename(email), "application/pdf", email)
+}
+
+// htmlBody is the HTML body of a message, with the parts its cid: URLs
+// refer to.
+type htmlBody struct {
+	html  string
+	parts map[string]string // data: URLs by Content-ID, without angle brackets
+}
+
+func (b *htmlBody) collect(contentType, disposition, contentID string, r io.Reader) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = partMediaType(contentType)
+	}
+	attachment := strings.HasPrefix(strings.ToLower(strings.TrimSpace(disposition)), "attachment")
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				return
+			}
+			b.collect(part.Header.Get("Content-Type"), part.Header.Get("Content-Disposition"), part.Header.Get("Content-ID"),
+				decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+			part.Close()
+		}
+	case mediaType == "text/html" && !attachment && b.html == "":
+		b.html = readText(r, params["charset"])
+	case contentID != "":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return
+		}
+		if b.parts == nil {
+			b.parts = make(map[string]string)
+		}
+		id := strings.Trim(strings.TrimSpace(contentID), "<>")
+		b.parts[id] = "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+// cidURL matches the cid: URLs by which HTML bodies show parts of their
+// message.
+var cidURL = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// document returns the HTML body, declared as UTF-8, which readText
+// converted it to, with its cid: URLs replaced by the data of their parts.
+func (b *htmlBody) document() []byte {
+	html := cidURL.ReplaceAllStringFunc(b.html, func(ref string) string {
+		id := ref[len("cid:"):]
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		if data, ok := b.parts[id]; ok {
+			return data
+		}
+		return ref
+	})
+	// The first declaration counts, so this one overrides any in the body
+	return []byte(`<meta charset="utf-8">` + "\n" + html)
+}
@@ -0,0 +1,212 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// imageTypes are the media types of the images ImagesToPDF converts.
+var imageTypes = map[string]bool{
+	"image/jpeg":  true,
+	"image/pjpeg": true,
+	"image/png":   true,
+	"image/tiff":  true,
+}
+
+// minImagePixels is the size below which images are taken to be logos,
+// icons and the like, which are not converted. Photographed receipts and
+// scans are far larger.
+const minImagePixels = 250_000
+
+// isConvertibleImage reports whether an attachment with the given media type
+// and filename is a JPEG, PNG or TIFF image.
+func isConvertibleImage(mediaType, filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".tif", ".tiff":
+		return true
+	}
+	return imageTypes[mediaType]
+}
+
+// processImage saves an image attachment named filename as a PDF, named
+// after it, with the image on an A4 page, turned upright as its EXIF
+// orientation says. TIFF images, which may have several pages, are
+// converted by TIFF2PDF.
+func (x *Extractor) processImage(body io.Reader, filename string, email *Email) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error reading image %s: %v", filename, err)
+	}
+
+	var pdf []byte
+	if bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")) {
+		if x.TIFF2PDF == "" {
+			slog.Warn("Skipping TIFF image, as converting it requires tiff2pdf", "source", email.Path, "filename", filename)
+			return nil
+		}
+		if pdf, err = x.convertTIFF(data); err != nil {
+			return fmt.Errorf("error converting image %s: %v", filename, err)
+		}
+	} else {
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("error reading image %s: %v", filename, err)
+		}
+		if config.Width*config.Height < minImagePixels {
+			slog.Debug("Skipping small image", "source", email.Path, "filename", filename, "width", config.Width, "height", config.Height)
+			return nil
+		}
+		if pdf, err = imagePDF(data, filename); err != nil {
+			return fmt.Errorf("error converting image %s: %v", filename, err)
+		}
+	}
+
+	name := filename
+	if name != "" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".pdf"
+	}
+	slog.Debug("Converted image to PDF", "source", email.Path, "filename", filename)
+	return x.saveAttachment(bytes.NewReader(pdf), name, "application/pdf", email)
+}
+
+// imagePDF returns a PDF of one A4 page showing a JPEG or PNG image, as
+// large as the margins allow.
+func imagePDF(data []byte, title string) ([]byte, error) {
+	img, err := newPDFImage(data)
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if img.filter == "DCTDecode" {
+		// Decoded images are stored as they are, but JPEG data is embedded
+		// as taken, often sideways
+		orientation = jpegOrientation(data)
+	}
+
+	width, height := float64(img.width), float64(img.height)
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	scale := min((pdfPageWidth-2*pdfMargin)/width, (pdfPageHeight-2*pdfMargin)/height)
+	width, height = width*scale, height*scale
+	x, y := (pdfPageWidth-width)/2, pdfPageHeight-pdfMargin-height
+
+	d := &pdfDoc{}
+	d.images = append(d.images, img)
+	fmt.Fprintf(d.page(), "q %s cm /Im1 Do Q\n", imageMatrix(orientation, x, y, width, height))
+	return d.bytes(title), nil
+}
+
+// imageMatrix returns the transformation drawing an image, whose EXIF
+// orientation is orientation, upright in the box at x, y of width by height
+// points. Images are drawn in the unit square, their first row at the top.
+func imageMatrix(orientation int, x, y, width, height float64) string {
+	var m [6]float64
+	switch orientation {
+	case 2: // mirrored
+		m = [6]float64{-width, 0, 0, height, x + width, y}
+	case 3: // upside down
+		m = [6]float64{-width, 0, 0, -height, x + width, y + height}
+	case 4: // mirrored upside down
+		m = [6]float64{width, 0, 0, -height, x, y + height}
+	case 5: // mirrored, on its left side
+		m = [6]float64{0, -height, -width, 0, x + width, y + height}
+	case 6: // on its left side, to be turned clockwise
+		m = [6]float64{0, -height, width, 0, x, y + height}
+	case 7: // mirrored, on its right side
+		m = [6]float64{0, height, width, 0, x, y}
+	case 8: // on its right side, to be turned counterclockwise
+		m = [6]float64{0, height, -width, 0, x + width, y}
+	default:
+		m = [6]float64{width, 0, 0, height, x, y}
+	}
+	return fmt.Sprintf("%.2f %.2f %.2f %.2f %.2f %.2f", m[0], m[1], m[2], m[3], m[4], m[5])
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, from 1 for
+// upright to 8, as cameras and phones record it rather than turn the image.
+func jpegOrientation(data []byte) int {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || pos+2+length > len(data) {
+			// Start of the image data: there is no EXIF
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation returns the Orientation tag of the first image file
+// directory of EXIF data, a TIFF structure, or 1 if it has none.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := range n {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		// A SHORT, stored in the first bytes of the value
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// convertTIFF converts a TIFF image, with all its pages, to PDF with
+// TIFF2PDF, which keeps the fax compression of scans as it is.
+func (x *Extractor) convertTIFF(data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "maildir2pdf-image-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "image.tif"), filepath.Join(dir, "image.pdf")
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		return nil, err
+	}
+	// -p A4 puts each page on an A4 sheet, -F fills it
+	cmd := exec.Command(x.TIFF2PDF, "-p", "A4", "-F", "-o", out, in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("tiff2pdf: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(out)
+}
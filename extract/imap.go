@@ -0,0 +1,305 @@
+package extract
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IMAPSource describes a remote IMAP account to extract attachments from.
+type IMAPSource struct {
+	Addr        string // host:port
+	ImplicitTLS bool   // imaps; otherwise STARTTLS is required
+	Username    string
+	Password    string
+	OAuth2Token string // access token for XOAUTH2, used instead of Password if set
+	Folder      string // folder to scan; all folders if empty
+	Recursive   bool   // also scan the subfolders of Folder
+	TLSConfig   *tls.Config
+}
+
+// ParseIMAPURL parses an imaps:// or imap:// URL such as
+// imaps://user@imap.example.com/INBOX. A password in the URL is accepted but
+// better supplied separately, as URLs tend to end up in process listings.
+func ParseIMAPURL(raw string) (*IMAPSource, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &IMAPSource{TLSConfig: &tls.Config{ServerName: u.Hostname()}}
+	port := u.Port()
+	switch u.Scheme {
+	case "imaps":
+		src.ImplicitTLS = true
+		if port == "" {
+			port = "993"
+		}
+	case "imap":
+		if port == "" {
+			port = "143"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected imaps or imap", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	src.Addr = net.JoinHostPort(u.Hostname(), port)
+
+	if u.User != nil {
+		src.Username = u.User.Username()
+		src.Password, _ = u.User.Password()
+	}
+	src.Folder = strings.Trim(u.Path, "/")
+	return src, nil
+}
+
+// account identifies the source in the state database.
+func (src *IMAPSource) account() string {
+	return src.Username + "@" + src.Addr
+}
+
+// url returns the base of the paths messages are reported under.
+func (src *IMAPSource) url() string {
+	scheme := "imap"
+	if src.ImplicitTLS {
+		scheme = "imaps"
+	}
+	return (&url.URL{Scheme: scheme, User: url.User(src.Username), Host: src.Addr}).String()
+}
+
+// imapFetchBatch is the number of messages fetched per UID FETCH command.
+const imapFetchBatch = 50
+
+var uidValidityRegex = regexp.MustCompile(`(?i)\[UIDVALIDITY (\d+)\]`)
+
+// ScanIMAP extracts attachments from the messages of a remote IMAP account.
+// Folders are opened read-only, so messages are not marked as read. With a
+// state database, only messages with a UID above the highest one seen in
+// the previous run are fetched, unless the folder's UIDVALIDITY changed.
+func (s *Scanner) ScanIMAP(src *IMAPSource) error {
+	c, err := dialIMAP(src.Addr, src.ImplicitTLS, src.TLSConfig)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", src.Addr, err)
+	}
+	defer c.Close()
+
+	if src.OAuth2Token != "" {
+		err = c.authenticateXOAUTH2(src.Username, src.OAuth2Token)
+	} else {
+		err = c.login(src.Username, src.Password)
+	}
+	if err != nil {
+		return fmt.Errorf("error logging in as %s: %v", src.Username, err)
+	}
+
+	mailboxes, err := listIMAPFolders(c, src.Folder, src.Recursive)
+	if err != nil {
+		return fmt.Errorf("error listing folders: %v", err)
+	}
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+
+	type progress struct {
+		folder      string
+		uidValidity uint32
+		lastUID     uint32
+	}
+	var done []progress
+
+	failed := s.run(func(jobs chan<- emailJob) {
+		for _, mailbox := range mailboxes {
+			if s.cancelled() {
+				return
+			}
+			uidValidity, lastUID, err := s.scanIMAPFolder(c, src, mailbox, jobs)
+			if err != nil {
+				s.logError(fmt.Errorf("scanning IMAP folder %s: %v", mailbox.Name, err))
+				continue
+			}
+			done = append(done, progress{mailbox.Path, uidValidity, lastUID})
+		}
+	})
+
+	// Only record progress once every queued message has been processed,
+	// and only up to the first that failed, so that it is fetched again
+	// next time, like maildir messages that failed; State skips those after
+	// it that did not
+	if state := s.Extractor.State; state != nil {
+		for _, p := range done {
+			prefix := imapFolderURL(src, p.folder) + ";UID="
+			for _, path := range failed {
+				if uid, err := strconv.ParseUint(strings.TrimPrefix(path, prefix), 10, 32); err == nil && strings.HasPrefix(path, prefix) {
+					p.lastUID = min(p.lastUID, uint32(uid)-1)
+				}
+			}
+			if err := state.setIMAPLastUID(src.account(), p.folder, p.uidValidity, p.lastUID); err != nil {
+				slog.Warn("Could not record progress for IMAP folder", "folder", p.folder, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// listIMAPFolders returns the selectable folders to scan. Mailbox.Path holds
+// the folder name as the server knows it; Mailbox.Name is its decoded name
+// with the server's hierarchy delimiter replaced by "/".
+func listIMAPFolders(c *imapConn, folder string, recursive bool) ([]Mailbox, error) {
+	var patterns []string
+	switch {
+	case folder == "" && recursive:
+		patterns = []string{"*"}
+	case folder == "":
+		patterns = []string{"INBOX"}
+	default:
+		patterns = []string{folder}
+	}
+
+	var mailboxes []Mailbox
+	seen := make(map[string]bool)
+	for i := 0; i < len(patterns); i++ {
+		responses, err := c.command("LIST " + imapQuote("") + " " + imapQuote(patterns[i]))
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range responses {
+			if len(resp.fields) < 4 || !strings.EqualFold(imapString(resp.fields[0]), "LIST") {
+				continue
+			}
+			attrs, _ := resp.fields[1].([]any)
+			delim := imapString(resp.fields[2])
+			name := imapString(resp.fields[3])
+			if delim == "NIL" {
+				delim = ""
+			}
+
+			// Recurse into the subfolders of the requested folder
+			if recursive && i == 0 && folder != "" && delim != "" {
+				patterns = append(patterns, name+delim+"*")
+			}
+
+			if seen[name] || hasIMAPAttr(attrs, `\Noselect`) || hasIMAPAttr(attrs, `\NonExistent`) {
+				continue
+			}
+			seen[name] = true
+
+			display := decodeModifiedUTF7(name)
+			if delim != "" && delim != "/" {
+				display = strings.ReplaceAll(display, delim, "/")
+			}
+			mailboxes = append(mailboxes, Mailbox{Name: display, Path: name})
+		}
+	}
+
+	if len(mailboxes) == 0 && folder != "" {
+		return nil, fmt.Errorf("folder %s not found", folder)
+	}
+	return mailboxes, nil
+}
+
+func hasIMAPAttr(attrs []any, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(imapString(a), attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// imapFolderURL returns the URL of an IMAP folder, to which ;UID=n is
+// appended to name its messages.
+func imapFolderURL(src *IMAPSource, folder string) string {
+	return src.url() + "/" + (&url.URL{Path: folder}).EscapedPath()
+}
+
+// scanIMAPFolder queues the messages of one folder that were not fetched by
+// previous runs, and returns the folder's UIDVALIDITY and highest UID.
+func (s *Scanner) scanIMAPFolder(c *imapConn, src *IMAPSource, mailbox Mailbox, jobs chan<- emailJob) (uint32, uint32, error) {
+	responses, err := c.command("EXAMINE " + imapQuote(mailbox.Path))
+	if err != nil {
+		return 0, 0, err
+	}
+	var uidValidity uint32
+	for _, resp := range responses {
+		if m := uidValidityRegex.FindStringSubmatch(resp.text); m != nil {
+			v, _ := strconv.ParseUint(m[1], 10, 32)
+			uidValidity = uint32(v)
+		}
+	}
+
+	var lastUID uint32
+	if state := s.Extractor.State; state != nil && !s.Extractor.Force {
+		if lastUID, err = state.imapLastUID(src.account(), mailbox.Path, uidValidity); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	responses, err = c.command(fmt.Sprintf("UID SEARCH UID %d:*", lastUID+1))
+	if err != nil {
+		return 0, 0, err
+	}
+	var uids []uint32
+	for _, resp := range responses {
+		if len(resp.fields) == 0 || !strings.EqualFold(imapString(resp.fields[0]), "SEARCH") {
+			continue
+		}
+		for _, field := range resp.fields[1:] {
+			// "n:*" always matches the last message, even below n
+			if uid, err := strconv.ParseUint(imapString(field), 10, 32); err == nil && uint32(uid) > lastUID {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	s.queued(len(uids))
+
+	base := imapFolderURL(src, mailbox.Path)
+	for start := 0; start < len(uids); start += imapFetchBatch {
+		batch := uids[start:min(start+imapFetchBatch, len(uids))]
+		set := make([]string, len(batch))
+		for i, uid := range batch {
+			set[i] = strconv.FormatUint(uint64(uid), 10)
+		}
+
+		responses, err := c.command("UID FETCH " + strings.Join(set, ",") + " (UID BODY.PEEK[])")
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, resp := range responses {
+			if len(resp.fields) < 3 || !strings.EqualFold(imapString(resp.fields[1]), "FETCH") {
+				continue
+			}
+			items, _ := resp.fields[2].([]any)
+			var uid string
+			var body []byte
+			for i := 0; i+1 < len(items); i += 2 {
+				switch strings.ToUpper(imapString(items[i])) {
+				case "UID":
+					uid = imapString(items[i+1])
+				case "BODY[]":
+					body, _ = items[i+1].([]byte)
+				}
+			}
+			if uid == "" || body == nil {
+				continue
+			}
+			// Progress is only recorded for whole batches, so messages of an
+			// interrupted one are fetched again next time, and skipped if
+			// State has them
+			if !s.send(jobs, emailJob{path: base + ";UID=" + uid, mailbox: mailbox.Name, data: body}) {
+				return uidValidity, lastUID, nil
+			}
+		}
+		lastUID = batch[len(batch)-1]
+	}
+
+	return uidValidity, lastUID, nil
+}
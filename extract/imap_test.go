@@ -0,0 +1,231 @@
+package extract
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testIMAPServer answers the commands sent to an imapConn from a script of
+// untagged responses per command, completing each with OK, or with the
+// status given in the script after a "tagged" line.
+func testIMAPServer(t *testing.T, script map[string]string) *imapConn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, cmd, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			reply, ok := script[cmd]
+			if !ok {
+				reply = "tagged BAD unexpected command\r\n"
+			}
+			untagged, status, found := strings.Cut(reply, "tagged ")
+			if !found {
+				status = "OK done\r\n"
+			}
+			server.Write([]byte(untagged + tag + " " + status))
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+	return &imapConn{conn: client, r: bufio.NewReader(client)}
+}
+
+func TestIMAPReadResponse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want imapResponse
+	}{
+		{"* OK [UIDVALIDITY 3857529045] UIDs valid\r\n", imapResponse{tag: "*", status: "OK", text: "[UIDVALIDITY 3857529045] UIDs valid"}},
+		{"A001 no access denied\r\n", imapResponse{tag: "A001", status: "NO", text: "access denied"}},
+		{"+ \r\n", imapResponse{tag: "+"}},
+		{"* SEARCH 2 84 882\r\n", imapResponse{tag: "*", fields: []any{"SEARCH", "2", "84", "882"}}},
+		{
+			`* LIST (\HasNoChildren \Marked) "/" "Sent \"Items\""` + "\r\n",
+			imapResponse{tag: "*", fields: []any{"LIST", []any{`\HasNoChildren`, `\Marked`}, "/", `Sent "Items"`}},
+		},
+		{
+			"* 12 FETCH (UID 42 BODY[] {12}\r\nHello\r\nWorld)\r\n",
+			imapResponse{tag: "*", fields: []any{"12", "FETCH", []any{"UID", "42", "BODY[]", []byte("Hello\r\nWorld")}}}},
+		{
+			"* 1 FETCH (BODY[HEADER.FIELDS (DATE)] {0}\r\n)\r\n",
+			imapResponse{tag: "*", fields: []any{"1", "FETCH", []any{"BODY[HEADER.FIELDS (DATE)]", []byte{}}}},
+		},
+		{"* LIST () NIL INBOX\r\n", imapResponse{tag: "*", fields: []any{"LIST", []any(nil), "NIL", "INBOX"}}},
+	}
+	for _, tt := range tests {
+		c := &imapConn{r: bufio.NewReader(strings.NewReader(tt.in))}
+		got, err := c.readResponse()
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"* 1 FETCH (BODY[] {x}\r\n)\r\n", "* 1 FETCH (BODY[] {10}\r\nshort", "* LIST (\\Noselect"} {
+		c := &imapConn{r: bufio.NewReader(strings.NewReader(in))}
+		if got, err := c.readResponse(); err == nil {
+			t.Errorf("%q: got %#v, want an error", in, got)
+		}
+	}
+}
+
+func TestIMAPCommand(t *testing.T) {
+	c := testIMAPServer(t, map[string]string{
+		"CAPABILITY":        "* CAPABILITY IMAP4rev1 AUTH=XOAUTH2 LOGINDISABLED\r\n",
+		"NOOP":              "* 3 EXISTS\r\n* OK still here\r\n",
+		`EXAMINE "Missing"`: "tagged NO no such mailbox\r\n",
+		"CHECK":             "* BYE shutting down\r\n",
+	})
+	if err := c.capability(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.caps["AUTH=XOAUTH2"] || !c.caps["LOGINDISABLED"] || c.caps["STARTTLS"] {
+		t.Errorf("got capabilities %v", c.caps)
+	}
+	if err := c.login("user", "password"); err == nil || err.Error() != "server does not allow LOGIN" {
+		t.Errorf("got login error %v", err)
+	}
+
+	responses, err := c.command("NOOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 || imapString(responses[0].fields[1]) != "EXISTS" || responses[1].status != "OK" {
+		t.Errorf("got responses %#v", responses)
+	}
+	if _, err := c.command(`EXAMINE "Missing"`); err == nil || err.Error() != "EXAMINE failed: NO no such mailbox" {
+		t.Errorf("got error %v", err)
+	}
+	if _, err := c.command("CHECK"); err == nil || err.Error() != "server closed connection: shutting down" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestListIMAPFolders(t *testing.T) {
+	list := `LIST "" "*"`
+	script := map[string]string{
+		`LIST "" "INBOX"`: `* LIST (\HasChildren) "." INBOX` + "\r\n",
+		list: `* LIST (\HasChildren) "." INBOX` + "\r\n" +
+			`* LIST (\Noselect \HasChildren) "." Archive` + "\r\n" +
+			`* LIST (\HasNoChildren) "." Archive.2023` + "\r\n" +
+			`* LIST (\HasNoChildren) "." "Entw&APw-rfe"` + "\r\n",
+		`LIST "" "Archive"`:   `* LIST (\Noselect \HasChildren) "." Archive` + "\r\n",
+		`LIST "" "Archive.*"`: `* LIST (\HasNoChildren) "." Archive.2023` + "\r\n",
+		`LIST "" "Nowhere"`:   "",
+	}
+	tests := []struct {
+		name      string
+		folder    string
+		recursive bool
+		want      []Mailbox
+		err       string
+	}{
+		{name: "inbox", want: []Mailbox{{Name: "INBOX", Path: "INBOX"}}},
+		{
+			name:      "all folders",
+			recursive: true,
+			want: []Mailbox{
+				{Name: "INBOX", Path: "INBOX"},
+				{Name: "Archive/2023", Path: "Archive.2023"},
+				{Name: "Entwürfe", Path: "Entw&APw-rfe"},
+			},
+		},
+		{
+			name:      "subfolders",
+			folder:    "Archive",
+			recursive: true,
+			want:      []Mailbox{{Name: "Archive/2023", Path: "Archive.2023"}},
+		},
+		{name: "unselectable folder", folder: "Archive", err: "folder Archive not found"},
+		{name: "missing folder", folder: "Nowhere", err: "folder Nowhere not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listIMAPFolders(testIMAPServer(t, script), tt.folder, tt.recursive)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIMAPURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want IMAPSource
+		err  string
+	}{
+		{
+			url:  "imaps://alice@imap.example.com/INBOX",
+			want: IMAPSource{Addr: "imap.example.com:993", ImplicitTLS: true, Username: "alice", Folder: "INBOX"},
+		},
+		{
+			url:  "imap://bob:secret@[2001:db8::1]:1143/Archive/2023/",
+			want: IMAPSource{Addr: "[2001:db8::1]:1143", Username: "bob", Password: "secret", Folder: "Archive/2023"},
+		},
+		{url: "imap://mail.example.org", want: IMAPSource{Addr: "mail.example.org:143"}},
+		{url: "pop3://mail.example.org", err: `unsupported scheme "pop3", expected imaps or imap`},
+		{url: "imaps:///INBOX", err: "missing host"},
+	}
+	for _, tt := range tests {
+		got, err := ParseIMAPURL(tt.url)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.url, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		got.TLSConfig = nil
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.url, *got, tt.want)
+		}
+	}
+}
+
+func TestModifiedUTF7(t *testing.T) {
+	tests := []struct {
+		decoded, encoded string
+	}{
+		{"INBOX", "INBOX"},
+		{"Entwürfe", "Entw&APw-rfe"},
+		{"Tom & Jerry", "Tom &- Jerry"},
+		{"日本語", "&ZeVnLIqe-"},
+		{"~peter/mail/台北/日本語", "~peter/mail/&U,BTFw-/&ZeVnLIqe-"},
+	}
+	for _, tt := range tests {
+		if got := encodeModifiedUTF7(tt.decoded); got != tt.encoded {
+			t.Errorf("encodeModifiedUTF7(%q) = %q, want %q", tt.decoded, got, tt.encoded)
+		}
+		if got := decodeModifiedUTF7(tt.encoded); got != tt.decoded {
+			t.Errorf("decodeModifiedUTF7(%q) = %q, want %q", tt.encoded, got, tt.decoded)
+		}
+	}
+	for _, malformed := range []string{"&Jjo", "&A-", "&!!!-"} {
+		if got := decodeModifiedUTF7(malformed); got != malformed {
+			t.Errorf("decodeModifiedUTF7(%q) = %q, want it unchanged", malformed, got)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package extract
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// imapConn is a minimal IMAP4rev1 client, implementing only the commands
+// needed to list folders and fetch messages.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+	caps map[string]bool
+}
+
+// imapResponse is an untagged or tagged server response. Status responses
+// (OK, NO, BAD, BYE, PREAUTH) keep the rest of their line in text; all other
+// responses are parsed into fields, which hold strings for atoms and quoted
+// strings, []byte for literals and []any for parenthesized lists.
+type imapResponse struct {
+	tag    string
+	status string
+	text   string
+	fields []any
+}
+
+const imapDialTimeout = 30 * time.Second
+
+func dialIMAP(addr string, implicitTLS bool, config *tls.Config) (*imapConn, error) {
+	dialer := &net.Dialer{Timeout: imapDialTimeout}
+	var conn net.Conn
+	var err error
+	if implicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading greeting: %v", err)
+	}
+	if greeting.status != "OK" && greeting.status != "PREAUTH" {
+		conn.Close()
+		return nil, fmt.Errorf("server refused connection: %s %s", greeting.status, greeting.text)
+	}
+
+	if err := c.capability(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !implicitTLS {
+		if !c.caps["STARTTLS"] {
+			conn.Close()
+			return nil, errors.New("server does not offer STARTTLS")
+		}
+		if _, err := c.command("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+		// Capabilities may change once the connection is secure
+		if err := c.capability(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *imapConn) Close() error {
+	c.command("LOGOUT")
+	return c.conn.Close()
+}
+
+func (c *imapConn) capability() error {
+	responses, err := c.command("CAPABILITY")
+	if err != nil {
+		return err
+	}
+	c.caps = make(map[string]bool)
+	for _, resp := range responses {
+		if len(resp.fields) > 0 && strings.EqualFold(imapString(resp.fields[0]), "CAPABILITY") {
+			for _, cap := range resp.fields[1:] {
+				c.caps[strings.ToUpper(imapString(cap))] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (c *imapConn) login(username, password string) error {
+	if c.caps["LOGINDISABLED"] {
+		return errors.New("server does not allow LOGIN")
+	}
+	_, err := c.command("LOGIN " + imapQuote(username) + " " + imapQuote(password))
+	return err
+}
+
+// authenticateXOAUTH2 logs in with an OAuth2 access token, as supported by
+// Gmail and Outlook.com.
+func (c *imapConn) authenticateXOAUTH2(username, token string) error {
+	if !c.caps["AUTH=XOAUTH2"] {
+		return errors.New("server does not support XOAUTH2")
+	}
+	ir := base64.StdEncoding.EncodeToString([]byte("user=" + username + "\x01auth=Bearer " + token + "\x01\x01"))
+	_, err := c.command("AUTHENTICATE XOAUTH2 " + ir)
+	return err
+}
+
+// command sends a command and returns the untagged responses received
+// before its tagged completion, or an error if it did not complete with OK.
+func (c *imapConn) command(cmd string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%03d", c.tag)
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	var responses []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case tag:
+			if resp.status != "OK" {
+				verb, _, _ := strings.Cut(cmd, " ")
+				return nil, fmt.Errorf("%s failed: %s %s", verb, resp.status, resp.text)
+			}
+			return responses, nil
+		case "+":
+			// A continuation request here can only be an authentication
+			// challenge carrying an error; cancel to get the tagged NO
+			if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+				return nil, err
+			}
+		case "*":
+			if resp.status == "BYE" && !strings.HasPrefix(cmd, "LOGOUT") {
+				return nil, fmt.Errorf("server closed connection: %s", resp.text)
+			}
+			responses = append(responses, resp)
+		}
+	}
+}
+
+// readResponse reads one complete response line, including any literals.
+func (c *imapConn) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	tag, err := c.readAtom()
+	if err != nil {
+		return resp, err
+	}
+	resp.tag = tag
+	if tag == "+" {
+		resp.text, err = c.readText()
+		return resp, err
+	}
+	if err := c.skipSpace(); err != nil {
+		return resp, err
+	}
+
+	first, err := c.readAtom()
+	if err != nil {
+		return resp, err
+	}
+	switch strings.ToUpper(first) {
+	case "OK", "NO", "BAD", "BYE", "PREAUTH":
+		resp.status = strings.ToUpper(first)
+		resp.text, err = c.readText()
+		return resp, err
+	}
+
+	resp.fields, err = c.readFields(first)
+	return resp, err
+}
+
+// readFields reads the values up to the end of the line, after first.
+func (c *imapConn) readFields(first string) ([]any, error) {
+	fields := []any{first}
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case ' ':
+			continue
+		case '\r':
+			continue
+		case '\n':
+			return fields, nil
+		}
+		c.r.UnreadByte()
+		value, err := c.readValue()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, value)
+	}
+}
+
+func (c *imapConn) readValue() (any, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case '(':
+		var list []any
+		for {
+			b, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == ')' {
+				return list, nil
+			}
+			if b == ' ' {
+				continue
+			}
+			c.r.UnreadByte()
+			value, err := c.readValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+	case '"':
+		var s strings.Builder
+		for {
+			b, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == '"' {
+				return s.String(), nil
+			}
+			if b == '\\' {
+				if b, err = c.r.ReadByte(); err != nil {
+					return nil, err
+				}
+			}
+			s.WriteByte(b)
+		}
+	case '{':
+		size, err := c.r.ReadString('}')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(size, "}"), "+"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid literal size %q", size)
+		}
+		if _, err := c.r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		literal := make([]byte, n)
+		_, err = io.ReadFull(c.r, literal)
+		return literal, err
+	}
+	c.r.UnreadByte()
+	return c.readAtom()
+}
+
+// readAtom reads an atom. Brackets are kept with their contents, so
+// section specifiers such as BODY[HEADER.FIELDS (DATE)] read as one atom.
+func (c *imapConn) readAtom() (string, error) {
+	var s strings.Builder
+	depth := 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case b == '[':
+			depth++
+		case b == ']':
+			depth--
+		case depth == 0 && (b == ' ' || b == '(' || b == ')' || b == '\r' || b == '\n'):
+			c.r.UnreadByte()
+			return s.String(), nil
+		}
+		s.WriteByte(b)
+	}
+}
+
+func (c *imapConn) skipSpace() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != ' ' {
+		c.r.UnreadByte()
+	}
+	return nil
+}
+
+// readText returns the rest of the line.
+func (c *imapConn) readText() (string, error) {
+	line, err := c.r.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+// imapString returns the string value of an atom, quoted string or literal.
+func imapString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func imapQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// decodeModifiedUTF7 decodes a folder name in the modified UTF-7 of
+// RFC 3501, returning it unchanged if it is malformed.
+func decodeModifiedUTF7(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '&' {
+			b.WriteByte(name[i])
+			continue
+		}
+		end := strings.IndexByte(name[i:], '-')
+		if end < 0 {
+			return name
+		}
+		encoded := name[i+1 : i+end]
+		i += end
+		if encoded == "" {
+			b.WriteByte('&')
+			continue
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(strings.ReplaceAll(encoded, ",", "/"))
+		if err != nil || len(raw)%2 != 0 {
+			return name
+		}
+		units := make([]uint16, len(raw)/2)
+		for j := range units {
+			units[j] = uint16(raw[2*j])<<8 | uint16(raw[2*j+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+	}
+	return b.String()
+}
+
+// encodeModifiedUTF7 encodes a folder name in the modified UTF-7 of
+// RFC 3501, as maildirs and IMAP servers store them.
+func encodeModifiedUTF7(name string) string {
+	var b strings.Builder
+	var units []uint16
+	flush := func() {
+		if len(units) == 0 {
+			return
+		}
+		raw := make([]byte, 2*len(units))
+		for i, u := range units {
+			raw[2*i], raw[2*i+1] = byte(u>>8), byte(u)
+		}
+		b.WriteString("&" + strings.ReplaceAll(base64.RawStdEncoding.EncodeToString(raw), "/", ",") + "-")
+		units = nil
+	}
+	for _, r := range name {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				b.WriteString("&-")
+			} else {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		units = append(units, utf16.Encode([]rune{r})...)
+	}
+	flush()
+	return b.String()
+}
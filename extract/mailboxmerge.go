@@ -0,0 +1,127 @@
+package extract
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MailboxMerger gathers the PDFs saved from each mailbox, so they can be
+// merged into one document per mailbox once extraction is done. Messages are
+// ordered by date and each gets a bookmark showing its subject and date.
+type MailboxMerger struct {
+	mu    sync.Mutex
+	saved map[string][]*Saved // mailbox name -> PDFs saved from it
+}
+
+// NewMailboxMerger returns an empty MailboxMerger.
+func NewMailboxMerger() *MailboxMerger {
+	return &MailboxMerger{saved: make(map[string][]*Saved)}
+}
+
+// Add records a saved attachment, and is meant to be called from
+// Extractor.OnSaved. Duplicates and attachments other than PDFs are ignored.
+func (m *MailboxMerger) Add(s *Saved) {
+	if s.Path == "" || s.MediaType != "application/pdf" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saved[s.Email.Mailbox] = append(m.saved[s.Email.Mailbox], s)
+}
+
+// Write merges the PDFs of each mailbox into dir, in a file named after the
+// mailbox, replacing any existing one. It returns the paths written. PDFs
+// that cannot be merged are left out with a warning.
+func (m *MailboxMerger) Write(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %v", dir, err)
+	}
+
+	mailboxes := make([]string, 0, len(m.saved))
+	for name := range m.saved {
+		mailboxes = append(mailboxes, name)
+	}
+	sort.Strings(mailboxes)
+
+	var written []string
+	for _, name := range mailboxes {
+		path := filepath.Join(dir, sanitizeFilename(name)+".pdf")
+		ok, err := writeMailboxPDF(path, name, m.saved[name])
+		if err != nil {
+			return written, err
+		}
+		if ok {
+			written = append(written, path)
+		}
+	}
+	return written, nil
+}
+
+// writeMailboxPDF merges saved into path, reporting whether any page was
+// written.
+func writeMailboxPDF(path, mailboxName string, saved []*Saved) (bool, error) {
+	// Workers finish messages in any order, so sort on everything that
+	// identifies an attachment
+	sort.SliceStable(saved, func(i, j int) bool {
+		a, b := saved[i], saved[j]
+		if !a.Email.Date.Equal(b.Email.Date) {
+			return a.Email.Date.Before(b.Email.Date)
+		}
+		if a.Email.Path != b.Email.Path {
+			return a.Email.Path < b.Email.Path
+		}
+		return a.Index < b.Index
+	})
+
+	merger := newPDFMerger()
+	var last *Email
+	for _, s := range saved {
+		data, err := os.ReadFile(s.Path)
+		if err != nil {
+			return false, fmt.Errorf("error reading %s: %v", s.Path, err)
+		}
+		page, err := merger.add(data)
+		if err != nil {
+			slog.Warn("Leaving PDF out of merged PDF", "path", s.Path, "mailbox", mailboxName, "error", err)
+			continue
+		}
+		// One bookmark per message, at its first PDF
+		if s.Email != last {
+			merger.bookmark(bookmarkTitle(s.Email), page)
+			last = s.Email
+		}
+	}
+	if len(merger.kids) == 0 {
+		return false, nil
+	}
+
+	data := merger.bytes(pdfDict{"Title": pdfTextString(mailboxName), "Producer": pdfTextString("maildir2pdf")})
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return false, fmt.Errorf("error writing %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("error renaming %s: %v", tmp, err)
+	}
+	return true, nil
+}
+
+func bookmarkTitle(email *Email) string {
+	title := strings.TrimSpace(email.Subject)
+	if title == "" {
+		title = "(no subject)"
+	}
+	if !email.Date.IsZero() {
+		title += " (" + email.Date.Format("2006-01-02") + ")"
+	}
+	return title
+}
@@ -0,0 +1,163 @@
+package extract
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dovecotKeywords is the file in which Dovecot maps the letters a to z of
+// maildir filenames to the keywords of a mailbox, as lines like
+// "0 $PDFExtracted" for a.
+const dovecotKeywords = "dovecot-keywords"
+
+// keywordsMu serializes additions to dovecot-keywords files.
+var keywordsMu sync.Mutex
+
+// markLetter returns the letter marking messages of the maildir mailboxDir
+// with Mark: Mark itself if it is a single letter, such as F for flagged,
+// or the letter of the keyword in the mailbox's dovecot-keywords file. With
+// add, a keyword that is not in the file yet is added to it; otherwise 0 is
+// returned for it.
+func (x *Extractor) markLetter(mailboxDir string, add bool) (byte, error) {
+	if len(x.Mark) == 1 && ('a' <= x.Mark[0] && x.Mark[0] <= 'z' || 'A' <= x.Mark[0] && x.Mark[0] <= 'Z') {
+		return x.Mark[0], nil
+	}
+	return keywordLetter(mailboxDir, x.Mark, add)
+}
+
+// keywordLetter returns the letter of keyword in the dovecot-keywords file
+// of the maildir mailboxDir, adding it to the file with add, or 0.
+func keywordLetter(mailboxDir, keyword string, add bool) (byte, error) {
+	keywordsMu.Lock()
+	defer keywordsMu.Unlock()
+	path := filepath.Join(mailboxDir, dovecotKeywords)
+	keywords, err := readDovecotKeywords(path)
+	if err != nil {
+		return 0, err
+	}
+	for i, k := range keywords {
+		if k == keyword {
+			return byte('a' + i), nil
+		}
+	}
+	if !add {
+		return 0, nil
+	}
+	i := slices.Index(keywords, "")
+	if i < 0 {
+		if len(keywords) >= 26 {
+			return 0, fmt.Errorf("%s already has the 26 keywords maildir filenames allow", path)
+		}
+		i = len(keywords)
+		keywords = append(keywords, "")
+	}
+	keywords[i] = keyword
+	if err := writeDovecotKeywords(path, keywords); err != nil {
+		return 0, err
+	}
+	return byte('a' + i), nil
+}
+
+// readDovecotKeywords returns the keywords in a dovecot-keywords file,
+// indexed by their number, with gaps left empty. A missing file has none.
+func readDovecotKeywords(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keywords := make([]string, 0, 26)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		number, keyword, ok := strings.Cut(scanner.Text(), " ")
+		n, err := strconv.Atoi(number)
+		if !ok || err != nil || n < 0 || n >= 26 || keyword == "" {
+			continue
+		}
+		for len(keywords) <= n {
+			keywords = append(keywords, "")
+		}
+		keywords[n] = keyword
+	}
+	return keywords, scanner.Err()
+}
+
+// writeDovecotKeywords replaces a dovecot-keywords file, as Dovecot does, by
+// renaming a new one over it.
+func writeDovecotKeywords(path string, keywords []string) error {
+	var b strings.Builder
+	for i, keyword := range keywords {
+		if keyword != "" {
+			fmt.Fprintf(&b, "%d %s\n", i, keyword)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+dovecotKeywords+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(b.String())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// mark adds the Mark flag to the maildir message file of email, once it
+// has been processed without errors. Messages in new are moved to cur, as
+// only those there have flags.
+func (x *Extractor) mark(email *Email) error {
+	path := email.Path
+	dir := filepath.Dir(path)
+	if base := filepath.Base(dir); base != "cur" && base != "new" {
+		return nil
+	}
+	letter, err := x.markLetter(filepath.Dir(dir), true)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+	sep := ":2,"
+	if strings.Contains(name, "!2,") {
+		sep = "!2,"
+	}
+	base, flags, _ := strings.Cut(name, sep)
+	if strings.IndexByte(flags, letter) >= 0 && filepath.Base(dir) == "cur" {
+		return nil
+	}
+	if strings.IndexByte(flags, letter) < 0 {
+		// Flags are kept in ASCII order
+		letters := []byte(flags + string(letter))
+		slices.Sort(letters)
+		flags = string(letters)
+	}
+	newPath := filepath.Join(filepath.Dir(dir), "cur", base+sep+flags)
+	if err := os.Rename(path, newPath); err != nil {
+		return err
+	}
+	email.Path = newPath
+	return nil
+}
+
+// marked reports whether the maildir message file named filename carries
+// letter, or 0 for none, in its flags.
+func marked(filename string, letter byte) bool {
+	return letter != 0 && strings.IndexByte(maildirFlags(filename), letter) >= 0
+}
@@ -0,0 +1,118 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// bodyMarkdown returns the message as a Markdown document for SaveBody: its
+// subject as a heading, its main headers, its text body (or its HTML body
+// converted to Markdown) and the names of its attachments. It is worked out
+// once per message.
+func (email *Email) bodyMarkdown() string {
+	if email.body != nil {
+		return *email.body
+	}
+	markdown := ""
+	email.body = &markdown
+
+	msg, err := mail.ReadMessage(bytes.NewReader(email.raw))
+	if err != nil {
+		return markdown
+	}
+	var body messageBody
+	body.collect(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Disposition"),
+		decodeTransferEncoding(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+
+	var b strings.Builder
+	subject := strings.TrimSpace(email.Subject)
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	fmt.Fprintf(&b, "# %s\n\n", subject)
+	field := func(name, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			// Two trailing spaces break the line
+			fmt.Fprintf(&b, "**%s:** %s  \n", name, value)
+		}
+	}
+	field("From", decodeHeader(msg.Header.Get("From")))
+	field("To", decodeHeader(msg.Header.Get("To")))
+	field("Cc", decodeHeader(msg.Header.Get("Cc")))
+	if email.Date.IsZero() {
+		field("Date", msg.Header.Get("Date"))
+	} else {
+		field("Date", email.Date.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+	if email.MessageID != "" {
+		field("Message-ID", "`"+email.MessageID+"`")
+	}
+	if text := body.markdown(); text != "" {
+		b.WriteString("\n" + text + "\n")
+	}
+	if len(body.attachments) > 0 {
+		b.WriteString("\n---\n\n**Attachments:** " + strings.Join(body.attachments, ", ") + "\n")
+	}
+
+	markdown = b.String()
+	return markdown
+}
+
+// markdown returns the body as Markdown, preferring a text/plain
+// alternative, which is used as it is, to converting HTML.
+func (b *messageBody) markdown() string {
+	if strings.TrimSpace(b.plain) != "" || b.html == "" {
+		return strings.TrimSpace(strings.ReplaceAll(b.plain, "\r\n", "\n"))
+	}
+	return htmlToMarkdown(b.html)
+}
+
+var (
+	mdHeadingRegex = regexp.MustCompile(`(?is)<h([1-6])\b[^>]*>(.*?)</h[1-6]\s*>`)
+	mdLinkRegex    = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a\s*>`)
+	mdBoldRegex    = regexp.MustCompile(`(?i)</?(b|strong)\b[^>]*>`)
+	mdItalicRegex  = regexp.MustCompile(`(?i)</?(i|em)\b[^>]*>`)
+	mdRuleRegex    = regexp.MustCompile(`(?i)<hr\b[^>]*>`)
+	mdBreakRegex   = regexp.MustCompile(`(?i)<br\b[^>]*>`)
+	mdBlockRegex   = regexp.MustCompile(`(?i)</(p|div|tr|blockquote|table|ul|ol)\s*>`)
+	mdItemRegex    = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+)
+
+// htmlToMarkdown converts an HTML body to Markdown, keeping its headings,
+// links, emphasis, lists and paragraphs, and dropping the rest of its markup,
+// like htmlToText.
+func htmlToMarkdown(s string) string {
+	s = htmlHiddenRegex.ReplaceAllString(s, "")
+	s = htmlSpaceRegex.ReplaceAllString(s, " ")
+	s = mdHeadingRegex.ReplaceAllStringFunc(s, func(h string) string {
+		m := mdHeadingRegex.FindStringSubmatch(h)
+		return "\n\n" + strings.Repeat("#", int(m[1][0]-'0')) + " " + strings.TrimSpace(m[2]) + "\n\n"
+	})
+	s = mdLinkRegex.ReplaceAllStringFunc(s, func(a string) string {
+		m := mdLinkRegex.FindStringSubmatch(a)
+		href, text := strings.TrimSpace(m[1]), strings.TrimSpace(m[2])
+		if href == "" || strings.HasPrefix(href, "#") || text == href {
+			return text
+		}
+		return "[" + text + "](" + href + ")"
+	})
+	s = mdBoldRegex.ReplaceAllString(s, "**")
+	s = mdItalicRegex.ReplaceAllString(s, "_")
+	s = mdRuleRegex.ReplaceAllString(s, "\n\n---\n\n")
+	s = mdBreakRegex.ReplaceAllString(s, "\n")
+	s = mdBlockRegex.ReplaceAllString(s, "\n\n")
+	s = mdItemRegex.ReplaceAllString(s, "\n- ")
+	s = htmlCellRegex.ReplaceAllString(s, " ")
+	s = htmlTagRegex.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
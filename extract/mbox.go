@@ -0,0 +1,203 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ScanMbox extracts attachments from every message in an mbox file, or in
+// every mbox file found under a directory. Each file is treated as a mailbox
+// named after its path without the .mbox extension, so the mailbox filters
+// and PreserveFolders apply as they do to maildirs.
+func (s *Scanner) ScanMbox(mboxPath string) error {
+	mailboxes, err := DiscoverMboxes(mboxPath)
+	if err != nil {
+		return fmt.Errorf("error discovering mbox files: %v", err)
+	}
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+
+	if s.OnQueued != nil {
+		for _, mailbox := range mailboxes {
+			if n, err := countMbox(mailbox.Path); err == nil {
+				s.queued(n)
+			}
+		}
+	}
+	s.run(func(jobs chan<- emailJob) {
+		for _, mailbox := range mailboxes {
+			if s.cancelled() {
+				return
+			}
+			if err := s.scanMboxFile(mailbox.Path, mailbox.Name, jobs); err != nil {
+				s.logError(fmt.Errorf("scanning mbox %s: %v", mailbox.Path, err))
+			}
+		}
+	})
+
+	return nil
+}
+
+// DiscoverMboxes returns the mbox file at mboxPath, or every mbox file under
+// it if it is a directory. Files that do not start with a "From " line are
+// ignored.
+func DiscoverMboxes(mboxPath string) ([]Mailbox, error) {
+	info, err := os.Stat(mboxPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		name := strings.TrimSuffix(filepath.Base(mboxPath), filepath.Ext(mboxPath))
+		return []Mailbox{{Name: name, Path: mboxPath}}, nil
+	}
+
+	var mailboxes []Mailbox
+	err = filepath.Walk(mboxPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip symlinks
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || !isMbox(path) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(mboxPath, path)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.ToSlash(relPath), ".mbox")
+		mailboxes = append(mailboxes, Mailbox{Name: name, Path: path})
+		return nil
+	})
+
+	return mailboxes, err
+}
+
+// isMbox reports whether the file at path starts with an mbox "From " line.
+func isMbox(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, 5)
+	_, err = io.ReadFull(file, head)
+	return err == nil && string(head) == "From "
+}
+
+// scanMboxFile queues every message of an mbox file.
+func (s *Scanner) scanMboxFile(path, mailboxName string, jobs chan<- emailJob) error {
+	return s.readMboxFile(path, func(messagePath string, message []byte) bool {
+		return s.send(jobs, emailJob{path: messagePath, mailbox: mailboxName, data: message})
+	})
+}
+
+// readMboxFile calls fn with every message of an mbox file, identified as
+// path#N, N counting from 1, until it returns false.
+func (s *Scanner) readMboxFile(path string, fn func(messagePath string, message []byte) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count := 0
+	err = readMbox(file, func(message []byte) bool {
+		count++
+		return fn(fmt.Sprintf("%s#%d", path, count), message)
+	})
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return nil
+}
+
+// countMbox counts the messages of an mbox file, for progress reports,
+// without keeping them in memory.
+func countMbox(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	count, lineStart := 0, true
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if lineStart && bytes.HasPrefix(chunk, []byte("From ")) {
+			count++
+		}
+		lineStart = len(chunk) > 0 && chunk[len(chunk)-1] == '\n'
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return count, err
+		}
+	}
+}
+
+// readMbox splits an mbox stream into messages, calling fn with each one
+// until it returns false.
+// Body lines quoted as ">From " are unquoted: mboxrd quotes every line
+// matching ">*From " by adding one '>', and removing one '>' is also the
+// best reading of mboxo, which only quotes "From " itself.
+func readMbox(r io.Reader, fn func(message []byte) bool) error {
+	reader := bufio.NewReader(r)
+	var message []byte
+	started := false
+
+	flush := func() bool {
+		more := true
+		if started && len(message) > 0 {
+			// The blank line before the next "From " line is a separator
+			message = bytes.TrimSuffix(message, []byte("\n"))
+			message = bytes.TrimSuffix(message, []byte("\r"))
+			more = fn(message)
+		}
+		message = nil
+		return more
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if !flush() {
+					return nil
+				}
+				started = true
+			case started:
+				if quoted := bytes.TrimLeft(line, ">"); len(quoted) < len(line) && bytes.HasPrefix(quoted, []byte("From ")) {
+					line = line[1:]
+				}
+				message = append(message, line...)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	flush()
+
+	return nil
+}
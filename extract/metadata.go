@@ -0,0 +1,247 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// addMetadata records the email a PDF came from in its document information
+// dictionary, in an incremental update: Title is the subject, Author the
+// sender, CreationDate the date of the email and MessageID its Message-ID. Documents without XMP metadata also get an
+// XMP packet with the same details; existing packets are left alone, as they
+// may carry conformance claims such as PDF/A that a rewrite would break.
+func addMetadata(data []byte, email *Email) ([]byte, error) {
+	u, err := newPDFUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	info := pdfDict{}
+	if old, ok := u.f.resolve(u.f.trailer["Info"]).(pdfDict); ok {
+		for k, v := range old {
+			info[k] = v
+		}
+	}
+	for key, value := range map[pdfName]string{"Title": email.Subject, "Author": emailAuthor(email), "MessageID": email.MessageID} {
+		if value != "" {
+			info[key] = pdfTextString(value)
+		}
+	}
+	if !email.Date.IsZero() {
+		info["CreationDate"] = pdfString(pdfDate(email.Date))
+	}
+	infoRef, ok := u.f.trailer["Info"].(pdfRef)
+	if !ok {
+		infoRef = u.newObject()
+	}
+	u.write(infoRef, info)
+	u.trailer["Info"] = infoRef
+
+	rootRef, catalog, err := u.catalog()
+	if err != nil {
+		return nil, err
+	}
+	if catalog["Metadata"] == nil {
+		xmpRef := u.newObject()
+		u.write(xmpRef, pdfStream{
+			dict: pdfDict{"Type": pdfName("Metadata"), "Subtype": pdfName("XML")},
+			data: xmpPacket(email),
+		})
+		catalog["Metadata"] = xmpRef
+		u.write(rootRef, catalog)
+	}
+	return u.bytes(), nil
+}
+
+// pdfUpdate is an incremental update: objects appended to a document,
+// replacing earlier versions with the same numbers.
+type pdfUpdate struct {
+	f       *pdfFile
+	out     bytes.Buffer
+	offsets map[pdfRef]int
+	next    int     // first unused object number
+	trailer pdfDict // of the update; Size and the cross-reference keys are added by bytes
+}
+
+func newPDFUpdate(data []byte) (*pdfUpdate, error) {
+	f, err := parsePDF(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.repaired {
+		// Updates chain to the existing cross-reference data
+		return nil, errors.New("damaged cross-reference table")
+	}
+	if f.crypt != nil {
+		// New objects would have to be encrypted too
+		return nil, errors.New("cannot update encrypted PDFs")
+	}
+
+	u := &pdfUpdate{f: f, offsets: make(map[pdfRef]int), trailer: pdfDict{}}
+	size, _ := f.trailer["Size"].(int64)
+	for num := range f.xref {
+		size = max(size, int64(num)+1)
+	}
+	u.next = int(size)
+	for _, key := range []pdfName{"Root", "Info", "ID"} {
+		if v, ok := f.trailer[key]; ok {
+			u.trailer[key] = v
+		}
+	}
+	u.trailer["Prev"] = int64(f.startxref)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		u.out.WriteByte('\n')
+	}
+	return u, nil
+}
+
+func (u *pdfUpdate) newObject() pdfRef {
+	u.next++
+	return pdfRef{num: u.next - 1}
+}
+
+// catalog returns a copy of the document catalog, to be modified and written
+// back under its reference.
+func (u *pdfUpdate) catalog() (pdfRef, pdfDict, error) {
+	ref, ok := u.f.trailer["Root"].(pdfRef)
+	catalog, isDict := u.f.resolve(ref).(pdfDict)
+	if !ok || !isDict {
+		return ref, nil, errors.New("missing document catalog")
+	}
+	updated := pdfDict{}
+	for k, v := range catalog {
+		updated[k] = v
+	}
+	return ref, updated, nil
+}
+
+func (u *pdfUpdate) write(ref pdfRef, obj any) {
+	u.offsets[ref] = len(u.f.data) + u.out.Len()
+	fmt.Fprintf(&u.out, "%d %d obj\n", ref.num, ref.gen)
+	if stream, ok := obj.(pdfStream); ok {
+		stream.dict["Length"] = int64(len(stream.data))
+		writePDFObject(&u.out, stream.dict)
+		u.out.WriteString("\nstream\n")
+		u.out.Write(stream.data)
+		u.out.WriteString("\nendstream")
+	} else {
+		writePDFObject(&u.out, obj)
+	}
+	u.out.WriteString("\nendobj\n")
+}
+
+// bytes returns the updated document. The update ends with the same kind of
+// cross-reference section as the document: readers need not accept a table
+// following a stream.
+func (u *pdfUpdate) bytes() []byte {
+	if u.f.xrefStream {
+		u.finishStream()
+	} else {
+		u.finishTable()
+	}
+	return append(append([]byte{}, u.f.data...), u.out.Bytes()...)
+}
+
+func (u *pdfUpdate) refs() []pdfRef {
+	refs := make([]pdfRef, 0, len(u.offsets))
+	for ref := range u.offsets {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].num < refs[j].num })
+	return refs
+}
+
+func (u *pdfUpdate) finishTable() {
+	xref := len(u.f.data) + u.out.Len()
+	u.out.WriteString("xref\n")
+	for _, ref := range u.refs() {
+		fmt.Fprintf(&u.out, "%d 1\n%010d %05d n \n", ref.num, u.offsets[ref], ref.gen)
+	}
+	u.trailer["Size"] = int64(u.next)
+	u.out.WriteString("trailer\n")
+	writePDFObject(&u.out, u.trailer)
+	fmt.Fprintf(&u.out, "\nstartxref\n%d\n%%%%EOF\n", xref)
+}
+
+func (u *pdfUpdate) finishStream() {
+	self := u.newObject()
+	xref := len(u.f.data) + u.out.Len()
+	u.offsets[self] = xref
+
+	var index pdfArray
+	var entries []byte
+	for _, ref := range u.refs() {
+		index = append(index, int64(ref.num), int64(1))
+		entry := make([]byte, 7)
+		entry[0] = 1
+		binary.BigEndian.PutUint32(entry[1:5], uint32(u.offsets[ref]))
+		binary.BigEndian.PutUint16(entry[5:7], uint16(ref.gen))
+		entries = append(entries, entry...)
+	}
+
+	u.trailer["Type"] = pdfName("XRef")
+	u.trailer["Size"] = int64(u.next)
+	u.trailer["W"] = pdfArray{int64(1), int64(4), int64(2)}
+	u.trailer["Index"] = index
+	u.trailer["Length"] = int64(len(entries))
+	fmt.Fprintf(&u.out, "%d 0 obj\n", self.num)
+	writePDFObject(&u.out, u.trailer)
+	u.out.WriteString("\nstream\n")
+	u.out.Write(entries)
+	fmt.Fprintf(&u.out, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xref)
+}
+
+// emailAuthor formats the sender as "Name <address>", or just the address.
+func emailAuthor(email *Email) string {
+	if email.FromName == "" {
+		return email.From
+	}
+	return fmt.Sprintf("%s <%s>", email.FromName, email.From)
+}
+
+// pdfDate formats t as a PDF date string.
+func pdfDate(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("D:%s%c%02d'%02d'", t.Format("20060102150405"), sign, offset/3600, offset%3600/60)
+}
+
+// xmpPacket describes the email in XMP, the XML metadata format PDF readers
+// show alongside the document information dictionary.
+func xmpPacket(email *Email) []byte {
+	escape := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString("<rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("<rdf:Description rdf:about=\"\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\"" +
+		" xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\" xmlns:email=\"https://github.com/fazalmajid/maildir2pdf/ns/email/\">\n")
+	if email.Subject != "" {
+		fmt.Fprintf(&b, "<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", escape(email.Subject))
+	}
+	if author := emailAuthor(email); author != "" {
+		fmt.Fprintf(&b, "<dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", escape(author))
+	}
+	if !email.Date.IsZero() {
+		fmt.Fprintf(&b, "<xmp:CreateDate>%s</xmp:CreateDate>\n", email.Date.Format(time.RFC3339))
+	}
+	if email.MessageID != "" {
+		fmt.Fprintf(&b, "<email:MessageID>%s</email:MessageID>\n", escape(email.MessageID))
+	}
+	b.WriteString("</rdf:Description>\n</rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return []byte(b.String())
+}
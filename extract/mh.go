@@ -0,0 +1,169 @@
+package extract
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ScanMH extracts attachments from every message in an MH mail directory, as
+// kept by nmh, Claws Mail, Sylpheed and Gnus's nnml: a tree of folders, each
+// holding messages in files named by number. Folders are named by their path
+// below mhPath, and messages directly in it belong to INBOX, so the mailbox
+// filters and PreserveFolders apply as they do to maildirs. SeenOnly skips
+// the messages in a folder's unseen sequence.
+func (s *Scanner) ScanMH(mhPath string) error {
+	mailboxes, err := DiscoverMHFolders(mhPath)
+	if err != nil {
+		return fmt.Errorf("error discovering MH folders: %v", err)
+	}
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+
+	var queue []emailJob
+	for _, mailbox := range mailboxes {
+		numbers, err := mhMessages(mailbox.Path)
+		if err != nil {
+			s.logError(fmt.Errorf("scanning MH folder %s: %v", mailbox.Name, err))
+			continue
+		}
+		var unseen map[int]bool
+		if s.SeenOnly {
+			if unseen, err = mhSequence(mailbox.Path, "unseen"); err != nil {
+				s.logError(fmt.Errorf("scanning MH folder %s: %v", mailbox.Name, err))
+				continue
+			}
+		}
+		for _, n := range numbers {
+			if !unseen[n] {
+				queue = append(queue, emailJob{path: filepath.Join(mailbox.Path, strconv.Itoa(n)), mailbox: mailbox.Name})
+			}
+		}
+	}
+	s.queued(len(queue))
+
+	s.run(func(jobs chan<- emailJob) {
+		for _, job := range queue {
+			if !s.send(jobs, job) {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// DiscoverMHFolders returns every MH folder under mhPath, including mhPath
+// itself, named INBOX, if it holds messages. A folder is a directory with
+// a .mh_sequences file or at least one message.
+func DiscoverMHFolders(mhPath string) ([]Mailbox, error) {
+	var mailboxes []Mailbox
+	err := filepath.Walk(mhPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip symlinks
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() || !isMHFolder(path) {
+			return nil
+		}
+
+		name := "INBOX"
+		if path != mhPath {
+			relPath, err := filepath.Rel(mhPath, path)
+			if err != nil {
+				return err
+			}
+			name = filepath.ToSlash(relPath)
+		} else if numbers, _ := mhMessages(path); len(numbers) == 0 {
+			// The top of an nmh Path usually only holds its context
+			return nil
+		}
+		mailboxes = append(mailboxes, Mailbox{Name: name, Path: path})
+		return nil
+	})
+
+	return mailboxes, err
+}
+
+func isMHFolder(path string) bool {
+	if _, err := os.Stat(filepath.Join(path, ".mh_sequences")); err == nil {
+		return true
+	}
+	numbers, err := mhMessages(path)
+	return err == nil && len(numbers) > 0
+}
+
+// mhMessages returns the numbers of the messages in an MH folder, in order.
+// Files named with a leading comma or #, which MH leaves behind when
+// messages are deleted, are not messages.
+func mhMessages(folder string) ([]int, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		n, err := strconv.Atoi(entry.Name())
+		if err != nil || n <= 0 || strconv.Itoa(n) != entry.Name() {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	slices.Sort(numbers)
+	return numbers, nil
+}
+
+// mhSequence returns the messages of the named sequence in the
+// .mh_sequences file of an MH folder, whose lines read like
+// "unseen: 3 5-9". A folder without the file has empty sequences.
+func mhSequence(folder, name string) (map[int]bool, error) {
+	file, err := os.Open(filepath.Join(folder, ".mh_sequences"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	messages := make(map[int]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		sequence, ranges, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(sequence) != name {
+			continue
+		}
+		for _, r := range strings.Fields(ranges) {
+			first, last, isRange := strings.Cut(r, "-")
+			from, err := strconv.Atoi(first)
+			if err != nil {
+				continue
+			}
+			to := from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					continue
+				}
+			}
+			for n := from; n <= to; n++ {
+				messages[n] = true
+			}
+		}
+	}
+	return messages, scanner.Err()
+}
@@ -0,0 +1,124 @@
+package extract
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// MaildirFolder returns the folder of the maildir at maildirPath named
+// name, such as Archive/Processed, which may also be given as the path of
+// its directory, such as .Archive.Processed. A folder that does not exist
+// yet is created, as a Maildir++ one.
+func MaildirFolder(maildirPath, name string) (Mailbox, error) {
+	name = mailboxName(name)
+	if name == "" || strings.EqualFold(name, "INBOX") {
+		return Mailbox{}, fmt.Errorf("messages can only be moved to a folder other than the inbox")
+	}
+	mailboxes, err := DiscoverMailboxes(maildirPath)
+	if err != nil {
+		return Mailbox{}, err
+	}
+	folder := Mailbox{Name: name}
+	for _, mailbox := range mailboxes {
+		if mailbox.Name == name {
+			folder.Path = mailbox.Path
+		}
+	}
+	if folder.Path == "" {
+		levels := strings.Split(name, "/")
+		for i, level := range levels {
+			if level == "" || strings.Contains(level, ".") {
+				return Mailbox{}, fmt.Errorf("%q cannot be the name of a Maildir++ folder", name)
+			}
+			levels[i] = encodeModifiedUTF7(level)
+		}
+		folder.Path = filepath.Join(maildirPath, "."+strings.Join(levels, "."))
+	}
+
+	for _, subdir := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(folder.Path, subdir), 0700); err != nil {
+			return Mailbox{}, err
+		}
+	}
+	if strings.HasPrefix(filepath.Base(folder.Path), ".") {
+		marker := filepath.Join(folder.Path, "maildirfolder")
+		if _, err := os.Stat(marker); os.IsNotExist(err) {
+			if err := os.WriteFile(marker, nil, 0600); err != nil {
+				return Mailbox{}, err
+			}
+		}
+	}
+	return folder, nil
+}
+
+// move renames the maildir message file of email into the MoveTo folder,
+// into its new or cur directory as it was, keeping its name. Keywords in
+// its flags are given the letters the folder's dovecot-keywords file has
+// for them, as they differ from mailbox to mailbox.
+func (x *Extractor) move(email *Email) error {
+	path := email.Path
+	dir := filepath.Dir(path)
+	subdir := filepath.Base(dir)
+	if subdir != "cur" && subdir != "new" {
+		return nil
+	}
+	from := filepath.Dir(dir)
+	if from == x.MoveTo {
+		return nil
+	}
+	name, err := moveKeywords(filepath.Base(path), from, x.MoveTo)
+	if err != nil {
+		return err
+	}
+
+	newPath := filepath.Join(x.MoveTo, subdir, name)
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("%s already exists", newPath)
+	}
+	if err := os.Rename(path, newPath); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(newPath))
+
+	slog.Debug("Moved message", "source", path, "path", newPath)
+	email.Path = newPath
+	return nil
+}
+
+// moveKeywords returns the name of a maildir message file moved from the
+// mailbox from to the mailbox to, with the letters of its keywords changed
+// to those of the same keywords in to, which are added to its
+// dovecot-keywords file if needed. Letters from keywords from does not
+// know are kept.
+func moveKeywords(name, from, to string) (string, error) {
+	sep := ":2,"
+	if strings.Contains(name, "!2,") {
+		sep = "!2,"
+	}
+	base, flags, ok := strings.Cut(name, sep)
+	if !ok || strings.IndexFunc(flags, func(r rune) bool { return 'a' <= r && r <= 'z' }) < 0 {
+		return name, nil
+	}
+	keywords, err := readDovecotKeywords(filepath.Join(from, dovecotKeywords))
+	if err != nil {
+		return "", err
+	}
+
+	letters := []byte(flags)
+	for i, letter := range letters {
+		n := int(letter - 'a')
+		if letter < 'a' || letter > 'z' || n >= len(keywords) || keywords[n] == "" {
+			continue
+		}
+		if letters[i], err = keywordLetter(to, keywords[n], true); err != nil {
+			return "", err
+		}
+	}
+	// Flags are kept in ASCII order
+	slices.Sort(letters)
+	return base + sep + string(slices.Compact(letters)), nil
+}
@@ -0,0 +1,114 @@
+package extract
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// nameFields is the data made available to -name-template.
+type nameFields struct {
+	Date     nameDate
+	From     string
+	FromName string
+	Subject  string
+	Mailbox  string
+	OrigName string
+	Ext      string
+	Index    int
+}
+
+// nameDate prints as YYYY-MM-DD but still exposes the time.Time methods,
+// so templates can use either {{.Date}} or {{.Date.Format "200601"}}.
+type nameDate struct {
+	time.Time
+}
+
+func (d nameDate) String() string {
+	if d.IsZero() {
+		return "undated"
+	}
+	return d.Format("2006-01-02")
+}
+
+var nameTemplateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+	"trim":    strings.TrimSpace,
+	"slug":    slugify,
+}
+
+// ParseNameTemplate parses a text/template for Extractor.NameTemplate. The
+// template may use .Date, .From, .FromName, .Subject, .Mailbox, .OrigName,
+// .Ext and .Index, and the lower, upper, replace, trim and slug functions.
+func ParseNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Funcs(nameTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// expandNameTemplate renders the output name for an attachment with tmpl,
+// NameTemplate or the target of a Rule. The result is a slash-separated
+// relative path; every component is sanitized so the template cannot escape
+// the output directory.
+func expandNameTemplate(tmpl *template.Template, origName string, email *Email) (string, error) {
+	// Only the template itself may add directories, not a "/" in a field
+	origName = sanitizeFilename(origName)
+	fields := nameFields{
+		Date:     nameDate{email.Date},
+		From:     sanitizeNameField(email.From),
+		FromName: sanitizeNameField(email.FromName),
+		Subject:  sanitizeNameField(email.Subject),
+		Mailbox:  sanitizeNameField(email.Mailbox),
+		OrigName: origName,
+		Ext:      filepath.Ext(origName),
+		Index:    email.attachments,
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		return "", err
+	}
+
+	var components []string
+	for _, component := range strings.Split(b.String(), "/") {
+		component = strings.TrimSpace(component)
+		if component == "" || component == "." || component == ".." {
+			continue
+		}
+		components = append(components, sanitizeFilename(component))
+	}
+	if len(components) == 0 {
+		return "", fmt.Errorf("template produced an empty name")
+	}
+
+	return filepath.Join(components...), nil
+}
+
+// sanitizeNameField sanitizes the value of a field for NameTemplate as
+// sanitizeFilename does, but leaves empty values empty.
+func sanitizeNameField(value string) string {
+	if value == "" {
+		return ""
+	}
+	return sanitizeFilename(value)
+}
+
+// slugify lowercases s and collapses every run of characters other than
+// letters and digits into a single hyphen.
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			hyphen = false
+		} else if !hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
@@ -0,0 +1,120 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ScanNotmuch extracts attachments from the messages matching a notmuch
+// search query, such as "tag:invoices and date:2023..", which notmuch lists
+// the files of. Messages are attributed to the maildir folder they are in
+// below the database's mail root, named as in Scan, so the mailbox filters
+// and maildir flag filters apply as they do to maildirs. A message stored
+// more than once is processed from its first copy only.
+func (s *Scanner) ScanNotmuch(query string) error {
+	command := s.Notmuch
+	if command == "" {
+		command = "notmuch"
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("notmuch queries require notmuch: %v", err)
+	}
+
+	root, err := notmuchMailRoot(command)
+	if err != nil {
+		return err
+	}
+	output, err := runNotmuch(command, "search", "--output=files", "--format=text0", "--duplicate=1", "--", query)
+	if err != nil {
+		return err
+	}
+
+	var files []emailJob
+	for _, path := range strings.Split(string(output), "\x00") {
+		if path == "" || !s.wantedFlags(filepath.Base(path)) {
+			continue
+		}
+		files = append(files, emailJob{path: path, mailbox: notmuchMailbox(root, path)})
+	}
+
+	var mailboxes []Mailbox
+	seen := make(map[string]bool)
+	for _, job := range files {
+		if !seen[job.mailbox] {
+			seen[job.mailbox] = true
+			mailboxes = append(mailboxes, Mailbox{Name: job.mailbox, Path: filepath.Dir(job.path)})
+		}
+	}
+	slices.SortFunc(mailboxes, func(a, b Mailbox) int { return strings.Compare(a.Name, b.Name) })
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+	selected := make(map[string]bool)
+	for _, mailbox := range mailboxes {
+		selected[mailbox.Name] = true
+	}
+
+	var queue []emailJob
+	for _, job := range files {
+		if selected[job.mailbox] {
+			queue = append(queue, job)
+		}
+	}
+	s.queued(len(queue))
+
+	s.run(func(jobs chan<- emailJob) {
+		for _, job := range queue {
+			if !s.send(jobs, job) {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// notmuchMailRoot returns the directory the messages of the notmuch
+// database are stored under: database.mail_root, which notmuch 0.32 added,
+// or else database.path.
+func notmuchMailRoot(command string) (string, error) {
+	for _, key := range []string{"database.mail_root", "database.path"} {
+		output, err := runNotmuch(command, "config", "get", key)
+		if err != nil {
+			continue
+		}
+		if root := strings.TrimSpace(string(output)); root != "" {
+			return root, nil
+		}
+	}
+	return "", fmt.Errorf("could not find the mail root of the notmuch database; is notmuch set up?")
+}
+
+// notmuchMailbox returns the name of the maildir folder holding the message
+// file at path, or INBOX for the top of the mail root and files outside it.
+func notmuchMailbox(root, path string) string {
+	dir := filepath.Dir(path)
+	switch filepath.Base(dir) {
+	case "cur", "new", "tmp":
+		dir = filepath.Dir(dir)
+	}
+	relPath, err := filepath.Rel(root, dir)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return "INBOX"
+	}
+	return mailboxName(relPath)
+}
+
+// runNotmuch runs a notmuch command and returns its output.
+func runNotmuch(command string, args ...string) ([]byte, error) {
+	cmd := exec.Command(command, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("notmuch %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
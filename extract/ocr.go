@@ -0,0 +1,140 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ocrPDF adds a text layer to a PDF that has none. It uses OCRmyPDF when it
+// is installed, which keeps the original page content; otherwise the pages
+// are rendered with Ghostscript and Tesseract rebuilds the PDF from the
+// images.
+func ocrPDF(data []byte, language, gs string) ([]byte, error) {
+	hasText, err := pdfHasText(data)
+	if err != nil {
+		return nil, err
+	}
+	if hasText {
+		return data, nil
+	}
+	if language == "" {
+		language = "eng"
+	}
+
+	dir, err := os.MkdirTemp("", "maildir2pdf-ocr")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+
+	run := func(name string, args ...string) error {
+		if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %v: %s", name, err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+
+	output := filepath.Join(dir, "out.pdf")
+	if ocrmypdf, err := exec.LookPath("ocrmypdf"); err == nil {
+		if err := run(ocrmypdf, "--quiet", "--skip-text", "-l", language, input, output); err != nil {
+			return nil, err
+		}
+		return os.ReadFile(output)
+	}
+
+	if gs == "" {
+		gs = "gs"
+	}
+	if err := run(gs, "-q", "-dBATCH", "-dNOPAUSE", "-dSAFER", "-sDEVICE=png16m", "-r300",
+		"-sOutputFile="+filepath.Join(dir, "page%04d.png"), input); err != nil {
+		return nil, err
+	}
+	pages, _ := filepath.Glob(filepath.Join(dir, "page*.png"))
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("%s rendered no pages", gs)
+	}
+	list := filepath.Join(dir, "pages.txt")
+	if err := os.WriteFile(list, []byte(strings.Join(pages, "\n")+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	if err := run("tesseract", list, strings.TrimSuffix(output, ".pdf"), "-l", language, "pdf"); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(output)
+}
+
+// textOperatorRegex matches the usual text showing operators of a content
+// stream. The rare ' and " operators are left out, as single characters
+// match too easily in inline image data.
+var textOperatorRegex = regexp.MustCompile(`(?:^|[\s)\]>])(?:Tj|TJ)(?:$|[\s/\[(<])`)
+
+// pdfHasText reports whether any page of a PDF shows text, directly or
+// through form XObjects. Content it cannot decode is assumed to contain
+// text, so that only PDFs known to be image-only are sent to OCR.
+func pdfHasText(data []byte) (bool, error) {
+	f, err := parsePDF(data)
+	if err != nil {
+		return false, err
+	}
+	pages, err := f.pages()
+	if err != nil {
+		return false, err
+	}
+
+	seen := make(map[pdfRef]bool)
+	var showsText func(contents any, resources any, depth int) bool
+	showsText = func(contents any, resources any, depth int) bool {
+		if ref, ok := contents.(pdfRef); ok {
+			if seen[ref] {
+				return false
+			}
+			seen[ref] = true
+		}
+		var streams []pdfStream
+		switch c := f.resolve(contents).(type) {
+		case pdfStream:
+			streams = append(streams, c)
+		case pdfArray:
+			for _, item := range c {
+				if s, ok := f.resolve(item).(pdfStream); ok {
+					streams = append(streams, s)
+				}
+			}
+		}
+		for _, s := range streams {
+			content, err := f.decodeStream(s)
+			if err != nil || textOperatorRegex.Match(content) {
+				return true
+			}
+		}
+
+		res, _ := f.resolve(resources).(pdfDict)
+		xobjects, _ := f.resolve(res["XObject"]).(pdfDict)
+		for _, ref := range xobjects {
+			form, ok := f.resolve(ref).(pdfStream)
+			if !ok || form.dict["Subtype"] != pdfName("Form") || depth > 8 {
+				continue
+			}
+			if showsText(ref, form.dict["Resources"], depth+1) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, page := range pages {
+		if showsText(page.dict["Contents"], page.dict["Resources"], 0) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
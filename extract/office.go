@@ -0,0 +1,230 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// officeExts are the filename extensions of the office documents converted
+// with Office.
+var officeExts = map[string]bool{
+	".doc":  true,
+	".docx": true,
+	".xls":  true,
+	".xlsx": true,
+	".ppt":  true,
+	".pptx": true,
+	".odt":  true,
+	".ods":  true,
+	".odp":  true,
+	".rtf":  true,
+}
+
+// officeTypes are the extensions of the office documents converted with
+// Office by their media types, for those attached without one.
+var officeTypes = map[string]string{
+	"application/msword":            ".doc",
+	"application/vnd.ms-excel":      ".xls",
+	"application/vnd.ms-powerpoint": ".ppt",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/rtf": ".rtf",
+	"text/rtf":        ".rtf",
+}
+
+// isOfficeDocument reports whether an attachment with the given media type
+// and filename is a word processing document, spreadsheet or presentation.
+func isOfficeDocument(mediaType, filename string) bool {
+	return officeExts[strings.ToLower(filepath.Ext(filename))] || officeTypes[mediaType] != ""
+}
+
+// OfficeConverter converts office documents to PDF.
+type OfficeConverter interface {
+	// Convert returns the PDF of the document data, attached as filename,
+	// whose extension says what kind of document it is.
+	Convert(data []byte, filename string) ([]byte, error)
+}
+
+// LibreOffice converts office documents with LibreOffice, run headless.
+type LibreOffice struct {
+	Command string        // soffice, or the path to it
+	Timeout time.Duration // after which a conversion is abandoned
+}
+
+// NewLibreOffice returns a converter running command, such as soffice.
+func NewLibreOffice(command string) *LibreOffice {
+	return &LibreOffice{Command: command, Timeout: 2 * time.Minute}
+}
+
+// Convert runs LibreOffice on the document in a directory of its own, with a
+// profile of its own, so that conversions can run at the same time as each
+// other and as a LibreOffice the user has open.
+func (l *LibreOffice) Convert(data []byte, filename string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "maildir2pdf-office-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// LibreOffice goes by the extension, and names its output after the input
+	in := filepath.Join(dir, "document"+strings.ToLower(filepath.Ext(filename)))
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, l.Command, "--headless", "--norestore", "--nolockcheck",
+		"-env:UserInstallation=file://"+filepath.ToSlash(filepath.Join(dir, "profile")),
+		"--convert-to", "pdf", "--outdir", filepath.Join(dir, "out"), in)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("LibreOffice timed out after %v", l.Timeout)
+		}
+		return nil, fmt.Errorf("LibreOffice: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+	// LibreOffice exits successfully even when it cannot read the document
+	pdf, err := os.ReadFile(filepath.Join(dir, "out", "document.pdf"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("LibreOffice could not convert the document: %s", strings.TrimSpace(output.String()))
+	}
+	return pdf, err
+}
+
+// Gotenberg converts office documents with the LibreOffice route of a
+// Gotenberg server.
+type Gotenberg struct {
+	URL    string // of the server, e.g. http://localhost:3000
+	Client *http.Client
+}
+
+// NewGotenberg returns a client for the Gotenberg server at serverURL.
+func NewGotenberg(serverURL string) *Gotenberg {
+	return &Gotenberg{
+		URL:    strings.TrimSuffix(serverURL, "/"),
+		Client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Convert posts the document to the server, which returns its PDF.
+func (g *Gotenberg) Convert(data []byte, filename string) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	// Gotenberg goes by the extension too
+	file, err := form.CreateFormFile("files", "document"+strings.ToLower(filepath.Ext(filename)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(data); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	resp, err := g.Client.Post(g.URL+"/forms/libreoffice/convert", form.FormDataContentType(), &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("Gotenberg: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// processOffice saves an office document attachment named filename as a PDF,
+// named after it, converted by Office. Documents that cannot be converted
+// are saved as they are to QuarantineDir, if set, with the reason beside
+// them.
+func (x *Extractor) processOffice(body io.Reader, filename, mediaType string, email *Email) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error reading document %s: %v", filename, err)
+	}
+	if !officeExts[strings.ToLower(filepath.Ext(filename))] {
+		if filename == "" {
+			filename = "attachment"
+		}
+		filename += officeTypes[mediaType]
+	}
+
+	pdf, err := x.convertOffice(data, filename)
+	if err != nil {
+		if x.QuarantineDir == "" {
+			return fmt.Errorf("error converting document %s: %v", filename, err)
+		}
+		email.quarantine = "could not convert to PDF: " + err.Error()
+		defer func() { email.quarantine = "" }()
+		return x.saveAttachment(bytes.NewReader(data), filename, mediaType, email)
+	}
+
+	name := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".pdf"
+	slog.Debug("Converted document to PDF", "source", email.Path, "filename", filename)
+	return x.saveAttachment(bytes.NewReader(pdf), name, "application/pdf", email)
+}
+
+// convertOffice converts a document with Office, through OfficeCache.
+// Failures are not cached, as they may be those of a converter that was
+// not running.
+func (x *Extractor) convertOffice(data []byte, filename string) ([]byte, error) {
+	var cached string
+	if x.OfficeCache != "" {
+		sum := sha256.Sum256(data)
+		cached = filepath.Join(x.OfficeCache, hex.EncodeToString(sum[:])+".pdf")
+		if pdf, err := os.ReadFile(cached); err == nil {
+			return pdf, nil
+		}
+	}
+
+	pdf, err := x.Office.Convert(data, filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePDF(pdf); err != nil {
+		return nil, fmt.Errorf("unusable PDF: %v", err)
+	}
+	if cached != "" {
+		if err := writeCacheFile(cached, pdf); err != nil {
+			slog.Warn("Could not cache converted document", "path", cached, "error", err)
+		}
+	}
+	return pdf, nil
+}
+
+// writeCacheFile writes a file to the conversion cache through a temporary
+// file, so that concurrent workers never read it half written.
+func writeCacheFile(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
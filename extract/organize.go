@@ -0,0 +1,42 @@
+package extract
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// Axes of Extractor.Organize.
+const (
+	OrganizeBySender = "by-sender" // by-sender/DOMAIN/NAME
+	OrganizeByYear   = "by-year"   // by-year/YYYY/NAME
+)
+
+// organize adds symbolic links to the file saved at path to the directories
+// of each axis in Organize, under OutputDir, so it can be browsed by sender
+// or year as well as where it was saved. Failures are only logged.
+func (x *Extractor) organize(path string, email *Email) {
+	for _, axis := range x.Organize {
+		var dir string
+		switch axis {
+		case OrganizeBySender:
+			_, domain, _ := strings.Cut(strings.ToLower(email.From), "@")
+			domain = sanitizeFilename(domain)
+			if domain == "" || domain == "." || domain == ".." {
+				domain = "unknown"
+			}
+			dir = filepath.Join(x.OutputDir, axis, domain)
+		case OrganizeByYear:
+			year := "undated"
+			if !email.Date.IsZero() {
+				year = email.Date.Format("2006")
+			}
+			dir = filepath.Join(x.OutputDir, axis, year)
+		default:
+			continue
+		}
+		if _, err := linkInto(path, dir, filepath.Base(path), true); err != nil {
+			slog.Warn("Could not link file", "path", path, "dir", dir, "error", err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paperless uploads saved PDFs to a paperless-ngx server, with the title,
+// correspondent and creation date of each taken from its email.
+type Paperless struct {
+	URL    string // of the server, e.g. https://paperless.example.com
+	Token  string // API token of the user to upload as
+	Client *http.Client
+
+	mu             sync.Mutex
+	correspondents map[string]int // IDs by name, as looked up or created
+}
+
+// NewPaperless returns a client for the paperless-ngx server at serverURL.
+func NewPaperless(serverURL, token string) *Paperless {
+	return &Paperless{
+		URL:            strings.TrimSuffix(serverURL, "/"),
+		Token:          token,
+		Client:         &http.Client{Timeout: 5 * time.Minute},
+		correspondents: make(map[string]int),
+	}
+}
+
+// upload posts the file saved as s, at path, to the consumption queue of
+// the server, returning the ID of the task that consumes it.
+func (p *Paperless) upload(s *Saved, path string) (string, error) {
+	email := s.Email
+	title := email.Subject
+	if title == "" {
+		title = strings.TrimSuffix(s.Filename, filepath.Ext(s.Filename))
+	}
+	fields := map[string]string{"title": title}
+	if !email.Date.IsZero() {
+		fields["created"] = email.Date.Format("2006-01-02")
+	}
+	if name := correspondentName(email); name != "" {
+		id, err := p.correspondent(name)
+		if err != nil {
+			return "", fmt.Errorf("error looking up correspondent %q: %v", name, err)
+		}
+		fields["correspondent"] = fmt.Sprint(id)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, err := form.CreateFormFile("document", filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(part, file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	// The response is the task ID as a JSON string
+	var task string
+	if err := p.do("POST", "/api/documents/post_document/", form.FormDataContentType(), &body, &task); err != nil {
+		return "", err
+	}
+	return task, nil
+}
+
+// correspondentName is the name the sender of email is filed under: their
+// display name, or their address if they have none.
+func correspondentName(email *Email) string {
+	if email.FromName != "" {
+		return email.FromName
+	}
+	return email.From
+}
+
+// correspondent returns the ID of the correspondent called name, creating
+// it if the server has none by that name.
+func (p *Paperless) correspondent(name string) (int, error) {
+	// Held throughout, so concurrent workers cannot both create the same
+	// correspondent
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id, ok := p.correspondents[name]; ok {
+		return id, nil
+	}
+
+	var found struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+	if err := p.do("GET", "/api/correspondents/?name__iexact="+url.QueryEscape(name), "", nil, &found); err != nil {
+		return 0, err
+	}
+	var created struct {
+		ID int `json:"id"`
+	}
+	if len(found.Results) > 0 {
+		created.ID = found.Results[0].ID
+	} else {
+		data, err := json.Marshal(map[string]string{"name": name})
+		if err != nil {
+			return 0, err
+		}
+		if err := p.do("POST", "/api/correspondents/", "application/json", bytes.NewReader(data), &created); err != nil {
+			return 0, err
+		}
+	}
+	p.correspondents[name] = created.ID
+	return created.ID, nil
+}
+
+// do makes an API request and decodes its JSON response into result.
+func (p *Paperless) do(method, path, contentType string, body io.Reader, result any) error {
+	req, err := http.NewRequest(method, p.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+p.Token)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%s %s: unexpected response: %v", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // decoders for inline images
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pdfDoc lays out text and images on A4 pages using the standard Helvetica
+// fonts, which every PDF viewer provides, so nothing needs to be embedded.
+// Text is limited to what the WinAnsi (Windows-1252) encoding can represent.
+type pdfDoc struct {
+	pages  []*bytes.Buffer // content streams
+	images []pdfImage
+	y      float64 // baseline of the next line on the current page
+}
+
+type pdfImage struct {
+	width, height int
+	colorSpace    string
+	filter        string
+	data          []byte
+}
+
+const (
+	pdfPageWidth  = 595.0 // A4 in points
+	pdfPageHeight = 842.0
+	pdfMargin     = 50.0
+	pdfFontSize   = 10.0
+	pdfLeading    = 13.0
+
+	pdfRegular = "F1"
+	pdfBold    = "F2"
+)
+
+// helveticaWidths are the advance widths of ASCII 32-126 in Helvetica, in
+// thousandths of the font size. Other characters are assumed to be as wide as
+// a digit.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+func textWidth(s, font string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += helveticaWidths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	width := float64(total) * size / 1000
+	if font == pdfBold {
+		width *= 1.1 // close enough for the few bold labels
+	}
+	return width
+}
+
+func (d *pdfDoc) newPage() {
+	d.pages = append(d.pages, new(bytes.Buffer))
+	d.y = pdfPageHeight - pdfMargin
+}
+
+func (d *pdfDoc) page() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.newPage()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// ensure starts a new page unless height points are left on this one.
+func (d *pdfDoc) ensure(height float64) {
+	if len(d.pages) == 0 || d.y-height < pdfMargin {
+		d.newPage()
+	}
+}
+
+func (d *pdfDoc) text(font string, size, x float64, s string) {
+	fmt.Fprintf(d.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y, pdfEscape(s))
+}
+
+// field writes a "Label: value" line, wrapping the value under itself.
+func (d *pdfDoc) field(label, value string) {
+	if value == "" {
+		return
+	}
+	label += ": "
+	indent := textWidth(label, pdfBold, pdfFontSize)
+	d.ensure(pdfLeading)
+	d.text(pdfBold, pdfFontSize, pdfMargin, label)
+	for i, line := range wrapText(value, pdfPageWidth-2*pdfMargin-indent, pdfRegular, pdfFontSize) {
+		if i > 0 {
+			d.y -= pdfLeading
+			d.ensure(pdfLeading)
+		}
+		d.text(pdfRegular, pdfFontSize, pdfMargin+indent, line)
+	}
+	d.y -= pdfLeading
+}
+
+// rule draws a horizontal line across the text area.
+func (d *pdfDoc) rule() {
+	d.ensure(pdfLeading)
+	y := d.y + pdfLeading/2
+	fmt.Fprintf(d.page(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", pdfMargin, y, pdfPageWidth-pdfMargin, y)
+	d.y -= pdfLeading / 2
+}
+
+// paragraphs writes text, wrapping long lines.
+func (d *pdfDoc) paragraphs(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		for _, wrapped := range wrapText(line, pdfPageWidth-2*pdfMargin, pdfRegular, pdfFontSize) {
+			d.ensure(pdfLeading)
+			d.text(pdfRegular, pdfFontSize, pdfMargin, wrapped)
+			d.y -= pdfLeading
+		}
+	}
+}
+
+// image places an image below the text, scaled down to fit the page.
+func (d *pdfDoc) image(img pdfImage) {
+	width, height := float64(img.width), float64(img.height)
+	maxWidth, maxHeight := pdfPageWidth-2*pdfMargin, pdfPageHeight-2*pdfMargin
+	if scale := min(maxWidth/width, maxHeight/height, 1); scale < 1 {
+		width, height = width*scale, height*scale
+	}
+
+	d.ensure(height)
+	d.images = append(d.images, img)
+	fmt.Fprintf(d.page(), "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width, height, pdfMargin, d.y-height+pdfFontSize, len(d.images))
+	d.y -= height + pdfLeading
+}
+
+// wrapText breaks s into lines no wider than width, at spaces where
+// possible.
+func wrapText(s string, width float64, font string, size float64) []string {
+	s = strings.TrimRightFunc(strings.ReplaceAll(s, "\t", "    "), unicode.IsSpace)
+	if s == "" {
+		return []string{""}
+	}
+
+	var lines []string
+	for textWidth(s, font, size) > width {
+		// Longest prefix that fits, then back up to the last space
+		fit, used := 0, 0.0
+		for i, r := range s {
+			if used += textWidth(string(r), font, size); used > width {
+				break
+			}
+			fit = i + utf8.RuneLen(r)
+		}
+		if fit == 0 {
+			fit = len(s)
+		}
+		if space := strings.LastIndexByte(s[:fit], ' '); space > 0 {
+			fit = space
+		}
+		lines = append(lines, s[:fit])
+		s = strings.TrimLeft(s[fit:], " ")
+	}
+	return append(lines, s)
+}
+
+// pdfEscape encodes s as the body of a WinAnsi PDF string literal.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		c, ok := winAnsiByte(r)
+		if !ok {
+			c = '?'
+		}
+		switch c {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			if c < 32 || c > 126 {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// winAnsiByte returns the Windows-1252 code of r.
+func winAnsiByte(r rune) (byte, bool) {
+	if r < 0x80 || (r >= 0xA0 && r <= 0xFF) {
+		return byte(r), true
+	}
+	for i, w := range windows1252 {
+		if w == r {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
+
+// newPDFImage prepares an inline image for embedding. JPEG data is embedded
+// as is; other formats are decoded and stored as compressed RGB, dropping
+// any transparency against a white background.
+func newPDFImage(data []byte) (pdfImage, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return pdfImage{}, err
+	}
+	if format == "jpeg" {
+		img := pdfImage{width: config.Width, height: config.Height, filter: "DCTDecode", data: data, colorSpace: "DeviceRGB"}
+		switch config.ColorModel {
+		case color.GrayModel:
+			img.colorSpace = "DeviceGray"
+		case color.CMYKModel:
+			img.colorSpace = "DeviceCMYK"
+		}
+		return img, nil
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return pdfImage{}, err
+	}
+	bounds := decoded.Bounds()
+	raw := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := decoded.At(x, y).RGBA()
+			// Composite the premultiplied color over white
+			white := 0xFFFF - a
+			raw = append(raw, byte((r+white)>>8), byte((g+white)>>8), byte((b+white)>>8))
+		}
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(raw)
+	zw.Close()
+	return pdfImage{width: bounds.Dx(), height: bounds.Dy(), colorSpace: "DeviceRGB", filter: "FlateDecode", data: compressed.Bytes()}, nil
+}
+
+// bytes serializes the document.
+func (d *pdfDoc) bytes(title string) []byte {
+	if len(d.pages) == 0 {
+		d.newPage()
+	}
+
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string, stream []byte) int {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s", len(offsets), body)
+		if stream != nil {
+			out.WriteString("\nstream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream")
+		}
+		out.WriteString("\nendobj\n")
+		return len(offsets)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+
+	// Object numbers are fixed up front: catalog 1, pages 2, fonts 3-4,
+	// info 5, then images, then a content stream and page per page
+	const firstImage = 6
+	firstPage := firstImage + len(d.images)
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i+1))
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)), nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+	object(fmt.Sprintf("<< /Title (%s) /Producer (maildir2pdf) >>", pdfEscape(title)), nil)
+
+	var xobjects []string
+	for i, img := range d.images {
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s /Length %d >>",
+			img.width, img.height, img.colorSpace, img.filter, len(img.data)), img.data)
+		xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", i+1, firstImage+i))
+	}
+	resources := fmt.Sprintf("<< /Font << /%s 3 0 R /%s 4 0 R >> /XObject << %s >> >>", pdfRegular, pdfBold, strings.Join(xobjects, " "))
+
+	for _, content := range d.pages {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(content.Bytes())
+		zw.Close()
+		contents := object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", compressed.Len()), compressed.Bytes())
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources %s /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, contents), nil)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,108 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// convertPDFA rewrites a PDF as PDF/A-3b with Ghostscript, which embeds the
+// fonts and converts colors to sRGB as the standard requires.
+func convertPDFA(gs string, data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "maildir2pdf-pdfa")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input, output := filepath.Join(dir, "in.pdf"), filepath.Join(dir, "out.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(gs, "-q", "-dBATCH", "-dNOPAUSE", "-dSAFER",
+		"-sDEVICE=pdfwrite", "-dPDFA=3", "-dPDFACompatibilityPolicy=1",
+		"-sColorConversionStrategy=RGB", "-sOutputFile="+output, input)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", gs, err, bytes.TrimSpace(out))
+	}
+	return os.ReadFile(output)
+}
+
+// embedSource attaches the raw email to a PDF as an associated file whose
+// relationship is Source, as PDF/A-3 allows, in an incremental update.
+func embedSource(data, message []byte, email *Email) ([]byte, error) {
+	u, err := newPDFUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	rootRef, catalog, err := u.catalog()
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(message)
+	zw.Close()
+
+	modDate := email.Date
+	if modDate.IsZero() {
+		modDate = time.Now()
+	}
+	fileRef := u.newObject()
+	u.write(fileRef, pdfStream{
+		dict: pdfDict{
+			"Type":    pdfName("EmbeddedFile"),
+			"Subtype": pdfName("message/rfc822"),
+			"Filter":  pdfName("FlateDecode"),
+			"Params":  pdfDict{"Size": int64(len(message)), "ModDate": pdfString(pdfDate(modDate))},
+		},
+		data: compressed.Bytes(),
+	})
+
+	const name = "message.eml"
+	specRef := u.newObject()
+	u.write(specRef, pdfDict{
+		"Type":           pdfName("Filespec"),
+		"F":              pdfString(name),
+		"UF":             pdfString(name),
+		"Desc":           pdfString("Original email"),
+		"EF":             pdfDict{"F": fileRef, "UF": fileRef},
+		"AFRelationship": pdfName("Source"),
+	})
+
+	af, _ := u.f.resolve(catalog["AF"]).(pdfArray)
+	catalog["AF"] = append(append(pdfArray{}, af...), specRef)
+
+	names := pdfDict{}
+	if old, ok := u.f.resolve(catalog["Names"]).(pdfDict); ok {
+		for k, v := range old {
+			names[k] = v
+		}
+	}
+	if existing := names["EmbeddedFiles"]; existing != nil {
+		tree, _ := u.f.resolve(existing).(pdfDict)
+		if entries, ok := u.f.resolve(tree["Names"]).(pdfArray); ok {
+			// Keys of a name tree are sorted
+			i := 0
+			for i+1 < len(entries) {
+				if key, _ := entries[i].(pdfString); key > name {
+					break
+				}
+				i += 2
+			}
+			merged := append(append(append(pdfArray{}, entries[:i]...), pdfString(name), specRef), entries[i:]...)
+			names["EmbeddedFiles"] = pdfDict{"Names": merged}
+		}
+		// Deeper trees are left alone: the email is still listed in AF
+	} else {
+		names["EmbeddedFiles"] = pdfDict{"Names": pdfArray{pdfString(name), specRef}}
+	}
+	catalog["Names"] = names
+	u.write(rootRef, catalog)
+	return u.bytes(), nil
+}
@@ -0,0 +1,335 @@
+package extract
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// This file implements decryption for the standard security handler of PDF,
+// revisions 2 to 6: RC4 and AES keys derived from the user or owner
+// password. Public key security handlers are not supported.
+
+// pdfPadding pads passwords for revisions 2 to 4.
+var pdfPadding = []byte{
+	0x28, 0xBF, 0x4E, 0x5E, 0x4E, 0x75, 0x8A, 0x41, 0x64, 0x00, 0x4E, 0x56, 0xFF, 0xFA, 0x01, 0x08,
+	0x2E, 0x2E, 0x00, 0xB6, 0xD0, 0x68, 0x3E, 0x80, 0x2F, 0x0C, 0xA9, 0xFE, 0x64, 0x53, 0x69, 0x7A,
+}
+
+// pdfCrypt decrypts the strings and streams of an encrypted document.
+type pdfCrypt struct {
+	key             []byte
+	revision        int
+	stream, str     string // crypt methods: "RC4", "AES" or "" for none
+	encryptMetadata bool
+	dictNum         int // the encryption dictionary itself is not encrypted
+}
+
+// newPDFCrypt checks password against the encryption dictionary of f,
+// returning nil if it is neither the user nor the owner password.
+func newPDFCrypt(f *pdfFile, password string) (*pdfCrypt, error) {
+	dict, ok := f.resolve(f.trailer["Encrypt"]).(pdfDict)
+	if !ok {
+		return nil, errors.New("invalid encryption dictionary")
+	}
+	if dict["Filter"] != pdfName("Standard") {
+		return nil, fmt.Errorf("unsupported security handler %v", dict["Filter"])
+	}
+	v, _ := dict["V"].(int64)
+	r, _ := dict["R"].(int64)
+	o, _ := dict["O"].(pdfString)
+	u, _ := dict["U"].(pdfString)
+	p, _ := dict["P"].(int64)
+	c := &pdfCrypt{revision: int(r), stream: "RC4", str: "RC4", encryptMetadata: dict["EncryptMetadata"] != false}
+	if ref, ok := f.trailer["Encrypt"].(pdfRef); ok {
+		c.dictNum = ref.num
+	}
+
+	if v >= 4 {
+		filters, _ := f.resolve(dict["CF"]).(pdfDict)
+		method := func(name any) string {
+			key, ok := name.(pdfName)
+			if !ok || key == "Identity" {
+				return ""
+			}
+			cf, _ := f.resolve(filters[key]).(pdfDict)
+			switch cf["CFM"] {
+			case pdfName("AESV2"), pdfName("AESV3"):
+				return "AES"
+			case pdfName("None"):
+				return ""
+			}
+			return "RC4"
+		}
+		c.stream, c.str = method(dict["StmF"]), method(dict["StrF"])
+	}
+
+	switch {
+	case r >= 2 && r <= 4:
+		length, _ := dict["Length"].(int64)
+		n := 5
+		if r >= 3 && length > 0 {
+			n = int(length) / 8
+		}
+		var id []byte
+		if ids, ok := f.resolve(f.trailer["ID"]).(pdfArray); ok && len(ids) > 0 {
+			first, _ := f.resolve(ids[0]).(pdfString)
+			id = []byte(first)
+		}
+		pw := pdfDocBytes(password)
+		if key := c.userKeyR4(pw, []byte(o), []byte(u), int32(p), id, n); key != nil {
+			c.key = key
+			return c, nil
+		}
+		// The owner password decrypts O into the user password
+		userPW := c.ownerToUser(pw, []byte(o), n)
+		if key := c.userKeyR4(userPW, []byte(o), []byte(u), int32(p), id, n); key != nil {
+			c.key = key
+			return c, nil
+		}
+	case r == 5 || r == 6:
+		oe, _ := dict["OE"].(pdfString)
+		ue, _ := dict["UE"].(pdfString)
+		if len(o) < 48 || len(u) < 48 {
+			return nil, errors.New("invalid encryption dictionary")
+		}
+		pw := []byte(password)
+		if len(pw) > 127 {
+			pw = pw[:127]
+		}
+		ob, ub := []byte(o), []byte(u)
+		if bytes.Equal(c.hashR6(pw, ub[32:40], nil), ub[:32]) {
+			c.key = aesDecryptNoIV(c.hashR6(pw, ub[40:48], nil), []byte(ue))
+		} else if bytes.Equal(c.hashR6(pw, ob[32:40], ub[:48]), ob[:32]) {
+			c.key = aesDecryptNoIV(c.hashR6(pw, ob[40:48], ub[:48]), []byte(oe))
+		}
+		if c.key != nil {
+			return c, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption revision %d", r)
+	}
+	return nil, nil
+}
+
+// pdfDocBytes encodes a password for revisions 2 to 4, which predate
+// Unicode passwords.
+func pdfDocBytes(password string) []byte {
+	var out []byte
+	for _, r := range password {
+		c, _ := winAnsiByte(r)
+		out = append(out, c)
+	}
+	return out
+}
+
+func padPassword(pw []byte) []byte {
+	return append(append([]byte{}, pw[:min(len(pw), 32)]...), pdfPadding[:32-min(len(pw), 32)]...)
+}
+
+// userKeyR4 derives the file key from a user password, returning it if the
+// password is correct.
+func (c *pdfCrypt) userKeyR4(pw, o, u []byte, p int32, id []byte, n int) []byte {
+	h := md5.New()
+	h.Write(padPassword(pw))
+	h.Write(o)
+	binary.Write(h, binary.LittleEndian, p)
+	h.Write(id)
+	if c.revision >= 4 && !c.encryptMetadata {
+		h.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	}
+	key := h.Sum(nil)
+	if c.revision >= 3 {
+		for i := 0; i < 50; i++ {
+			sum := md5.Sum(key[:n])
+			key = sum[:]
+		}
+	}
+	key = key[:n]
+
+	if c.revision == 2 {
+		if bytes.Equal(rc4Crypt(key, pdfPadding), u) {
+			return key
+		}
+		return nil
+	}
+	h = md5.New()
+	h.Write(pdfPadding)
+	h.Write(id)
+	check := h.Sum(nil)
+	for i := 0; i < 20; i++ {
+		check = rc4Crypt(xorKey(key, byte(i)), check)
+	}
+	if len(u) >= 16 && bytes.Equal(check, u[:16]) {
+		return key
+	}
+	return nil
+}
+
+// ownerToUser recovers the user password from O, given the owner password.
+func (c *pdfCrypt) ownerToUser(pw, o []byte, n int) []byte {
+	sum := md5.Sum(padPassword(pw))
+	key := sum[:]
+	if c.revision >= 3 {
+		for i := 0; i < 50; i++ {
+			sum = md5.Sum(key)
+			key = sum[:]
+		}
+	}
+	key = key[:n]
+	user := append([]byte{}, o...)
+	if c.revision == 2 {
+		return rc4Crypt(key, user)
+	}
+	for i := 19; i >= 0; i-- {
+		user = rc4Crypt(xorKey(key, byte(i)), user)
+	}
+	return user
+}
+
+func xorKey(key []byte, b byte) []byte {
+	out := make([]byte, len(key))
+	for i := range key {
+		out[i] = key[i] ^ b
+	}
+	return out
+}
+
+func rc4Crypt(key, data []byte) []byte {
+	stream, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	out := make([]byte, len(data))
+	stream.XORKeyStream(out, data)
+	return out
+}
+
+// hashR6 is the password hash of revision 6 (plain SHA-256 for the
+// deprecated revision 5).
+func (c *pdfCrypt) hashR6(pw, salt, udata []byte) []byte {
+	h := sha256.New()
+	h.Write(pw)
+	h.Write(salt)
+	h.Write(udata)
+	k := h.Sum(nil)
+	if c.revision == 5 {
+		return k
+	}
+
+	for i := 0; ; i++ {
+		var k1 []byte
+		for j := 0; j < 64; j++ {
+			k1 = append(append(append(k1, pw...), k...), udata...)
+		}
+		block, _ := aes.NewCipher(k[:16])
+		e := make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+
+		sum := 0
+		for _, b := range e[:16] {
+			sum += int(b)
+		}
+		var next hash.Hash
+		switch sum % 3 {
+		case 0:
+			next = sha256.New()
+		case 1:
+			next = sha512.New384()
+		default:
+			next = sha512.New()
+		}
+		next.Write(e)
+		k = next.Sum(nil)
+		if i >= 63 && int(e[len(e)-1]) <= i-31 {
+			break
+		}
+	}
+	return k[:32]
+}
+
+func aesDecryptNoIV(key, data []byte) []byte {
+	if len(data) < 32 {
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	out := make([]byte, 32)
+	cipher.NewCBCDecrypter(block, make([]byte, 16)).CryptBlocks(out, data[:32])
+	return out
+}
+
+// objectKey derives the key of an object for revisions 2 to 4; later
+// revisions use the file key throughout.
+func (c *pdfCrypt) objectKey(ref pdfRef, method string) []byte {
+	if c.revision >= 5 {
+		return c.key
+	}
+	h := md5.New()
+	h.Write(c.key)
+	h.Write([]byte{byte(ref.num), byte(ref.num >> 8), byte(ref.num >> 16), byte(ref.gen), byte(ref.gen >> 8)})
+	if method == "AES" {
+		h.Write([]byte("sAlT"))
+	}
+	return h.Sum(nil)[:min(len(c.key)+5, 16)]
+}
+
+func (c *pdfCrypt) decrypt(ref pdfRef, method string, data []byte) []byte {
+	switch method {
+	case "RC4":
+		return rc4Crypt(c.objectKey(ref, method), data)
+	case "AES":
+		if len(data) < 32 || len(data)%16 != 0 {
+			return data
+		}
+		block, err := aes.NewCipher(c.objectKey(ref, method))
+		if err != nil {
+			return data
+		}
+		out := make([]byte, len(data)-16)
+		cipher.NewCBCDecrypter(block, data[:16]).CryptBlocks(out, data[16:])
+		if pad := int(out[len(out)-1]); pad >= 1 && pad <= 16 {
+			out = out[:len(out)-pad]
+		}
+		return out
+	}
+	return data
+}
+
+// decryptObject decrypts the strings and stream data of an object loaded
+// from ref.
+func (c *pdfCrypt) decryptObject(ref pdfRef, obj any) any {
+	switch o := obj.(type) {
+	case pdfString:
+		return pdfString(c.decrypt(ref, c.str, []byte(o)))
+	case pdfArray:
+		arr := make(pdfArray, len(o))
+		for i, v := range o {
+			arr[i] = c.decryptObject(ref, v)
+		}
+		return arr
+	case pdfDict:
+		dict := pdfDict{}
+		for k, v := range o {
+			dict[k] = c.decryptObject(ref, v)
+		}
+		return dict
+	case pdfStream:
+		dict := c.decryptObject(ref, o.dict).(pdfDict)
+		if dict["Type"] == pdfName("XRef") || (dict["Type"] == pdfName("Metadata") && !c.encryptMetadata) {
+			return pdfStream{dict: dict, data: o.data}
+		}
+		return pdfStream{dict: dict, data: c.decrypt(ref, c.stream, o.data)}
+	}
+	return obj
+}
@@ -0,0 +1,249 @@
+package extract
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// testEncryption describes how testEncryptedPDF encrypts a document.
+type testEncryption struct {
+	revision    int
+	bits        int  // of the key, for revisions 2 to 4
+	aes         bool // AESV2 rather than RC4, for revision 4
+	user, owner string
+}
+
+var testFileID = []byte("0123456789abcdef")
+
+// testEncryptedPDF returns a document with a page showing text and a title,
+// encrypted with the standard security handler. The encryption is written
+// out from the specification, independently of pdfCrypt except for the
+// password hash of revision 6.
+func testEncryptedPDF(e testEncryption, text, title string) []byte {
+	const p = -4
+	var key []byte
+	var encrypt string
+	encryptObject := func(num int, data []byte) []byte { return data }
+
+	if e.revision <= 4 {
+		n := e.bits / 8
+		pad := func(pw string) []byte {
+			return append([]byte(pw), pdfPadding[:32-len(pw)]...)
+		}
+		rc4 := func(key, data []byte) []byte {
+			c, _ := rc4.NewCipher(key)
+			out := make([]byte, len(data))
+			c.XORKeyStream(out, data)
+			return out
+		}
+		// Rounds 1 to 19 of revision 3 and later, with the key XORed with
+		// the round number
+		rounds := func(key, data []byte) []byte {
+			for i := 1; i <= 19; i++ {
+				k := make([]byte, len(key))
+				for j := range key {
+					k[j] = key[j] ^ byte(i)
+				}
+				data = rc4(k, data)
+			}
+			return data
+		}
+
+		sum := md5.Sum(pad(e.owner))
+		ownerKey := sum[:]
+		if e.revision >= 3 {
+			for i := 0; i < 50; i++ {
+				sum = md5.Sum(ownerKey)
+				ownerKey = sum[:]
+			}
+		}
+		o := rc4(ownerKey[:n], pad(e.user))
+		if e.revision >= 3 {
+			o = rounds(ownerKey[:n], o)
+		}
+
+		var buf bytes.Buffer
+		buf.Write(pad(e.user))
+		buf.Write(o)
+		binary.Write(&buf, binary.LittleEndian, int32(p))
+		buf.Write(testFileID)
+		sum = md5.Sum(buf.Bytes())
+		key = sum[:]
+		if e.revision >= 3 {
+			for i := 0; i < 50; i++ {
+				sum = md5.Sum(key[:n])
+				key = sum[:]
+			}
+		}
+		key = key[:n]
+
+		var u []byte
+		if e.revision == 2 {
+			u = rc4(key, pdfPadding)
+		} else {
+			check := md5.Sum(append(append([]byte{}, pdfPadding...), testFileID...))
+			u = append(rounds(key, rc4(key, check[:])), make([]byte, 16)...)
+		}
+
+		encryptObject = func(num int, data []byte) []byte {
+			objKey := append(append([]byte{}, key...), byte(num), 0, 0, 0, 0)
+			if e.aes {
+				objKey = append(objKey, "sAlT"...)
+			}
+			sum := md5.Sum(objKey)
+			objKey = sum[:min(n+5, 16)]
+			if e.aes {
+				return testAESEncrypt(objKey, data)
+			}
+			return rc4(objKey, data)
+		}
+		v := 1
+		if e.revision >= 3 {
+			v = 2
+		}
+		filters := ""
+		if e.revision == 4 {
+			v = 4
+			cfm := "V2"
+			if e.aes {
+				cfm = "AESV2"
+			}
+			filters = fmt.Sprintf("/CF << /StdCF << /CFM /%s /Length %d >> >> /StmF /StdCF /StrF /StdCF", cfm, n)
+		}
+		encrypt = fmt.Sprintf("<< /Filter /Standard /V %d /R %d /Length %d /P %d /O <%x> /U <%x> %s >>",
+			v, e.revision, e.bits, p, o, u, filters)
+	} else {
+		key = bytes.Repeat([]byte{0x42}, 32)
+		hash := (&pdfCrypt{revision: e.revision}).hashR6
+		wrap := func(kek []byte) []byte {
+			block, _ := aes.NewCipher(kek)
+			out := make([]byte, 32)
+			cipher.NewCBCEncrypter(block, make([]byte, 16)).CryptBlocks(out, key)
+			return out
+		}
+		userSalts := []byte("uvsaltxxukslatxx")
+		ownerSalts := []byte("ovsaltxxokslatxx")
+		u := append(hash([]byte(e.user), userSalts[:8], nil), userSalts...)
+		ue := wrap(hash([]byte(e.user), userSalts[8:], nil))
+		o := append(hash([]byte(e.owner), ownerSalts[:8], u), ownerSalts...)
+		oe := wrap(hash([]byte(e.owner), ownerSalts[8:], u))
+
+		encryptObject = func(num int, data []byte) []byte { return testAESEncrypt(key, data) }
+		encrypt = fmt.Sprintf("<< /Filter /Standard /V 5 /R %d /Length 256 /P %d /O <%x> /U <%x> /OE <%x> /UE <%x> "+
+			"/CF << /StdCF << /CFM /AESV3 /Length 32 >> >> /StmF /StdCF /StrF /StdCF >>", e.revision, p, o, u, oe, ue)
+	}
+
+	objects := testPageObjects(text)
+	content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+	data := encryptObject(5, []byte(content))
+	objects[4] = fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(data), data)
+	objects = append(objects, fmt.Sprintf("<< /Title <%x> >>", encryptObject(6, []byte(title))), encrypt)
+	return testPDF(objects, fmt.Sprintf("/Root 1 0 R /Info 6 0 R /Encrypt 7 0 R /ID [<%x> <%x>]", testFileID, testFileID))
+}
+
+// testAESEncrypt encrypts data with AES in CBC mode, behind a fixed
+// initialization vector and padded as PKCS #7 does.
+func testAESEncrypt(key, data []byte) []byte {
+	pad := 16 - len(data)%16
+	data = append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	iv := bytes.Repeat([]byte{0x17}, 16)
+	block, _ := aes.NewCipher(key)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+	return append(iv, out...)
+}
+
+func TestOpenEncryptedPDF(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption testEncryption
+		passwords  []string
+		password   string // expected to open the document
+		err        error
+	}{
+		{
+			name:       "revision 2, empty user password",
+			encryption: testEncryption{revision: 2, bits: 40, owner: "owner"},
+		},
+		{
+			name:       "revision 3, user password",
+			encryption: testEncryption{revision: 3, bits: 128, user: "secret", owner: "owner"},
+			passwords:  []string{"wrong", "secret"},
+			password:   "secret",
+		},
+		{
+			name:       "revision 3, owner password",
+			encryption: testEncryption{revision: 3, bits: 128, user: "secret", owner: "owner"},
+			passwords:  []string{"owner"},
+			password:   "owner",
+		},
+		{
+			name:       "revision 4, AES",
+			encryption: testEncryption{revision: 4, bits: 128, aes: true, user: "secret", owner: "owner"},
+			passwords:  []string{"secret"},
+			password:   "secret",
+		},
+		{
+			name:       "revision 6, user password",
+			encryption: testEncryption{revision: 6, user: "pässwörd", owner: "owner"},
+			passwords:  []string{"pässwörd"},
+			password:   "pässwörd",
+		},
+		{
+			name:       "revision 6, owner password",
+			encryption: testEncryption{revision: 6, user: "secret", owner: "owner"},
+			passwords:  []string{"owner"},
+			password:   "owner",
+		},
+		{
+			name:       "unknown password",
+			encryption: testEncryption{revision: 3, bits: 128, user: "secret", owner: "owner"},
+			passwords:  []string{"wrong"},
+			err:        errPDFEncrypted,
+		},
+		{
+			name:       "revision 6, unknown password",
+			encryption: testEncryption{revision: 6, user: "secret", owner: "owner"},
+			err:        errPDFEncrypted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := openPDF(testEncryptedPDF(tt.encryption, "Confidential", "Top secret"), tt.passwords)
+			if tt.err != nil {
+				if err != tt.err {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.password != tt.password {
+				t.Errorf("opened with %q, want %q", f.password, tt.password)
+			}
+			if text, _ := pdfText(f); text != "Confidential\n" {
+				t.Errorf("got text %q", text)
+			}
+			info, _ := f.resolve(f.trailer["Info"]).(pdfDict)
+			if info["Title"] != pdfString("Top secret") {
+				t.Errorf("got title %q", info["Title"])
+			}
+
+			// Rewriting leaves the document decrypted
+			plain, err := parsePDF(rewritePDF(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text, _ := pdfText(plain); text != "Confidential\n" {
+				t.Errorf("got rewritten text %q", text)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+)
+
+// pdfMerger builds a document from the pages of other documents. Each page is
+// copied with the objects it uses; everything else in the source documents,
+// such as their outlines and form definitions, is left behind.
+type pdfMerger struct {
+	out      bytes.Buffer
+	offsets  []int // of each object, numbered from 1
+	pagesNum int
+	kids     pdfArray
+	outline  []pdfBookmark
+}
+
+// pdfBookmark is a top-level outline entry.
+type pdfBookmark struct {
+	title string
+	page  pdfRef
+}
+
+func newPDFMerger() *pdfMerger {
+	m := &pdfMerger{}
+	m.out.WriteString("%PDF-1.7\n%\xE2\xE3\xCF\xD3\n")
+	m.pagesNum = m.reserve()
+	return m
+}
+
+// reserve allocates an object number, to be written later.
+func (m *pdfMerger) reserve() int {
+	m.offsets = append(m.offsets, 0)
+	return len(m.offsets)
+}
+
+func (m *pdfMerger) write(num int, obj any) {
+	m.offsets[num-1] = m.out.Len()
+	fmt.Fprintf(&m.out, "%d 0 obj\n", num)
+	if stream, ok := obj.(pdfStream); ok {
+		dict := pdfDict{}
+		for k, v := range stream.dict {
+			dict[k] = v
+		}
+		dict["Length"] = int64(len(stream.data))
+		writePDFObject(&m.out, dict)
+		m.out.WriteString("\nstream\n")
+		m.out.Write(stream.data)
+		m.out.WriteString("\nendstream")
+	} else {
+		writePDFObject(&m.out, obj)
+	}
+	m.out.WriteString("\nendobj\n")
+}
+
+// add appends the pages of a document, returning the reference of the first
+// one.
+func (m *pdfMerger) add(data []byte) (pdfRef, error) {
+	src, err := parsePDF(data)
+	if err != nil {
+		return pdfRef{}, err
+	}
+	pages, err := src.pages()
+	if err != nil {
+		return pdfRef{}, err
+	}
+
+	c := &pdfCopier{m: m, src: src, refs: make(map[int]int)}
+	// Number the pages up front, so links between them stay within the copy
+	// and references to the page tree point at the new one
+	if root, ok := src.resolve(src.trailer["Root"]).(pdfDict); ok {
+		if ref, ok := root["Pages"].(pdfRef); ok {
+			c.refs[ref.num] = m.pagesNum
+		}
+	}
+	nums := make([]int, len(pages))
+	for i, page := range pages {
+		nums[i] = m.reserve()
+		if page.ref.num != 0 {
+			c.refs[page.ref.num] = nums[i]
+		}
+	}
+
+	for i, page := range pages {
+		dict := pdfDict{}
+		for k, v := range page.dict {
+			if k == "Parent" || k == "B" {
+				continue
+			}
+			dict[k] = c.copy(v)
+		}
+		dict["Parent"] = pdfRef{num: m.pagesNum}
+		m.write(nums[i], dict)
+		m.kids = append(m.kids, pdfRef{num: nums[i]})
+	}
+	return pdfRef{num: nums[0]}, nil
+}
+
+// bookmark adds an outline entry pointing at page.
+func (m *pdfMerger) bookmark(title string, page pdfRef) {
+	m.outline = append(m.outline, pdfBookmark{title: title, page: page})
+}
+
+// rewritePDF writes out every object reachable from the trailer of f. Objects
+// are written as loaded, so encrypted documents come out decrypted.
+func rewritePDF(f *pdfFile) []byte {
+	m := &pdfMerger{}
+	m.out.WriteString("%PDF-1.7\n%\xE2\xE3\xCF\xD3\n")
+	c := &pdfCopier{m: m, src: f, refs: make(map[int]int)}
+	trailer := pdfDict{}
+	for _, key := range []pdfName{"Root", "Info", "ID"} {
+		if v, ok := f.trailer[key]; ok {
+			trailer[key] = c.copy(v)
+		}
+	}
+	return m.finish(trailer)
+}
+
+// bytes finishes the document, with the given document information.
+func (m *pdfMerger) bytes(info pdfDict) []byte {
+	m.write(m.pagesNum, pdfDict{"Type": pdfName("Pages"), "Kids": m.kids, "Count": int64(len(m.kids))})
+	catalog := pdfDict{"Type": pdfName("Catalog"), "Pages": pdfRef{num: m.pagesNum}}
+	if len(m.outline) > 0 {
+		catalog["Outlines"] = m.writeOutline()
+		catalog["PageMode"] = pdfName("UseOutlines")
+	}
+	catalogNum := m.reserve()
+	m.write(catalogNum, catalog)
+	trailer := pdfDict{"Root": pdfRef{num: catalogNum}}
+	if len(info) > 0 {
+		num := m.reserve()
+		m.write(num, info)
+		trailer["Info"] = pdfRef{num: num}
+	}
+	return m.finish(trailer)
+}
+
+// finish writes the cross-reference table and trailer.
+func (m *pdfMerger) finish(trailer pdfDict) []byte {
+	xref := m.out.Len()
+	fmt.Fprintf(&m.out, "xref\n0 %d\n0000000000 65535 f \n", len(m.offsets)+1)
+	for _, offset := range m.offsets {
+		fmt.Fprintf(&m.out, "%010d 00000 n \n", offset)
+	}
+	trailer["Size"] = int64(len(m.offsets) + 1)
+	m.out.WriteString("trailer\n")
+	writePDFObject(&m.out, trailer)
+	fmt.Fprintf(&m.out, "\nstartxref\n%d\n%%%%EOF\n", xref)
+	return m.out.Bytes()
+}
+
+// writeOutline writes the bookmarks as a flat outline, returning a reference
+// to its root.
+func (m *pdfMerger) writeOutline() pdfRef {
+	root := m.reserve()
+	nums := make([]int, len(m.outline))
+	for i := range nums {
+		nums[i] = m.reserve()
+	}
+	for i, b := range m.outline {
+		item := pdfDict{
+			"Title":  pdfTextString(b.title),
+			"Parent": pdfRef{num: root},
+			"Dest":   pdfArray{b.page, pdfName("Fit")},
+		}
+		if i > 0 {
+			item["Prev"] = pdfRef{num: nums[i-1]}
+		}
+		if i < len(nums)-1 {
+			item["Next"] = pdfRef{num: nums[i+1]}
+		}
+		m.write(nums[i], item)
+	}
+	m.write(root, pdfDict{
+		"Type":  pdfName("Outlines"),
+		"First": pdfRef{num: nums[0]},
+		"Last":  pdfRef{num: nums[len(nums)-1]},
+		"Count": int64(len(nums)),
+	})
+	return pdfRef{num: root}
+}
+
+// pdfTextString encodes s for use in document information and outlines:
+// as is if it is ASCII, otherwise as UTF-16 with a byte order mark.
+func pdfTextString(s string) pdfString {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return pdfString(s)
+	}
+	out := []byte{0xFE, 0xFF}
+	for _, u := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return pdfString(out)
+}
+
+// pdfCopier copies objects from a source document into a merger, renumbering
+// indirect objects as they are first referenced.
+type pdfCopier struct {
+	m    *pdfMerger
+	src  *pdfFile
+	refs map[int]int // source object number -> merged object number
+}
+
+func (c *pdfCopier) copy(obj any) any {
+	switch o := obj.(type) {
+	case pdfRef:
+		if num, ok := c.refs[o.num]; ok {
+			return pdfRef{num: num}
+		}
+		num := c.m.reserve()
+		c.refs[o.num] = num
+		c.m.write(num, c.copy(c.src.load(o.num)))
+		return pdfRef{num: num}
+	case pdfDict:
+		dict := pdfDict{}
+		for k, v := range o {
+			dict[k] = c.copy(v)
+		}
+		return dict
+	case pdfArray:
+		arr := make(pdfArray, len(o))
+		for i, v := range o {
+			arr[i] = c.copy(v)
+		}
+		return arr
+	case pdfStream:
+		return pdfStream{dict: c.copy(o.dict).(pdfDict), data: o.data}
+	}
+	return obj
+}
+
+// writePDFObject serializes a direct object. Streams must be written by the
+// caller, as they can only appear as indirect objects.
+func writePDFObject(buf *bytes.Buffer, obj any) {
+	switch o := obj.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(o))
+	case int64:
+		buf.WriteString(strconv.FormatInt(o, 10))
+	case float64:
+		buf.WriteString(strconv.FormatFloat(o, 'f', -1, 64))
+	case pdfName:
+		buf.WriteByte('/')
+		for i := 0; i < len(o); i++ {
+			c := o[i]
+			if c < '!' || c > '~' || c == '#' || isPDFDelimiter(c) {
+				fmt.Fprintf(buf, "#%02X", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	case pdfString:
+		fmt.Fprintf(buf, "<%X>", string(o))
+	case pdfRef:
+		fmt.Fprintf(buf, "%d %d R", o.num, o.gen)
+	case pdfArray:
+		buf.WriteByte('[')
+		for i, v := range o {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			writePDFObject(buf, v)
+		}
+		buf.WriteByte(']')
+	case pdfDict:
+		keys := make([]string, 0, len(o))
+		for k := range o {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		buf.WriteString("<<")
+		for _, k := range keys {
+			writePDFObject(buf, pdfName(k))
+			buf.WriteByte(' ')
+			writePDFObject(buf, o[pdfName(k)])
+		}
+		buf.WriteString(">>")
+	case pdfKeyword:
+		buf.WriteString(string(o))
+	case pdfStream:
+		// Not valid inline; keep the dictionary so the output still parses
+		writePDFObject(buf, o.dict)
+	}
+}
@@ -0,0 +1,110 @@
+package extract
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPDFMerger(t *testing.T) {
+	tests := []struct {
+		name      string
+		docs      [][]byte
+		bookmarks []string
+		info      pdfDict
+		text      string
+	}{
+		{
+			name: "two documents",
+			docs: [][]byte{
+				testPDF(testPageObjects("Alpha"), "/Root 1 0 R"),
+				testPDF(testPageObjects("Beta", "Gamma"), "/Root 1 0 R"),
+			},
+			bookmarks: []string{"first", "second"},
+			text:      "Alpha\n\f\nBeta\n\f\nGamma\n",
+		},
+		{
+			name: "object streams",
+			docs: [][]byte{
+				testCompressedPDF("Packed"),
+				testPDF(testPageObjects("Plain"), "/Root 1 0 R"),
+			},
+			info: pdfDict{"Title": pdfTextString("Réunion")},
+			text: "Packed\n\f\nPlain\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newPDFMerger()
+			for i, doc := range tt.docs {
+				first, err := m.add(doc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i < len(tt.bookmarks) {
+					m.bookmark(tt.bookmarks[i], first)
+				}
+			}
+			f, err := parsePDF(m.bytes(tt.info))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.repaired {
+				t.Error("merged document needed repair")
+			}
+			text, err := pdfText(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tt.text {
+				t.Errorf("got text %q, want %q", text, tt.text)
+			}
+
+			pages, _ := f.pages()
+			root := f.resolve(f.trailer["Root"]).(pdfDict)
+			outline, _ := f.resolve(root["Outlines"]).(pdfDict)
+			var titles []string
+			for item, _ := f.resolve(outline["First"]).(pdfDict); item != nil; item, _ = f.resolve(item["Next"]).(pdfDict) {
+				titles = append(titles, string(item["Title"].(pdfString)))
+				dest := item["Dest"].(pdfArray)
+				if dest[0] != pages[sumPages(tt.docs[:len(titles)-1])].ref {
+					t.Errorf("bookmark %q points at %v", titles[len(titles)-1], dest[0])
+				}
+			}
+			if !slices.Equal(titles, tt.bookmarks) {
+				t.Errorf("got bookmarks %q, want %q", titles, tt.bookmarks)
+			}
+
+			info, _ := f.resolve(f.trailer["Info"]).(pdfDict)
+			if got, want := info["Title"], tt.info["Title"]; got != want {
+				t.Errorf("got title %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// sumPages counts the pages of the given documents.
+func sumPages(docs [][]byte) int {
+	n := 0
+	for _, doc := range docs {
+		f, _ := parsePDF(doc)
+		pages, _ := f.pages()
+		n += len(pages)
+	}
+	return n
+}
+
+func TestPDFTextString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Plain", "Plain"},
+		{"", ""},
+		{"é", "\xFE\xFF\x00\xE9"},
+		{"😀", "\xFE\xFF\xD8\x3D\xDE\x00"},
+	}
+	for _, tt := range tests {
+		if got := pdfTextString(tt.in); string(got) != tt.want {
+			t.Errorf("pdfTextString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,837 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// This file implements just enough of a PDF reader to copy pages between
+// documents: the object syntax, classic and compressed cross-reference
+// tables, and object streams. Page content is copied without decoding it.
+
+type (
+	pdfName   string
+	pdfString string // raw bytes, without delimiters or escapes
+	pdfDict   map[pdfName]any
+	pdfArray  []any
+	pdfRef    struct{ num, gen int }
+	pdfStream struct {
+		dict pdfDict
+		data []byte // still encoded with the dict's filters
+	}
+	pdfKeyword string // operators such as "obj" seen while lexing
+)
+
+// errPDFEncrypted is returned for encrypted PDFs none of the known passwords
+// open.
+var errPDFEncrypted = errors.New("encrypted PDF, password unknown")
+
+// pdfFile is a parsed PDF document held in memory.
+type pdfFile struct {
+	data    []byte
+	xref    map[int]pdfXref
+	trailer pdfDict
+	objects map[int]any // objects loaded so far
+
+	startxref  int  // offset of the last cross-reference section
+	xrefStream bool // whether that section is a stream
+	repaired   bool // whether the cross-reference data had to be rebuilt
+
+	crypt    *pdfCrypt // for encrypted documents
+	password string    // that opened the document
+}
+
+// pdfXref locates an object: at an offset in the file, or at an index within
+// an object stream.
+type pdfXref struct {
+	offset   int
+	stream   int
+	index    int
+	inStream bool
+}
+
+func parsePDF(data []byte) (*pdfFile, error) {
+	return openPDF(data, nil)
+}
+
+// openPDF parses a PDF, trying the empty password and then the given ones if
+// it is encrypted. Objects are decrypted as they are loaded.
+func openPDF(data []byte, passwords []string) (*pdfFile, error) {
+	f := &pdfFile{data: data, xref: make(map[int]pdfXref), objects: make(map[int]any)}
+	if !bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+		return nil, errors.New("not a PDF file")
+	}
+
+	if err := f.readXrefChain(); err != nil || f.trailer["Root"] == nil {
+		// Damaged or missing cross-reference data: find the objects by scanning
+		if err := f.rebuildXref(); err != nil {
+			return nil, err
+		}
+	}
+	if f.trailer["Encrypt"] == nil {
+		return f, nil
+	}
+	for _, password := range append([]string{""}, passwords...) {
+		crypt, err := newPDFCrypt(f, password)
+		if err != nil {
+			return nil, err
+		}
+		if crypt != nil {
+			f.crypt, f.password = crypt, password
+			f.objects = make(map[int]any) // loaded before decryption was set up
+			return f, nil
+		}
+	}
+	return nil, errPDFEncrypted
+}
+
+var startxrefRegex = regexp.MustCompile(`startxref\s+(\d+)`)
+
+func (f *pdfFile) readXrefChain() error {
+	tail := f.data[max(0, len(f.data)-2048):]
+	matches := startxrefRegex.FindAllSubmatch(tail, -1)
+	if matches == nil {
+		return errors.New("startxref not found")
+	}
+	offset, _ := strconv.Atoi(string(matches[len(matches)-1][1]))
+	f.startxref = offset
+
+	seen := make(map[int]bool)
+	for offset > 0 && !seen[offset] {
+		seen[offset] = true
+		if offset >= len(f.data) {
+			return errors.New("xref offset out of range")
+		}
+		trailer, err := f.readXrefSection(offset)
+		if err != nil {
+			return err
+		}
+		if f.trailer == nil {
+			f.trailer = trailer
+		}
+		// Hybrid files keep compressed entries in a separate stream
+		if stm, ok := trailer["XRefStm"].(int64); ok {
+			if _, err := f.readXrefSection(int(stm)); err != nil {
+				return err
+			}
+		}
+		prev, _ := trailer["Prev"].(int64)
+		offset = int(prev)
+	}
+	return nil
+}
+
+// readXrefSection reads one cross-reference table or stream, adding the
+// entries not already known from later sections, and returns its trailer.
+func (f *pdfFile) readXrefSection(offset int) (pdfDict, error) {
+	lx := &pdfLexer{data: f.data, pos: offset}
+	tok, err := lx.token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == pdfKeyword("xref") {
+		return f.readXrefTable(lx)
+	}
+	if offset == f.startxref {
+		f.xrefStream = true
+	}
+
+	// A cross-reference stream: "n g obj << ... >> stream"
+	lx.pos = offset
+	_, obj, err := lx.indirectObject()
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := obj.(pdfStream)
+	if !ok || stream.dict["Type"] != pdfName("XRef") {
+		return nil, errors.New("invalid xref stream")
+	}
+	data, err := f.decodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	widths, _ := stream.dict["W"].(pdfArray)
+	if len(widths) != 3 {
+		return nil, errors.New("invalid xref stream widths")
+	}
+	w := make([]int, 3)
+	for i := range w {
+		n, _ := widths[i].(int64)
+		w[i] = int(n)
+	}
+	index, _ := stream.dict["Index"].(pdfArray)
+	if index == nil {
+		size, _ := stream.dict["Size"].(int64)
+		index = pdfArray{int64(0), size}
+	}
+
+	entrySize := w[0] + w[1] + w[2]
+	if entrySize == 0 {
+		return nil, errors.New("invalid xref stream widths")
+	}
+	pos := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		first, _ := index[i].(int64)
+		count, _ := index[i+1].(int64)
+		for n := int(first); n < int(first+count) && pos+entrySize <= len(data); n++ {
+			field := func(k, start int) int {
+				v := 0
+				for _, b := range data[start : start+w[k]] {
+					v = v<<8 | int(b)
+				}
+				return v
+			}
+			kind := 1 // default when the type field is omitted
+			if w[0] > 0 {
+				kind = field(0, pos)
+			}
+			a, b := field(1, pos+w[0]), field(2, pos+w[0]+w[1])
+			pos += entrySize
+
+			if _, known := f.xref[n]; known {
+				continue
+			}
+			switch kind {
+			case 1:
+				f.xref[n] = pdfXref{offset: a}
+			case 2:
+				f.xref[n] = pdfXref{stream: a, index: b, inStream: true}
+			}
+		}
+	}
+	return stream.dict, nil
+}
+
+func (f *pdfFile) readXrefTable(lx *pdfLexer) (pdfDict, error) {
+	for {
+		tok, err := lx.token()
+		if err != nil {
+			return nil, err
+		}
+		if tok == pdfKeyword("trailer") {
+			obj, err := lx.object()
+			if err != nil {
+				return nil, err
+			}
+			trailer, ok := obj.(pdfDict)
+			if !ok {
+				return nil, errors.New("invalid trailer")
+			}
+			return trailer, nil
+		}
+		first, ok1 := tok.(int64)
+		countTok, err := lx.token()
+		count, ok2 := countTok.(int64)
+		if err != nil || !ok1 || !ok2 {
+			return nil, errors.New("invalid xref table")
+		}
+		for n := int(first); n < int(first+count); n++ {
+			offsetTok, _ := lx.token()
+			lx.token() // generation
+			kind, _ := lx.token()
+			offset, _ := offsetTok.(int64)
+			if _, known := f.xref[n]; !known && kind == pdfKeyword("n") {
+				f.xref[n] = pdfXref{offset: int(offset)}
+			}
+		}
+	}
+}
+
+var objHeaderRegex = regexp.MustCompile(`(?m)(?:^|[\r\n\s])(\d+)\s+(\d+)\s+obj\b`)
+
+// rebuildXref recovers the objects of a file with a damaged cross-reference
+// table by looking for "n g obj" headers. Later definitions win, as they
+// would with incremental updates.
+func (f *pdfFile) rebuildXref() error {
+	f.xref = make(map[int]pdfXref)
+	f.objects = make(map[int]any)
+	f.trailer = nil
+	f.repaired = true
+	for _, m := range objHeaderRegex.FindAllSubmatchIndex(f.data, -1) {
+		n, _ := strconv.Atoi(string(f.data[m[2]:m[3]]))
+		f.xref[n] = pdfXref{offset: m[2]}
+	}
+
+	// Use the last trailer, or failing that find the catalog
+	if i := bytes.LastIndex(f.data, []byte("trailer")); i >= 0 {
+		lx := &pdfLexer{data: f.data, pos: i + len("trailer")}
+		if obj, err := lx.object(); err == nil {
+			f.trailer, _ = obj.(pdfDict)
+		}
+	}
+	if f.trailer == nil || f.trailer["Root"] == nil {
+		f.trailer = pdfDict{}
+		for n := range f.xref {
+			if dict, ok := f.resolve(pdfRef{num: n}).(pdfDict); ok && dict["Type"] == pdfName("Catalog") {
+				f.trailer["Root"] = pdfRef{num: n}
+				break
+			}
+		}
+	}
+	if f.trailer["Root"] == nil {
+		return errors.New("no document catalog found")
+	}
+	return nil
+}
+
+// resolve follows indirect references, returning nil for missing objects.
+func (f *pdfFile) resolve(obj any) any {
+	for depth := 0; depth < 32; depth++ {
+		ref, ok := obj.(pdfRef)
+		if !ok {
+			return obj
+		}
+		obj = f.load(ref.num)
+	}
+	return nil
+}
+
+func (f *pdfFile) load(num int) any {
+	if obj, ok := f.objects[num]; ok {
+		return obj
+	}
+	f.objects[num] = nil // guards against reference loops
+
+	entry, ok := f.xref[num]
+	if !ok {
+		return nil
+	}
+	var obj any
+	if entry.inStream {
+		obj = f.loadFromStream(entry.stream, entry.index)
+	} else if entry.offset < len(f.data) {
+		lx := &pdfLexer{data: f.data, pos: entry.offset, file: f}
+		if ref, o, err := lx.indirectObject(); err == nil {
+			obj = o
+			if f.crypt != nil && ref.num != f.crypt.dictNum {
+				obj = f.crypt.decryptObject(ref, obj)
+			}
+		}
+	}
+	f.objects[num] = obj
+	return obj
+}
+
+func (f *pdfFile) loadFromStream(streamNum, index int) any {
+	stream, ok := f.resolve(pdfRef{num: streamNum}).(pdfStream)
+	if !ok {
+		return nil
+	}
+	data, err := f.decodeStream(stream)
+	if err != nil {
+		return nil
+	}
+	n, _ := stream.dict["N"].(int64)
+	first, _ := stream.dict["First"].(int64)
+	if index >= int(n) {
+		return nil
+	}
+
+	header := &pdfLexer{data: data}
+	var offset int64
+	for i := 0; i <= index; i++ {
+		header.token() // object number
+		tok, _ := header.token()
+		offset, _ = tok.(int64)
+	}
+	if int(first+offset) >= len(data) {
+		return nil
+	}
+	lx := &pdfLexer{data: data, pos: int(first + offset), file: f}
+	obj, err := lx.object()
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+// decodeStream decodes a stream compressed with FlateDecode, the only filter
+// used by cross-reference and object streams.
+func (f *pdfFile) decodeStream(s pdfStream) ([]byte, error) {
+	filter := f.resolve(s.dict["Filter"])
+	params, _ := f.resolve(s.dict["DecodeParms"]).(pdfDict)
+	if arr, ok := filter.(pdfArray); ok {
+		if len(arr) > 1 {
+			return nil, errors.New("unsupported filter chain")
+		}
+		if len(arr) == 1 {
+			filter = arr[0]
+		} else {
+			filter = nil
+		}
+		if paramsArr, ok := f.resolve(s.dict["DecodeParms"]).(pdfArray); ok && len(paramsArr) > 0 {
+			params, _ = f.resolve(paramsArr[0]).(pdfDict)
+		}
+	}
+
+	switch filter {
+	case nil:
+		return s.data, nil
+	case pdfName("FlateDecode"):
+		zr, err := zlib.NewReader(bytes.NewReader(s.data))
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil && len(data) == 0 {
+			return nil, err
+		}
+		return applyPredictor(data, params)
+	}
+	return nil, fmt.Errorf("unsupported filter %v", filter)
+}
+
+// applyPredictor reverses the PNG predictors used by cross-reference
+// streams.
+func applyPredictor(data []byte, params pdfDict) ([]byte, error) {
+	predictor, _ := params["Predictor"].(int64)
+	if predictor < 10 {
+		return data, nil
+	}
+	columns, _ := params["Columns"].(int64)
+	if columns <= 0 {
+		columns = 1
+	}
+	rowSize := int(columns) + 1
+	prev := make([]byte, columns)
+	var out []byte
+	for start := 0; start+rowSize <= len(data); start += rowSize {
+		row := data[start+1 : start+rowSize]
+		cur := make([]byte, columns)
+		for i := range row {
+			var left, upLeft byte
+			if i > 0 {
+				left, upLeft = cur[i-1], prev[i-1]
+			}
+			up := prev[i]
+			switch data[start] {
+			case 0:
+				cur[i] = row[i]
+			case 1:
+				cur[i] = row[i] + left
+			case 2:
+				cur[i] = row[i] + up
+			case 3:
+				cur[i] = row[i] + byte((int(left)+int(up))/2)
+			case 4:
+				cur[i] = row[i] + paeth(left, up, upLeft)
+			default:
+				return nil, errors.New("invalid PNG predictor")
+			}
+		}
+		out = append(out, cur...)
+		prev = cur
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// pdfPage is a page dictionary, with inherited attributes copied into it,
+// and the reference it was found at (zero for direct objects).
+type pdfPage struct {
+	ref  pdfRef
+	dict pdfDict
+}
+
+// pages returns the pages of the document in order.
+func (f *pdfFile) pages() ([]pdfPage, error) {
+	root, ok := f.resolve(f.trailer["Root"]).(pdfDict)
+	if !ok {
+		return nil, errors.New("missing document catalog")
+	}
+	var pages []pdfPage
+	var walk func(node any, inherited pdfDict, depth int) error
+	walk = func(node any, inherited pdfDict, depth int) error {
+		dict, ok := f.resolve(node).(pdfDict)
+		if !ok || depth > 64 {
+			return errors.New("invalid page tree")
+		}
+		attrs := pdfDict{}
+		for k, v := range inherited {
+			attrs[k] = v
+		}
+		for _, key := range []pdfName{"Resources", "MediaBox", "CropBox", "Rotate"} {
+			if v, ok := dict[key]; ok {
+				attrs[key] = v
+			}
+		}
+
+		if kids, ok := f.resolve(dict["Kids"]).(pdfArray); ok && dict["Type"] != pdfName("Page") {
+			for _, kid := range kids {
+				if err := walk(kid, attrs, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		page := pdfDict{}
+		for k, v := range dict {
+			page[k] = v
+		}
+		for k, v := range attrs {
+			page[k] = v
+		}
+		ref, _ := node.(pdfRef)
+		pages = append(pages, pdfPage{ref: ref, dict: page})
+		return nil
+	}
+	if err := walk(root["Pages"], pdfDict{}, 0); err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("document has no pages")
+	}
+	return pages, nil
+}
+
+// pdfLexer reads PDF objects from data. Stream lengths given as indirect
+// references are resolved through file, if set.
+type pdfLexer struct {
+	data []byte
+	pos  int
+	file *pdfFile
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+func (lx *pdfLexer) skipSpace() {
+	for lx.pos < len(lx.data) {
+		c := lx.data[lx.pos]
+		if c == '%' {
+			for lx.pos < len(lx.data) && lx.data[lx.pos] != '\r' && lx.data[lx.pos] != '\n' {
+				lx.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		lx.pos++
+	}
+}
+
+// token returns the next token: a number, name, string, keyword, or one of
+// the delimiters "[", "]", "<<" and ">>" as keywords.
+func (lx *pdfLexer) token() (any, error) {
+	lx.skipSpace()
+	if lx.pos >= len(lx.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	c := lx.data[lx.pos]
+	switch {
+	case c == '/':
+		lx.pos++
+		start := lx.pos
+		for lx.pos < len(lx.data) && !isPDFSpace(lx.data[lx.pos]) && !isPDFDelimiter(lx.data[lx.pos]) {
+			lx.pos++
+		}
+		return pdfName(unescapeName(lx.data[start:lx.pos])), nil
+	case c == '(':
+		return lx.literalString()
+	case c == '<':
+		if lx.pos+1 < len(lx.data) && lx.data[lx.pos+1] == '<' {
+			lx.pos += 2
+			return pdfKeyword("<<"), nil
+		}
+		return lx.hexString()
+	case c == '>':
+		if lx.pos+1 < len(lx.data) && lx.data[lx.pos+1] == '>' {
+			lx.pos += 2
+			return pdfKeyword(">>"), nil
+		}
+		lx.pos++
+		return nil, errors.New("unexpected '>'")
+	case c == '[' || c == ']' || c == '{' || c == '}':
+		lx.pos++
+		return pdfKeyword(string(c)), nil
+	case c == ')':
+		lx.pos++
+		return nil, errors.New("unexpected ')'")
+	}
+
+	start := lx.pos
+	for lx.pos < len(lx.data) && !isPDFSpace(lx.data[lx.pos]) && !isPDFDelimiter(lx.data[lx.pos]) {
+		lx.pos++
+	}
+	word := string(lx.data[start:lx.pos])
+	if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return n, nil
+	}
+	if n, err := strconv.ParseFloat(word, 64); err == nil {
+		return n, nil
+	}
+	return pdfKeyword(word), nil
+}
+
+func unescapeName(raw []byte) string {
+	if bytes.IndexByte(raw, '#') < 0 {
+		return string(raw)
+	}
+	var out []byte
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && i+2 < len(raw) {
+			if v, err := strconv.ParseUint(string(raw[i+1:i+3]), 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, raw[i])
+	}
+	return string(out)
+}
+
+func (lx *pdfLexer) literalString() (any, error) {
+	lx.pos++ // (
+	var out []byte
+	depth := 1
+	for lx.pos < len(lx.data) {
+		c := lx.data[lx.pos]
+		lx.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfString(out), nil
+			}
+		case '\\':
+			if lx.pos >= len(lx.data) {
+				break
+			}
+			e := lx.data[lx.pos]
+			lx.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if lx.pos < len(lx.data) && lx.data[lx.pos] == '\n' {
+					lx.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for k := 0; k < 2 && lx.pos < len(lx.data) && lx.data[lx.pos] >= '0' && lx.data[lx.pos] <= '7'; k++ {
+						v = v*8 + int(lx.data[lx.pos]-'0')
+						lx.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (lx *pdfLexer) hexString() (any, error) {
+	lx.pos++ // <
+	var digits []byte
+	for lx.pos < len(lx.data) {
+		c := lx.data[lx.pos]
+		lx.pos++
+		if c == '>' {
+			if len(digits)%2 == 1 {
+				digits = append(digits, '0')
+			}
+			out := make([]byte, len(digits)/2)
+			for i := range out {
+				v, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+				out[i] = byte(v)
+			}
+			return pdfString(out), nil
+		}
+		if !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// object reads a complete object, including references and streams.
+func (lx *pdfLexer) object() (any, error) {
+	tok, err := lx.token()
+	if err != nil {
+		return nil, err
+	}
+	return lx.objectFrom(tok)
+}
+
+func (lx *pdfLexer) objectFrom(tok any) (any, error) {
+	switch t := tok.(type) {
+	case int64:
+		// Look ahead for "gen R"
+		save := lx.pos
+		if gen, err := lx.token(); err == nil {
+			if g, ok := gen.(int64); ok {
+				if r, err := lx.token(); err == nil && r == pdfKeyword("R") {
+					return pdfRef{num: int(t), gen: int(g)}, nil
+				}
+			}
+		}
+		lx.pos = save
+		return t, nil
+	case pdfKeyword:
+		switch t {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		case "[":
+			var arr pdfArray
+			for {
+				tok, err := lx.token()
+				if err != nil {
+					return nil, err
+				}
+				if tok == pdfKeyword("]") {
+					return arr, nil
+				}
+				obj, err := lx.objectFrom(tok)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, obj)
+			}
+		case "<<":
+			dict := pdfDict{}
+			for {
+				tok, err := lx.token()
+				if err != nil {
+					return nil, err
+				}
+				if tok == pdfKeyword(">>") {
+					break
+				}
+				key, ok := tok.(pdfName)
+				if !ok {
+					return nil, fmt.Errorf("invalid dictionary key %v", tok)
+				}
+				value, err := lx.object()
+				if err != nil {
+					return nil, err
+				}
+				if value != nil {
+					dict[key] = value
+				}
+			}
+			return lx.maybeStream(dict)
+		}
+		return t, nil
+	}
+	return tok, nil
+}
+
+// maybeStream reads the stream data following dict, if any.
+func (lx *pdfLexer) maybeStream(dict pdfDict) (any, error) {
+	save := lx.pos
+	if tok, err := lx.token(); err != nil || tok != pdfKeyword("stream") {
+		lx.pos = save
+		return dict, nil
+	}
+	if lx.pos < len(lx.data) && lx.data[lx.pos] == '\r' {
+		lx.pos++
+	}
+	if lx.pos < len(lx.data) && lx.data[lx.pos] == '\n' {
+		lx.pos++
+	}
+	start := lx.pos
+
+	length := -1
+	switch l := dict["Length"].(type) {
+	case int64:
+		length = int(l)
+	case pdfRef:
+		if lx.file != nil {
+			if n, ok := lx.file.resolve(l).(int64); ok {
+				length = int(n)
+			}
+		}
+	}
+	end := start + length
+	if length < 0 || end > len(lx.data) || !bytes.HasPrefix(bytes.TrimLeft(lx.data[end:min(end+20, len(lx.data))], "\r\n \t"), []byte("endstream")) {
+		// Missing or wrong /Length: look for the end marker instead
+		i := bytes.Index(lx.data[start:], []byte("endstream"))
+		if i < 0 {
+			return nil, errors.New("unterminated stream")
+		}
+		end = start + i
+		for end > start && (lx.data[end-1] == '\n' || lx.data[end-1] == '\r') {
+			end--
+		}
+	}
+	lx.pos = end
+	if tok, err := lx.token(); err != nil || tok != pdfKeyword("endstream") {
+		return nil, errors.New("missing endstream")
+	}
+	return pdfStream{dict: dict, data: lx.data[start:end]}, nil
+}
+
+// indirectObject reads "n g obj ... endobj".
+func (lx *pdfLexer) indirectObject() (pdfRef, any, error) {
+	numTok, err := lx.token()
+	if err != nil {
+		return pdfRef{}, nil, err
+	}
+	num, ok := numTok.(int64)
+	if !ok {
+		return pdfRef{}, nil, errors.New("expected object number")
+	}
+	genTok, _ := lx.token()
+	gen, _ := genTok.(int64)
+	if tok, err := lx.token(); err != nil || tok != pdfKeyword("obj") {
+		return pdfRef{}, nil, errors.New("expected obj")
+	}
+	obj, err := lx.object()
+	if err != nil {
+		return pdfRef{}, nil, err
+	}
+	return pdfRef{num: int(num), gen: int(gen)}, obj, nil
+}
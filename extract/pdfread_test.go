@@ -0,0 +1,231 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPDF assembles a document from the bodies of its objects, numbered
+// from 1, with a cross-reference table and a trailer holding the given
+// entries besides Size.
+func testPDF(objects []string, trailer string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailer, xref)
+	return b.Bytes()
+}
+
+// testPageObjects returns the objects of a document with a page showing
+// each text in Helvetica, the catalog being object 1.
+func testPageObjects(texts ...string) []string {
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", "", "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"}
+	var kids []string
+	for _, text := range texts {
+		page := len(objects) + 1
+		content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", page+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d /MediaBox [0 0 612 792] >>", strings.Join(kids, " "), len(texts))
+	return objects
+}
+
+// testCompressedPDF returns a document with a page showing text whose page
+// objects are in an object stream, located by a compressed cross-reference
+// stream with a PNG predictor.
+func testCompressedPDF(text string) []byte {
+	content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+	// Objects 1 to 4 go in object stream 5; 6 is the content, 7 the xref
+	inStream := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 4 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+	var header, body strings.Builder
+	for i, obj := range inStream {
+		fmt.Fprintf(&header, "%d %d ", i+1, body.Len())
+		body.WriteString(obj + " ")
+	}
+	objStm := header.String() + body.String()
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n")
+	stmOffset := b.Len()
+	fmt.Fprintf(&b, "5 0 obj\n<< /Type /ObjStm /N %d /First %d /Length %d >>\nstream\n%s\nendstream\nendobj\n",
+		len(inStream), header.Len(), len(objStm), objStm)
+	contentOffset := b.Len()
+	fmt.Fprintf(&b, "6 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+	xrefOffset := b.Len()
+
+	// Rows of type, offset or stream, and generation or index, each
+	// behind the PNG Up predictor
+	rows := [][]byte{{0, 0, 0, 0}}
+	for i := range inStream {
+		rows = append(rows, []byte{2, 0, 5, byte(i)})
+	}
+	rows = append(rows,
+		[]byte{1, byte(stmOffset >> 8), byte(stmOffset), 0},
+		[]byte{1, byte(contentOffset >> 8), byte(contentOffset), 0},
+		[]byte{1, byte(xrefOffset >> 8), byte(xrefOffset), 0})
+	var raw bytes.Buffer
+	prev := make([]byte, 4)
+	for _, row := range rows {
+		raw.WriteByte(2)
+		for i := range row {
+			raw.WriteByte(row[i] - prev[i])
+		}
+		prev = row
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(raw.Bytes())
+	zw.Close()
+
+	fmt.Fprintf(&b, "7 0 obj\n<< /Type /XRef /Size 8 /W [1 2 1] /Root 1 0 R /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 4 >> /Length %d >>\nstream\n",
+		compressed.Len())
+	b.Write(compressed.Bytes())
+	fmt.Fprintf(&b, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+	return b.Bytes()
+}
+
+func TestParsePDF(t *testing.T) {
+	twoPages := testPDF(testPageObjects("First", "Second"), "/Root 1 0 R")
+	tests := []struct {
+		name     string
+		data     []byte
+		pages    int
+		repaired bool
+		err      string
+	}{
+		{name: "xref table", data: twoPages, pages: 2},
+		{name: "xref stream and object stream", data: testCompressedPDF("Packed"), pages: 1},
+		{
+			name:     "wrong startxref",
+			data:     bytes.Replace(twoPages, []byte("startxref\n"), []byte("startxref\n9"), 1),
+			pages:    2,
+			repaired: true,
+		},
+		{
+			name:     "no xref table",
+			data:     twoPages[:bytes.Index(twoPages, []byte("xref\n0 "))],
+			pages:    2,
+			repaired: true,
+		},
+		{
+			name:  "inherited attributes",
+			data:  testPDF(testPageObjects("Only"), "/Root 1 0 R"),
+			pages: 1,
+		},
+		{name: "not a PDF", data: []byte("hello"), err: "not a PDF file"},
+		{
+			name: "no catalog",
+			data: testPDF([]string{"<< /Type /Pages /Kids [] /Count 0 >>"}, ""),
+			err:  "no document catalog found",
+		},
+		{
+			name: "no pages",
+			data: testPDF([]string{"<< /Type /Catalog /Pages 2 0 R >>", "<< /Type /Pages /Kids [] /Count 0 >>"}, "/Root 1 0 R"),
+			err:  "document has no pages",
+		},
+		{
+			name: "page tree loop",
+			data: testPDF([]string{"<< /Type /Catalog /Pages 2 0 R >>", "<< /Type /Pages /Kids [2 0 R] /Count 1 >>"}, "/Root 1 0 R"),
+			err:  "invalid page tree",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parsePDF(tt.data)
+			var pages []pdfPage
+			if err == nil {
+				pages, err = f.pages()
+			}
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pages) != tt.pages {
+				t.Errorf("got %d pages, want %d", len(pages), tt.pages)
+			}
+			if f.repaired != tt.repaired {
+				t.Errorf("got repaired %v, want %v", f.repaired, tt.repaired)
+			}
+			for i, page := range pages {
+				if _, ok := page.dict["MediaBox"].(pdfArray); !ok {
+					t.Errorf("page %d has no MediaBox", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestPDFLexer(t *testing.T) {
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"42", int64(42)},
+		{"-3.5", -3.5},
+		{"true", true},
+		{"null", nil},
+		{"/Name", pdfName("Name")},
+		{"/A#20B", pdfName("A B")},
+		{`(a\(b\)\n\101\
+c)`, pdfString("a(b)\nAc")},
+		{"(nested (parens))", pdfString("nested (parens)")},
+		{"<48 65 6C6C 6F>", pdfString("Hello")},
+		{"<4>", pdfString("\x40")},
+		{"12 0 R", pdfRef{num: 12}},
+		{"[1 2 0 R /X]", pdfArray{int64(1), pdfRef{num: 2}, pdfName("X")}},
+		{"<< /A 1 /B [true] /C null >>", pdfDict{"A": int64(1), "B": pdfArray{true}}},
+		{"% comment\n7", int64(7)},
+		{
+			"<< /Length 5 >>\nstream\nab\ncd\nendstream",
+			pdfStream{dict: pdfDict{"Length": int64(5)}, data: []byte("ab\ncd")},
+		},
+		{
+			"<< /Length 99 >>\nstream\nwrong length\nendstream",
+			pdfStream{dict: pdfDict{"Length": int64(99)}, data: []byte("wrong length")},
+		},
+	}
+	for _, tt := range tests {
+		lx := &pdfLexer{data: []byte(tt.in)}
+		got, err := lx.object()
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"(unterminated", "<< /A >>", "<< 1 2 >>", "[1 2", "<< /Length 3 >> stream\nabc"} {
+		lx := &pdfLexer{data: []byte(in)}
+		if got, err := lx.object(); err == nil {
+			t.Errorf("%q: got %#v, want an error", in, got)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package extract
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// extractPDFText returns the text of a PDF, opening it with passwords if
+// it is encrypted.
+func extractPDFText(data []byte, passwords []string) (string, error) {
+	f, err := openPDF(data, passwords)
+	if err != nil {
+		return "", err
+	}
+	return pdfText(f)
+}
+
+// pdfText extracts the text shown on the pages of a PDF, page by page, in
+// the order it is drawn. Lines are broken where the text moves vertically.
+// It does not attempt to reconstruct columns or tables.
+func pdfText(f *pdfFile) (string, error) {
+	pages, err := f.pages()
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for i, page := range pages {
+		if i > 0 {
+			out.WriteString("\n\f\n")
+		}
+		t := &textExtractor{f: f, fonts: make(map[pdfRef]*pdfFont)}
+		t.run(page.dict["Contents"], page.dict["Resources"], 0)
+		out.WriteString(strings.TrimSpace(t.out.String()))
+	}
+	return out.String() + "\n", nil
+}
+
+type textExtractor struct {
+	f     *pdfFile
+	out   strings.Builder
+	fonts map[pdfRef]*pdfFont
+
+	font      *pdfFont
+	y, scale  float64 // current baseline and vertical scale of the text matrix
+	lastY     float64 // baseline of the last text shown
+	shown     bool    // whether text was shown yet
+	moved     bool    // whether the position changed since then
+	lineScale float64
+}
+
+// run interprets a content stream (or array of them) with its resources.
+func (t *textExtractor) run(contents, resources any, depth int) {
+	var data []byte
+	switch c := t.f.resolve(contents).(type) {
+	case pdfStream:
+		data, _ = t.f.decodeStream(c)
+	case pdfArray:
+		for _, item := range c {
+			if s, ok := t.f.resolve(item).(pdfStream); ok {
+				part, _ := t.f.decodeStream(s)
+				data = append(append(data, part...), '\n')
+			}
+		}
+	}
+	res, _ := t.f.resolve(resources).(pdfDict)
+
+	lx := &pdfLexer{data: data}
+	var operands []any
+	for {
+		tok, err := lx.token()
+		if err != nil {
+			return
+		}
+		op, isOp := tok.(pdfKeyword)
+		if !isOp || op == "[" || op == "<<" || op == "true" || op == "false" || op == "null" {
+			obj, err := lx.objectFrom(tok)
+			if err != nil {
+				return
+			}
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "BI":
+			// Inline image: skip its binary data up to EI
+			i := bytes.Index(lx.data[lx.pos:], []byte("ID"))
+			if i < 0 {
+				return
+			}
+			lx.pos += i + 3
+			for {
+				j := bytes.Index(lx.data[lx.pos:], []byte("EI"))
+				if j < 0 {
+					return
+				}
+				lx.pos += j + 2
+				if lx.pos >= len(lx.data) || isPDFSpace(lx.data[lx.pos]) {
+					break
+				}
+			}
+		case "BT":
+			t.y, t.scale = 0, 1
+			t.moved = true
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[0].(pdfName); ok {
+					fonts, _ := t.f.resolve(res["Font"]).(pdfDict)
+					t.font = t.loadFont(fonts[name])
+				}
+			}
+		case "Tm":
+			if len(operands) == 6 {
+				t.scale, t.y = number(operands[3]), number(operands[5])
+				t.moved = true
+			}
+		case "Td", "TD":
+			if len(operands) == 2 {
+				t.y += number(operands[1]) * t.scale
+				t.moved = true
+			}
+		case "TL":
+			if len(operands) == 1 {
+				t.lineScale = number(operands[0])
+			}
+		case "T*":
+			t.newLine()
+		case "Tj":
+			if len(operands) == 1 {
+				t.show(operands[0])
+			}
+		case "'":
+			if len(operands) == 1 {
+				t.newLine()
+				t.show(operands[0])
+			}
+		case "\"":
+			if len(operands) == 3 {
+				t.newLine()
+				t.show(operands[2])
+			}
+		case "TJ":
+			if len(operands) == 1 {
+				arr, _ := operands[0].(pdfArray)
+				for _, item := range arr {
+					// Large negative adjustments separate words
+					if n, ok := item.(float64); ok && n < -200 {
+						t.space()
+					} else if n, ok := item.(int64); ok && n < -200 {
+						t.space()
+					} else {
+						t.show(item)
+					}
+				}
+			}
+		case "Do":
+			if len(operands) == 1 && depth < 8 {
+				xobjects, _ := t.f.resolve(res["XObject"]).(pdfDict)
+				if name, ok := operands[0].(pdfName); ok {
+					if form, ok := t.f.resolve(xobjects[name]).(pdfStream); ok && form.dict["Subtype"] == pdfName("Form") {
+						saved := t.font
+						t.run(xobjects[name], form.dict["Resources"], depth+1)
+						t.font = saved
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+func number(v any) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func (t *textExtractor) newLine() {
+	leading := t.lineScale
+	if leading == 0 {
+		leading = 1
+	}
+	t.y -= leading * t.scale
+	t.moved = true
+}
+
+func (t *textExtractor) space() {
+	if s := t.out.String(); s != "" && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\n") {
+		t.out.WriteByte(' ')
+	}
+}
+
+func (t *textExtractor) show(v any) {
+	s, ok := v.(pdfString)
+	if !ok || t.font == nil {
+		return
+	}
+	if t.shown && t.moved {
+		if math.Abs(t.y-t.lastY) > 0.5 {
+			t.out.WriteByte('\n')
+		} else {
+			t.space()
+		}
+	}
+	t.out.WriteString(t.font.decode([]byte(s)))
+	t.shown, t.moved, t.lastY = true, false, t.y
+}
+
+// pdfFont maps the character codes of a font to text.
+type pdfFont struct {
+	codeLengths []int             // byte lengths of codes, shortest first
+	toUnicode   map[string]string // code bytes -> text, from the ToUnicode CMap
+	simple      *[256]rune        // for single-byte fonts without a complete ToUnicode
+}
+
+func (t *textExtractor) loadFont(obj any) *pdfFont {
+	ref, isRef := obj.(pdfRef)
+	if font, ok := t.fonts[ref]; isRef && ok {
+		return font
+	}
+	dict, _ := t.f.resolve(obj).(pdfDict)
+	font := &pdfFont{codeLengths: []int{1}}
+	if dict["Subtype"] == pdfName("Type0") {
+		font.codeLengths = []int{2}
+	} else {
+		font.simple = simpleEncoding(t.f, dict["Encoding"])
+	}
+	if cmap, ok := t.f.resolve(dict["ToUnicode"]).(pdfStream); ok {
+		if data, err := t.f.decodeStream(cmap); err == nil {
+			font.parseCMap(data)
+		}
+	}
+	if isRef {
+		t.fonts[ref] = font
+	}
+	return font
+}
+
+func (font *pdfFont) decode(s []byte) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		n := font.codeLengths[len(font.codeLengths)-1]
+		if font.toUnicode != nil {
+			for _, length := range font.codeLengths {
+				if length <= len(s) {
+					if text, ok := font.toUnicode[string(s[:length])]; ok {
+						n = length
+						b.WriteString(text)
+						goto next
+					}
+				}
+			}
+		}
+		if font.simple != nil {
+			n = 1
+			if r := font.simple[s[0]]; r != 0 {
+				b.WriteRune(r)
+			}
+		}
+	next:
+		s = s[min(n, len(s)):]
+	}
+	return b.String()
+}
+
+// parseCMap reads the code space and bfchar/bfrange mappings of a ToUnicode
+// CMap.
+func (font *pdfFont) parseCMap(data []byte) {
+	font.toUnicode = make(map[string]string)
+	lengths := make(map[int]bool)
+	lx := &pdfLexer{data: data}
+	var operands []any
+	section := ""
+	for {
+		tok, err := lx.token()
+		if err != nil {
+			break
+		}
+		switch tok {
+		case pdfKeyword("begincodespacerange"), pdfKeyword("beginbfchar"), pdfKeyword("beginbfrange"):
+			section = string(tok.(pdfKeyword))
+			operands = operands[:0]
+			continue
+		case pdfKeyword("endcodespacerange"), pdfKeyword("endbfchar"), pdfKeyword("endbfrange"):
+			section = ""
+			continue
+		}
+		if section == "" {
+			continue
+		}
+		obj, err := lx.objectFrom(tok)
+		if err != nil {
+			break
+		}
+		operands = append(operands, obj)
+
+		switch section {
+		case "begincodespacerange":
+			if len(operands) == 2 {
+				if lo, ok := operands[0].(pdfString); ok && len(lo) > 0 {
+					lengths[len(lo)] = true
+				}
+				operands = operands[:0]
+			}
+		case "beginbfchar":
+			if len(operands) == 2 {
+				src, _ := operands[0].(pdfString)
+				dst, _ := operands[1].(pdfString)
+				font.toUnicode[string(src)] = utf16Text([]byte(dst))
+				operands = operands[:0]
+			}
+		case "beginbfrange":
+			if len(operands) == 3 {
+				lo, _ := operands[0].(pdfString)
+				hi, _ := operands[1].(pdfString)
+				font.addRange([]byte(lo), []byte(hi), operands[2])
+				operands = operands[:0]
+			}
+		}
+	}
+
+	if len(lengths) > 0 {
+		font.codeLengths = font.codeLengths[:0]
+		for n := range lengths {
+			font.codeLengths = append(font.codeLengths, n)
+		}
+		sort.Ints(font.codeLengths)
+	}
+}
+
+func (font *pdfFont) addRange(lo, hi []byte, dst any) {
+	if len(lo) != len(hi) || len(lo) == 0 || len(lo) > 4 {
+		return
+	}
+	toInt := func(b []byte) int {
+		v := 0
+		for _, c := range b {
+			v = v<<8 | int(c)
+		}
+		return v
+	}
+	start, end := toInt(lo), toInt(hi)
+	if end < start || end-start > 0xFFFF {
+		return
+	}
+	for code := start; code <= end; code++ {
+		key := make([]byte, len(lo))
+		for i, v := len(key)-1, code; i >= 0; i, v = i-1, v>>8 {
+			key[i] = byte(v)
+		}
+		switch d := dst.(type) {
+		case pdfString:
+			// The last byte of the destination is incremented along the range
+			text := append([]byte{}, d...)
+			if len(text) > 0 {
+				text[len(text)-1] += byte(code - start)
+			}
+			font.toUnicode[string(key)] = utf16Text(text)
+		case pdfArray:
+			if i := code - start; i < len(d) {
+				if s, ok := d[i].(pdfString); ok {
+					font.toUnicode[string(key)] = utf16Text([]byte(s))
+				}
+			}
+		}
+	}
+}
+
+func utf16Text(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(units))
+}
+
+// simpleEncoding returns the code to character mapping of a single-byte
+// font: WinAnsi (also assumed for the standard and Mac encodings, which share
+// its ASCII range) with any Differences applied.
+func simpleEncoding(f *pdfFile, encoding any) *[256]rune {
+	var table [256]rune
+	for i := range table {
+		if i >= 0x80 && i < 0xA0 {
+			table[i] = windows1252[i-0x80]
+		} else if i >= 32 {
+			table[i] = rune(i)
+		}
+	}
+	dict, ok := f.resolve(encoding).(pdfDict)
+	if !ok {
+		return &table
+	}
+	differences, _ := f.resolve(dict["Differences"]).(pdfArray)
+	code := 0
+	for _, item := range differences {
+		switch v := item.(type) {
+		case int64:
+			code = int(v)
+		case pdfName:
+			if code >= 0 && code < 256 {
+				table[code] = glyphRune(string(v))
+			}
+			code++
+		}
+	}
+	return &table
+}
+
+// glyphNames maps the glyph names most often found in Differences arrays
+// that are not a single letter or digit.
+var glyphNames = map[string]rune{
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#', "dollar": '$', "percent": '%',
+	"ampersand": '&', "quotesingle": '\'', "parenleft": '(', "parenright": ')', "asterisk": '*',
+	"plus": '+', "comma": ',', "hyphen": '-', "period": '.', "slash": '/', "colon": ':',
+	"semicolon": ';', "less": '<', "equal": '=', "greater": '>', "question": '?', "at": '@',
+	"bracketleft": '[', "backslash": '\\', "bracketright": ']', "asciicircum": '^',
+	"underscore": '_', "grave": '`', "braceleft": '{', "bar": '|', "braceright": '}',
+	"asciitilde": '~', "zero": '0', "one": '1', "two": '2', "three": '3', "four": '4',
+	"five": '5', "six": '6', "seven": '7', "eight": '8', "nine": '9', "quoteleft": '‘',
+	"quoteright": '’', "quotedblleft": '“', "quotedblright": '”', "endash": '–', "emdash": '—',
+	"bullet": '•', "ellipsis": '…', "Euro": '€', "sterling": '£', "yen": '¥', "cent": '¢',
+	"section": '§', "paragraph": '¶', "degree": '°', "copyright": '©', "registered": '®',
+	"trademark": '™', "minus": '−', "multiply": '×', "divide": '÷', "germandbls": 'ß',
+	"fi": 'ﬁ', "fl": 'ﬂ', "dotlessi": 'ı', "AE": 'Æ', "ae": 'æ', "OE": 'Œ', "oe": 'œ',
+	"Oslash": 'Ø', "oslash": 'ø', "Eth": 'Ð', "eth": 'ð', "Thorn": 'Þ', "thorn": 'þ',
+	"guillemotleft": '«', "guillemotright": '»', "nbspace": ' ',
+}
+
+// accentedLetters composes names such as "eacute" from a base letter and an
+// accent.
+var accentedLetters = map[string]string{
+	"grave": "ÀÈÌÒÙàèìòù", "acute": "ÁÉÍÓÚÝáéíóúý", "circumflex": "ÂÊÎÔÛâêîôû",
+	"tilde": "ÃÑÕãñõ", "dieresis": "ÄËÏÖÜäëïöüÿ", "ring": "Åå", "cedilla": "Çç", "caron": "ŠŽšž",
+}
+
+func glyphRune(name string) rune {
+	// Variants such as "a.sc" or "one.oldstyle"
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	if len(name) == 1 {
+		return rune(name[0])
+	}
+	if r, ok := glyphNames[name]; ok {
+		return r
+	}
+	if strings.HasPrefix(name, "uni") && len(name) == 7 {
+		if v, err := strconv.ParseUint(name[3:], 16, 32); err == nil {
+			return rune(v)
+		}
+	}
+	if strings.HasPrefix(name, "u") && len(name) >= 5 && len(name) <= 7 {
+		if v, err := strconv.ParseUint(name[1:], 16, 32); err == nil {
+			return rune(v)
+		}
+	}
+	for accent, letters := range accentedLetters {
+		if base, ok := strings.CutSuffix(name, accent); ok && len(base) == 1 {
+			for _, r := range letters {
+				if decomposeLatin(r) == base {
+					return r
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// decomposeLatin returns the unaccented letter of an accented Latin letter.
+func decomposeLatin(r rune) string {
+	const plain = "AEIOUaeiouAEIOUYaeiouyAEIOUaeiouANOanoAEIOUaeiouyAaCcSZsz"
+	const accented = "ÀÈÌÒÙàèìòùÁÉÍÓÚÝáéíóúýÂÊÎÔÛâêîôûÃÑÕãñõÄËÏÖÜäëïöüÿÅåÇçŠŽšž"
+	i := 0
+	for _, a := range accented {
+		if a == r {
+			return plain[i : i+1]
+		}
+		i++
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package extract
+
+import "log/slog"
+
+// unlockPDF tries the known passwords on an encrypted PDF. It reports
+// "unlocked" if one opens it, or "decrypted" if DecryptPDFs is also set, in
+// which case the decrypted document is returned; "locked" if none does; and
+// "" for PDFs that are not encrypted or cannot be read.
+func (x *Extractor) unlockPDF(data []byte, filename string, email *Email) (string, []byte) {
+	f, err := openPDF(data, x.PDFPasswords)
+	if err == errPDFEncrypted {
+		slog.Warn("No known password opens PDF", "filename", filename, "source", email.Path)
+		return "locked", data
+	}
+	if err != nil || f.crypt == nil {
+		return "", data
+	}
+	if x.DecryptPDFs {
+		return "decrypted", rewritePDF(f)
+	}
+	return "unlocked", data
+}
+
+// postProcess applies the configured transformations to a PDF about to be
+// saved. A step that fails is skipped with a warning, and the PDF saved as
+// the previous steps left it.
+func (x *Extractor) postProcess(data []byte, filename string, email *Email) []byte {
+	step := func(what string, transform func([]byte) ([]byte, error)) {
+		if out, err := transform(data); err != nil {
+			slog.Warn("Could not "+what+" PDF", "filename", filename, "source", email.Path, "error", err)
+		} else {
+			data = out
+		}
+	}
+
+	gs := x.Ghostscript
+	if gs == "" {
+		gs = "gs"
+	}
+	if x.OCR {
+		step("OCR", func(data []byte) ([]byte, error) { return ocrPDF(data, x.OCRLanguage, gs) })
+	}
+	if x.PDFA {
+		step("convert to PDF/A", func(data []byte) ([]byte, error) { return convertPDFA(gs, data) })
+		if email.raw != nil {
+			step("embed the email in", func(data []byte) ([]byte, error) { return embedSource(data, email.raw, email) })
+		}
+	}
+	if x.Metadata {
+		step("add metadata to", func(data []byte) ([]byte, error) { return addMetadata(data, email) })
+	}
+	return data
+}
@@ -0,0 +1,501 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ScanPST extracts attachments from the messages of an Outlook .pst file,
+// or an .ost file of Outlook 2010 or earlier. Every folder below the top
+// of the file is a mailbox named by its path, such as Inbox/Invoices, and
+// its messages, which are converted to MIME as they are queued, are
+// identified as PSTPATH#Inbox/Invoices/NID, NID being the number of the
+// message in the file. SkipDrafts and SeenOnly apply to the unsent and
+// read flags Outlook keeps.
+func (s *Scanner) ScanPST(pstPath string) error {
+	file, err := os.Open(pstPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	f, err := openPST(file)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", pstPath, err)
+	}
+	nodes, err := f.nodes()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", pstPath, err)
+	}
+
+	// Only the folders holding messages are mailboxes
+	folders := make(map[uint32]pstNode)
+	holding := make(map[uint32]bool)
+	for _, node := range nodes {
+		switch node.nid & 0x1F {
+		case pstNIDTypeFolder:
+			folders[node.nid] = node
+		case pstNIDTypeMessage:
+			holding[node.parent] = true
+		}
+	}
+	displayNames := make(map[uint32]string)
+	for nid, node := range folders {
+		_, props, err := f.props(node)
+		if err != nil {
+			s.logError(fmt.Errorf("reading PST folder %d: %v", nid, err))
+			continue
+		}
+		displayNames[nid] = props.string(prDisplayName)
+	}
+	names := pstFolderNames(folders, displayNames, f.ipmSubtree(nodes))
+	var mailboxes []Mailbox
+	for nid, name := range names {
+		if holding[nid] {
+			mailboxes = append(mailboxes, Mailbox{Name: name, Path: pstPath + "#" + name})
+		}
+	}
+	slices.SortFunc(mailboxes, func(a, b Mailbox) int { return strings.Compare(a.Name, b.Name) })
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+	selected := make(map[string]bool)
+	for _, mailbox := range mailboxes {
+		selected[mailbox.Name] = true
+	}
+
+	type message struct {
+		node pstNode
+		job  emailJob
+	}
+	var queue []message
+	for _, node := range nodes {
+		name, ok := names[node.parent]
+		if node.nid&0x1F != pstNIDTypeMessage || !ok || !selected[name] {
+			continue
+		}
+		job := emailJob{path: fmt.Sprintf("%s#%s/%d", pstPath, name, node.nid), mailbox: name}
+		if s.SkipDrafts || s.SeenOnly {
+			_, props, err := f.props(node)
+			if err != nil {
+				s.logError(fmt.Errorf("processing %s: %v", job.path, err))
+				continue
+			}
+			if !s.wantedPSTFlags(props.int(prMessageFlags)) {
+				continue
+			}
+		}
+		queue = append(queue, message{node: node, job: job})
+	}
+	s.queued(len(queue))
+
+	s.run(func(jobs chan<- emailJob) {
+		for _, m := range queue {
+			var b bytes.Buffer
+			if err := f.writeMessage(&b, m.node, 0); err != nil {
+				s.logError(fmt.Errorf("processing %s: %v", m.job.path, err))
+				continue
+			}
+			m.job.data = b.Bytes()
+			if !s.send(jobs, m.job) {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// MAPI properties of folders, messages and attachments
+const (
+	prDisplayName          = 0x3001
+	prIPMSubtreeEntryID    = 0x35E0
+	prMessageFlags         = 0x0E07
+	prSubject              = 0x0037
+	prClientSubmitTime     = 0x0039
+	prMessageDeliveryTime  = 0x0E06
+	prTransportHeaders     = 0x007D
+	prSenderName           = 0x0C1A
+	prSenderEmail          = 0x0C1F
+	prSenderSMTP           = 0x5D01
+	prSentRepresentingName = 0x0042
+	prSentRepresentingMail = 0x0065
+	prSentRepresentingSMTP = 0x5D02
+	prInternetMessageID    = 0x1035
+	prInReplyTo            = 0x1042
+	prReferences           = 0x1039
+	prBody                 = 0x1000
+	prHTML                 = 0x1013
+	prInternetCodepage     = 0x3FDE
+	prAttachMethod         = 0x3705
+	prAttachData           = 0x3701
+	prAttachContentID      = 0x3712
+
+	msgFlagRead   = 0x01
+	msgFlagUnsent = 0x08
+
+	attachEmbeddedMessage = 5
+
+	pstMaxDepth = 8 // of messages attached to messages
+)
+
+// wantedPSTFlags applies SkipDrafts and SeenOnly to the flags of a message.
+func (s *Scanner) wantedPSTFlags(flags int64) bool {
+	if s.SkipDrafts && flags&msgFlagUnsent != 0 {
+		return false
+	}
+	if s.SeenOnly && flags&msgFlagRead == 0 {
+		return false
+	}
+	return true
+}
+
+// ipmSubtree returns the node ID of the top folder of the file, whose
+// subfolders, such as Inbox, hold the mail, or that of the root folder if
+// the message store does not name it.
+func (f *pstFile) ipmSubtree(nodes []pstNode) uint32 {
+	for _, node := range nodes {
+		if node.nid != pstNIDMessageStore {
+			continue
+		}
+		// An EntryID of flags, the store's GUID and the folder's node ID
+		if _, props, err := f.props(node); err == nil {
+			if id := props.bytes(prIPMSubtreeEntryID); len(id) == 24 {
+				return binary.LittleEndian.Uint32(id[20:])
+			}
+		}
+	}
+	return pstNIDRootFolder
+}
+
+// pstFolderNames returns the paths of the folders below top, by node ID,
+// from their display names. Folders elsewhere, such as search results, are
+// left out.
+func pstFolderNames(folders map[uint32]pstNode, displayNames map[uint32]string, top uint32) map[uint32]string {
+	names := make(map[uint32]string)
+	for nid := range folders {
+		var path []string
+		for n := nid; n != top; n = folders[n].parent {
+			// A path longer than there are folders loops
+			name, ok := displayNames[n]
+			if !ok || len(path) == len(folders) {
+				path = nil
+				break
+			}
+			path = append(path, name)
+		}
+		if len(path) > 0 {
+			slices.Reverse(path)
+			names[nid] = strings.Join(path, "/")
+		}
+	}
+	return names
+}
+
+// writeMessage writes a message of the file as MIME: its transport headers,
+// or if it has none, such as a message that was sent, headers made from its
+// properties, followed by its text and HTML bodies, and its attachments.
+// Messages attached to it are written as message/rfc822 parts.
+func (f *pstFile) writeMessage(w io.Writer, node pstNode, depth int) error {
+	h, props, err := f.props(node)
+	if err != nil {
+		return err
+	}
+	var attachments []pstNode
+	for nid, sub := range h.sub {
+		if nid&0x1F == pstNIDTypeAttachment {
+			attachments = append(attachments, sub)
+		}
+	}
+	slices.SortFunc(attachments, func(a, b pstNode) int { return int(a.nid>>5) - int(b.nid>>5) })
+
+	var alternatives []pstEntity
+	if text := props.string(prBody); text != "" {
+		alternatives = append(alternatives, pstText("text/plain", "utf-8", []byte(text)))
+	}
+	if html := props.bytes(prHTML); len(html) > 0 {
+		alternatives = append(alternatives, pstText("text/html", pstCharset(props.int(prInternetCodepage)), html))
+	} else if html := props.string(prHTML); html != "" {
+		alternatives = append(alternatives, pstText("text/html", "utf-8", []byte(html)))
+	}
+	var body pstEntity
+	switch len(alternatives) {
+	case 0:
+		body = pstText("text/plain", "utf-8", nil)
+	case 1:
+		body = alternatives[0]
+	default:
+		body = pstMultipart("alternative", pstBoundary("alt", node.nid, depth), alternatives)
+	}
+	if len(attachments) > 0 {
+		parts := []pstEntity{body}
+		for i, node := range attachments {
+			part, ok, err := f.attachment(node, depth)
+			if err != nil {
+				return fmt.Errorf("attachment %d: %v", i+1, err)
+			}
+			if ok {
+				parts = append(parts, part)
+			}
+		}
+		body = pstMultipart("mixed", pstBoundary("mix", node.nid, depth), parts)
+	}
+
+	if _, err := io.WriteString(w, pstHeader(props)+"MIME-Version: 1.0\r\n"); err != nil {
+		return err
+	}
+	return body.write(w)
+}
+
+// attachment returns the MIME part of an attachment, or false for those
+// with no content of their own, such as links to files and OLE objects.
+func (f *pstFile) attachment(node pstNode, depth int) (pstEntity, bool, error) {
+	h, props, err := f.props(node)
+	if err != nil {
+		return pstEntity{}, false, err
+	}
+	filename := props.string(prAttachLongFilename)
+	if filename == "" {
+		filename = props.string(prAttachFilename)
+	}
+	if filename == "" {
+		filename = props.string(prDisplayName)
+	}
+	header := make(textproto.MIMEHeader)
+	disposition := "attachment"
+	if cid := props.string(prAttachContentID); cid != "" {
+		header.Set("Content-ID", "<"+strings.Trim(cid, "<>")+">")
+		disposition = "inline"
+	}
+	if filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+
+	if props.int(prAttachMethod) == attachEmbeddedMessage {
+		object := props[prAttachData]
+		if object.typ != ptObject || len(object.value) < 4 {
+			return pstEntity{}, false, errors.New("attached message not found")
+		}
+		message, ok := h.sub[binary.LittleEndian.Uint32(object.value)]
+		if !ok {
+			return pstEntity{}, false, errors.New("attached message not found")
+		}
+		if depth == pstMaxDepth {
+			return pstEntity{}, false, errors.New("messages attached too deeply")
+		}
+		header.Set("Content-Type", "message/rfc822")
+		return pstEntity{header: header, body: func(w io.Writer) error {
+			return f.writeMessage(w, message, depth+1)
+		}}, true, nil
+	}
+
+	data := props.bytes(prAttachData)
+	if data == nil {
+		return pstEntity{}, false, nil
+	}
+	mediaType := strings.ToLower(props.string(prAttachMimeTag))
+	if _, _, err := mime.ParseMediaType(mediaType); err != nil || strings.HasPrefix(mediaType, "multipart/") {
+		mediaType = "application/octet-stream"
+	}
+	if filename != "" {
+		header.Set("Content-Type", mime.FormatMediaType(mediaType, map[string]string{"name": filename}))
+	} else {
+		header.Set("Content-Type", mediaType)
+	}
+	header.Set("Content-Transfer-Encoding", "base64")
+	return pstEntity{header: header, body: func(w io.Writer) error {
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 0 {
+			n := min(len(encoded), 76)
+			if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+				return err
+			}
+			encoded = encoded[n:]
+		}
+		return nil
+	}}, true, nil
+}
+
+// pstHeader returns the header of a message, without its Content- fields.
+func pstHeader(props pstProps) string {
+	if header := pstTransportHeader(props.string(prTransportHeaders)); header != "" {
+		return header
+	}
+
+	var b strings.Builder
+	name, address := props.string(prSenderName), props.string(prSenderSMTP)
+	if address == "" {
+		address = props.string(prSentRepresentingSMTP)
+	}
+	for _, id := range []uint16{prSenderEmail, prSentRepresentingMail} {
+		// Exchange senders have X.500 addresses instead
+		if email := props.string(id); address == "" && strings.Contains(email, "@") {
+			address = email
+		}
+	}
+	if name == "" {
+		name = props.string(prSentRepresentingName)
+	}
+	switch {
+	case address != "":
+		b.WriteString("From: " + (&mail.Address{Name: name, Address: address}).String() + "\r\n")
+	case name != "":
+		b.WriteString("From: " + mime.QEncoding.Encode("utf-8", name) + "\r\n")
+	}
+	date := props.time(prClientSubmitTime)
+	if date.IsZero() {
+		date = props.time(prMessageDeliveryTime)
+	}
+	if !date.IsZero() {
+		b.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	}
+	subject := props.string(prSubject)
+	if len(subject) >= 2 && subject[0] == 0x01 {
+		// Prefixed with the length of its "RE: " for Outlook to sort by
+		subject = subject[2:]
+	}
+	if subject != "" {
+		b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	}
+	for _, field := range []struct {
+		name string
+		id   uint16
+	}{{"Message-ID", prInternetMessageID}, {"In-Reply-To", prInReplyTo}, {"References", prReferences}} {
+		if value := props.string(field.id); value != "" {
+			b.WriteString(field.name + ": " + value + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// pstTransportHeader returns the fields of a header as received, with CRLF
+// line endings, leaving out MIME-Version and the Content- fields, which
+// describe a body that is no longer there.
+func pstTransportHeader(header string) string {
+	var b strings.Builder
+	keep := false
+	for _, line := range strings.Split(strings.ReplaceAll(header, "\r\n", "\n"), "\n") {
+		if line == "" {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, ok := strings.Cut(line, ":")
+			if !ok {
+				return ""
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			keep = !strings.HasPrefix(name, "content-") && name != "mime-version"
+		}
+		if keep {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// pstCharset returns the charset of a Windows code page, as used for the
+// HTML bodies of messages, or "" for those it does not know.
+func pstCharset(codepage int64) string {
+	switch codepage {
+	case 65001:
+		return "utf-8"
+	case 1252:
+		return "windows-1252"
+	case 28591:
+		return "iso-8859-1"
+	case 28605:
+		return "iso-8859-15"
+	case 20127:
+		return "us-ascii"
+	}
+	return ""
+}
+
+// pstBoundary returns a multipart boundary for a message of the file, the
+// same on every run so the message is. "=_" cannot appear in the quoted
+// printable and base64 parts it separates.
+func pstBoundary(kind string, nid uint32, depth int) string {
+	return fmt.Sprintf("=_%s_%x_%d", kind, nid, depth)
+}
+
+// pstEntity is a MIME entity: its Content- fields and a function writing
+// its body.
+type pstEntity struct {
+	header textproto.MIMEHeader
+	body   func(w io.Writer) error
+}
+
+// write writes the entity, as the part of a message after its other
+// header fields.
+func (e pstEntity) write(w io.Writer) error {
+	var b strings.Builder
+	keys := make([]string, 0, len(e.header))
+	for key := range e.header {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		for _, value := range e.header[key] {
+			b.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	if _, err := io.WriteString(w, b.String()+"\r\n"); err != nil {
+		return err
+	}
+	return e.body(w)
+}
+
+func pstText(mediaType, charset string, data []byte) pstEntity {
+	header := make(textproto.MIMEHeader)
+	params := make(map[string]string)
+	if charset != "" {
+		params["charset"] = charset
+	}
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return pstEntity{header: header, body: func(w io.Writer) error {
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write(data); err != nil {
+			return err
+		}
+		if err := qw.Close(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\r\n")
+		return err
+	}}
+}
+
+func pstMultipart(subtype, boundary string, parts []pstEntity) pstEntity {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary}))
+	return pstEntity{header: header, body: func(w io.Writer) error {
+		mw := multipart.NewWriter(w)
+		if err := mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+		for _, part := range parts {
+			pw, err := mw.CreatePart(part.header)
+			if err != nil {
+				return err
+			}
+			if err := part.body(pw); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	}}
+}
@@ -0,0 +1,642 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// testPST builds an Outlook data file holding the nodes added to it.
+type testPST struct {
+	unicode   bool
+	crypt     byte
+	perPage   int // B-tree and subnode block entries per page; as many as fit if 0
+	blockSize int // of the blocks data is split into; 8176 if 0
+
+	blocks  []testPSTBlock
+	nodes   []pstNode
+	nextBID uint64
+	nextSub uint32
+}
+
+type testPSTBlock struct {
+	bid  uint64
+	data []byte
+}
+
+type testProp struct {
+	id, typ uint16
+	value   []byte
+}
+
+func testString(id uint16, s string) testProp {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return testProp{id, ptUnicode, b}
+}
+
+func testInt(id uint16, v uint32) testProp {
+	return testProp{id, ptInt32, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func testTime(id uint16, t time.Time) testProp {
+	return testProp{id, ptTime, binary.LittleEndian.AppendUint64(nil, uint64(t.UnixNano()/100+116444736000000000))}
+}
+
+func (p *testPST) appendID(b []byte, v uint64) []byte {
+	if p.unicode {
+		return binary.LittleEndian.AppendUint64(b, v)
+	}
+	return binary.LittleEndian.AppendUint32(b, uint32(v))
+}
+
+func (p *testPST) width() int {
+	if p.unicode {
+		return 8
+	}
+	return 4
+}
+
+// block stores a block, encrypting it if it holds data, and returns its ID.
+func (p *testPST) block(data []byte, internal bool) uint64 {
+	p.nextBID += 4
+	bid := p.nextBID
+	if internal {
+		bid |= pstInternal
+	} else if p.crypt == pstCryptPermute {
+		var encode [256]byte
+		for i, c := range pstPermute {
+			encode[c] = byte(i)
+		}
+		data = slices.Clone(data)
+		for i, c := range data {
+			data[i] = encode[c]
+		}
+	}
+	p.blocks = append(p.blocks, testPSTBlock{bid, data})
+	return bid
+}
+
+// data stores data in blocks, listed by XBLOCKs if there are several.
+func (p *testPST) data(data []byte) uint64 {
+	size := p.blockSize
+	if size == 0 {
+		size = 8176
+	}
+	var bids []uint64
+	var sizes []int
+	for first := true; first || len(data) > 0; first = false {
+		n := min(len(data), size)
+		bids = append(bids, p.block(data[:n], false))
+		sizes = append(sizes, n)
+		data = data[n:]
+	}
+	per := (size - 8) / p.width()
+	for level := 1; len(bids) > 1; level++ {
+		var upperBIDs []uint64
+		var upperSizes []int
+		for i := 0; i < len(bids); i += per {
+			end := min(i+per, len(bids))
+			total := 0
+			for _, n := range sizes[i:end] {
+				total += n
+			}
+			x := []byte{0x01, byte(level)}
+			x = binary.LittleEndian.AppendUint16(x, uint16(end-i))
+			x = binary.LittleEndian.AppendUint32(x, uint32(total))
+			for _, bid := range bids[i:end] {
+				x = p.appendID(x, bid)
+			}
+			upperBIDs = append(upperBIDs, p.block(x, true))
+			upperSizes = append(upperSizes, total)
+		}
+		bids, sizes = upperBIDs, upperSizes
+	}
+	return bids[0]
+}
+
+// subnodes stores a subnode tree, and returns the ID of its top block.
+func (p *testPST) subnodes(nodes []pstNode) uint64 {
+	if len(nodes) == 0 {
+		return 0
+	}
+	slices.SortFunc(nodes, func(a, b pstNode) int { return int(a.nid) - int(b.nid) })
+	header := func(level, count int) []byte {
+		b := []byte{0x02, byte(level)}
+		b = binary.LittleEndian.AppendUint16(b, uint16(count))
+		if p.unicode {
+			b = append(b, 0, 0, 0, 0)
+		}
+		return b
+	}
+	per := len(nodes)
+	if p.perPage > 0 {
+		per = p.perPage
+	}
+	var leaves []uint64
+	var firsts []uint32
+	for i := 0; i < len(nodes); i += per {
+		chunk := nodes[i:min(i+per, len(nodes))]
+		b := header(0, len(chunk))
+		for _, node := range chunk {
+			b = p.appendID(b, uint64(node.nid))
+			b = p.appendID(b, node.data)
+			b = p.appendID(b, node.sub)
+		}
+		leaves = append(leaves, p.block(b, true))
+		firsts = append(firsts, chunk[0].nid)
+	}
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	b := header(1, len(leaves))
+	for i, bid := range leaves {
+		b = p.appendID(b, uint64(firsts[i]))
+		b = p.appendID(b, bid)
+	}
+	return p.block(b, true)
+}
+
+// node stores a property context, and returns its node, with children in
+// its subnode tree as well as the values too large for its heap.
+func (p *testPST) node(nid, parent uint32, props []testProp, children ...pstNode) pstNode {
+	sub := slices.Clone(children)
+	allocs := [][]byte{nil, nil} // the B-tree header and its records
+	slices.SortFunc(props, func(a, b testProp) int { return int(a.id) - int(b.id) })
+	var records []byte
+	for _, prop := range props {
+		var hnid uint32
+		switch {
+		case prop.typ == ptInt32 || prop.typ == ptBoolean:
+			hnid = binary.LittleEndian.Uint32(append(slices.Clone(prop.value), 0, 0, 0, 0))
+		case len(prop.value) == 0:
+		case len(prop.value) <= 256:
+			allocs = append(allocs, prop.value)
+			hnid = uint32(len(allocs)) << 5
+		default:
+			p.nextSub++
+			hnid = p.nextSub<<5 | 0x1F
+			sub = append(sub, pstNode{nid: hnid, data: p.data(prop.value)})
+		}
+		records = binary.LittleEndian.AppendUint16(records, prop.id)
+		records = binary.LittleEndian.AppendUint16(records, prop.typ)
+		records = binary.LittleEndian.AppendUint32(records, hnid)
+	}
+	allocs[0] = []byte{0xB5, 2, 6, 0}
+	if len(records) > 0 {
+		allocs[0] = binary.LittleEndian.AppendUint32(allocs[0], 2<<5)
+	} else {
+		allocs[0] = binary.LittleEndian.AppendUint32(allocs[0], 0)
+	}
+	allocs[1] = records
+
+	page := make([]byte, 12)
+	page[2], page[3] = 0xEC, 0xBC
+	binary.LittleEndian.PutUint32(page[4:], 1<<5)
+	offsets := []uint16{12}
+	for _, a := range allocs {
+		page = append(page, a...)
+		offsets = append(offsets, uint16(len(page)))
+	}
+	if len(page)%2 == 1 {
+		page = append(page, 0)
+	}
+	binary.LittleEndian.PutUint16(page, uint16(len(page)))
+	page = binary.LittleEndian.AppendUint16(page, uint16(len(allocs)))
+	page = binary.LittleEndian.AppendUint16(page, 0)
+	for _, offset := range offsets {
+		page = binary.LittleEndian.AppendUint16(page, offset)
+	}
+	return pstNode{nid: nid, parent: parent, data: p.block(page, false), sub: p.subnodes(sub)}
+}
+
+// add stores a node in the node B-tree.
+func (p *testPST) add(nid, parent uint32, props []testProp, children ...pstNode) {
+	p.nodes = append(p.nodes, p.node(nid, parent, props, children...))
+}
+
+// btree appends the pages of a B-tree of entries of size bytes, sorted by
+// key, to out, and returns the offset of its root page.
+func (p *testPST) btree(out *[]byte, ptype byte, keys []uint64, entries [][]byte, size int) int64 {
+	area, trailer := 488, 496
+	if !p.unicode {
+		area, trailer = 496, 500
+	}
+	for level := 0; ; level++ {
+		per := area / size
+		if p.perPage > 0 {
+			per = min(per, p.perPage)
+		}
+		var upperKeys []uint64
+		var upper [][]byte
+		for i := 0; i == 0 || i < len(entries); i += per {
+			chunk := entries[i:min(i+per, len(entries))]
+			page := make([]byte, pstPageSize)
+			for j, e := range chunk {
+				copy(page[j*size:], e)
+			}
+			page[area], page[area+1], page[area+2], page[area+3] = byte(len(chunk)), byte(per), byte(size), byte(level)
+			page[trailer], page[trailer+1] = ptype, ptype
+			for len(*out)%pstPageSize != 0 {
+				*out = append(*out, 0)
+			}
+			offset := len(*out)
+			*out = append(*out, page...)
+			if len(entries) <= per {
+				return int64(offset)
+			}
+			key := keys[i]
+			upperKeys = append(upperKeys, key)
+			upper = append(upper, p.appendID(p.appendID(p.appendID(nil, key), 0), uint64(offset)))
+		}
+		keys, entries, size = upperKeys, upper, 3*p.width()
+	}
+}
+
+func (p *testPST) bytes() []byte {
+	w := p.width()
+	headerSize := 564
+	if !p.unicode {
+		headerSize = 512
+	}
+	out := make([]byte, headerSize)
+
+	slices.SortFunc(p.blocks, func(a, b testPSTBlock) int { return int(a.bid) - int(b.bid) })
+	var bbtKeys []uint64
+	var bbt [][]byte
+	for _, block := range p.blocks {
+		for len(out)%64 != 0 {
+			out = append(out, 0)
+		}
+		e := p.appendID(p.appendID(nil, block.bid), uint64(len(out)))
+		e = binary.LittleEndian.AppendUint16(e, uint16(len(block.data)))
+		e = binary.LittleEndian.AppendUint16(e, 1)
+		if p.unicode {
+			e = append(e, 0, 0, 0, 0)
+		}
+		bbtKeys = append(bbtKeys, block.bid)
+		bbt = append(bbt, e)
+		out = append(out, block.data...)
+		out = append(out, make([]byte, 2*w)...) // the block trailer
+	}
+
+	slices.SortFunc(p.nodes, func(a, b pstNode) int { return int(a.nid) - int(b.nid) })
+	var nbtKeys []uint64
+	var nbt [][]byte
+	for _, node := range p.nodes {
+		e := p.appendID(p.appendID(p.appendID(nil, uint64(node.nid)), node.data), node.sub)
+		e = binary.LittleEndian.AppendUint32(e, node.parent)
+		if p.unicode {
+			e = append(e, 0, 0, 0, 0)
+		}
+		nbtKeys = append(nbtKeys, uint64(node.nid))
+		nbt = append(nbt, e)
+	}
+
+	bbtRoot := p.btree(&out, pstBTreeBBT, bbtKeys, bbt, len(bbt[0]))
+	nbtRoot := p.btree(&out, pstBTreeNBT, nbtKeys, nbt, len(nbt[0]))
+
+	copy(out, "!BDN")
+	copy(out[8:], "SM")
+	binary.LittleEndian.PutUint16(out[12:], 19)
+	if p.unicode {
+		binary.LittleEndian.PutUint16(out[10:], 23)
+		binary.LittleEndian.PutUint64(out[224:], uint64(nbtRoot))
+		binary.LittleEndian.PutUint64(out[240:], uint64(bbtRoot))
+		out[513] = p.crypt
+	} else {
+		binary.LittleEndian.PutUint16(out[10:], 14)
+		binary.LittleEndian.PutUint32(out[188:], uint32(nbtRoot))
+		binary.LittleEndian.PutUint32(out[196:], uint32(bbtRoot))
+		out[461] = p.crypt
+	}
+	return out
+}
+
+// The node IDs of the folders and messages of testPSTFile
+const (
+	testNIDTop      = 0x8022
+	testNIDInbox    = 0x8042
+	testNIDInvoices = 0x8062
+	testNIDEmpty    = 0x8082
+	testNIDSearch   = 0x80A2
+
+	testNIDStatement = 0x200004 // in Inbox, read, with transport headers
+	testNIDInvoice   = 0x200024 // in Inbox/Invoices, unread, with an attached message
+	testNIDDraft     = 0x200044 // in Inbox, unsent
+	testNIDFound     = 0x200064 // in a search folder
+)
+
+var (
+	testStatementPDF = []byte("%PDF-1.4\n" + strings.Repeat("statement line\n", 1500) + "%%EOF\n")
+	testInvoicePDF   = []byte("%PDF-1.4\ninvoice\n%%EOF\n")
+	testInnerPDF     = []byte("%PDF-1.4\nquoted\n%%EOF\n")
+)
+
+// testPSTFile returns a file of Top of Outlook data file, the folder of
+// its mail, holding Inbox, Inbox/Invoices and Empty, and of a search folder
+// outside it, with the messages above.
+func testPSTFile(p *testPST) []byte {
+	ipm := make([]byte, 20)
+	ipm = binary.LittleEndian.AppendUint32(ipm, testNIDTop)
+	p.add(pstNIDMessageStore, 0, []testProp{{prIPMSubtreeEntryID, ptBinary, ipm}})
+	p.add(pstNIDRootFolder, pstNIDRootFolder, []testProp{testString(prDisplayName, "")})
+	p.add(testNIDTop, pstNIDRootFolder, []testProp{testString(prDisplayName, "Top of Outlook data file")})
+	p.add(testNIDInbox, testNIDTop, []testProp{testString(prDisplayName, "Inbox")})
+	p.add(testNIDInvoices, testNIDInbox, []testProp{testString(prDisplayName, "Invoices")})
+	p.add(testNIDEmpty, testNIDTop, []testProp{testString(prDisplayName, "Empty")})
+	p.add(testNIDSearch, pstNIDRootFolder, []testProp{testString(prDisplayName, "Finder")})
+
+	attachment := func(nid uint32, filename, mediaType string, data []byte, more ...testProp) pstNode {
+		props := append([]testProp{
+			testInt(prAttachMethod, 1),
+			testString(prAttachLongFilename, filename),
+			testString(prAttachMimeTag, mediaType),
+			{prAttachData, ptBinary, data},
+		}, more...)
+		return p.node(nid, 0, props)
+	}
+
+	p.add(testNIDStatement, testNIDInbox, []testProp{
+		testString(prTransportHeaders, "Received: from mx.example.com\r\n\tby mail.example.org; Fri, 1 Mar 2024 09:00:00 +0000\r\n"+
+			"From: Alice <alice@example.com>\r\nSubject: Statement\r\nMIME-Version: 1.0\r\n"+
+			"Content-Type: multipart/mixed;\r\n\tboundary=\"gone\"\r\nDate: Fri, 1 Mar 2024 09:00:00 +0000\r\n\r\n"),
+		testString(prBody, "See attached.\r\n"),
+		testInt(prMessageFlags, msgFlagRead),
+	}, attachment(0x25, "statement.pdf", "application/pdf", testStatementPDF))
+
+	inner := p.node(0x41, 0, []testProp{
+		testString(prSubject, "Original"),
+		testString(prBody, "The original."),
+	}, attachment(0x45, "quoted.pdf", "application/pdf", testInnerPDF))
+	embedded := binary.LittleEndian.AppendUint32(nil, inner.nid)
+	embedded = binary.LittleEndian.AppendUint32(embedded, 0)
+	p.add(testNIDInvoice, testNIDInvoices, []testProp{
+		testString(prSubject, "\x01\x04RE: Invoice 42 – März"),
+		testString(prSenderName, "Bob Example"),
+		testString(prSenderEmail, "/O=EXAMPLE/OU=EXCHANGE/CN=BOB"),
+		testString(prSenderSMTP, "bob@example.com"),
+		testTime(prClientSubmitTime, time.Date(2024, 3, 2, 10, 30, 0, 0, time.UTC)),
+		testString(prInternetMessageID, "<42@example.com>"),
+		{prHTML, ptBinary, []byte("<p>Invoice attached</p>")},
+		testInt(prInternetCodepage, 65001),
+	},
+		attachment(0x25, "invoice.pdf", "application/pdf", testInvoicePDF, testString(prAttachContentID, "inv@1")),
+		p.node(0x45, 0, []testProp{
+			testInt(prAttachMethod, attachEmbeddedMessage),
+			testString(prDisplayName, "Original"),
+			{prAttachData, ptObject, embedded},
+		}, inner),
+		attachment(0x65, "", "", nil),
+	)
+
+	p.add(testNIDDraft, testNIDInbox, []testProp{
+		testString(prSubject, "Draft"),
+		testInt(prMessageFlags, msgFlagRead|msgFlagUnsent),
+	}, attachment(0x25, "draft.pdf", "application/pdf", testInvoicePDF))
+	p.add(testNIDFound, testNIDSearch, []testProp{testString(prSubject, "Found")},
+		attachment(0x25, "found.pdf", "application/pdf", testInvoicePDF))
+	return p.bytes()
+}
+
+func TestScanPST(t *testing.T) {
+	all := map[string]string{
+		"Inbox/" + fmt.Sprint(testNIDStatement):        "statement.pdf",
+		"Inbox/Invoices/" + fmt.Sprint(testNIDInvoice): "invoice.pdf",
+		"Inbox/" + fmt.Sprint(testNIDDraft):            "draft.pdf",
+	}
+	tests := []struct {
+		name    string
+		pst     testPST
+		scanner Scanner
+		want    map[string]string // filenames by message, below the file
+	}{
+		{name: "unicode", pst: testPST{unicode: true}, want: all},
+		{name: "unicode encrypted", pst: testPST{unicode: true, crypt: pstCryptPermute}, want: all},
+		{name: "ansi encrypted", pst: testPST{crypt: pstCryptPermute}, want: all},
+		{name: "unicode small pages", pst: testPST{unicode: true, perPage: 2, blockSize: 200}, want: all},
+		{name: "ansi small pages", pst: testPST{perPage: 2, blockSize: 100}, want: all},
+		{
+			name:    "seen only",
+			pst:     testPST{unicode: true},
+			scanner: Scanner{SeenOnly: true},
+			want: map[string]string{
+				"Inbox/" + fmt.Sprint(testNIDStatement): "statement.pdf",
+				"Inbox/" + fmt.Sprint(testNIDDraft):     "draft.pdf",
+			},
+		},
+		{
+			name:    "skip drafts",
+			pst:     testPST{unicode: true},
+			scanner: Scanner{SkipDrafts: true, ExcludeMailboxes: []string{"Inbox/Invoices"}},
+			want:    map[string]string{"Inbox/" + fmt.Sprint(testNIDStatement): "statement.pdf"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pstPath := filepath.Join(t.TempDir(), "archive.pst")
+			if err := os.WriteFile(pstPath, testPSTFile(&tt.pst), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			got := make(map[string]string)
+			var mailboxes []string
+			x := NewExtractor(t.TempDir())
+			x.Handler = func(a *Attachment, content io.Reader) error {
+				data, err := io.ReadAll(content)
+				if err != nil {
+					return err
+				}
+				want := testInvoicePDF
+				if a.Filename == "statement.pdf" {
+					want = testStatementPDF
+				}
+				if !bytes.Equal(data, want) {
+					t.Errorf("%s: got content %q", a.Filename, data)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				got[strings.TrimPrefix(a.Email.Path, pstPath+"#")] = a.Filename
+				return nil
+			}
+			s := tt.scanner
+			s.Extractor, s.Workers = x, 2
+			s.OnMailbox = func(m Mailbox) { mailboxes = append(mailboxes, m.Name) }
+			s.OnError = func(err error) { t.Error(err) }
+			if err := s.ScanPST(pstPath); err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got attachments %v, want %v", got, tt.want)
+			}
+			wantMailboxes := []string{"Inbox", "Inbox/Invoices"}
+			if tt.scanner.ExcludeMailboxes != nil {
+				wantMailboxes = wantMailboxes[:1]
+			}
+			if !slices.Equal(mailboxes, wantMailboxes) {
+				t.Errorf("got mailboxes %q, want %q", mailboxes, wantMailboxes)
+			}
+		})
+	}
+}
+
+// testPSTMessage returns a message of testPSTFile as written by ScanPST.
+func testPSTMessage(t *testing.T, nid uint32) *mail.Message {
+	t.Helper()
+	f, err := openPST(bytes.NewReader(testPSTFile(&testPST{unicode: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := f.nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(nodes, func(n pstNode) bool { return n.nid == nid })
+	var b bytes.Buffer
+	if err := f.writeMessage(&b, nodes[i], 0); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// testParts returns the media types and filenames of the parts of a
+// multipart body, with the body of the last one.
+func testParts(t *testing.T, contentType string, body io.Reader) ([]string, []byte) {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	var last []byte
+	r := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return parts, last
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts = append(parts, strings.TrimSuffix(mediaType+" "+part.FileName(), " "))
+		if last, err = io.ReadAll(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPSTMessage(t *testing.T) {
+	t.Run("transport headers", func(t *testing.T) {
+		msg := testPSTMessage(t, testNIDStatement)
+		if got := msg.Header.Get("Received"); got != "from mx.example.com by mail.example.org; Fri, 1 Mar 2024 09:00:00 +0000" {
+			t.Errorf("got Received %q", got)
+		}
+		if got := msg.Header.Get("Subject"); got != "Statement" {
+			t.Errorf("got Subject %q", got)
+		}
+		if got := msg.Header["Mime-Version"]; len(got) != 1 {
+			t.Errorf("got MIME-Version %q, want one", got)
+		}
+		parts, _ := testParts(t, msg.Header.Get("Content-Type"), msg.Body)
+		if want := []string{"text/plain", "application/pdf statement.pdf"}; !slices.Equal(parts, want) {
+			t.Errorf("got parts %q, want %q", parts, want)
+		}
+	})
+
+	t.Run("properties", func(t *testing.T) {
+		msg := testPSTMessage(t, testNIDInvoice)
+		from, err := msg.Header.AddressList("From")
+		if err != nil || len(from) != 1 || from[0].Name != "Bob Example" || from[0].Address != "bob@example.com" {
+			t.Errorf("got From %v, %v", from, err)
+		}
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil || subject != "RE: Invoice 42 – März" {
+			t.Errorf("got Subject %q, %v", subject, err)
+		}
+		date, err := msg.Header.Date()
+		if err != nil || !date.Equal(time.Date(2024, 3, 2, 10, 30, 0, 0, time.UTC)) {
+			t.Errorf("got Date %v, %v", date, err)
+		}
+		if got := msg.Header.Get("Message-ID"); got != "<42@example.com>" {
+			t.Errorf("got Message-ID %q", got)
+		}
+		parts, attached := testParts(t, msg.Header.Get("Content-Type"), msg.Body)
+		if want := []string{"text/html", "application/pdf invoice.pdf", "message/rfc822 Original"}; !slices.Equal(parts, want) {
+			t.Errorf("got parts %q, want %q", parts, want)
+		}
+
+		inner, err := mail.ReadMessage(bytes.NewReader(attached))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := inner.Header.Get("Subject"); got != "Original" {
+			t.Errorf("got attached Subject %q", got)
+		}
+		parts, last := testParts(t, inner.Header.Get("Content-Type"), inner.Body)
+		if want := []string{"text/plain", "application/pdf quoted.pdf"}; !slices.Equal(parts, want) {
+			t.Errorf("got attached parts %q, want %q", parts, want)
+		}
+		if want := "JVBERi0xLjQKcXVvdGVkCiUlRU9GCg==\r\n"; string(last) != want {
+			t.Errorf("got attached content %q, want %q", last, want)
+		}
+	})
+}
+
+func TestOpenPST(t *testing.T) {
+	valid := testPSTFile(&testPST{unicode: true})
+	with := func(offset int, value byte) []byte {
+		b := slices.Clone(valid)
+		b[offset] = value
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{name: "short", data: []byte("!BDN"), err: "not a PST file"},
+		{name: "not a PST", data: make([]byte, 1024), err: "not a PST file"},
+		{name: "4K pages", data: with(10, 36), err: "PST files with 4K pages are not supported"},
+		{name: "unknown version", data: with(10, 5), err: "unknown PST version 5"},
+		{name: "cyclic encryption", data: with(513, 2), err: "PST encryption 2 is not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := openPST(bytes.NewReader(tt.data))
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	// The root of the node B-tree pointing at the block B-tree
+	f, err := openPST(bytes.NewReader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.nbt = f.bbt
+	if _, err := f.nodes(); err == nil || !strings.HasPrefix(err.Error(), "invalid B-tree page") {
+		t.Errorf("got error %v, want an invalid page", err)
+	}
+}
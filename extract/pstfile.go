@@ -0,0 +1,562 @@
+package extract
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Outlook data files are read as described in [MS-PST]: the node database
+// layer, of B-trees of nodes and blocks, and above it the heap, B-tree and
+// property context structures of the lists, tables and properties layer.
+// Only what is needed to recover folders, messages and attachments is
+// decoded; cyclic encryption and the 4K pages of Outlook 2013 OST files are
+// not supported.
+
+const (
+	pstPageSize  = 512
+	pstBTreeBBT  = 0x80 // page type of the block B-tree
+	pstBTreeNBT  = 0x81 // and of the node B-tree
+	pstInternal  = 0x02 // block ID bit of blocks holding other blocks' IDs
+	pstMaxData   = 1 << 30
+	pstMaxLevels = 8 // deeper heap B-trees are taken to be damaged
+
+	pstCryptNone    = 0
+	pstCryptPermute = 1
+)
+
+// Node IDs and types
+const (
+	pstNIDMessageStore = 0x21
+	pstNIDRootFolder   = 0x122
+
+	pstNIDTypeFolder     = 0x02
+	pstNIDTypeMessage    = 0x04
+	pstNIDTypeAttachment = 0x05
+)
+
+// pstFile is an open Outlook data file, in the ANSI format of Outlook 97 to
+// 2002 or the Unicode one of later versions.
+type pstFile struct {
+	r       io.ReaderAt
+	unicode bool
+	crypt   byte
+	nbt     int64 // offset of the root page of the node B-tree
+	bbt     int64 // and of the block B-tree
+}
+
+// pstNode is an entry of the node B-tree, or of a node's subnode tree.
+type pstNode struct {
+	nid    uint32
+	parent uint32 // the folder of a folder or message, in the node B-tree
+	data   uint64 // block IDs of its data
+	sub    uint64 // and of its subnode tree
+}
+
+func openPST(r io.ReaderAt) (*pstFile, error) {
+	header := make([]byte, 564)
+	n, err := r.ReadAt(header, 0)
+	if n < pstPageSize {
+		if err == nil || err == io.EOF {
+			err = errors.New("not a PST file")
+		}
+		return nil, err
+	}
+	if string(header[:4]) != "!BDN" {
+		return nil, errors.New("not a PST file")
+	}
+
+	f := &pstFile{r: r}
+	switch version := binary.LittleEndian.Uint16(header[10:]); {
+	case version == 14 || version == 15:
+		f.nbt = int64(binary.LittleEndian.Uint32(header[188:]))
+		f.bbt = int64(binary.LittleEndian.Uint32(header[196:]))
+		f.crypt = header[461]
+	case version >= 23 && n == len(header):
+		if version >= 36 {
+			return nil, errors.New("PST files with 4K pages are not supported")
+		}
+		f.unicode = true
+		f.nbt = int64(binary.LittleEndian.Uint64(header[224:]))
+		f.bbt = int64(binary.LittleEndian.Uint64(header[240:]))
+		f.crypt = header[513]
+	default:
+		return nil, fmt.Errorf("unknown PST version %d", version)
+	}
+	if f.crypt != pstCryptNone && f.crypt != pstCryptPermute {
+		return nil, fmt.Errorf("PST encryption %d is not supported", f.crypt)
+	}
+	return f, nil
+}
+
+// width is the size of block IDs, node IDs in B-trees and file offsets.
+func (f *pstFile) width() int {
+	if f.unicode {
+		return 8
+	}
+	return 4
+}
+
+// id reads a block ID, node ID or file offset.
+func (f *pstFile) id(b []byte) uint64 {
+	if f.unicode {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return uint64(binary.LittleEndian.Uint32(b))
+}
+
+// page reads the entries of a B-tree page of type ptype, and its level,
+// 0 for a leaf.
+func (f *pstFile) page(offset int64, ptype byte) ([][]byte, int, error) {
+	buf := make([]byte, pstPageSize)
+	if _, err := f.r.ReadAt(buf, offset); err != nil {
+		return nil, 0, fmt.Errorf("reading B-tree page at %d: %v", offset, err)
+	}
+	area, trailer := 488, 496
+	if !f.unicode {
+		area, trailer = 496, 500
+	}
+	count, size, level := int(buf[area]), int(buf[area+2]), int(buf[area+3])
+	w := f.width()
+	need := 3 * w // key and reference to the page below
+	if level == 0 && ptype == pstBTreeNBT {
+		need = 3*w + 4
+	} else if level == 0 {
+		need = 2*w + 2
+	}
+	if buf[trailer] != ptype || size < need || count*size > area {
+		return nil, 0, fmt.Errorf("invalid B-tree page at %d", offset)
+	}
+	entries := make([][]byte, count)
+	for i := range entries {
+		entries[i] = buf[i*size : (i+1)*size]
+	}
+	return entries, level, nil
+}
+
+// nodes returns every entry of the node B-tree, in order of node ID.
+func (f *pstFile) nodes() ([]pstNode, error) {
+	var nodes []pstNode
+	err := f.walkNodes(f.nbt, -1, func(node pstNode) {
+		nodes = append(nodes, node)
+	})
+	return nodes, err
+}
+
+// walkNodes calls fn with the entries below the node B-tree page at offset,
+// which must be at level if that is not -1.
+func (f *pstFile) walkNodes(offset int64, level int, fn func(node pstNode)) error {
+	entries, got, err := f.page(offset, pstBTreeNBT)
+	if err != nil {
+		return err
+	}
+	if level >= 0 && got != level {
+		return fmt.Errorf("invalid node B-tree page at %d", offset)
+	}
+	w := f.width()
+	for _, e := range entries {
+		if got > 0 {
+			if err := f.walkNodes(int64(f.id(e[2*w:])), got-1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		fn(pstNode{
+			nid:    uint32(f.id(e)),
+			data:   f.id(e[w:]),
+			sub:    f.id(e[2*w:]),
+			parent: binary.LittleEndian.Uint32(e[3*w:]),
+		})
+	}
+	return nil
+}
+
+// lookup returns the offset and size of a block, from the block B-tree.
+func (f *pstFile) lookup(bid uint64) (int64, int, error) {
+	bid &^= 1
+	offset, level := f.bbt, -1
+	for {
+		entries, got, err := f.page(offset, pstBTreeBBT)
+		if err != nil {
+			return 0, 0, err
+		}
+		if level >= 0 && got != level-1 {
+			return 0, 0, fmt.Errorf("invalid block B-tree page at %d", offset)
+		}
+		level = got
+		w := f.width()
+		if level == 0 {
+			for _, e := range entries {
+				if f.id(e)&^1 == bid {
+					return int64(f.id(e[w:])), int(binary.LittleEndian.Uint16(e[2*w:])), nil
+				}
+			}
+			return 0, 0, fmt.Errorf("block %#x not found", bid)
+		}
+		next := -1
+		for i, e := range entries {
+			if f.id(e)&^1 > bid {
+				break
+			}
+			next = i
+		}
+		if next < 0 {
+			return 0, 0, fmt.Errorf("block %#x not found", bid)
+		}
+		offset = int64(f.id(entries[next][2*w:]))
+	}
+}
+
+// block reads a block, decrypting it if it holds data.
+func (f *pstFile) block(bid uint64) ([]byte, error) {
+	offset, size, err := f.lookup(bid)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := f.r.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("reading block %#x: %v", bid, err)
+	}
+	if bid&pstInternal == 0 && f.crypt == pstCryptPermute {
+		for i, c := range data {
+			data[i] = pstPermute[c]
+		}
+	}
+	return data, nil
+}
+
+// blocks returns the data blocks of a node, which are listed by an XBLOCK,
+// or an XXBLOCK of XBLOCKs, if there is more than one.
+func (f *pstFile) blocks(bid uint64) ([][]byte, error) {
+	if bid == 0 {
+		return nil, nil
+	}
+	var blocks [][]byte
+	var total int
+	var add func(bid uint64, levels int) error
+	add = func(bid uint64, levels int) error {
+		b, err := f.block(bid)
+		if err != nil {
+			return err
+		}
+		if bid&pstInternal == 0 {
+			if total += len(b); total > pstMaxData {
+				return errors.New("node data too large")
+			}
+			blocks = append(blocks, b)
+			return nil
+		}
+		w := f.width()
+		if len(b) < 8 || b[0] != 0x01 || b[1] == 0 || int(b[1]) > levels {
+			return fmt.Errorf("invalid data tree block %#x", bid)
+		}
+		level, count := int(b[1]), int(binary.LittleEndian.Uint16(b[2:]))
+		if 8+count*w > len(b) {
+			return fmt.Errorf("invalid data tree block %#x", bid)
+		}
+		for i := 0; i < count; i++ {
+			if err := add(f.id(b[8+i*w:]), level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return blocks, add(bid, 2)
+}
+
+// data returns the data of a node.
+func (f *pstFile) data(bid uint64) ([]byte, error) {
+	blocks, err := f.blocks(bid)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 1 {
+		return blocks[0], nil
+	}
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// subnodes returns the entries of a node's subnode tree, by node ID.
+func (f *pstFile) subnodes(bid uint64) (map[uint32]pstNode, error) {
+	nodes := make(map[uint32]pstNode)
+	if bid == 0 {
+		return nodes, nil
+	}
+	var add func(bid uint64, levels int) error
+	add = func(bid uint64, levels int) error {
+		b, err := f.block(bid)
+		if err != nil {
+			return err
+		}
+		if bid&pstInternal == 0 || len(b) < 4 || b[0] != 0x02 || int(b[1]) > levels {
+			return fmt.Errorf("invalid subnode block %#x", bid)
+		}
+		w := f.width()
+		start, size := 4, 3*w
+		if f.unicode {
+			start = 8
+		}
+		level, count := int(b[1]), int(binary.LittleEndian.Uint16(b[2:]))
+		if level > 0 {
+			size = 2 * w
+		}
+		if start+count*size > len(b) {
+			return fmt.Errorf("invalid subnode block %#x", bid)
+		}
+		for i := 0; i < count; i++ {
+			e := b[start+i*size:]
+			if level > 0 {
+				if err := add(f.id(e[w:]), level-1); err != nil {
+					return err
+				}
+				continue
+			}
+			nid := uint32(f.id(e))
+			nodes[nid] = pstNode{nid: nid, data: f.id(e[w:]), sub: f.id(e[2*w:])}
+		}
+		return nil
+	}
+	return nodes, add(bid, 1)
+}
+
+// pstHeap is the heap a node's data holds, one page per data block, with
+// its subnodes, which hold the values too large for it.
+type pstHeap struct {
+	f      *pstFile
+	pages  [][]byte
+	sub    map[uint32]pstNode
+	client byte   // 0xBC for a property context
+	root   uint32 // heap ID of the client's data
+}
+
+func (f *pstFile) heap(node pstNode) (*pstHeap, error) {
+	pages, err := f.blocks(node.data)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 || len(pages[0]) < 12 || pages[0][2] != 0xEC {
+		return nil, fmt.Errorf("node %#x holds no heap", node.nid)
+	}
+	sub, err := f.subnodes(node.sub)
+	if err != nil {
+		return nil, err
+	}
+	return &pstHeap{
+		f:      f,
+		pages:  pages,
+		sub:    sub,
+		client: pages[0][3],
+		root:   binary.LittleEndian.Uint32(pages[0][4:]),
+	}, nil
+}
+
+// alloc returns an allocation of the heap, by its heap ID: the page it is
+// on and its 1-based index in the page map at the end of that page.
+func (h *pstHeap) alloc(hid uint32) ([]byte, error) {
+	index, block := int(hid>>5&0x7FF), int(hid>>16)
+	if hid&0x1F != 0 || index == 0 || block >= len(h.pages) {
+		return nil, fmt.Errorf("invalid heap ID %#x", hid)
+	}
+	page := h.pages[block]
+	if len(page) < 2 {
+		return nil, fmt.Errorf("invalid heap ID %#x", hid)
+	}
+	m := int(binary.LittleEndian.Uint16(page))
+	if m+4 > len(page) || index > int(binary.LittleEndian.Uint16(page[m:])) || m+6+2*index > len(page) {
+		return nil, fmt.Errorf("invalid heap ID %#x", hid)
+	}
+	start := int(binary.LittleEndian.Uint16(page[m+2+2*index:]))
+	end := int(binary.LittleEndian.Uint16(page[m+4+2*index:]))
+	if start > end || end > len(page) {
+		return nil, fmt.Errorf("invalid heap ID %#x", hid)
+	}
+	return page[start:end], nil
+}
+
+// records calls fn with the key and data of every record of the B-tree on
+// the heap whose header is at hid, stopping at the first error.
+func (h *pstHeap) records(hid uint32, fn func(key, data []byte) error) error {
+	header, err := h.alloc(hid)
+	if err != nil {
+		return err
+	}
+	if len(header) < 8 || header[0] != 0xB5 || header[1] == 0 || header[3] > pstMaxLevels {
+		return errors.New("invalid B-tree on heap")
+	}
+	keySize, dataSize := int(header[1]), int(header[2])
+	var walk func(hid uint32, level int) error
+	walk = func(hid uint32, level int) error {
+		b, err := h.alloc(hid)
+		if err != nil {
+			return err
+		}
+		size := keySize + dataSize
+		if level > 0 {
+			size = keySize + 4
+		}
+		for i := 0; i+size <= len(b); i += size {
+			if level > 0 {
+				err = walk(binary.LittleEndian.Uint32(b[i+keySize:]), level-1)
+			} else {
+				err = fn(b[i:i+keySize], b[i+keySize:i+size])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if root := binary.LittleEndian.Uint32(header[4:]); root != 0 {
+		return walk(root, int(header[3]))
+	}
+	return nil
+}
+
+// MAPI property types
+const (
+	ptInt16   = 0x0002
+	ptInt32   = 0x0003
+	ptFloat   = 0x0004
+	ptError   = 0x000A
+	ptBoolean = 0x000B
+	ptInt64   = 0x0014
+	ptTime    = 0x0040
+)
+
+type pstProp struct {
+	typ   uint16
+	value []byte
+}
+
+// pstProps are the properties of a folder, message or attachment, by ID.
+type pstProps map[uint16]pstProp
+
+// props reads the property context of the heap.
+func (h *pstHeap) props() (pstProps, error) {
+	if h.client != 0xBC {
+		return nil, errors.New("not a property context")
+	}
+	props := make(pstProps)
+	err := h.records(h.root, func(key, data []byte) error {
+		if len(key) != 2 || len(data) != 6 {
+			return errors.New("invalid property context")
+		}
+		id, typ := binary.LittleEndian.Uint16(key), binary.LittleEndian.Uint16(data)
+		hnid := binary.LittleEndian.Uint32(data[2:])
+		var value []byte
+		var err error
+		switch {
+		case typ == ptInt16 || typ == ptInt32 || typ == ptFloat || typ == ptError || typ == ptBoolean:
+			value = data[2:6]
+		case hnid == 0:
+		case hnid&0x1F == 0:
+			value, err = h.alloc(hnid)
+		default:
+			node, ok := h.sub[hnid]
+			if !ok {
+				return fmt.Errorf("property %#04x: subnode %#x not found", id, hnid)
+			}
+			value, err = h.f.data(node.data)
+		}
+		if err != nil {
+			return fmt.Errorf("property %#04x: %v", id, err)
+		}
+		props[id] = pstProp{typ: typ, value: value}
+		return nil
+	})
+	return props, err
+}
+
+// props reads the property context of a node.
+func (f *pstFile) props(node pstNode) (*pstHeap, pstProps, error) {
+	h, err := f.heap(node)
+	if err != nil {
+		return nil, nil, err
+	}
+	props, err := h.props()
+	return h, props, err
+}
+
+// string returns a string property, or "" if it is missing. 8-bit strings
+// are taken as UTF-8 if they are valid, else as Windows-1252.
+func (p pstProps) string(id uint16) string {
+	prop := p[id]
+	switch prop.typ {
+	case ptUnicode:
+		return tnefString(ptUnicode, prop.value)
+	case ptString8:
+		if utf8.Valid(prop.value) {
+			return tnefString(ptString8, prop.value)
+		}
+		return tnefString(ptString8, []byte(mapBytes(prop.value, &windows1252, nil)))
+	}
+	return ""
+}
+
+// bytes returns a binary property, or nil if it is missing.
+func (p pstProps) bytes(id uint16) []byte {
+	if prop := p[id]; prop.typ == ptBinary {
+		return prop.value
+	}
+	return nil
+}
+
+// int returns an integer or boolean property, or 0 if it is missing.
+func (p pstProps) int(id uint16) int64 {
+	prop := p[id]
+	switch {
+	case prop.typ == ptBoolean && len(prop.value) >= 1:
+		return int64(prop.value[0])
+	case prop.typ == ptInt16 && len(prop.value) >= 2:
+		return int64(int16(binary.LittleEndian.Uint16(prop.value)))
+	case prop.typ == ptInt32 && len(prop.value) >= 4:
+		return int64(int32(binary.LittleEndian.Uint32(prop.value)))
+	case prop.typ == ptInt64 && len(prop.value) >= 8:
+		return int64(binary.LittleEndian.Uint64(prop.value))
+	}
+	return 0
+}
+
+// time returns a time property, or the zero time if it is missing.
+func (p pstProps) time(id uint16) time.Time {
+	prop := p[id]
+	if prop.typ != ptTime || len(prop.value) < 8 {
+		return time.Time{}
+	}
+	// FILETIME counts 100ns intervals since 1601
+	ft := int64(binary.LittleEndian.Uint64(prop.value))
+	if ft == 0 {
+		return time.Time{}
+	}
+	const unixEpoch = 116444736000000000
+	ft -= unixEpoch
+	return time.Unix(ft/1e7, ft%1e7*100).UTC()
+}
+
+// pstPermute decodes the bytes of data blocks encrypted with the permutation
+// of [MS-PST] 5.1, which Outlook calls compressible encryption.
+var pstPermute = [256]byte{
+	0x47, 0xf1, 0xb4, 0xe6, 0x0b, 0x6a, 0x72, 0x48, 0x85, 0x4e, 0x9e, 0xeb, 0xe2, 0xf8, 0x94, 0x53,
+	0xe0, 0xbb, 0xa0, 0x02, 0xe8, 0x5a, 0x09, 0xab, 0xdb, 0xe3, 0xba, 0xc6, 0x7c, 0xc3, 0x10, 0xdd,
+	0x39, 0x05, 0x96, 0x30, 0xf5, 0x37, 0x60, 0x82, 0x8c, 0xc9, 0x13, 0x4a, 0x6b, 0x1d, 0xf3, 0xfb,
+	0x8f, 0x26, 0x97, 0xca, 0x91, 0x17, 0x01, 0xc4, 0x32, 0x2d, 0x6e, 0x31, 0x95, 0xff, 0xd9, 0x23,
+	0xd1, 0x00, 0x5e, 0x79, 0xdc, 0x44, 0x3b, 0x1a, 0x28, 0xc5, 0x61, 0x57, 0x20, 0x90, 0x3d, 0x83,
+	0xb9, 0x43, 0xbe, 0x67, 0xd2, 0x46, 0x42, 0x76, 0xc0, 0x6d, 0x5b, 0x7e, 0xb2, 0x0f, 0x16, 0x29,
+	0x3c, 0xa9, 0x03, 0x54, 0x0d, 0xda, 0x5d, 0xdf, 0xf6, 0xb7, 0xc7, 0x62, 0xcd, 0x8d, 0x06, 0xd3,
+	0x69, 0x5c, 0x86, 0xd6, 0x14, 0xf7, 0xa5, 0x66, 0x75, 0xac, 0xb1, 0xe9, 0x45, 0x21, 0x70, 0x0c,
+	0x87, 0x9f, 0x74, 0xa4, 0x22, 0x4c, 0x6f, 0xbf, 0x1f, 0x56, 0xaa, 0x2e, 0xb3, 0x78, 0x33, 0x50,
+	0xb0, 0xa3, 0x92, 0xbc, 0xcf, 0x19, 0x1c, 0xa7, 0x63, 0xcb, 0x1e, 0x4d, 0x3e, 0x4b, 0x1b, 0x9b,
+	0x4f, 0xe7, 0xf0, 0xee, 0xad, 0x3a, 0xb5, 0x59, 0x04, 0xea, 0x40, 0x55, 0x25, 0x51, 0xe5, 0x7a,
+	0x89, 0x38, 0x68, 0x52, 0x7b, 0xfc, 0x27, 0xae, 0xd7, 0xbd, 0xfa, 0x07, 0xf4, 0xcc, 0x8e, 0x5f,
+	0xef, 0x35, 0x9c, 0x84, 0x2b, 0x15, 0xd5, 0x77, 0x34, 0x49, 0xb6, 0x12, 0x0a, 0x7f, 0x71, 0x88,
+	0xfd, 0x9d, 0x18, 0x41, 0x7d, 0x93, 0xd8, 0x58, 0x2c, 0xce, 0xfe, 0x24, 0xaf, 0xde, 0xb8, 0x36,
+	0xc8, 0xa1, 0x80, 0xa6, 0x99, 0x98, 0xa8, 0x2f, 0x0e, 0x81, 0x65, 0x73, 0xe4, 0xc2, 0xa2, 0x8a,
+	0xd4, 0xe1, 0x11, 0xd0, 0x08, 0x8b, 0x2a, 0xf2, 0xed, 0x9a, 0x64, 0x3f, 0xc1, 0x6c, 0xf9, 0xec,
+}
@@ -0,0 +1,133 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+)
+
+// rawCopy decodes a part while keeping the encoded bytes the decoder has
+// consumed, so that a part that fails to decode can be saved as received.
+type rawCopy struct {
+	decoder io.Reader
+	raw     bytes.Buffer
+	rest    io.Reader // the encoded part, after what raw holds
+	err     error     // the first error decoding or reading the part
+}
+
+func (c *rawCopy) Read(p []byte) (int, error) {
+	n, err := c.decoder.Read(p)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// decodePart undoes the transfer encoding of a part, warning if damaged
+// base64 had to be repaired. With RawErrorDir set, it also returns a rawCopy
+// for saveRawOnError; otherwise that is nil.
+func (x *Extractor) decodePart(body io.Reader, encoding, filename string, email *Email) (io.Reader, *rawCopy) {
+	var c *rawCopy
+	if x.RawErrorDir != "" {
+		c = &rawCopy{rest: body}
+		body = io.TeeReader(body, &c.raw)
+	}
+	decoded := decodeTransferEncoding(body, encoding)
+	if b, ok := decoded.(*base64Reader); ok {
+		b.onRepair = func(repairs string) {
+			slog.Warn("Repaired damaged base64", "source", email.Path, "filename", filename, "repairs", repairs)
+		}
+	}
+	if c == nil {
+		return decoded, nil
+	}
+	c.decoder = decoded
+	return c, c
+}
+
+// saveRawOnError saves the part c was decoding to RawErrorDir if err, from
+// processing the part, is due to it failing to decode. The error is returned
+// either way, saying where the part was saved.
+func (x *Extractor) saveRawOnError(err error, c *rawCopy, header map[string][]string, filename string, email *Email) error {
+	if err == nil || c == nil || c.err == nil {
+		return err
+	}
+	path, saveErr := x.saveRaw(c, header, filename, email)
+	if saveErr != nil {
+		return fmt.Errorf("%v (could not save the raw part: %v)", err, saveErr)
+	}
+	return fmt.Errorf("%v (raw part saved as %s)", err, path)
+}
+
+// saveRaw writes the part as received, headers and all, to RawErrorDir, with
+// a .txt file beside it saying which message it came from and why it could
+// not be decoded.
+func (x *Extractor) saveRaw(c *rawCopy, header map[string][]string, filename string, email *Email) (string, error) {
+	rest, err := io.ReadAll(c.rest)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(x.RawErrorDir, 0755); err != nil {
+		return "", err
+	}
+
+	var part bytes.Buffer
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&part, "%s: %s\r\n", key, value)
+		}
+	}
+	part.WriteString("\r\n")
+	part.Write(c.raw.Bytes())
+	part.Write(rest)
+
+	if filename == "" {
+		filename = "part"
+	}
+	filename = sanitizeFilename(filename) + ".part"
+	file, err := os.CreateTemp(x.RawErrorDir, ".maildir2pdf-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(part.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	path, err := linkUnique(file.Name(), x.RawErrorDir, filename)
+	if err != nil {
+		return "", err
+	}
+
+	var about strings.Builder
+	fmt.Fprintf(&about, "Could not decode this part: %v\n", c.err)
+	fmt.Fprintf(&about, "From message %s in mailbox %s\n", email.Path, email.Mailbox)
+	if email.MessageID != "" {
+		fmt.Fprintf(&about, "Message-ID: %s\n", email.MessageID)
+	}
+	if email.From != "" {
+		fmt.Fprintf(&about, "From: %s\n", email.From)
+	}
+	if email.Subject != "" {
+		fmt.Fprintf(&about, "Subject: %s\n", email.Subject)
+	}
+	if !email.Date.IsZero() {
+		fmt.Fprintf(&about, "Date: %s\n", email.Date.Format("2006-01-02 15:04:05 -0700"))
+	}
+	if err := os.WriteFile(path+".txt", []byte(about.String()), 0644); err != nil {
+		slog.Warn("Could not record why a part was saved raw", "path", path, "error", err)
+	}
+	return path, nil
+}
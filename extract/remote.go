@@ -0,0 +1,95 @@
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Remote is an output backend that stores saved files elsewhere than the
+// local filesystem, such as object storage. Files are named by keys, paths
+// relative to the root of the backend with / as separator.
+type Remote interface {
+	// Create stores the content of r under key, failing with an error
+	// wrapping fs.ErrExist if there is a file there already.
+	Create(key string, r io.ReadSeeker, contentType string) error
+	// Put stores the content of r under key, replacing any file there.
+	Put(key string, r io.ReadSeeker, contentType string) error
+	// Remove deletes the file stored under key.
+	Remove(key string) error
+	// URL returns the location of the file stored under key, for logs and
+	// manifests.
+	URL(key string) string
+}
+
+// IsRemoteOutput reports whether output, as recorded in a state database
+// or manifest, is the URL of a file stored in a Remote rather than a local
+// path, so that it cannot be checked on the local filesystem.
+func IsRemoteOutput(output string) bool {
+	return strings.Contains(output, "://")
+}
+
+// upload stores the file saved at localPath, under OutputDir, in Remote
+// under the same relative path, adding a numeric suffix if the name is taken
+// as linkUnique does, and returns its key.
+func (x *Extractor) upload(localPath, contentType string) (string, error) {
+	rel, err := filepath.Rel(x.OutputDir, localPath)
+	if err != nil {
+		return "", err
+	}
+	dir, filename := path.Split(filepath.ToSlash(rel))
+	ext := path.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+
+	key := dir + filename
+	for counter := 1; ; counter++ {
+		file, err := os.Open(localPath)
+		if err != nil {
+			return "", err
+		}
+		err = x.Remote.Create(key, file, contentType)
+		file.Close()
+		if !errors.Is(err, fs.ErrExist) {
+			return key, err
+		}
+		key = fmt.Sprintf("%s%s_%d%s", dir, name, counter, ext)
+	}
+}
+
+// uploadSidecars stores the files written beside a saved file, whose key is
+// key, in Remote beside it, replacing their local paths in s with their
+// URLs, and removes the local copies.
+func (x *Extractor) uploadSidecars(s *Saved, localPath, key string) {
+	sidecars := []*string{&s.TextPath, &s.EMLPath, &s.BodyPath, &s.InvoiceXML}
+	var checksum string
+	if x.Checksums == ChecksumFile {
+		checksum = localPath + ".sha256"
+		sidecars = append(sidecars, &checksum)
+	}
+	for _, sidecar := range sidecars {
+		if *sidecar == "" {
+			continue
+		}
+		sidecarKey := key + strings.TrimPrefix(*sidecar, localPath)
+		file, err := os.Open(*sidecar)
+		if err != nil {
+			slog.Warn("Could not upload file", "path", *sidecar, "error", err)
+			continue
+		}
+		err = x.Remote.Put(sidecarKey, file, mime.TypeByExtension(path.Ext(sidecarKey)))
+		file.Close()
+		if err != nil {
+			slog.Warn("Could not upload file", "path", *sidecar, "error", err)
+			continue
+		}
+		os.Remove(*sidecar)
+		*sidecar = x.Remote.URL(sidecarKey)
+	}
+}
@@ -0,0 +1,203 @@
+package extract
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// maxRenderedNameLength bounds the subject-derived name of rendered messages.
+const maxRenderedNameLength = 100
+
+// renderMessage saves a message as a PDF, like an attachment.
+func (x *Extractor) renderMessage(data []byte, email *Email) error {
+	rendered, err := renderPDF(data, email)
+	if err != nil {
+		return err
+	}
+	return x.saveAttachment(bytes.NewReader(rendered), renderedFilename(email), "application/pdf", email)
+}
+
+// combineMessage saves a message as one PDF: its rendering followed by the
+// pages of the PDF attachments saveAttachment held back. Attachments that
+// cannot be merged, such as encrypted ones, are saved separately.
+func (x *Extractor) combineMessage(data []byte, email *Email) error {
+	rendered, err := renderPDF(data, email)
+	if err != nil {
+		return err
+	}
+	merger := newPDFMerger()
+	if _, err := merger.add(rendered); err != nil {
+		return err
+	}
+
+	held := email.held
+	email.holding, email.held = false, nil
+	for _, a := range held {
+		if _, err := merger.add(a.data); err != nil {
+			slog.Warn("Saving PDF separately", "filename", a.filename, "source", email.Path, "error", err)
+			if err := x.saveAttachment(bytes.NewReader(a.data), a.filename, "application/pdf", email); err != nil {
+				return err
+			}
+		}
+	}
+
+	info := pdfDict{"Title": pdfTextString(email.Subject), "Producer": pdfTextString("maildir2pdf")}
+	return x.saveAttachment(bytes.NewReader(merger.bytes(info)), renderedFilename(email), "application/pdf", email)
+}
+
+// renderPDF lays out a message as a PDF, with its main headers, its text
+// body (or its HTML body converted to text), the images it shows inline and
+// the names of its attachments.
+func renderPDF(data []byte, email *Email) ([]byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var body messageBody
+	body.collect(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Disposition"),
+		decodeTransferEncoding(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+
+	doc := &pdfDoc{}
+	doc.field("From", decodeHeader(msg.Header.Get("From")))
+	doc.field("To", decodeHeader(msg.Header.Get("To")))
+	doc.field("Cc", decodeHeader(msg.Header.Get("Cc")))
+	if email.Date.IsZero() {
+		doc.field("Date", msg.Header.Get("Date"))
+	} else {
+		doc.field("Date", email.Date.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+	doc.field("Subject", email.Subject)
+	doc.rule()
+
+	doc.paragraphs(body.text())
+	for _, img := range body.images {
+		doc.image(img)
+	}
+	if len(body.attachments) > 0 {
+		doc.rule()
+		doc.field("Attachments", strings.Join(body.attachments, ", "))
+	}
+
+	return doc.bytes(email.Subject), nil
+}
+
+// renderedFilename names the PDF of a rendered message after its subject.
+func renderedFilename(email *Email) string {
+	name := strings.TrimSpace(email.Subject)
+	if name == "" {
+		name = "message"
+	}
+	if runes := []rune(name); len(runes) > maxRenderedNameLength {
+		name = strings.TrimSpace(string(runes[:maxRenderedNameLength]))
+	}
+	return name + ".pdf"
+}
+
+// messageBody is what renderMessage shows of a message's MIME parts.
+type messageBody struct {
+	plain, html string
+	images      []pdfImage
+	attachments []string
+}
+
+// text returns the body as plain text, preferring a text/plain alternative
+// to converting HTML.
+func (b *messageBody) text() string {
+	if strings.TrimSpace(b.plain) != "" || b.html == "" {
+		return strings.ReplaceAll(b.plain, "\r\n", "\n")
+	}
+	return htmlToText(b.html)
+}
+
+func (b *messageBody) collect(contentType, disposition string, r io.Reader) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = partMediaType(contentType)
+	}
+	if contentType == "" {
+		mediaType = "text/plain"
+	}
+	filename := extractFilename(disposition, contentType)
+	attachment := strings.HasPrefix(strings.ToLower(strings.TrimSpace(disposition)), "attachment")
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				return
+			}
+			b.collect(part.Header.Get("Content-Type"), part.Header.Get("Content-Disposition"),
+				decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+			part.Close()
+		}
+	case mediaType == "text/plain" && !attachment && b.plain == "":
+		b.plain = readText(r, params["charset"])
+	case mediaType == "text/html" && !attachment && b.html == "":
+		b.html = readText(r, params["charset"])
+	case strings.HasPrefix(mediaType, "image/") && !attachment:
+		data, err := io.ReadAll(r)
+		if err == nil {
+			if img, err := newPDFImage(data); err == nil {
+				b.images = append(b.images, img)
+				return
+			}
+		}
+		b.addAttachment(filename, mediaType)
+	case filename != "" || attachment:
+		b.addAttachment(filename, mediaType)
+	}
+}
+
+func (b *messageBody) addAttachment(filename, mediaType string) {
+	if filename == "" {
+		filename = defaultFilename(mediaType)
+	}
+	b.attachments = append(b.attachments, filename)
+}
+
+// readText reads a text part, converting it to UTF-8.
+func readText(r io.Reader, charset string) string {
+	data, _ := io.ReadAll(r)
+	if text, err := decodeCharset(charset, data); err == nil {
+		return text
+	}
+	return strings.ToValidUTF8(string(data), "�")
+}
+
+var (
+	htmlHiddenRegex = regexp.MustCompile(`(?is)<(script|style|head|title)\b.*?</(script|style|head|title)\s*>`)
+	htmlSpaceRegex  = regexp.MustCompile(`\s+`)
+	htmlBreakRegex  = regexp.MustCompile(`(?i)<(br|hr)\b[^>]*>|</(p|div|tr|h[1-6]|li|blockquote|table|ul|ol)\s*>`)
+	htmlItemRegex   = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	htmlCellRegex   = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+	htmlTagRegex    = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText approximates the text an HTML body displays, keeping line
+// breaks between blocks.
+func htmlToText(s string) string {
+	s = htmlHiddenRegex.ReplaceAllString(s, "")
+	s = htmlSpaceRegex.ReplaceAllString(s, " ")
+	s = htmlBreakRegex.ReplaceAllString(s, "\n")
+	s = htmlItemRegex.ReplaceAllString(s, "\n• ")
+	s = htmlCellRegex.ReplaceAllString(s, " ")
+	s = htmlTagRegex.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
@@ -0,0 +1,245 @@
+package extract
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Rule routes the attachments matching all its conditions: they are either
+// skipped or saved under a name given by a template. Render and download
+// rules instead apply to messages, whose HTML bodies, or the PDFs they link
+// to, are saved. Empty conditions match everything.
+type Rule struct {
+	From     string         // sender address glob, or "@domain" for a domain and its subdomains
+	Subject  *regexp.Regexp // matched against the decoded subject
+	Mailbox  string         // mailbox glob; like IncludeMailboxes, it matches subfolders too
+	Filename string         // glob matched against the original filename, ignoring case
+
+	Skip   bool
+	Target *template.Template // output path, with the fields of ParseNameTemplate
+	Folder bool               // Target names a folder for the usual name, rather than a file
+	Render bool               // render the HTML body of matching messages with HTMLRenderer; see renderHTMLMessage
+
+	// Download matches the links of matching messages to download with
+	// Downloader, if set; see downloadLinks
+	Download *regexp.Regexp
+}
+
+// ParseRules reads routing rules, one per line:
+//
+//	from:@bank.com subject:"(?i)statement" -> Finance/Statements/{{.Date}}.pdf
+//	from:billing@*.example.com -> Invoices/
+//	mailbox:Spam -> skip
+//	from:@airline.example subject:"(?i)e-ticket" -> render
+//	from:@vendor.example -> download ^https://billing\.vendor\.example/invoices/
+//
+// Conditions are from:, subject: (a regular expression), mailbox: and
+// filename:, and values containing spaces are double-quoted. The action
+// after -> is "skip", "render", "download" and a regular expression, or a
+// name template; one ending in / is a folder in which attachments get their
+// usual name. Render and download rules cannot have a filename: condition.
+// Blank lines and lines starting with # are ignored.
+func ParseRules(r io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(line string) (*Rule, error) {
+	conditions, action, ok := strings.Cut(strings.Replace(line, "→", "->", 1), "->")
+	if !ok {
+		return nil, errors.New("missing ->")
+	}
+
+	rule := &Rule{}
+	fields, err := splitQuoted(conditions)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid condition %q", field)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate %s: condition", key)
+		}
+		seen[key] = true
+		switch key {
+		case "from":
+			rule.From = strings.ToLower(value)
+			if !strings.HasPrefix(rule.From, "@") {
+				if _, err := path.Match(rule.From, ""); err != nil {
+					return nil, fmt.Errorf("invalid glob %q: %v", value, err)
+				}
+			}
+		case "subject":
+			if rule.Subject, err = regexp.Compile(value); err != nil {
+				return nil, err
+			}
+		case "mailbox", "filename":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("invalid glob %q: %v", value, err)
+			}
+			if key == "mailbox" {
+				rule.Mailbox = value
+			} else {
+				rule.Filename = strings.ToLower(value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown condition %s:", key)
+		}
+	}
+
+	action = strings.TrimSpace(action)
+	switch {
+	case action == "":
+		return nil, errors.New("missing action")
+	case action == "skip":
+		rule.Skip = true
+	case action == "render":
+		if rule.Filename != "" {
+			return nil, errors.New("render rules apply to messages, which have no filename:")
+		}
+		rule.Render = true
+	case action == "download" || strings.HasPrefix(action, "download "):
+		if rule.Filename != "" {
+			return nil, errors.New("download rules apply to messages, which have no filename:")
+		}
+		args, err := splitQuoted(action)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 2 {
+			return nil, errors.New("download takes one regular expression, matching the links to download")
+		}
+		if rule.Download, err = regexp.Compile(args[1]); err != nil {
+			return nil, err
+		}
+	default:
+		rule.Folder = strings.HasSuffix(action, "/")
+		if rule.Target, err = ParseNameTemplate(action); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// splitQuoted splits s at spaces, except within double quotes, which are
+// removed. A backslash escapes a quote or backslash within quotes.
+func splitQuoted(s string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s):
+			i++
+			field.WriteByte(s[i])
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// matches reports whether an attachment meets all the conditions of r.
+func (r *Rule) matches(a *Attachment) bool {
+	email := a.Email
+	if r.From != "" {
+		from := strings.ToLower(email.From)
+		if domain, ok := strings.CutPrefix(r.From, "@"); ok {
+			_, fromDomain, _ := strings.Cut(from, "@")
+			if fromDomain != domain && !strings.HasSuffix(fromDomain, "."+domain) {
+				return false
+			}
+		} else if ok, _ := path.Match(r.From, from); !ok {
+			return false
+		}
+	}
+	if r.Subject != nil && !r.Subject.MatchString(email.Subject) {
+		return false
+	}
+	if r.Mailbox != "" && !matchMailbox([]string{r.Mailbox}, email.Mailbox) {
+		return false
+	}
+	if r.Filename != "" {
+		if ok, _ := path.Match(r.Filename, strings.ToLower(a.Filename)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// outputName returns the relative output path of an attachment from
+// NameTemplate and the target of rule, either of which may be unset.
+func (x *Extractor) outputName(filename string, email *Email, rule *Rule) (string, error) {
+	name := filename
+	if x.NameTemplate != nil {
+		var err error
+		if name, err = expandNameTemplate(x.NameTemplate, filename, email); err != nil {
+			return "", fmt.Errorf("error expanding name template: %v", err)
+		}
+	}
+	if rule == nil || rule.Target == nil {
+		return name, nil
+	}
+	target, err := expandNameTemplate(rule.Target, filename, email)
+	if err != nil {
+		return "", fmt.Errorf("error expanding rule target: %v", err)
+	}
+	if rule.Folder {
+		if x.NameTemplate == nil {
+			name = sanitizeFilename(name)
+		}
+		return filepath.Join(target, name), nil
+	}
+	return target, nil
+}
+
+// matchRule returns the first of x.Rules matching an attachment, or nil.
+// Render and download rules are left out, as they apply to messages.
+func (x *Extractor) matchRule(a *Attachment) *Rule {
+	for _, rule := range x.Rules {
+		if !rule.Render && rule.Download == nil && rule.matches(a) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package extract
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 stores files in a bucket of Amazon S3 or a compatible object store such
+// as MinIO, signing requests with AWS Signature Version 4.
+type S3 struct {
+	Bucket string
+	Prefix string // prepended to keys, e.g. "invoices/"
+
+	// Endpoint is the URL of an S3-compatible server, e.g.
+	// https://minio.example.com:9000, which is addressed with the bucket in
+	// the path. Amazon S3 is used if it is empty.
+	Endpoint string
+	Region   string
+
+	AccessKey, SecretKey string
+	SessionToken         string // for temporary credentials
+
+	StorageClass string // e.g. STANDARD_IA; the bucket default if empty
+	ContentType  string // of every file, instead of their own
+
+	Client *http.Client
+}
+
+// ParseS3URL returns the bucket and key prefix of an s3://BUCKET/PREFIX URL.
+// A non-empty prefix always ends with /.
+func ParseS3URL(rawURL string) (bucket, prefix string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("%s is not an s3://BUCKET/PREFIX URL", rawURL)
+	}
+	prefix = strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return u.Host, prefix, nil
+}
+
+// S3Credentials returns the AWS access key, secret key and session token
+// from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables, or failing that from the profile named by
+// AWS_PROFILE (default: "default") in the shared credentials file named by
+// AWS_SHARED_CREDENTIALS_FILE (default: ~/.aws/credentials), as the AWS CLI
+// does.
+func S3Credentials() (accessKey, secretKey, sessionToken string, err error) {
+	if accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); accessKey != "" && secretKey != "" {
+		return accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", "", err
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set, and %v", err)
+	}
+	defer file.Close()
+
+	var section string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			accessKey = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			secretKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			sessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", "", fmt.Errorf("%s: %v", path, err)
+	}
+	if accessKey == "" || secretKey == "" {
+		return "", "", "", fmt.Errorf("%s: no credentials for profile %s", path, profile)
+	}
+	return accessKey, secretKey, sessionToken, nil
+}
+
+// Create implements Remote, with a conditional write that the server
+// refuses if the key exists.
+func (s *S3) Create(key string, r io.ReadSeeker, contentType string) error {
+	return s.put(key, r, contentType, true)
+}
+
+// Put implements Remote.
+func (s *S3) Put(key string, r io.ReadSeeker, contentType string) error {
+	return s.put(key, r, contentType, false)
+}
+
+func (s *S3) put(key string, r io.ReadSeeker, contentType string, create bool) error {
+	header := make(http.Header)
+	if s.ContentType != "" {
+		contentType = s.ContentType
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if s.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", s.StorageClass)
+	}
+	if create {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := s.do("PUT", key, r, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case create && (resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict):
+		// 409 is a concurrent conditional write of the same key
+		return fmt.Errorf("%s: %w", s.URL(key), fs.ErrExist)
+	case resp.StatusCode/100 != 2:
+		return s.responseError("PUT", key, resp)
+	}
+	return nil
+}
+
+// Remove implements Remote.
+func (s *S3) Remove(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s.responseError("DELETE", key, resp)
+	}
+	return nil
+}
+
+// URL implements Remote.
+func (s *S3) URL(key string) string {
+	return "s3://" + s.Bucket + "/" + s.Prefix + key
+}
+
+func (s *S3) responseError(method, key string, resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s: %s", method, s.URL(key), resp.Status, strings.TrimSpace(string(message)))
+}
+
+// objectURL returns the HTTP URL of key, with the path escaped as Signature
+// Version 4 requires. The path of Endpoint, for servers behind a path
+// prefix, comes before the bucket.
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	var base string
+	objectPath := "/" + s.Prefix + key
+	switch {
+	case s.Endpoint != "":
+		base = s.Endpoint
+		objectPath = "/" + s.Bucket + objectPath
+	case strings.Contains(s.Bucket, "."):
+		// Bucket names with dots do not match the wildcard certificate of
+		// virtual-hosted style addresses
+		base = "https://s3." + s.Region + ".amazonaws.com"
+		objectPath = "/" + s.Bucket + objectPath
+	default:
+		base = "https://" + s.Bucket + ".s3." + s.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	objectPath = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.Path, u.RawPath = objectPath, s3Escape(objectPath)
+	return u, nil
+}
+
+func (s *S3) do(method, key string, body io.ReadSeeker, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	payload := sha256.New()
+	var size int64
+	var reqBody io.Reader
+	if body != nil {
+		if size, err = io.Copy(payload, body); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		// The caller closes the body, not the transport
+		reqBody = io.NopCloser(body)
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	// S3 does not accept chunked uploads without signing each chunk
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, hex.EncodeToString(payload.Sum(nil)), time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, whose
+// body has the SHA-256 payloadHash, covering all its headers.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name, value := range req.Header {
+		name = strings.ToLower(name)
+		names = append(names, name)
+		values[name] = strings.Join(value, ",")
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(values[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes every byte of a path but unreserved characters
+// and /, as Signature Version 4 requires.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
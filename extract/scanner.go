@@ -0,0 +1,396 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Scanner walks a maildir and hands every message it selects to an
+// Extractor.
+type Scanner struct {
+	Extractor        *Extractor
+	Workers          int      // messages processed in parallel; at least 1
+	IncludeMailboxes []string // globs; scan only matching mailboxes if set
+	ExcludeMailboxes []string // globs of mailboxes to skip
+	IncludeTmp       bool     // also scan tmp/, which holds incomplete deliveries
+	SkipTrashed      bool
+	SkipDrafts       bool
+	SeenOnly         bool
+	Notmuch          string // command ScanNotmuch queries with; "notmuch" if empty
+
+	// OnError, if set, is called with every error logged while scanning,
+	// such as a message that could not be parsed. It may be called
+	// concurrently.
+	OnError func(err error)
+	// OnQueued and OnProcessed, if set, report progress: OnQueued is
+	// called with the number of messages found, before they are processed
+	// where possible, and OnProcessed after each message. They may be called
+	// concurrently.
+	OnQueued    func(n int)
+	OnProcessed func()
+	// OnMailbox, if set, is called with each mailbox selected for scanning,
+	// before its messages are.
+	OnMailbox func(m Mailbox)
+	// Context, if set, stops scanning once it is cancelled: the messages
+	// being processed are finished, and no more are started, so a later run
+	// with the same State carries on where this one stopped.
+	Context context.Context
+}
+
+// logError logs a non-fatal scanning error and reports it to OnError. The
+// error reads as what failed, e.g. "processing <path>: <reason>".
+func (s *Scanner) logError(err error) {
+	slog.Error("Scanning error", "error", err)
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Scanner) queued(n int) {
+	if s.OnQueued != nil && n > 0 {
+		s.OnQueued(n)
+	}
+}
+
+func (s *Scanner) scanning(mailboxes []Mailbox) {
+	if s.OnMailbox != nil {
+		for _, m := range mailboxes {
+			s.OnMailbox(m)
+		}
+	}
+}
+
+// cancelled reports whether Context has been cancelled.
+func (s *Scanner) cancelled() bool {
+	return s.Context != nil && s.Context.Err() != nil
+}
+
+// send queues a job for the worker pool started by run. It returns false,
+// without queuing it, once Context is cancelled; jobs that were queued are
+// always processed.
+func (s *Scanner) send(jobs chan<- emailJob, job emailJob) bool {
+	var done <-chan struct{}
+	if s.Context != nil {
+		done = s.Context.Done()
+	}
+	if s.cancelled() {
+		return false
+	}
+	select {
+	case jobs <- job:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// NewScanner returns a single-threaded Scanner feeding x.
+func NewScanner(x *Extractor) *Scanner {
+	return &Scanner{Extractor: x, Workers: 1}
+}
+
+// Scan extracts attachments from every selected message in the maildir.
+// Errors with individual mailboxes and messages are logged, not returned.
+func (s *Scanner) Scan(maildirPath string) error {
+	mailboxes, err := DiscoverMailboxes(maildirPath)
+	if err != nil {
+		return fmt.Errorf("error discovering mailboxes: %v", err)
+	}
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+
+	// Listing the messages first is quick, and gives progress reports a
+	// total to work towards
+	var queue []emailJob
+	for _, mailbox := range mailboxes {
+		err := s.scanSingleMailbox(mailbox.Path, mailbox.Name, func(job emailJob) {
+			queue = append(queue, job)
+		})
+		if err != nil {
+			s.logError(fmt.Errorf("scanning mailbox %s: %v", mailbox.Name, err))
+		}
+	}
+	s.queued(len(queue))
+
+	s.run(func(jobs chan<- emailJob) {
+		for _, job := range queue {
+			if !s.send(jobs, job) {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// ScanFiles extracts attachments from individual message files, such as
+// exported .eml files, attributing them all to the named mailbox.
+func (s *Scanner) ScanFiles(paths []string, mailboxName string) {
+	s.queued(len(paths))
+	s.run(func(jobs chan<- emailJob) {
+		for _, path := range paths {
+			if !s.send(jobs, emailJob{path: path, mailbox: mailboxName}) {
+				return
+			}
+		}
+	})
+}
+
+// emailJob is a single message queued for the worker pool. Messages read
+// from files holding several of them, such as mbox, carry their content in
+// data; otherwise the message is read from path.
+type emailJob struct {
+	path    string
+	mailbox string
+	data    []byte
+}
+
+// run starts the worker pool, lets queue feed it, and waits until every
+// queued message has been processed. It returns the paths of the messages
+// that failed, which State does not record as scanned.
+func (s *Scanner) run(queue func(jobs chan<- emailJob)) []string {
+	jobs := make(chan emailJob)
+	var mu sync.Mutex
+	var failed []string
+	var wg sync.WaitGroup
+	for i := 0; i < max(s.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				slog.Debug("Processing message", "source", job.path, "mailbox", job.mailbox)
+				var err error
+				if job.data != nil {
+					err = s.Extractor.ExtractMessage(bytes.NewReader(job.data), job.path, job.mailbox)
+				} else {
+					err = s.Extractor.ExtractFile(job.path, job.mailbox)
+				}
+				if err != nil {
+					s.logError(fmt.Errorf("processing %s: %v", job.path, err))
+					mu.Lock()
+					failed = append(failed, job.path)
+					mu.Unlock()
+				}
+				if s.OnProcessed != nil {
+					s.OnProcessed()
+				}
+			}
+		}()
+	}
+
+	queue(jobs)
+	close(jobs)
+	wg.Wait()
+	return failed
+}
+
+// Mailbox is a maildir folder. The top-level folder is named INBOX; Maildir++
+// subfolders are named by their path, without the leading dot.
+type Mailbox struct {
+	Name string
+	Path string
+}
+
+// DiscoverMailboxes returns every mailbox under maildirPath.
+func DiscoverMailboxes(maildirPath string) ([]Mailbox, error) {
+	var mailboxes []Mailbox
+
+	// Add the main inbox
+	if isValidMailbox(maildirPath) {
+		mailboxes = append(mailboxes, Mailbox{Name: "INBOX", Path: maildirPath})
+	}
+
+	// Discover all subdirectories that are valid mailboxes
+	err := filepath.Walk(maildirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip symlinks
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() || path == maildirPath {
+			return nil
+		}
+
+		if isValidMailbox(path) {
+			relPath, err := filepath.Rel(maildirPath, path)
+			if err != nil {
+				return err
+			}
+			mailboxes = append(mailboxes, Mailbox{Name: mailboxName(relPath), Path: path})
+		}
+
+		return nil
+	})
+
+	return mailboxes, err
+}
+
+// mailboxName returns the name of the mailbox at relPath, below the root of
+// a maildir, with "/" between the levels of its hierarchy.
+//
+// Maildir++, the layout of Courier and the default of Dovecot, keeps every
+// folder in a directory of the root named after its full name, starting
+// with a dot and with dots between levels, e.g. .Archive.2023.Taxes for
+// Archive/2023/Taxes. Dovecot's LAYOUT=fs nests directories instead, as in
+// Archive/2023/Taxes. Both write names in the modified UTF-7 of IMAP, e.g.
+// .Re&AOc-us for Reçus.
+func mailboxName(relPath string) string {
+	var levels []string
+	for i, component := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if i == 0 && strings.HasPrefix(component, ".") {
+			for _, level := range strings.Split(component[1:], ".") {
+				if level != "" {
+					levels = append(levels, level)
+				}
+			}
+		} else {
+			levels = append(levels, component)
+		}
+	}
+	for i, level := range levels {
+		levels[i] = decodeModifiedUTF7(level)
+	}
+	return strings.Join(levels, "/")
+}
+
+// isValidMailbox reports whether path is a maildir: one with any of cur,
+// new and tmp, or the maildirfolder file Maildir++ marks folders with.
+func isValidMailbox(path string) bool {
+	subdirs := []string{"cur", "new", "tmp", "maildirfolder"}
+
+	for _, subdir := range subdirs {
+		dirPath := filepath.Join(path, subdir)
+		if _, err := os.Stat(dirPath); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Scanner) scanSingleMailbox(mailboxPath, mailboxName string, found func(job emailJob)) error {
+	// Messages marked as processed by an earlier run are skipped
+	var mark byte
+	if s.Extractor.Mark != "" && !s.Extractor.Force {
+		var err error
+		if mark, err = s.Extractor.markLetter(mailboxPath, false); err != nil {
+			return err
+		}
+	}
+
+	// tmp/ holds deliveries still being written, so it is normally skipped
+	subdirs := []string{"cur", "new"}
+	if s.IncludeTmp {
+		subdirs = append(subdirs, "tmp")
+	}
+
+	for _, subdir := range subdirs {
+		dirPath := filepath.Join(mailboxPath, subdir)
+		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Skip symlinks
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !info.IsDir() && s.wantedFlags(info.Name()) && !marked(info.Name(), mark) {
+				found(emailJob{path: path, mailbox: mailboxName})
+			}
+			return nil
+		})
+
+		if err != nil {
+			return fmt.Errorf("error walking directory %s: %v", dirPath, err)
+		}
+	}
+
+	return nil
+}
+
+// matchMailbox reports whether a mailbox name or one of its parent folders
+// matches any of the globs, ignoring case. "Archive" therefore also
+// matches "Archive/2023".
+func matchMailbox(globs []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, glob := range globs {
+		glob = strings.ToLower(glob)
+		for candidate := name; ; {
+			if ok, _ := path.Match(glob, candidate); ok {
+				return true
+			}
+			parent := path.Dir(candidate)
+			if parent == "." || parent == candidate {
+				break
+			}
+			candidate = parent
+		}
+	}
+	return false
+}
+
+// filterMailboxes applies IncludeMailboxes and ExcludeMailboxes.
+func (s *Scanner) filterMailboxes(mailboxes []Mailbox) []Mailbox {
+	var kept []Mailbox
+	for _, mailbox := range mailboxes {
+		if len(s.IncludeMailboxes) > 0 && !matchMailbox(s.IncludeMailboxes, mailbox.Name) {
+			continue
+		}
+		if matchMailbox(s.ExcludeMailboxes, mailbox.Name) {
+			continue
+		}
+		kept = append(kept, mailbox)
+	}
+	return kept
+}
+
+// maildirFlags returns the flags in the info suffix of a maildir filename,
+// e.g. "RS" for "1680000001.M1P1.host:2,RS". Filesystems that do not allow
+// colons in names use "!" instead.
+func maildirFlags(filename string) string {
+	for _, sep := range []string{":2,", "!2,"} {
+		if i := strings.LastIndex(filename, sep); i >= 0 {
+			return filename[i+len(sep):]
+		}
+	}
+	return ""
+}
+
+// wantedFlags applies SkipTrashed, SkipDrafts and SeenOnly to the flags of a
+// maildir message file.
+func (s *Scanner) wantedFlags(filename string) bool {
+	flags := maildirFlags(filename)
+	if s.SkipTrashed && strings.ContainsRune(flags, 'T') {
+		return false
+	}
+	if s.SkipDrafts && strings.ContainsRune(flags, 'D') {
+		return false
+	}
+	if s.SeenOnly && !strings.ContainsRune(flags, 'S') {
+		return false
+	}
+	return true
+}
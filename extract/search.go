@@ -0,0 +1,173 @@
+package extract
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// searchSchema keeps the details of each saved file in documents, and the
+// words to search in documents_fts under the same rowid.
+const searchSchema = `
+CREATE TABLE IF NOT EXISTS documents (
+	id         INTEGER PRIMARY KEY,
+	output     TEXT NOT NULL UNIQUE,
+	filename   TEXT NOT NULL,
+	source     TEXT NOT NULL,
+	mailbox    TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	sender     TEXT NOT NULL,
+	subject    TEXT NOT NULL,
+	date       TEXT NOT NULL
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS documents_fts USING fts5(
+	subject, sender, filename, date, body,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+`
+
+// SearchIndex is a full-text index of saved files: the text of PDFs along
+// with the sender, subject, date and filename of each attachment.
+type SearchIndex struct {
+	db *sql.DB
+}
+
+// SearchResult is a saved file matching a search.
+type SearchResult struct {
+	Output    string
+	Filename  string
+	Source    string // the message the file was extracted from
+	Mailbox   string
+	MessageID string
+	From      string
+	Subject   string
+	Date      time.Time // zero if the message had no date
+	Snippet   string    // matching text, with matches between [ and ]
+}
+
+// OpenSearchIndex opens the search index at path, creating it if needed.
+func OpenSearchIndex(path string) (*SearchIndex, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(searchSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing search index %s: %v", path, err)
+	}
+	return &SearchIndex{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (idx *SearchIndex) Close() error {
+	return idx.db.Close()
+}
+
+// add indexes a saved file with its text, replacing any earlier entry for
+// the same output path.
+func (idx *SearchIndex) add(s *Saved, text string) error {
+	email := s.Email
+	var date string
+	if !email.Date.IsZero() {
+		date = email.Date.Format(time.RFC3339)
+	}
+	sender := emailAuthor(email)
+
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`SELECT id FROM documents WHERE output = ?`, s.Path).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		res, err := tx.Exec(`INSERT INTO documents (output, filename, source, mailbox, message_id, sender, subject, date) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			s.Path, s.Filename, email.Path, email.Mailbox, email.MessageID, sender, email.Subject, date)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if _, err := tx.Exec(`UPDATE documents SET filename = ?, source = ?, mailbox = ?, message_id = ?, sender = ?, subject = ?, date = ? WHERE id = ?`,
+			s.Filename, email.Path, email.Mailbox, email.MessageID, sender, email.Subject, date, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM documents_fts WHERE rowid = ?`, id); err != nil {
+			return err
+		}
+	}
+
+	// Dates are indexed as YYYY-MM-DD, so that a year or month matches
+	var day string
+	if !email.Date.IsZero() {
+		day = email.Date.Format(time.DateOnly)
+	}
+	if _, err := tx.Exec(`INSERT INTO documents_fts (rowid, subject, sender, filename, date, body) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, email.Subject, sender, s.Filename, day, text); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Search returns up to limit files matching all the words of query, best
+// matches first. A word ending in * matches any word it is a prefix of.
+func (idx *SearchIndex) Search(query string, limit int) ([]SearchResult, error) {
+	match := searchMatch(query)
+	if match == "" {
+		return nil, errors.New("empty search")
+	}
+	rows, err := idx.db.Query(`
+		SELECT d.output, d.filename, d.source, d.mailbox, d.message_id, d.sender, d.subject, d.date,
+			snippet(documents_fts, -1, '[', ']', '...', 12)
+		FROM documents_fts JOIN documents d ON d.id = documents_fts.rowid
+		WHERE documents_fts MATCH ?
+		ORDER BY rank
+		LIMIT ?`, match, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		var date string
+		if err := rows.Scan(&r.Output, &r.Filename, &r.Source, &r.Mailbox, &r.MessageID, &r.From, &r.Subject, &date, &r.Snippet); err != nil {
+			return nil, err
+		}
+		if date != "" {
+			r.Date, _ = time.Parse(time.RFC3339, date)
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// searchMatch turns the words of a query into an FTS5 expression, quoting
+// each so that punctuation and FTS5 operators are taken literally.
+func searchMatch(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		if word == "" {
+			continue
+		}
+		term := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,237 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SFTP stores files in a directory of an SFTP server by running the OpenSSH
+// sftp command, so that authentication is set up as for ssh: with keys from
+// the agent, ~/.ssh or Identity, and ~/.ssh/config. Connections are shared
+// between commands with ssh multiplexing, for up to a minute after the last.
+type SFTP struct {
+	User     string // the ssh default if empty
+	Host     string
+	Port     string // the ssh default if empty
+	Dir      string // the root of keys, relative to the home directory unless absolute
+	Identity string // private key file, if not those ssh tries by default
+	Command  string // "sftp" if empty
+
+	mu   sync.Mutex
+	dirs map[string]bool // made or found to exist, by key
+}
+
+// NewSFTP returns a client for the directory at an sftp://USER@HOST:PORT/PATH
+// URL. As with curl, PATH is absolute, unless it starts with /~/, which
+// stands for the home directory.
+func NewSFTP(rawURL string) (*SFTP, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "sftp" || u.Hostname() == "" {
+		return nil, fmt.Errorf("%s is not an sftp://USER@HOST/PATH URL", rawURL)
+	}
+	s := &SFTP{Host: u.Hostname(), Port: u.Port(), Dir: u.Path, dirs: make(map[string]bool)}
+	if u.User != nil {
+		s.User = u.User.Username()
+	}
+	if s.Dir == "/~" || strings.HasPrefix(s.Dir, "/~/") {
+		s.Dir = strings.TrimPrefix(strings.TrimPrefix(s.Dir, "/~"), "/")
+	}
+	return s, nil
+}
+
+// Create implements Remote. The file is uploaded under a temporary name and
+// renamed with the SFTP rename request, which fails rather than replace an
+// existing file.
+func (s *SFTP) Create(key string, r io.ReadSeeker, contentType string) error {
+	local, err := stageUpload(r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(local)
+
+	remote := s.remotePath(key)
+	tmp := path.Join(path.Dir(remote), "."+filepath.Base(local)+".tmp")
+	if err := s.batch(append(s.mkdirs(key), "put "+sftpQuote(local, true)+" "+sftpQuote(tmp, false))...); err != nil {
+		return err
+	}
+	s.madeDirs(key)
+	// -l forces the rename request of the protocol over the
+	// posix-rename@openssh.com extension, which replaces files
+	renameErr := s.batch("rename -l " + sftpQuote(tmp, false) + " " + sftpQuote(remote, false))
+	if renameErr == nil {
+		return nil
+	}
+	if err := s.batch("-rm "+sftpQuote(tmp, true), "ls "+sftpQuote(remote, true)); err == nil {
+		return fmt.Errorf("%s: %w", s.URL(key), fs.ErrExist)
+	}
+	return renameErr
+}
+
+// Put implements Remote.
+func (s *SFTP) Put(key string, r io.ReadSeeker, contentType string) error {
+	local, err := stageUpload(r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(local)
+
+	if err := s.batch(append(s.mkdirs(key), "put "+sftpQuote(local, true)+" "+sftpQuote(s.remotePath(key), false))...); err != nil {
+		return err
+	}
+	s.madeDirs(key)
+	return nil
+}
+
+// Remove implements Remote.
+func (s *SFTP) Remove(key string) error {
+	return s.batch("rm " + sftpQuote(s.remotePath(key), true))
+}
+
+// URL implements Remote.
+func (s *SFTP) URL(key string) string {
+	remote := s.remotePath(key)
+	if !path.IsAbs(remote) {
+		remote = "/~/" + remote
+	}
+	u := url.URL{Scheme: "sftp", Host: s.Host, Path: remote}
+	if strings.Contains(u.Host, ":") {
+		u.Host = "[" + u.Host + "]"
+	}
+	if s.Port != "" {
+		u.Host += ":" + s.Port
+	}
+	if s.User != "" {
+		u.User = url.User(s.User)
+	}
+	return u.String()
+}
+
+func (s *SFTP) remotePath(key string) string {
+	if s.Dir == "" {
+		return key
+	}
+	return path.Join(s.Dir, key)
+}
+
+// mkdirs returns the commands making the directories the file stored under
+// key goes in that are not known to exist, ignoring failures for those that
+// do.
+func (s *SFTP) mkdirs(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var commands []string
+	var dir string
+	components := strings.Split(key, "/")
+	for _, component := range components[:len(components)-1] {
+		dir += component + "/"
+		if !s.dirs[dir] {
+			commands = append(commands, "-mkdir "+sftpQuote(s.remotePath(dir), false))
+		}
+	}
+	return commands
+}
+
+// madeDirs records that the directories of key exist.
+func (s *SFTP) madeDirs(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dir string
+	components := strings.Split(key, "/")
+	for _, component := range components[:len(components)-1] {
+		dir += component + "/"
+		s.dirs[dir] = true
+	}
+}
+
+// batch runs sftp with commands, which stops at the first that fails unless
+// it starts with -. Commands with control characters are refused: a line
+// break in a path would start another command, and sftp runs those starting
+// with ! in a local shell.
+func (s *SFTP) batch(commands ...string) error {
+	for _, command := range commands {
+		if strings.ContainsFunc(command, func(c rune) bool { return c < 0x20 || c >= 0x7f && c < 0xa0 }) {
+			return fmt.Errorf("sftp: refusing path with control characters in %q", command)
+		}
+	}
+	args := []string{"-b", "-",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(os.TempDir(), "maildir2pdf-ssh-%C"),
+		"-o", "ControlPersist=60"}
+	if s.Port != "" {
+		args = append(args, "-P", s.Port)
+	}
+	if s.Identity != "" {
+		args = append(args, "-i", s.Identity)
+	}
+	destination := s.Host
+	if strings.Contains(destination, ":") {
+		destination = "[" + destination + "]"
+	}
+	if s.User != "" {
+		destination = s.User + "@" + destination
+	}
+	command := s.Command
+	if command == "" {
+		command = "sftp"
+	}
+	cmd := exec.Command(command, append(args, destination)...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sftp %s: %v: %s", destination, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// stageUpload copies r to a temporary file, whose name, unlike that of the
+// file being uploaded, has no characters sftp would take for a pattern.
+func stageUpload(r io.ReadSeeker) (string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp("", "maildir2pdf-sftp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// sftpQuote quotes an argument of an sftp command, escaping the characters
+// sftp takes for a pattern if glob, for commands that expand patterns.
+func sftpQuote(arg string, glob bool) string {
+	special := `\"`
+	if glob {
+		special += "*?[]"
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range arg {
+		if strings.ContainsRune(special, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
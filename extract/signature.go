@@ -0,0 +1,437 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// signedDataOID is id-signedData of RFC 5652, 1.2.840.113549.1.7.2, as
+// encoded in DER.
+var signedDataOID = []byte{0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x02}
+
+// isSMIMESigned reports whether a message, or part, with the given
+// Content-Type is S/MIME signed data, which carries the signed entity
+// inside it rather than beside the signature as multipart/signed does.
+func isSMIMESigned(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/pkcs7-mime" && mediaType != "application/x-pkcs7-mime" {
+		return false
+	}
+	return strings.EqualFold(params["smime-type"], "signed-data")
+}
+
+// openSigned returns the entity whose attachments are extracted from a
+// signed message: msg itself for multipart/signed, whose first part is the
+// content, or the entity S/MIME signed data holds. With VerifySignatures,
+// the signature is checked and recorded in email.
+func (x *Extractor) openSigned(msg *mail.Message, email *Email) (*mail.Message, error) {
+	contentType := msg.Header.Get("Content-Type")
+	if isSMIMESigned(contentType) {
+		data, err := io.ReadAll(decodeTransferEncoding(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			return nil, err
+		}
+		inner, err := readSignedEntity(data)
+		if err != nil {
+			return nil, err
+		}
+		if x.VerifySignatures {
+			email.Signature, email.Signer = x.verifySMIME(data, nil)
+			x.logSignature(email)
+		}
+		email.unwrapped = true
+		return inner, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/signed" || !x.VerifySignatures {
+		return msg, nil
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	msg.Body = bytes.NewReader(body)
+	email.Signature, email.Signer = x.verifyMultipartSigned(body, params)
+	x.logSignature(email)
+	return msg, nil
+}
+
+// processSMIMESigned extracts the attachments of the entity held by an
+// S/MIME signed data part, such as a signed message forwarded as an
+// attachment. Its signature is not checked.
+func (x *Extractor) processSMIMESigned(body io.Reader, email *Email) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	inner, err := readSignedEntity(data)
+	if err != nil {
+		return err
+	}
+	defer func(unwrapped bool) { email.unwrapped = unwrapped }(email.unwrapped)
+	email.unwrapped = true
+	return x.extractAttachments(inner, email)
+}
+
+// readSignedEntity parses the MIME entity held by S/MIME signed data.
+func readSignedEntity(data []byte) (*mail.Message, error) {
+	content, err := signedContent(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading S/MIME signed data: %v", err)
+	}
+	inner, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the signed content: %v", err)
+	}
+	return inner, nil
+}
+
+func (x *Extractor) logSignature(email *Email) {
+	if email.Signature == "invalid" {
+		slog.Warn("Message signature is invalid", "source", email.Path, "signer", email.Signer)
+		return
+	}
+	slog.Debug("Checked message signature", "source", email.Path, "signature", email.Signature, "signer", email.Signer)
+}
+
+// verifyMultipartSigned checks the signature of a multipart/signed entity
+// of RFC 1847 with the given body and Content-Type parameters: S/MIME ones
+// with OpenSSL, PGP/MIME ones with GnuPG.
+func (x *Extractor) verifyMultipartSigned(body []byte, params map[string]string) (signature, signer string) {
+	boundary := params["boundary"]
+	if boundary == "" {
+		return "unverified", ""
+	}
+	content, ok := signedPart(body, boundary)
+	if !ok {
+		return "unverified", ""
+	}
+
+	// The signature is the second part
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var sig []byte
+	for n := 0; n < 2; n++ {
+		part, err := reader.NextPart()
+		if err != nil {
+			return "unverified", ""
+		}
+		if n == 1 {
+			sig, err = io.ReadAll(decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+			if err != nil {
+				return "unverified", ""
+			}
+		}
+	}
+
+	switch strings.ToLower(params["protocol"]) {
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		return x.verifySMIME(sig, content)
+	case "application/pgp-signature":
+		return x.verifyPGP(sig, content)
+	}
+	return "unverified", ""
+}
+
+// signedPart returns the first part of a multipart body, with its headers,
+// as signed: from after the first delimiter line to before the line break
+// ending it, converted to CRLF line breaks as signatures are made over.
+func signedPart(body []byte, boundary string) ([]byte, bool) {
+	delimiter := []byte("--" + boundary)
+	start := 0
+	for {
+		i := bytes.Index(body[start:], delimiter)
+		if i < 0 {
+			return nil, false
+		}
+		start += i
+		if start == 0 || body[start-1] == '\n' {
+			break
+		}
+		start += len(delimiter)
+	}
+	eol := bytes.IndexByte(body[start:], '\n')
+	if eol < 0 {
+		return nil, false
+	}
+	start += eol + 1
+	end := bytes.Index(body[start:], append([]byte("\n"), delimiter...))
+	if end < 0 {
+		return nil, false
+	}
+	content := bytes.TrimSuffix(body[start:start+end], []byte("\r"))
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(content, []byte("\n"), []byte("\r\n")), true
+}
+
+// verifySMIME checks an S/MIME signature with OpenSSL: sig is the signed
+// data, with content for a detached signature or nil if it holds the
+// content. The signature is "valid" if the signer's certificate is issued
+// by a certificate authority OpenSSL trusts, "untrusted" if the content is
+// intact but the certificate is not trusted, and "invalid" otherwise.
+func (x *Extractor) verifySMIME(sig, content []byte) (signature, signer string) {
+	if x.OpenSSL == "" {
+		return "unverified", ""
+	}
+	dir, err := os.MkdirTemp("", "maildir2pdf-signature-")
+	if err != nil {
+		return "unverified", ""
+	}
+	defer os.RemoveAll(dir)
+	sigPath, contentPath, signerPath := filepath.Join(dir, "signature.p7s"), filepath.Join(dir, "content"), filepath.Join(dir, "signer.pem")
+	if err := os.WriteFile(sigPath, sig, 0600); err != nil {
+		return "unverified", ""
+	}
+	args := []string{"cms", "-verify", "-binary", "-inform", "DER", "-in", sigPath, "-out", os.DevNull, "-signer", signerPath}
+	if content != nil {
+		if err := os.WriteFile(contentPath, content, 0600); err != nil {
+			return "unverified", ""
+		}
+		args = append(args, "-content", contentPath)
+	}
+
+	signature = "invalid"
+	if exec.Command(x.OpenSSL, args...).Run() == nil {
+		signature = "valid"
+	} else if exec.Command(x.OpenSSL, append(args, "-noverify")...).Run() == nil {
+		// The signature matches, but its certificate chain was not checked
+		signature = "untrusted"
+	}
+	if data, err := os.ReadFile(signerPath); err == nil {
+		signer = certificateSigner(data)
+	}
+	return signature, signer
+}
+
+// certificateSigner names the signer of the first certificate in PEM data:
+// by its email address, or else the common name of its subject.
+func certificateSigner(data []byte) string {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// verifyPGP checks a detached PGP signature of content with GnuPG, against
+// the keys of the user's keyring. The signature is "valid" if made by a
+// key the keyring fully trusts, "untrusted" if the key is not trusted or
+// has expired, "unknown-key" if the key is not in the keyring, and
+// "invalid" if the content was altered or the key revoked.
+func (x *Extractor) verifyPGP(sig, content []byte) (signature, signer string) {
+	if x.GPG == "" {
+		return "unverified", ""
+	}
+	dir, err := os.MkdirTemp("", "maildir2pdf-signature-")
+	if err != nil {
+		return "unverified", ""
+	}
+	defer os.RemoveAll(dir)
+	sigPath, contentPath := filepath.Join(dir, "signature.asc"), filepath.Join(dir, "content")
+	if err := os.WriteFile(sigPath, sig, 0600); err != nil {
+		return "unverified", ""
+	}
+	if err := os.WriteFile(contentPath, content, 0600); err != nil {
+		return "unverified", ""
+	}
+
+	// GnuPG exits with an error for bad signatures; its status lines say
+	// which
+	cmd := exec.Command(x.GPG, "--batch", "--no-tty", "--status-fd", "1", "--verify", sigPath, contentPath)
+	status, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "unverified", ""
+	}
+
+	signature = "unverified"
+	trusted := false
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.SplitN(strings.TrimPrefix(line, "[GNUPG:] "), " ", 3)
+		switch fields[0] {
+		case "GOODSIG", "EXPSIG", "EXPKEYSIG", "BADSIG", "REVKEYSIG":
+			if len(fields) == 3 {
+				signer = fields[2]
+			}
+			switch fields[0] {
+			case "GOODSIG":
+				signature = "valid"
+			case "EXPSIG", "EXPKEYSIG":
+				signature = "untrusted"
+			default:
+				signature = "invalid"
+			}
+		case "NO_PUBKEY":
+			if signature == "unverified" {
+				signature = "unknown-key"
+				if len(fields) > 1 {
+					signer = fields[1]
+				}
+			}
+		case "TRUST_FULLY", "TRUST_ULTIMATE":
+			trusted = true
+		}
+	}
+	if signature == "valid" && !trusted {
+		signature = "untrusted"
+	}
+	return signature, signer
+}
+
+// berValue is a value of BER, the encoding of ASN.1 CMS signed data uses,
+// with its tag: its class and number, without the constructed bit.
+type berValue struct {
+	tag         byte
+	constructed bool
+	content     []byte
+}
+
+// ASN.1 tags used by CMS, as berValue.tag.
+const (
+	berOctetString = 0x04
+	berOID         = 0x06
+	berSequence    = 0x10
+	berExplicit0   = 0x80 // context-specific [0]
+)
+
+// readBER reads the value at the start of data. Unlike encoding/asn1, it
+// reads the indefinite lengths that mail clients signing as they write use.
+func readBER(data []byte) (v berValue, rest []byte, err error) {
+	if len(data) < 2 {
+		return v, nil, errors.New("truncated value")
+	}
+	if data[0]&0x1f == 0x1f {
+		return v, nil, errors.New("unsupported tag")
+	}
+	v.tag, v.constructed = data[0]&^0x20, data[0]&0x20 != 0
+	length := int(data[1])
+	data = data[2:]
+	switch {
+	case length == 0x80:
+		// Indefinite: the values inside run to two zero bytes
+		if !v.constructed {
+			return v, nil, errors.New("indefinite length for a primitive value")
+		}
+		rest = data
+		for len(rest) < 2 || rest[0] != 0 || rest[1] != 0 {
+			if _, rest, err = readBER(rest); err != nil {
+				return v, nil, err
+			}
+		}
+		v.content = data[:len(data)-len(rest)]
+		return v, rest[2:], nil
+	case length > 0x80:
+		n := length & 0x7f
+		if n > 4 || len(data) < n {
+			return v, nil, errors.New("invalid length")
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length<<8 | int(b)
+		}
+		data = data[n:]
+	}
+	if length < 0 || length > len(data) {
+		return v, nil, errors.New("truncated value")
+	}
+	v.content = data[:length]
+	return v, data[length:], nil
+}
+
+// values returns the values a constructed value holds.
+func (v berValue) values() ([]berValue, error) {
+	var values []berValue
+	for data := v.content; len(data) > 0; {
+		var value berValue
+		var err error
+		if value, data, err = readBER(data); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// octets returns the bytes of an octet string, which BER may split into
+// several.
+func (v berValue) octets() ([]byte, error) {
+	if !v.constructed {
+		return v.content, nil
+	}
+	values, err := v.values()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, value := range values {
+		octets, err := value.octets()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, octets...)
+	}
+	return data, nil
+}
+
+// signedContent returns the content CMS signed data (RFC 5652) holds, found
+// at ContentInfo.content.encapContentInfo.eContent.
+func signedContent(data []byte) ([]byte, error) {
+	contentInfo, _, err := readBER(data)
+	if err != nil {
+		return nil, err
+	}
+	values, err := contentInfo.values()
+	if err != nil {
+		return nil, err
+	}
+	if contentInfo.tag != berSequence || len(values) < 2 || values[0].tag != berOID || !bytes.Equal(values[0].content, signedDataOID) || values[1].tag != berExplicit0 {
+		return nil, errors.New("not signed data")
+	}
+	if values, err = values[1].values(); err != nil {
+		return nil, err
+	}
+	// SignedData: version, digestAlgorithms, encapContentInfo...
+	if len(values) < 1 || values[0].tag != berSequence {
+		return nil, errors.New("malformed signed data")
+	}
+	if values, err = values[0].values(); err != nil {
+		return nil, err
+	}
+	if len(values) < 3 || values[2].tag != berSequence {
+		return nil, errors.New("malformed signed data")
+	}
+	// encapContentInfo: eContentType, then eContent unless detached
+	if values, err = values[2].values(); err != nil {
+		return nil, err
+	}
+	if len(values) < 2 || values[1].tag != berExplicit0 {
+		return nil, errors.New("the signed data holds no content")
+	}
+	if values, err = values[1].values(); err != nil {
+		return nil, err
+	}
+	if len(values) < 1 || values[0].tag != berOctetString {
+		return nil, errors.New("malformed signed data")
+	}
+	return values[0].octets()
+}
@@ -0,0 +1,117 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SMIMEKey is the private key, with its certificate, S/MIME encrypted
+// messages are decrypted with, by OpenSSL.
+type SMIMEKey struct {
+	openssl string
+	pem     []byte // the key and certificate, unencrypted, kept in memory only
+}
+
+// smimePasswordEnv passes the password of a PKCS #12 file to OpenSSL,
+// which would otherwise show in its command line.
+const smimePasswordEnv = "MAILDIR2PDF_OPENSSL_PASSIN"
+
+// LoadSMIMEKey reads the private key and certificate messages are decrypted
+// with from a PKCS #12 file, such as cert.p12 as exported by mail clients,
+// opened with password, or from a PEM file holding both.
+func LoadSMIMEKey(path, password string) (*SMIMEKey, error) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		return nil, fmt.Errorf("decrypting S/MIME messages requires OpenSSL: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(data, []byte("-----BEGIN ")) {
+		return &SMIMEKey{openssl: openssl, pem: data}, nil
+	}
+
+	// Files exported by older software use algorithms OpenSSL 3 only has
+	// in its legacy provider
+	var stderr bytes.Buffer
+	for _, legacy := range []bool{false, true} {
+		args := []string{"pkcs12", "-in", path, "-nodes", "-passin", "env:" + smimePasswordEnv}
+		if legacy {
+			args = append(args, "-legacy")
+		}
+		cmd := exec.Command(openssl, args...)
+		cmd.Env = append(os.Environ(), smimePasswordEnv+"="+password)
+		stderr.Reset()
+		cmd.Stderr = &stderr
+		if pem, err := cmd.Output(); err == nil {
+			return &SMIMEKey{openssl: openssl, pem: pem}, nil
+		}
+	}
+	return nil, fmt.Errorf("openssl pkcs12: %s", strings.TrimSpace(stderr.String()))
+}
+
+// isSMIMEEncrypted reports whether a message, or part, with the given
+// Content-Type is S/MIME enveloped data, as opposed to the signed data the
+// same media type can also carry.
+func isSMIMEEncrypted(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/pkcs7-mime" && mediaType != "application/x-pkcs7-mime" {
+		return false
+	}
+	switch strings.ToLower(params["smime-type"]) {
+	case "enveloped-data", "authenveloped-data":
+		return true
+	case "":
+		// Older clients leave smime-type out; encrypted messages are named
+		// smime.p7m
+		return strings.EqualFold(params["name"], "smime.p7m")
+	}
+	return false
+}
+
+// decryptSMIME returns the MIME entity S/MIME encrypted in msg, whose
+// attachments are then extracted as those of the message.
+func (x *Extractor) decryptSMIME(msg *mail.Message) (*mail.Message, error) {
+	der, err := io.ReadAll(decodeTransferEncoding(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return nil, err
+	}
+
+	// The key is handed over through a pipe rather than a file, so that it
+	// is never written to disk unencrypted
+	keyReader, keyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer keyReader.Close()
+	cmd := exec.Command(x.SMIME.openssl, "cms", "-decrypt", "-inform", "DER", "-inkey", "/dev/fd/3")
+	cmd.ExtraFiles = []*os.File{keyReader}
+	cmd.Stdin = bytes.NewReader(der)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		keyWriter.Close()
+		return nil, err
+	}
+	go func() {
+		keyWriter.Write(x.SMIME.pem)
+		keyWriter.Close()
+	}()
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("openssl cms: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	inner, err := mail.ReadMessage(bufio.NewReader(&stdout))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the decrypted message: %v", err)
+	}
+	return inner, nil
+}
@@ -0,0 +1,342 @@
+package extract
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "modernc.org/sqlite"
+)
+
+// stateSchema records every message scanned and every attachment extracted,
+// so later runs over the same maildir can skip work already done, and
+// catalogs the documents saved with the headers of their message, to query
+// them later. Databases written before documents existed have no catalog
+// entries for the attachments they recorded.
+const stateSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	message_key TEXT PRIMARY KEY,
+	path        TEXT NOT NULL,
+	mailbox     TEXT NOT NULL,
+	scanned_at  TEXT NOT NULL
+);
+-- Seen also looks messages up by path
+CREATE INDEX IF NOT EXISTS messages_path ON messages(path);
+CREATE TABLE IF NOT EXISTS attachments (
+	message_key TEXT NOT NULL,
+	part        INTEGER NOT NULL,
+	path        TEXT NOT NULL,
+	output      TEXT NOT NULL,
+	sha256      TEXT NOT NULL,
+	saved_at    TEXT NOT NULL,
+	PRIMARY KEY (message_key, part)
+);
+CREATE TABLE IF NOT EXISTS documents (
+	message_key TEXT NOT NULL,
+	part        INTEGER NOT NULL,
+	filename    TEXT NOT NULL,
+	media_type  TEXT NOT NULL,
+	size        INTEGER NOT NULL,
+	sender      TEXT NOT NULL,
+	sender_name TEXT NOT NULL,
+	subject     TEXT NOT NULL,
+	date        TEXT NOT NULL,
+	message_id  TEXT NOT NULL,
+	PRIMARY KEY (message_key, part)
+);
+CREATE TABLE IF NOT EXISTS contents (
+	sha256   TEXT PRIMARY KEY,
+	output   TEXT NOT NULL,
+	saved_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS imap_folders (
+	account      TEXT NOT NULL,
+	folder       TEXT NOT NULL,
+	uid_validity INTEGER NOT NULL,
+	last_uid     INTEGER NOT NULL,
+	PRIMARY KEY (account, folder)
+);
+`
+
+// StateDB is the persistent record of previous runs.
+type StateDB struct {
+	db *sql.DB
+}
+
+// OpenState opens the state database at path, creating it if needed.
+func OpenState(path string) (*StateDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialize access from the workers
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(stateSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing state database %s: %v", path, err)
+	}
+	return &StateDB{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (s *StateDB) Close() error {
+	return s.db.Close()
+}
+
+// messageKey identifies a message across runs. Maildir renames files when
+// their flags change, so the Message-ID is preferred over the path. Messages
+// with neither, such as those read from standard input without a
+// Message-ID, cannot be tracked and get an empty key.
+func messageKey(email *Email) string {
+	if email.MessageID != "" {
+		return "id:" + email.MessageID
+	}
+	if email.Path != "" {
+		return "path:" + email.Path
+	}
+	return ""
+}
+
+// Seen reports whether an earlier run recorded email, so that it is
+// skipped unless Force is set.
+func (s *StateDB) Seen(email *Email) (bool, error) {
+	key := messageKey(email)
+	if key == "" {
+		return false, nil
+	}
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE message_key = ? OR (path = ? AND path != '')`,
+		key, email.Path).Scan(&n)
+	return n > 0, err
+}
+
+func (s *StateDB) markScanned(email *Email) error {
+	if messageKey(email) == "" {
+		return nil
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO messages (message_key, path, mailbox, scanned_at) VALUES (?, ?, ?, ?)`,
+		messageKey(email), email.Path, email.Mailbox, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (s *StateDB) recordAttachment(saved *Saved) error {
+	email := saved.Email
+	if messageKey(email) == "" {
+		return nil
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO attachments (message_key, part, path, output, sha256, saved_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		messageKey(email), saved.Index, email.Path, saved.Path, saved.SHA256, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	var date string
+	if !email.Date.IsZero() {
+		date = email.Date.Format(time.RFC3339)
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO documents (message_key, part, filename, media_type, size, sender, sender_name, subject, date, message_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		messageKey(email), saved.Index, saved.Filename, saved.MediaType, saved.Size, email.From, email.FromName, email.Subject, date, email.MessageID)
+	return err
+}
+
+// savedContent returns the file an earlier run saved content with the given
+// SHA-256 to, as decoded before post-processing, if that file still exists.
+// Files stored in a Remote are assumed to still be there.
+func (s *StateDB) savedContent(sum string) (string, error) {
+	var output string
+	err := s.db.QueryRow(`SELECT output FROM contents WHERE sha256 = ?`, sum).Scan(&output)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if IsRemoteOutput(output) {
+		return output, nil
+	}
+	if _, err := os.Stat(output); err != nil {
+		return "", nil
+	}
+	return output, nil
+}
+
+func (s *StateDB) recordContent(sum, output string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO contents (sha256, output, saved_at) VALUES (?, ?, ?)`,
+		sum, output, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// imapLastUID returns the highest UID fetched from an IMAP folder by earlier
+// runs, or 0 if the folder is new or its UIDVALIDITY changed, which
+// invalidates all its UIDs.
+func (s *StateDB) imapLastUID(account, folder string, uidValidity uint32) (uint32, error) {
+	var storedValidity, lastUID uint32
+	err := s.db.QueryRow(`SELECT uid_validity, last_uid FROM imap_folders WHERE account = ? AND folder = ?`,
+		account, folder).Scan(&storedValidity, &lastUID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil || storedValidity != uidValidity {
+		return 0, err
+	}
+	return lastUID, nil
+}
+
+func (s *StateDB) setIMAPLastUID(account, folder string, uidValidity, lastUID uint32) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO imap_folders (account, folder, uid_validity, last_uid) VALUES (?, ?, ?, ?)`,
+		account, folder, uidValidity, lastUID)
+	return err
+}
+
+// Recorded is an attachment the state database records as extracted.
+type Recorded struct {
+	Key     string // identifies its message, for RecordedPart
+	Source  string // the message file it was extracted from
+	Mailbox string
+	Part    int // index of the attachment within its message
+	Output  string
+	SHA256  string // of the file as saved
+	SavedAt time.Time
+
+	// From the catalog; empty for attachments recorded by versions that
+	// did not keep one
+	Filename  string // original filename
+	MediaType string
+	Size      int64
+	From      string // bare address of the sender
+	FromName  string
+	Subject   string
+	Date      time.Time // of the message; zero if unknown
+	MessageID string
+}
+
+// recordedQuery selects the attachments recorded, with the columns
+// scanRecorded reads, for a WHERE clause to be appended.
+const recordedQuery = `
+	SELECT a.message_key, a.path, COALESCE(m.mailbox, ''), a.part, a.output, a.sha256, a.saved_at,
+		COALESCE(d.filename, ''), COALESCE(d.media_type, ''), COALESCE(d.size, 0), COALESCE(d.sender, ''),
+		COALESCE(d.sender_name, ''), COALESCE(d.subject, ''), COALESCE(d.date, ''), COALESCE(d.message_id, '')
+	FROM attachments a LEFT JOIN messages m ON m.message_key = a.message_key
+	LEFT JOIN documents d ON d.message_key = a.message_key AND d.part = a.part`
+
+func scanRecorded(rows *sql.Rows) ([]Recorded, error) {
+	defer rows.Close()
+	var recorded []Recorded
+	for rows.Next() {
+		var r Recorded
+		var savedAt, date string
+		if err := rows.Scan(&r.Key, &r.Source, &r.Mailbox, &r.Part, &r.Output, &r.SHA256, &savedAt,
+			&r.Filename, &r.MediaType, &r.Size, &r.From, &r.FromName, &r.Subject, &date, &r.MessageID); err != nil {
+			return nil, err
+		}
+		r.SavedAt, _ = time.Parse(time.RFC3339, savedAt)
+		if date != "" {
+			r.Date, _ = time.Parse(time.RFC3339, date)
+		}
+		recorded = append(recorded, r)
+	}
+	return recorded, rows.Err()
+}
+
+// Recorded returns the attachments extracted by earlier runs, oldest first.
+func (s *StateDB) Recorded() ([]Recorded, error) {
+	rows, err := s.db.Query(recordedQuery + ` ORDER BY a.saved_at, a.output`)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecorded(rows)
+}
+
+// RecordedFilter selects the attachments SearchRecorded returns. The
+// catalog fields, Sender, Year and Subject, match nothing recorded by
+// versions that did not keep one, except Year, which falls back to when
+// the file was saved.
+type RecordedFilter struct {
+	Words       []string // each contained in the output path or the mailbox, ignoring ASCII case
+	Mailbox     string   // if set, the only mailbox
+	Sender      string   // if set, the sender address, or a domain of the sender address or one above it, ignoring ASCII case
+	Year        int      // if set, the year of the message, or of when the file was saved, in local time, if its date is unknown
+	Subject     string   // contained in the subject of the message, ignoring ASCII case
+	OldestFirst bool     // rather than newest first
+	Limit       int      // at most this many, or all if 0
+	Offset      int      // skipping as many first
+}
+
+// SearchRecorded returns the attachments extracted by earlier runs that
+// match filter, newest first unless filter says otherwise, and how many
+// match in all.
+func (s *StateDB) SearchRecorded(filter RecordedFilter) ([]Recorded, int, error) {
+	where := ` WHERE 1`
+	var args []any
+	for _, word := range filter.Words {
+		where += ` AND instr(LOWER(a.output || ' ' || COALESCE(m.mailbox, '')), LOWER(?)) > 0`
+		args = append(args, word)
+	}
+	if filter.Mailbox != "" {
+		where += ` AND m.mailbox = ?`
+		args = append(args, filter.Mailbox)
+	}
+	if sender := strings.ToLower(filter.Sender); strings.Contains(sender, "@") {
+		where += ` AND LOWER(COALESCE(d.sender, '')) = ?`
+		args = append(args, sender)
+	} else if sender != "" {
+		// The address itself, or one ending with @ or . and the domain
+		where += ` AND (LOWER(COALESCE(d.sender, '')) = ? OR substr(LOWER(COALESCE(d.sender, '')), -?) IN (?, ?))`
+		args = append(args, sender, utf8.RuneCountInString(sender)+1, "@"+sender, "."+sender)
+	}
+	if filter.Year != 0 {
+		where += ` AND COALESCE(NULLIF(substr(d.date, 1, 4), ''), strftime('%Y', a.saved_at, 'localtime')) = ?`
+		args = append(args, fmt.Sprintf("%04d", filter.Year))
+	}
+	if filter.Subject != "" {
+		where += ` AND instr(LOWER(COALESCE(d.subject, '')), LOWER(?)) > 0`
+		args = append(args, filter.Subject)
+	}
+
+	var total int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM attachments a LEFT JOIN messages m ON m.message_key = a.message_key
+		LEFT JOIN documents d ON d.message_key = a.message_key AND d.part = a.part`+where,
+		args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // no limit, for SQLite
+	}
+	order := ` ORDER BY a.saved_at DESC, a.output DESC`
+	if filter.OldestFirst {
+		order = ` ORDER BY a.saved_at, a.output`
+	}
+	rows, err := s.db.Query(recordedQuery+where+order+` LIMIT ? OFFSET ?`,
+		append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	recorded, err := scanRecorded(rows)
+	return recorded, total, err
+}
+
+// RecordedPart returns the attachment recorded as part of the message with
+// key, as Recorded.Key reports it, if there is one.
+func (s *StateDB) RecordedPart(key string, part int) (Recorded, bool, error) {
+	rows, err := s.db.Query(recordedQuery+` WHERE a.message_key = ? AND a.part = ?`, key, part)
+	if err != nil {
+		return Recorded{}, false, err
+	}
+	recorded, err := scanRecorded(rows)
+	if err != nil || len(recorded) == 0 {
+		return Recorded{}, false, err
+	}
+	return recorded[0], true, nil
+}
+
+// MessageCount returns the number of messages scanned by earlier runs.
+func (s *StateDB) MessageCount() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,127 @@
+package extract
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Views of the content-addressable store, for Extractor.StoreViews.
+const (
+	ViewMailbox = "mailbox" // by-mailbox/MAILBOX/NAME
+	ViewDate    = "date"    // by-date/YYYY/MM/NAME
+	ViewSender  = "sender"  // by-sender/ADDRESS/NAME
+)
+
+// DefaultStoreViews lists the views of the store made when none are
+// configured.
+var DefaultStoreViews = []string{ViewMailbox, ViewDate, ViewSender}
+
+// storeFile files the complete file at tmpPath, whose content has the given
+// SHA-256, in the content-addressable store under OutputDir, unless the
+// store already has it, and links it into each of StoreViews under
+// filename. It returns the path of the file in the first view, or in the
+// store if there are no views.
+func (x *Extractor) storeFile(tmpPath, sum, filename string, email *Email) (string, error) {
+	dir := filepath.Join(x.OutputDir, "store", sum[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	object := filepath.Join(dir, sum[2:]+strings.ToLower(filepath.Ext(filename)))
+	if err := os.Link(tmpPath, object); err != nil && !os.IsExist(err) {
+		// No hard links on this filesystem
+		if _, statErr := os.Stat(object); !os.IsNotExist(statErr) {
+			return "", err
+		}
+		if err := os.Rename(tmpPath, object); err != nil {
+			return "", err
+		}
+	}
+	if x.Fsync {
+		syncDir(dir)
+	}
+
+	path := object
+	for i, view := range x.StoreViews {
+		viewPath, err := linkInto(object, x.viewDir(view, email), filename, x.StoreSymlinks)
+		if err != nil {
+			return "", fmt.Errorf("error adding to the %s view: %v", view, err)
+		}
+		if i == 0 {
+			path = viewPath
+		}
+	}
+	return path, nil
+}
+
+// viewDir returns the directory of a view an attachment of email goes in.
+func (x *Extractor) viewDir(view string, email *Email) string {
+	base := filepath.Join(x.OutputDir, "by-"+view)
+	switch view {
+	case ViewMailbox:
+		dir := base
+		for _, component := range strings.Split(email.Mailbox, "/") {
+			component = sanitizeFilename(component)
+			if component == "." || component == ".." || component == "" {
+				component = "_"
+			}
+			dir = filepath.Join(dir, component)
+		}
+		return dir
+	case ViewDate:
+		if email.Date.IsZero() {
+			return filepath.Join(base, "undated")
+		}
+		return filepath.Join(base, email.Date.Format("2006"), email.Date.Format("01"))
+	case ViewSender:
+		sender := sanitizeFilename(strings.ToLower(email.From))
+		if sender == "" || sender == "." || sender == ".." {
+			sender = "unknown"
+		}
+		return filepath.Join(base, sender)
+	}
+	return base
+}
+
+// linkInto links object into dir under filename, with a symbolic link if
+// symlink is set and a hard link otherwise, adding a numeric suffix if the
+// name is taken by another file, as linkUnique does. A link to object
+// already there, from an earlier run or another copy of the same message, is
+// kept instead of adding another.
+func linkInto(object, dir, filename string, symlink bool) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	objectInfo, err := os.Stat(object)
+	if err != nil {
+		return "", err
+	}
+	target := object
+	if symlink {
+		if target, err = filepath.Rel(dir, object); err != nil {
+			return "", err
+		}
+	}
+
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	path := filepath.Join(dir, filename)
+	for counter := 1; ; counter++ {
+		if symlink {
+			err = os.Symlink(target, path)
+		} else {
+			err = os.Link(target, path)
+		}
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		if info, err := os.Stat(path); err == nil && os.SameFile(info, objectInfo) {
+			return path, nil
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s_%d%s", name, counter, ext))
+	}
+}
@@ -0,0 +1,164 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// Gmail labels that name a system folder, and the mailboxes they map to.
+var gmailFolders = map[string]string{
+	"inbox":  "INBOX",
+	"sent":   "Sent",
+	"drafts": "Drafts",
+	"spam":   "Spam",
+	"trash":  "Trash",
+	"chat":   "Chat",
+}
+
+// gmailMarkers are Gmail labels that mark messages rather than file them.
+var gmailMarkers = map[string]bool{
+	"important": true,
+	"starred":   true,
+	"unread":    true,
+	"opened":    true,
+	"archived":  true,
+}
+
+// gmailArchive is the mailbox of messages with neither a label of their own
+// nor a system folder, which Gmail only shows in All Mail.
+const gmailArchive = "Archive"
+
+// ScanTakeout extracts attachments from a Gmail export made with Google
+// Takeout: an mbox file, or a directory of them, whose messages carry their
+// Gmail labels in an X-Gmail-Labels header. Each message is attributed to a
+// mailbox named after its labels, as GmailMailbox chooses, except that with
+// IncludeMailboxes, the first label they match is used. A message is
+// scanned if any of its labels, or that mailbox, matches IncludeMailboxes,
+// and none matches ExcludeMailboxes.
+func (s *Scanner) ScanTakeout(takeoutPath string) error {
+	files, err := DiscoverMboxes(takeoutPath)
+	if err != nil {
+		return fmt.Errorf("error discovering mbox files: %v", err)
+	}
+	if s.OnQueued != nil {
+		for _, file := range files {
+			if n, err := countMbox(file.Path); err == nil {
+				s.queued(n)
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	s.run(func(jobs chan<- emailJob) {
+		for _, file := range files {
+			if s.cancelled() {
+				return
+			}
+			err := s.readMboxFile(file.Path, func(path string, message []byte) bool {
+				mailbox, ok := s.takeoutMailbox(message)
+				if !ok {
+					if s.OnProcessed != nil {
+						s.OnProcessed()
+					}
+					return true
+				}
+				mu.Lock()
+				if !seen[mailbox] {
+					seen[mailbox] = true
+					s.scanning([]Mailbox{{Name: mailbox, Path: file.Path}})
+				}
+				mu.Unlock()
+				return s.send(jobs, emailJob{path: path, mailbox: mailbox, data: message})
+			})
+			if err != nil {
+				s.logError(fmt.Errorf("scanning mbox %s: %v", file.Path, err))
+			}
+		}
+	})
+
+	return nil
+}
+
+// takeoutMailbox returns the mailbox of a message of a Takeout export, and
+// whether the mailbox filters select it.
+func (s *Scanner) takeoutMailbox(message []byte) (string, bool) {
+	var labels []string
+	if msg, err := mail.ReadMessage(bytes.NewReader(message)); err == nil {
+		labels = GmailLabels(msg.Header.Get("X-Gmail-Labels"))
+	}
+	mailbox := GmailMailbox(labels)
+	names := append(labels, mailbox)
+	for _, label := range names {
+		if matchMailbox(s.ExcludeMailboxes, label) {
+			return "", false
+		}
+	}
+	if len(s.IncludeMailboxes) == 0 {
+		return mailbox, true
+	}
+	for _, label := range names {
+		if matchMailbox(s.IncludeMailboxes, label) {
+			if folder, ok := gmailFolders[strings.ToLower(label)]; ok {
+				return folder, true
+			}
+			return label, true
+		}
+	}
+	return "", false
+}
+
+// GmailLabels splits the value of an X-Gmail-Labels header into labels.
+// Labels are separated by commas, those containing one are quoted, and
+// non-ASCII ones are RFC 2047 encoded.
+func GmailLabels(header string) []string {
+	var labels []string
+	var label strings.Builder
+	quoted := false
+	flush := func() {
+		if l := strings.TrimSpace(label.String()); l != "" {
+			labels = append(labels, decodeHeader(l))
+		}
+		label.Reset()
+	}
+	for _, c := range header {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			flush()
+		default:
+			label.WriteRune(c)
+		}
+	}
+	flush()
+	return labels
+}
+
+// GmailMailbox returns the mailbox a message with the given Gmail labels
+// belongs in: its first label of its own, such as Receipts/2023, or failing
+// that, the system folder it is in, INBOX for Inbox, or Archive if it is in
+// none. Labels that only mark messages, such as Important, Unread or the
+// Category ones of the inbox tabs, are ignored.
+func GmailMailbox(labels []string) string {
+	folder := ""
+	for _, label := range labels {
+		key := strings.ToLower(label)
+		switch {
+		case gmailMarkers[key] || strings.HasPrefix(key, "category "):
+		case gmailFolders[key] != "":
+			if folder == "" {
+				folder = gmailFolders[key]
+			}
+		default:
+			return label
+		}
+	}
+	if folder == "" {
+		return gmailArchive
+	}
+	return folder
+}
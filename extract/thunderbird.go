@@ -0,0 +1,216 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ScanThunderbird extracts attachments from the folders of every account of
+// a Thunderbird profile, stored as mbox files or, with the maildir store of
+// newer versions, as maildirs. Folders are named after their account and
+// path, e.g. imap.example.com/Archives/2023 for
+// ImapMail/imap.example.com/Archives.sbd/2023, so the mailbox filters and
+// PreserveFolders apply as they do to maildirs. Messages Thunderbird has
+// deleted but not yet compacted away are skipped, and SeenOnly keeps those
+// it marks as read.
+func (s *Scanner) ScanThunderbird(profilePath string) error {
+	mailboxes, err := DiscoverThunderbirdFolders(profilePath)
+	if err != nil {
+		return fmt.Errorf("error discovering Thunderbird folders: %v", err)
+	}
+	mailboxes = s.filterMailboxes(mailboxes)
+	s.scanning(mailboxes)
+
+	// Messages of maildir folders are listed first, as in Scan
+	queues := make(map[string][]emailJob)
+	for _, mailbox := range mailboxes {
+		if info, err := os.Stat(mailbox.Path); err == nil && info.IsDir() {
+			queue, err := s.listThunderbirdMaildir(mailbox)
+			if err != nil {
+				s.logError(fmt.Errorf("scanning mailbox %s: %v", mailbox.Name, err))
+			}
+			queues[mailbox.Path] = queue
+			s.queued(len(queue))
+		} else if s.OnQueued != nil {
+			if n, err := countMbox(mailbox.Path); err == nil {
+				s.queued(n)
+			}
+		}
+	}
+
+	s.run(func(jobs chan<- emailJob) {
+		for _, mailbox := range mailboxes {
+			if s.cancelled() {
+				return
+			}
+			if queue, ok := queues[mailbox.Path]; ok {
+				for _, job := range queue {
+					if !s.send(jobs, job) {
+						return
+					}
+				}
+				continue
+			}
+			if err := s.scanThunderbirdMbox(mailbox.Path, mailbox.Name, jobs); err != nil {
+				s.logError(fmt.Errorf("scanning mbox %s: %v", mailbox.Path, err))
+			}
+		}
+	})
+
+	return nil
+}
+
+// DiscoverThunderbirdFolders returns the folders of every account in the
+// Mail and ImapMail directories of a Thunderbird profile. Mailbox.Path is
+// an mbox file, or a maildir with the maildir store.
+func DiscoverThunderbirdFolders(profilePath string) ([]Mailbox, error) {
+	var mailboxes []Mailbox
+	found := false
+	for _, store := range []string{"Mail", "ImapMail"} {
+		accounts, err := os.ReadDir(filepath.Join(profilePath, store))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, account := range accounts {
+			if !account.IsDir() {
+				continue
+			}
+			folders, err := thunderbirdFolders(filepath.Join(profilePath, store, account.Name()), account.Name()+"/")
+			if err != nil {
+				return nil, err
+			}
+			mailboxes = append(mailboxes, folders...)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s has no Mail or ImapMail directory; is it a Thunderbird profile?", profilePath)
+	}
+	return mailboxes, nil
+}
+
+// thunderbirdFolders returns the folders in dir, named with prefix, and
+// those in the NAME.sbd directories holding the subfolders of each.
+func thunderbirdFolders(dir, prefix string) ([]Mailbox, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var mailboxes []Mailbox
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.Type()&os.ModeSymlink != 0:
+			// Skip symlinks
+		case entry.IsDir() && strings.HasSuffix(entry.Name(), ".sbd"):
+			subfolders, err := thunderbirdFolders(path, prefix+strings.TrimSuffix(entry.Name(), ".sbd")+"/")
+			if err != nil {
+				return nil, err
+			}
+			mailboxes = append(mailboxes, subfolders...)
+		case entry.IsDir() && isValidMailbox(path):
+			mailboxes = append(mailboxes, Mailbox{Name: prefix + entry.Name(), Path: path})
+		case entry.Type().IsRegular() && isMbox(path):
+			// Indexes (.msf), filters and other files do not start with a
+			// "From " line, and nor do empty folders
+			mailboxes = append(mailboxes, Mailbox{Name: prefix + entry.Name(), Path: path})
+		}
+	}
+	return mailboxes, nil
+}
+
+// listThunderbirdMaildir lists the messages of a folder in the maildir
+// store, which keeps them in cur, with the flags in their X-Mozilla-Status
+// header rather than their filename.
+func (s *Scanner) listThunderbirdMaildir(mailbox Mailbox) ([]emailJob, error) {
+	entries, err := os.ReadDir(filepath.Join(mailbox.Path, "cur"))
+	if err != nil {
+		return nil, err
+	}
+	var queue []emailJob
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(mailbox.Path, "cur", entry.Name())
+		if s.SeenOnly {
+			head, err := readHead(path, 16*1024)
+			if err != nil {
+				s.logError(fmt.Errorf("processing %s: %v", path, err))
+				continue
+			}
+			if !s.wantedMozillaStatus(head) {
+				continue
+			}
+		}
+		queue = append(queue, emailJob{path: path, mailbox: mailbox.Name})
+	}
+	return queue, nil
+}
+
+// scanThunderbirdMbox queues the messages of an mbox folder, as
+// scanMboxFile does, leaving out those the X-Mozilla-Status header of
+// which rules out.
+func (s *Scanner) scanThunderbirdMbox(path, mailboxName string, jobs chan<- emailJob) error {
+	return s.readMboxFile(path, func(messagePath string, message []byte) bool {
+		if !s.wantedMozillaStatus(message) {
+			if s.OnProcessed != nil {
+				s.OnProcessed()
+			}
+			return true
+		}
+		return s.send(jobs, emailJob{path: messagePath, mailbox: mailboxName, data: message})
+	})
+}
+
+// Flags of the X-Mozilla-Status header, in hexadecimal.
+const (
+	mozillaRead     = 0x0001
+	mozillaExpunged = 0x0008 // deleted, until the folder is compacted
+)
+
+// wantedMozillaStatus reports whether a message, starting with its header,
+// is to be processed given its X-Mozilla-Status flags: not if it has been
+// deleted, nor, with SeenOnly, if it has not been read. Messages without
+// the header are.
+func (s *Scanner) wantedMozillaStatus(message []byte) bool {
+	header, _, _ := bytes.Cut(message, []byte("\n\n"))
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		value, ok := bytes.CutPrefix(line, []byte("X-Mozilla-Status:"))
+		if !ok {
+			continue
+		}
+		flags, err := strconv.ParseUint(string(bytes.TrimSpace(value)), 16, 32)
+		if err != nil {
+			return true
+		}
+		if flags&mozillaExpunged != 0 {
+			return false
+		}
+		return !s.SeenOnly || flags&mozillaRead != 0
+	}
+	return !s.SeenOnly
+}
+
+// readHead returns up to n bytes from the start of the file at path.
+func readHead(path string, n int) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, n)
+	read, err := file.Read(head)
+	if err != nil && read == 0 {
+		return nil, err
+	}
+	return head[:read], nil
+}
@@ -0,0 +1,252 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"unicode/utf16"
+)
+
+// TNEF (winmail.dat) is the Outlook/Exchange wrapper format described in
+// [MS-OXTNEF]. Only what is needed to recover attachments is decoded.
+
+const tnefSignature = 0x223E9F78
+
+const (
+	tnefLevelAttachment = 0x02
+
+	attAttachRendData = 0x9002 // starts a new attachment
+	attAttachTitle    = 0x8010 // short (8.3) filename
+	attAttachData     = 0x800F // attachment content
+	attAttachment     = 0x9005 // MAPI properties of the attachment
+)
+
+// MAPI property IDs and types used in attAttachment
+const (
+	prAttachFilename     = 0x3704
+	prAttachLongFilename = 0x3707
+	prAttachMimeTag      = 0x370E
+
+	ptString8   = 0x001E
+	ptUnicode   = 0x001F
+	ptBinary    = 0x0102
+	ptObject    = 0x000D
+	ptClsid     = 0x0048
+	ptMultiFlag = 0x1000
+)
+
+var errTNEFTruncated = errors.New("truncated TNEF data")
+
+// isTNEF reports whether an attachment is a TNEF (winmail.dat) blob.
+func isTNEF(mediaType, filename string) bool {
+	return mediaType == "application/ms-tnef" || mediaType == "application/vnd.ms-tnef" ||
+		strings.EqualFold(filename, "winmail.dat")
+}
+
+// processTNEF extracts the wanted attachments from a TNEF blob.
+func (x *Extractor) processTNEF(body io.Reader, email *Email) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error reading TNEF data: %v", err)
+	}
+
+	attachments, err := parseTNEF(data)
+	if err != nil {
+		if len(attachments) == 0 {
+			return fmt.Errorf("error decoding TNEF data: %v", err)
+		}
+		slog.Warn("TNEF data is damaged, extracting what could be decoded", "source", email.Path, "error", err)
+	}
+
+	for _, attachment := range attachments {
+		mediaType, reader := x.resolveType(attachment.MimeType, attachment.Filename, bytes.NewReader(attachment.Data))
+		if !x.wanted(mediaType, attachment.Filename) {
+			continue
+		}
+		if err := x.saveAttachment(reader, attachment.Filename, mediaType, email); err != nil {
+			x.partError(fmt.Errorf("saving %s from TNEF data: %v", attachment.Filename, err), email)
+		}
+	}
+	return nil
+}
+
+// tnefAttachment is a file found inside a TNEF stream.
+type tnefAttachment struct {
+	Filename string
+	MimeType string
+	Data     []byte
+}
+
+// parseTNEF returns the attachments contained in a TNEF stream.
+func parseTNEF(data []byte) ([]tnefAttachment, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != tnefSignature {
+		return nil, errors.New("not a TNEF stream")
+	}
+	data = data[6:] // signature and legacy key
+
+	var attachments []tnefAttachment
+	var current *tnefAttachment
+	for len(data) > 0 {
+		if len(data) < 9 {
+			return attachments, errTNEFTruncated
+		}
+		level := data[0]
+		id := binary.LittleEndian.Uint32(data[1:]) & 0xFFFF
+		length := binary.LittleEndian.Uint32(data[5:])
+		data = data[9:]
+		if uint64(len(data)) < uint64(length)+2 {
+			return attachments, errTNEFTruncated
+		}
+		value := data[:length]
+		data = data[length+2:] // skip the checksum
+
+		if level != tnefLevelAttachment {
+			continue
+		}
+		switch id {
+		case attAttachRendData:
+			attachments = append(attachments, tnefAttachment{})
+			current = &attachments[len(attachments)-1]
+		case attAttachTitle:
+			if current != nil && current.Filename == "" {
+				current.Filename = strings.TrimRight(string(value), "\x00")
+			}
+		case attAttachData:
+			if current != nil {
+				current.Data = value
+			}
+		case attAttachment:
+			if current != nil {
+				applyTNEFProperties(current, value)
+			}
+		}
+	}
+
+	return attachments, nil
+}
+
+// applyTNEFProperties extracts the long filename and MIME type from an
+// attAttachment MAPI property list. Decoding stops quietly at the first
+// property it does not understand; whatever was found until then is kept.
+func applyTNEFProperties(attachment *tnefAttachment, data []byte) {
+	r := tnefReader{data: data}
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		propType := r.uint16()
+		propID := r.uint16()
+		if propID >= 0x8000 {
+			// Named property: GUID, kind, then an ID or a name
+			r.skip(16)
+			if r.uint32() == 0 {
+				r.skip(4)
+			} else {
+				r.skip(pad4(r.uint32()))
+			}
+		}
+
+		values := uint32(1)
+		multi := propType&ptMultiFlag != 0
+		propType &^= ptMultiFlag
+		variable := propType == ptString8 || propType == ptUnicode || propType == ptBinary || propType == ptObject
+		if multi || variable {
+			values = r.uint32()
+		}
+
+		for v := uint32(0); v < values && r.err == nil; v++ {
+			if !variable {
+				r.skip(tnefFixedSize(propType))
+				continue
+			}
+			length := r.uint32()
+			value := r.bytes(length)
+			r.skipPadding(length)
+			if r.err != nil || v > 0 {
+				continue
+			}
+			switch propID {
+			case prAttachLongFilename, prAttachFilename:
+				if name := tnefString(propType, value); name != "" && (propID == prAttachLongFilename || attachment.Filename == "") {
+					attachment.Filename = name
+				}
+			case prAttachMimeTag:
+				attachment.MimeType = strings.ToLower(tnefString(propType, value))
+			}
+		}
+	}
+}
+
+func tnefFixedSize(propType uint16) uint32 {
+	switch propType {
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040: // double, currency, apptime, int64, systime
+		return 8
+	case ptClsid:
+		return 16
+	default: // short, long, float, error, boolean are padded to 4 bytes
+		return 4
+	}
+}
+
+func tnefString(propType uint16, value []byte) string {
+	if propType != ptUnicode {
+		return strings.TrimRight(string(value), "\x00")
+	}
+	units := make([]uint16, len(value)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(value[2*i:])
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+}
+
+func pad4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+// tnefReader reads little-endian values, remembering the first overrun.
+type tnefReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tnefReader) bytes(n uint32) []byte {
+	if r.err != nil || uint64(n) > uint64(len(r.data)) {
+		r.err = errTNEFTruncated
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+// skipPadding skips the alignment after a value of length n. A final value
+// is sometimes left unpadded, so running out of data is not an error.
+func (r *tnefReader) skipPadding(n uint32) {
+	if padding := pad4(n) - n; uint64(padding) <= uint64(len(r.data)) {
+		r.data = r.data[padding:]
+	}
+}
+
+func (r *tnefReader) skip(n uint32) {
+	if r.err != nil || uint64(n) > uint64(len(r.data)) {
+		r.err = errTNEFTruncated
+		return
+	}
+	r.data = r.data[n:]
+}
+
+func (r *tnefReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tnefReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+// tnefWriter builds TNEF streams for the tests.
+type tnefWriter struct {
+	bytes.Buffer
+}
+
+func newTNEFWriter() *tnefWriter {
+	w := &tnefWriter{}
+	binary.Write(w, binary.LittleEndian, uint32(tnefSignature))
+	binary.Write(w, binary.LittleEndian, uint16(0x0001))
+	return w
+}
+
+// attribute writes an attribute with its checksum.
+func (w *tnefWriter) attribute(level byte, id uint32, value []byte) {
+	w.WriteByte(level)
+	binary.Write(w, binary.LittleEndian, id)
+	binary.Write(w, binary.LittleEndian, uint32(len(value)))
+	w.Write(value)
+	var sum uint16
+	for _, b := range value {
+		sum += uint16(b)
+	}
+	binary.Write(w, binary.LittleEndian, sum)
+}
+
+// tnefProps builds an attAttachment MAPI property list.
+type tnefProps struct {
+	bytes.Buffer
+	count uint32
+}
+
+func (p *tnefProps) header(propType, propID uint16) {
+	p.count++
+	binary.Write(p, binary.LittleEndian, propType)
+	binary.Write(p, binary.LittleEndian, propID)
+}
+
+// variable writes a property with variable-length values.
+func (p *tnefProps) variable(propType, propID uint16, values ...[]byte) {
+	p.header(propType, propID)
+	binary.Write(p, binary.LittleEndian, uint32(len(values)))
+	for _, value := range values {
+		binary.Write(p, binary.LittleEndian, uint32(len(value)))
+		p.Write(value)
+		p.Write(make([]byte, pad4(uint32(len(value)))-uint32(len(value))))
+	}
+}
+
+func (p *tnefProps) bytes() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, p.count)
+	return append(out, p.Bytes()...)
+}
+
+func unicodeValue(s string) []byte {
+	var out []byte
+	for _, u := range utf16.Encode([]rune(s + "\x00")) {
+		out = binary.LittleEndian.AppendUint16(out, u)
+	}
+	return out
+}
+
+// testWinmail returns a winmail.dat with a message subject, a PDF whose long
+// filename and MIME type are MAPI properties, and a text file with only a
+// short filename.
+func testWinmail() []byte {
+	var props tnefProps
+	props.variable(ptString8, prAttachFilename, []byte("REPORT~1.PDF\x00"))
+	// A fixed-size property and a named property, to be skipped over
+	props.header(0x0003, 0x0E21)
+	props.Write([]byte{1, 0, 0, 0})
+	props.header(ptString8, 0x8001)
+	props.Write(make([]byte, 16))
+	binary.Write(&props, binary.LittleEndian, uint32(1))
+	name := unicodeValue("Keyword")
+	binary.Write(&props, binary.LittleEndian, uint32(len(name)))
+	props.Write(name)
+	props.Write(make([]byte, pad4(uint32(len(name)))-uint32(len(name))))
+	binary.Write(&props, binary.LittleEndian, uint32(1))
+	binary.Write(&props, binary.LittleEndian, uint32(3))
+	props.Write([]byte("ab\x00\x00"))
+	props.variable(ptUnicode, prAttachLongFilename, unicodeValue("Quarterly report.pdf"))
+	props.variable(ptString8|ptMultiFlag, 0x3A2F, []byte("one\x00"), []byte("two\x00"))
+	props.variable(ptString8, prAttachMimeTag, []byte("Application/PDF\x00"))
+
+	w := newTNEFWriter()
+	w.attribute(0x01, 0x00018004, []byte("Subject\x00"))
+	w.attribute(tnefLevelAttachment, 0x00060000|attAttachRendData, make([]byte, 14))
+	w.attribute(tnefLevelAttachment, 0x00010000|attAttachTitle, []byte("REPORT~1.PDF\x00"))
+	w.attribute(tnefLevelAttachment, 0x00060000|attAttachData, []byte("%PDF-1.4 report"))
+	w.attribute(tnefLevelAttachment, 0x00060000|attAttachment, props.bytes())
+	w.attribute(tnefLevelAttachment, 0x00060000|attAttachRendData, make([]byte, 14))
+	w.attribute(tnefLevelAttachment, 0x00010000|attAttachTitle, []byte("notes.txt\x00"))
+	w.attribute(tnefLevelAttachment, 0x00060000|attAttachData, []byte("some notes"))
+	return w.Bytes()
+}
+
+func TestParseTNEF(t *testing.T) {
+	report := tnefAttachment{Filename: "Quarterly report.pdf", MimeType: "application/pdf", Data: []byte("%PDF-1.4 report")}
+	notes := tnefAttachment{Filename: "notes.txt", Data: []byte("some notes")}
+	winmail := testWinmail()
+
+	tests := []struct {
+		name string
+		data []byte
+		want []tnefAttachment
+		err  string
+	}{
+		{name: "winmail.dat", data: winmail, want: []tnefAttachment{report, notes}},
+		{
+			name: "truncated",
+			data: winmail[:len(winmail)-5],
+			want: []tnefAttachment{report, {Filename: "notes.txt"}},
+			err:  errTNEFTruncated.Error(),
+		},
+		{
+			name: "truncated properties",
+			data: func() []byte {
+				var props tnefProps
+				props.variable(ptUnicode, prAttachLongFilename, unicodeValue("kept.pdf"))
+				props.variable(ptString8, prAttachMimeTag, []byte("application/pdf\x00"))
+				value := props.bytes()
+				w := newTNEFWriter()
+				w.attribute(tnefLevelAttachment, attAttachRendData, nil)
+				w.attribute(tnefLevelAttachment, attAttachment, value[:len(value)-10])
+				return w.Bytes()
+			}(),
+			want: []tnefAttachment{{Filename: "kept.pdf"}},
+		},
+		{name: "no attachments", data: newTNEFWriter().Bytes()},
+		{name: "not TNEF", data: []byte("PK\x03\x04 not TNEF"), err: "not a TNEF stream"},
+		{name: "empty", data: nil, err: "not a TNEF stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTNEF(tt.data)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTNEF(t *testing.T) {
+	tests := []struct {
+		mediaType, filename string
+		want                bool
+	}{
+		{"application/ms-tnef", "", true},
+		{"application/vnd.ms-tnef", "attachment.bin", true},
+		{"application/octet-stream", "WINMAIL.DAT", true},
+		{"application/octet-stream", "winmail.dat.pdf", false},
+		{"application/pdf", "report.pdf", false},
+	}
+	for _, tt := range tests {
+		if got := isTNEF(tt.mediaType, tt.filename); got != tt.want {
+			t.Errorf("isTNEF(%q, %q) = %v, want %v", tt.mediaType, tt.filename, got, tt.want)
+		}
+	}
+}
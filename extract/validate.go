@@ -0,0 +1,29 @@
+package extract
+
+import (
+	"bytes"
+	"errors"
+)
+
+// validatePDF checks that data is a usable PDF: it has a header and an end
+// of file marker, and its page tree can be read. Encrypted PDFs cannot be
+// checked past their cross-reference table and are accepted.
+func validatePDF(data []byte) error {
+	if !bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+		return errors.New("missing %PDF header")
+	}
+	if !bytes.Contains(data[max(0, len(data)-1024):], []byte("%%EOF")) {
+		return errors.New("missing %%EOF marker, the file may be truncated")
+	}
+	f, err := parsePDF(data)
+	if err == errPDFEncrypted {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.pages(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package extract
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDebounce is how long Watch waits for deliveries to settle.
+const DefaultDebounce = time.Second
+
+// Watch monitors the new/ directory of every selected mailbox in the maildir
+// and extracts attachments from messages as they are delivered, until ctx is
+// cancelled. Deliveries are collected until no new one has arrived for the
+// debounce interval, so a burst of mail is processed as one batch. Mailboxes
+// created after Watch starts are not monitored.
+func (s *Scanner) Watch(ctx context.Context, maildirPath string, debounce time.Duration) error {
+	mailboxes, err := DiscoverMailboxes(maildirPath)
+	if err != nil {
+		return fmt.Errorf("error discovering mailboxes: %v", err)
+	}
+	mailboxes = s.filterMailboxes(mailboxes)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	names := make(map[string]string) // watched directory -> mailbox name
+	for _, mailbox := range mailboxes {
+		dir := filepath.Join(mailbox.Path, "new")
+		if err := watcher.Add(dir); err != nil {
+			slog.Warn("Could not watch directory", "path", dir, "error", err)
+			continue
+		}
+		names[dir] = mailbox.Name
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no mailboxes to watch in %s", maildirPath)
+	}
+
+	pending := make(map[string]string) // message path -> mailbox name
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.processDeliveries(pending)
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if name, ok := names[filepath.Dir(event.Name)]; ok {
+				pending[event.Name] = name
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("Watcher error", "error", err)
+		case <-timer.C:
+			s.processDeliveries(pending)
+			pending = make(map[string]string)
+		}
+	}
+}
+
+// processDeliveries extracts attachments from newly delivered messages.
+func (s *Scanner) processDeliveries(pending map[string]string) {
+	if len(pending) == 0 {
+		return
+	}
+	s.run(func(jobs chan<- emailJob) {
+		for path, mailbox := range pending {
+			path, ok := locateMessage(path)
+			if !ok || !s.wantedFlags(filepath.Base(path)) {
+				continue
+			}
+			if !s.send(jobs, emailJob{path: path, mailbox: mailbox}) {
+				return
+			}
+		}
+	})
+}
+
+// locateMessage finds a message delivered to new/ at path. Mail clients may
+// already have moved it to cur/, adding flags to its name, by the time it is
+// processed.
+func locateMessage(path string) (string, bool) {
+	if info, err := os.Lstat(path); err == nil {
+		return path, info.Mode().IsRegular()
+	}
+
+	base := filepath.Base(path)
+	if i := strings.IndexAny(base, ":!"); i >= 0 {
+		base = base[:i]
+	}
+	cur := filepath.Join(filepath.Dir(filepath.Dir(path)), "cur")
+	for _, sep := range []string{":", "!"} {
+		matches, _ := filepath.Glob(filepath.Join(cur, globEscape(base)+sep+"*"))
+		if len(matches) > 0 {
+			return matches[0], true
+		}
+	}
+	return "", false
+}
+
+// globEscape quotes the characters filepath.Glob treats specially.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
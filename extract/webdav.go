@@ -0,0 +1,186 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// WebDAV stores files in a collection of a WebDAV server, such as the files
+// of a Nextcloud user, making collections for the directories in their keys
+// as needed.
+type WebDAV struct {
+	BaseURL  string // of the collection, ending with /, e.g. https://cloud.example.com/remote.php/dav/files/me/Documents/
+	User     string
+	Password string // for HTTP basic authentication, with User
+	Client   *http.Client
+
+	mu          sync.Mutex
+	collections map[string]bool // made or found to exist, by their key ending with /
+}
+
+// NewWebDAV returns a client for the collection at a webdav:// URL, which
+// stands for https://, or a webdav+http:// URL, which stands for http://.
+// The user, if any, is taken from the URL; a password in it is ignored.
+func NewWebDAV(rawURL string) (*WebDAV, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "webdav":
+		u.Scheme = "https"
+	case "webdav+http":
+		u.Scheme = "http"
+	default:
+		return nil, fmt.Errorf("%s is not a webdav:// URL", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s has no server", rawURL)
+	}
+	w := &WebDAV{Client: http.DefaultClient, collections: make(map[string]bool)}
+	if u.User != nil {
+		w.User = u.User.Username()
+		u.User = nil
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		if u.RawPath != "" {
+			u.RawPath += "/"
+		}
+	}
+	w.BaseURL = u.String()
+	return w, nil
+}
+
+// Create implements Remote, with a conditional write that the server
+// refuses if the key exists.
+func (w *WebDAV) Create(key string, r io.ReadSeeker, contentType string) error {
+	return w.put(key, r, contentType, true)
+}
+
+// Put implements Remote.
+func (w *WebDAV) Put(key string, r io.ReadSeeker, contentType string) error {
+	return w.put(key, r, contentType, false)
+}
+
+func (w *WebDAV) put(key string, r io.ReadSeeker, contentType string, create bool) error {
+	if err := w.makeCollections(key); err != nil {
+		return err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// The caller closes the body, not the transport
+	req, err := w.request("PUT", key, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if create {
+		req.Header.Set("If-None-Match", "*")
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case create && resp.StatusCode == http.StatusPreconditionFailed:
+		return fmt.Errorf("%s: %w", w.URL(key), fs.ErrExist)
+	case resp.StatusCode/100 != 2:
+		return w.responseError("PUT", key, resp)
+	}
+	return nil
+}
+
+// makeCollections makes the collections the file stored under key goes
+// in, below BaseURL, unless they were made or found earlier.
+func (w *WebDAV) makeCollections(key string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var dir string
+	components := strings.Split(key, "/")
+	for _, component := range components[:len(components)-1] {
+		dir += component + "/"
+		if w.collections[dir] {
+			continue
+		}
+		req, err := w.request("MKCOL", dir, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := w.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		// 405 Method Not Allowed means it exists already
+		if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusMethodNotAllowed {
+			err = w.responseError("MKCOL", dir, resp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.collections[dir] = true
+	}
+	return nil
+}
+
+// Remove implements Remote.
+func (w *WebDAV) Remove(key string) error {
+	req, err := w.request("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return w.responseError("DELETE", key, resp)
+	}
+	return nil
+}
+
+// URL implements Remote, returning the HTTP URL of the file.
+func (w *WebDAV) URL(key string) string {
+	return w.BaseURL + escapeKey(key)
+}
+
+func (w *WebDAV) request(method, key string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, w.URL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if w.User != "" {
+		req.SetBasicAuth(w.User, w.Password)
+	}
+	return req, nil
+}
+
+func (w *WebDAV) responseError(method, key string, resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s: %s", method, w.URL(key), resp.Status, strings.TrimSpace(string(message)))
+}
+
+// escapeKey escapes each component of a key for use in a URL path.
+func escapeKey(key string) string {
+	components := strings.Split(key, "/")
+	for i, component := range components {
+		components[i] = url.PathEscape(component)
+	}
+	return strings.Join(components, "/")
+}
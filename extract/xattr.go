@@ -0,0 +1,47 @@
+package extract
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// xattrPrefix starts the names of the extended attributes Xattrs sets, e.g.
+// user.maildir2pdf.message_id.
+const xattrPrefix = "user.maildir2pdf."
+
+// setXattrs records on the file at path which message it was extracted
+// from: its Message-ID, where it was read from, its sender and its subject.
+// Failures are only logged; a filesystem without extended attributes is
+// reported once.
+func (x *Extractor) setXattrs(path string, email *Email) {
+	source := email.Path
+	if source != "" && !strings.Contains(source, "://") {
+		if abs, err := filepath.Abs(source); err == nil {
+			source = abs
+		}
+	}
+	attrs := []struct{ name, value string }{
+		{"message_id", email.MessageID},
+		{"source", source},
+		{"from", email.From},
+		{"subject", email.Subject},
+	}
+	for _, attr := range attrs {
+		if attr.value == "" {
+			continue
+		}
+		err := setxattr(path, xattrPrefix+attr.name, []byte(attr.value))
+		if errors.Is(err, errors.ErrUnsupported) {
+			x.xattrOnce.Do(func() {
+				slog.Warn("Extended attributes are not supported here, so provenance is not recorded", "path", filepath.Dir(path))
+			})
+			return
+		}
+		if err != nil {
+			slog.Warn("Could not set extended attribute", "path", path, "name", xattrPrefix+attr.name, "error", err)
+			return
+		}
+	}
+}
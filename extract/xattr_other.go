@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+package extract
+
+import "errors"
+
+func setxattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package extract
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+func setxattr(path, name string, value []byte) error {
+	err := unix.Setxattr(path, name, value, 0)
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return errors.ErrUnsupported
+	}
+	return err
+}
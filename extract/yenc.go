@@ -0,0 +1,162 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// yencFile is a file found yEnc-encoded in the text of a message.
+type yencFile struct {
+	name string
+	data []byte
+}
+
+// hasYEnc reports whether a message text has a line starting a yEnc file.
+func hasYEnc(text []byte) bool {
+	return bytes.HasPrefix(text, []byte("=ybegin ")) || bytes.Contains(text, []byte("\n=ybegin "))
+}
+
+// processYEnc extracts the wanted files found yEnc-encoded in a text part,
+// as posted to Usenet and sent by the mail clients of newsreaders.
+func (x *Extractor) processYEnc(body io.Reader, email *Email) error {
+	text, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if !hasYEnc(text) {
+		return nil
+	}
+	files, err := decodeYEnc(text)
+	if err != nil {
+		if len(files) == 0 {
+			return fmt.Errorf("error decoding yEnc data: %v", err)
+		}
+		slog.Warn("Some yEnc data could not be decoded, extracting the rest", "source", email.Path, "error", err)
+	}
+	for _, file := range files {
+		mediaType, reader := x.resolveType("application/octet-stream", file.name, bytes.NewReader(file.data))
+		if !x.wanted(mediaType, file.name) {
+			continue
+		}
+		if err := x.saveAttachment(reader, file.name, mediaType, email); err != nil {
+			x.partError(fmt.Errorf("saving %s from yEnc data: %v", file.name, err), email)
+		}
+	}
+	return nil
+}
+
+// decodeYEnc returns the files yEnc-encoded in text, each between a
+// =ybegin and a =yend line, checking their sizes and CRC-32s. A file split
+// into parts is only decoded if it is whole, in a single part; those with
+// errors are left out, and the first error returned.
+func decodeYEnc(text []byte) ([]yencFile, error) {
+	var files []yencFile
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(text), "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "=ybegin ") {
+			continue
+		}
+		begin := yencParams(lines[i])
+		name := begin["name"]
+		size, err := strconv.Atoi(begin["size"])
+		if name == "" || err != nil {
+			fail(fmt.Errorf("malformed =ybegin line %q", lines[i]))
+			continue
+		}
+		whole := true
+		if _, ok := begin["part"]; ok {
+			// A part must follow with =ypart, covering the whole file for
+			// it to be of use alone
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "=ypart ") {
+				part := yencParams(lines[i+1])
+				whole = part["begin"] == "1" && part["end"] == strconv.Itoa(size)
+				i++
+			} else {
+				whole = false
+			}
+		}
+
+		var data []byte
+		var end map[string]string
+		for i++; i < len(lines); i++ {
+			if strings.HasPrefix(lines[i], "=yend") {
+				end = yencParams(lines[i])
+				break
+			}
+			data = yencDecodeLine(data, lines[i])
+		}
+		switch {
+		case !whole:
+			fail(fmt.Errorf("%s is only part of a file split between messages", name))
+		case end == nil:
+			fail(fmt.Errorf("%s has no =yend line", name))
+		case len(data) != size || end["size"] != "" && end["size"] != strconv.Itoa(len(data)):
+			fail(fmt.Errorf("%s should be %d bytes, but %d were decoded", name, size, len(data)))
+		case !yencCRCMatches(end, data):
+			fail(fmt.Errorf("%s does not match its CRC-32", name))
+		default:
+			files = append(files, yencFile{name: name, data: data})
+		}
+	}
+	return files, firstErr
+}
+
+// yencParams returns the keyword=value parameters of a =ybegin, =ypart or
+// =yend line. The name parameter runs to the end of the line, as names
+// may contain spaces.
+func yencParams(line string) map[string]string {
+	params := make(map[string]string)
+	_, rest, _ := strings.Cut(line, " ")
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(rest, "name=") {
+			params["name"] = strings.TrimSpace(rest[len("name="):])
+			break
+		}
+		var field string
+		field, rest, _ = strings.Cut(rest, " ")
+		if key, value, ok := strings.Cut(field, "="); ok {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+// yencDecodeLine appends the bytes encoded in a line of yEnc data to data.
+// Each byte is offset by 42, and those that would be special, such as NUL
+// or line breaks, are escaped with = and further offset by 64.
+func yencDecodeLine(data []byte, line string) []byte {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '=' && i+1 < len(line) {
+			i++
+			c = line[i] - 64
+		}
+		data = append(data, c-42)
+	}
+	return data
+}
+
+// yencCRCMatches reports whether data matches the CRC-32 given on its =yend
+// line, as crc32 or, for a part, pcrc32; one without any matches.
+func yencCRCMatches(end map[string]string, data []byte) bool {
+	for _, key := range []string{"crc32", "pcrc32"} {
+		if value := end[key]; value != "" {
+			crc, err := strconv.ParseUint(value, 16, 32)
+			return err == nil && uint32(crc) == crc32.ChecksumIEEE(data)
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package extract
+
+import (
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// yencEncode encodes data as lines of yEnc, escaping the critical
+// characters and = itself.
+func yencEncode(data []byte) string {
+	var b strings.Builder
+	for i, c := range data {
+		if i > 0 && i%64 == 0 {
+			b.WriteString("\r\n")
+		}
+		c += 42
+		switch c {
+		case 0, '\n', '\r', '=':
+			b.WriteByte('=')
+			c += 64
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func TestDecodeYEnc(t *testing.T) {
+	// Every byte value, so that each is escaped or offset
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	crc := crc32.ChecksumIEEE(data)
+	single := fmt.Sprintf("=ybegin line=128 size=%d name=all bytes.bin\r\n%s\r\n=yend size=%d crc32=%08x\r\n",
+		len(data), yencEncode(data), len(data), crc)
+	half := len(data) / 2
+	parts := fmt.Sprintf("=ybegin part=1 total=2 line=128 size=%d name=split.bin\n=ypart begin=1 end=%d\n%s\n=yend size=%d part=1 pcrc32=%08x\n"+
+		"=ybegin part=2 total=2 line=128 size=%d name=split.bin\n=ypart begin=%d end=%d\n%s\n=yend size=%d part=2 pcrc32=%08x crc32=%08x\n",
+		len(data), half, yencEncode(data[:half]), half, crc32.ChecksumIEEE(data[:half]),
+		len(data), half+1, len(data), yencEncode(data[half:]), len(data)-half, crc32.ChecksumIEEE(data[half:]), crc)
+	onePart := fmt.Sprintf("=ybegin part=1 total=1 line=128 size=%d name=whole.bin\n=ypart begin=1 end=%d\n%s\n=yend size=%d part=1 pcrc32=%08x\n",
+		len(data), len(data), yencEncode(data), len(data), crc)
+
+	tests := []struct {
+		name string
+		text string
+		want []yencFile
+		err  string
+	}{
+		{name: "single part", text: "Here it is:\r\n\r\n" + single, want: []yencFile{{"all bytes.bin", data}}},
+		{name: "whole file in one part", text: onePart, want: []yencFile{{"whole.bin", data}}},
+		{
+			name: "file split between parts",
+			text: parts,
+			err:  "split.bin is only part of a file split between messages",
+		},
+		{
+			name: "two files",
+			text: single + "\nand\n" + strings.ReplaceAll(single, "all bytes", "again"),
+			want: []yencFile{{"all bytes.bin", data}, {"again.bin", data}},
+		},
+		{
+			name: "bad CRC",
+			text: strings.Replace(single, fmt.Sprintf("crc32=%08x", crc), "crc32=00000000", 1),
+			err:  "all bytes.bin does not match its CRC-32",
+		},
+		{
+			name: "wrong size",
+			text: strings.Replace(single, fmt.Sprintf("size=%d name", len(data)), "size=301 name", 1),
+			err:  "all bytes.bin should be 301 bytes, but 300 were decoded",
+		},
+		{
+			name: "no =yend",
+			text: single[:strings.Index(single, "=yend")],
+			err:  "all bytes.bin has no =yend line",
+		},
+		{
+			name: "damaged file followed by a good one",
+			text: "=ybegin size=3 name=short.bin\nab\n=yend\n" + single,
+			want: []yencFile{{"all bytes.bin", data}},
+			err:  "short.bin should be 3 bytes, but 2 were decoded",
+		},
+		{name: "malformed", text: "=ybegin size=x name=a.bin\n=yend\n", err: `malformed =ybegin line "=ybegin size=x name=a.bin"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeYEnc([]byte(tt.text))
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %d files, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestYEncParams(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{"=ybegin line=128 size=1024 name=My File.pdf ", map[string]string{"line": "128", "size": "1024", "name": "My File.pdf"}},
+		{"=yend  size=10  crc32=abcdef01", map[string]string{"size": "10", "crc32": "abcdef01"}},
+		{"=ypart begin=1 end=10", map[string]string{"begin": "1", "end": "10"}},
+		{"=yend", map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := yencParams(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("yencParams(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestHasYEnc(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"=ybegin size=1 name=a", true},
+		{"text\n=ybegin size=1 name=a", true},
+		{"text =ybegin size=1 name=a", false},
+		{"plain text", false},
+	}
+	for _, tt := range tests {
+		if got := hasYEnc([]byte(tt.text)); got != tt.want {
+			t.Errorf("hasYEnc(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// parseList splits a comma-separated flag value into a set of lowercased,
+// trimmed entries.
+func parseList(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// parseExtensions is like parseList but also accepts extensions given
+// without their leading dot.
+func parseExtensions(value string) map[string]bool {
+	set := make(map[string]bool)
+	for ext := range parseList(value) {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		set[ext] = true
+	}
+	return set
+}
+
+// parseStoreViews parses -store-views, keeping the order of the views, as
+// the first is where sidecar files go.
+func parseStoreViews(value string) ([]string, error) {
+	views := []string{}
+	seen := make(map[string]bool)
+	for _, view := range strings.Split(value, ",") {
+		view = strings.ToLower(strings.TrimSpace(view))
+		switch {
+		case view == "" || view == "none" || seen[view]:
+		case slices.Contains(extract.DefaultStoreViews, view):
+			views = append(views, view)
+			seen[view] = true
+		default:
+			return nil, fmt.Errorf("unknown view %q: the views are mailbox, date and sender", view)
+		}
+	}
+	return views, nil
+}
+
+// parseOrganize parses -organize.
+func parseOrganize(value string) ([]string, error) {
+	var axes []string
+	for axis := range parseList(value) {
+		if axis != extract.OrganizeBySender && axis != extract.OrganizeByYear {
+			return nil, fmt.Errorf("unknown axis %q: the axes are by-sender and by-year", axis)
+		}
+		axes = append(axes, axis)
+	}
+	return axes, nil
+}
+
+// parseDateFlag parses a -since or -until value, either RFC 3339 or a plain
+// YYYY-MM-DD date in local time. A plain -until date includes that whole day,
+// so it is returned as midnight of the following day.
+func parseDateFlag(value string, until bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", value)
+	}
+	if until {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// compileFilterRegex compiles a -from-regex style flag, case-insensitively.
+func compileFilterRegex(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("(?i)" + expr)
+}
+
+// parseHeaderMatch parses a -header flag, NAME=REGEX, whose regular
+// expression is matched case-insensitively.
+func parseHeaderMatch(value string) (extract.HeaderMatch, error) {
+	name, expr, ok := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, ": \t") {
+		return extract.HeaderMatch{}, fmt.Errorf("%q is not NAME=REGEX", value)
+	}
+	re, err := compileFilterRegex(expr)
+	if err != nil {
+		return extract.HeaderMatch{}, err
+	}
+	if re == nil {
+		return extract.HeaderMatch{}, fmt.Errorf("no regular expression for %s", name)
+	}
+	return extract.HeaderMatch{Name: name, Regex: re}, nil
+}
+
+// parseGlobs splits a comma-separated list of mailbox globs, validating
+// each one.
+func parseGlobs(value string) ([]string, error) {
+	var globs []string
+	for _, glob := range strings.Split(value, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+		globs = append(globs, glob)
+	}
+	return globs, nil
+}
+
+// quoteGlob returns a glob matching name and nothing else.
+func quoteGlob(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// readSecret reads a password or token from a file, ignoring surrounding
+// whitespace such as a trailing newline.
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readPasswords reads a list of passwords, one per line. Only line endings
+// are stripped, as passwords may begin or end with spaces.
+func readPasswords(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var passwords []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			passwords = append(passwords, line)
+		}
+	}
+	return passwords, nil
+}
+
+// loadCAFile reads a PEM bundle of CA certificates.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// readMessageIDs reads a file of Message-IDs, one per line, with or
+// without angle brackets. Blank lines and lines starting with # are ignored.
+func readMessageIDs(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[strings.Trim(line, "<>")] = true
+	}
+	return ids, nil
+}
+
+// readRules parses the routing rules file given with -rules.
+func readRules(path string) ([]*extract.Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules, err := extract.ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// sourceFlags are the flags selecting the messages and attachments to
+// process, shared by the extract and scan commands.
+type sourceFlags struct {
+	maildirPath, mboxPath, mhPath, emlxPath              string
+	thunderbirdPath, pstPath, takeoutPath                string
+	notmuchQuery                                         string
+	stdin                                                bool
+	imapURL, imapPasswordFile, imapTokenFile, imapCAFile string
+	imapRecursive, imapInsecure                          bool
+	workers                                              int
+	types, exts, dispositions, nameGlobs                 string
+	since, until                                         string
+	fromRegex, subjectRegex                              string
+	headers                                              []string
+	skipMessageIDs                                       string
+	includeMailboxes, excludeMailboxes                   string
+	includeTmp                                           bool
+	skipTrashed, skipDrafts, seenOnly                    bool
+	filter, rulesPath                                    string
+	logging                                              logFlags
+}
+
+func (s *sourceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.maildirPath, "maildir", "", "Path to the maildir to scan")
+	fs.StringVar(&s.mboxPath, "mbox", "", "Path to an mbox file, or a directory of mbox files, to scan")
+	fs.StringVar(&s.emlxPath, "emlx", "", "Path to a tree of Apple Mail .emlx files to scan, e.g. ~/Library/Mail")
+	fs.StringVar(&s.thunderbirdPath, "thunderbird", "", "Path to a Thunderbird profile directory to scan the folders of, e.g. ~/.thunderbird/abcd1234.default-release")
+	fs.StringVar(&s.pstPath, "pst", "", "Path to an Outlook .pst file to scan")
+	fs.StringVar(&s.notmuchQuery, "notmuch", "", "notmuch search query selecting the messages to scan, e.g. 'tag:invoices and date:2023..'")
+	fs.StringVar(&s.takeoutPath, "takeout", "", "Path to a Gmail Takeout mbox file, or a directory of them, to scan with messages filed by their Gmail labels")
+	fs.StringVar(&s.mhPath, "mh", "", "Path to an MH mail directory to scan, as used by nmh, Claws Mail and Gnus's nnml, e.g. ~/Mail")
+	fs.BoolVar(&s.stdin, "stdin", false, "Read a single message from standard input, e.g. as a procmail filter")
+	fs.StringVar(&s.imapURL, "imap", "", "IMAP folder to scan, e.g. imaps://user@imap.example.com/INBOX")
+	fs.StringVar(&s.imapPasswordFile, "imap-password-file", "", "File containing the IMAP password (default: $MAILDIR2PDF_IMAP_PASSWORD)")
+	fs.StringVar(&s.imapTokenFile, "imap-oauth2-token-file", "", "File containing an OAuth2 access token, to log in with XOAUTH2 instead of a password")
+	fs.BoolVar(&s.imapRecursive, "imap-recursive", false, "Also scan the subfolders of the -imap folder, or all folders if it names none")
+	fs.StringVar(&s.imapCAFile, "imap-ca-file", "", "PEM file of CA certificates to verify the IMAP server with")
+	fs.BoolVar(&s.imapInsecure, "imap-insecure", false, "Do not verify the IMAP server's TLS certificate")
+	fs.IntVar(&s.workers, "j", 1, "Number of messages to process in parallel")
+	fs.StringVar(&s.types, "types", "", "Comma-separated MIME types to extract (default \""+strings.Join(extract.DefaultTypes, ",")+"\" unless -ext is given)")
+	fs.StringVar(&s.exts, "ext", "", "Comma-separated filename extensions to extract, e.g. .pdf,.docx")
+	fs.StringVar(&s.nameGlobs, "name-glob", "", "Comma-separated globs, e.g. 'invoice*.pdf,statement*.pdf', one of which attachment filenames must match, ignoring case")
+	fs.StringVar(&s.dispositions, "dispositions", "", "Comma-separated Content-Disposition types of the parts to extract: attachment, inline or both (default both)")
+	fs.StringVar(&s.since, "since", "", "Only extract from messages dated on or after this date (YYYY-MM-DD or RFC 3339)")
+	fs.StringVar(&s.until, "until", "", "Only extract from messages dated up to this date: on or before a YYYY-MM-DD date, before an RFC 3339 time")
+	fs.StringVar(&s.fromRegex, "from-regex", "", "Only extract from messages whose sender matches this regular expression")
+	fs.StringVar(&s.subjectRegex, "subject-regex", "", "Only extract from messages whose subject matches this regular expression")
+	fs.Func("header", "Only extract from messages with a header matching a regular expression, given as NAME=REGEX, e.g. 'List-Id=acme\\.com'; may be repeated, and all must match", func(value string) error {
+		s.headers = append(s.headers, value)
+		return nil
+	})
+	fs.StringVar(&s.skipMessageIDs, "skip-message-ids", "", "File of Message-IDs, one per line, of messages to skip")
+	fs.StringVar(&s.includeMailboxes, "include-mailbox", "", "Comma-separated globs of mailboxes to scan, e.g. 'INBOX,Archive*'")
+	fs.StringVar(&s.excludeMailboxes, "exclude-mailbox", "", "Comma-separated globs of mailboxes to skip, e.g. 'Spam,Trash*'")
+	fs.BoolVar(&s.includeTmp, "include-tmp", false, "Also scan tmp/ directories, which hold incomplete deliveries")
+	fs.BoolVar(&s.skipTrashed, "skip-trashed", false, "Skip messages with the maildir Trashed (T) flag")
+	fs.BoolVar(&s.skipDrafts, "skip-drafts", false, "Skip messages with the maildir Draft (D) flag")
+	fs.BoolVar(&s.seenOnly, "seen-only", false, "Only process messages with the maildir Seen (S) flag")
+	fs.StringVar(&s.filter, "filter", "", "Only extract attachments for which this expression is true, e.g. 'from.domain == \"acme.com\" && size > 100000'")
+	fs.StringVar(&s.rulesPath, "rules", "", "File of rules skipping attachments, choosing where they are saved, or rendering messages, e.g. 'from:@bank.com -> Finance/{{.Date}}.pdf'")
+	s.logging.register(fs)
+}
+
+// given reports whether any source of messages was given, counting the
+// message files named as arguments.
+func (s *sourceFlags) given(files []string) bool {
+	return s.maildirPath != "" || s.mboxPath != "" || s.mhPath != "" || s.emlxPath != "" || s.thunderbirdPath != "" || s.pstPath != "" || s.takeoutPath != "" || s.notmuchQuery != "" || s.imapURL != "" || s.stdin || len(files) > 0
+}
+
+// describe lists the sources of messages given, for the daemon's web
+// interface, as "kind: location" lines.
+func (s *sourceFlags) describe() []string {
+	var sources []string
+	for _, source := range []struct{ kind, location string }{
+		{"Maildir", s.maildirPath},
+		{"mbox", s.mboxPath},
+		{"MH", s.mhPath},
+		{"Apple Mail", s.emlxPath},
+		{"Thunderbird", s.thunderbirdPath},
+		{"Outlook PST", s.pstPath},
+		{"Gmail Takeout", s.takeoutPath},
+		{"notmuch", s.notmuchQuery},
+		{"IMAP", s.imapURL},
+	} {
+		if source.location == "" {
+			continue
+		}
+		if source.kind == "IMAP" {
+			if u, err := url.Parse(source.location); err == nil {
+				source.location = u.Redacted()
+			}
+		}
+		sources = append(sources, source.kind+": "+source.location)
+	}
+	return sources
+}
+
+// check validates the source flags, given the message files named as
+// arguments, and sets up logging.
+func (s *sourceFlags) check(files []string) error {
+	if err := s.logging.setup(os.Stderr); err != nil {
+		return err
+	}
+	if !s.given(files) {
+		return fatal("Please specify a maildir path using -maildir flag, an mbox using -mbox, an MH directory using -mh, Apple Mail's store using -emlx, a Thunderbird profile using -thunderbird, an Outlook file using -pst, a Gmail Takeout export using -takeout, a notmuch query using -notmuch, an IMAP folder using -imap, -stdin or message files")
+	}
+	if s.workers < 1 {
+		return fatal("-j must be at least 1")
+	}
+	return nil
+}
+
+// configure applies the attachment selection flags to x and returns a
+// Scanner feeding it.
+func (s *sourceFlags) configure(x *extract.Extractor) (*extract.Scanner, error) {
+	var err error
+	if s.types != "" || s.exts != "" {
+		x.Types = parseList(s.types)
+	}
+	x.Exts = parseExtensions(s.exts)
+	if x.NameGlobs, err = parseGlobs(strings.ToLower(s.nameGlobs)); err != nil {
+		return nil, fatal("Error parsing -name-glob", "error", err)
+	}
+	if s.dispositions != "" {
+		x.Dispositions = parseList(s.dispositions)
+		for disposition := range x.Dispositions {
+			if disposition != "attachment" && disposition != "inline" {
+				return nil, fatal("-dispositions must list attachment, inline or both", "disposition", disposition)
+			}
+		}
+	}
+	if s.since != "" {
+		if x.Since, err = parseDateFlag(s.since, false); err != nil {
+			return nil, fatal("Error parsing -since", "error", err)
+		}
+	}
+	if s.until != "" {
+		if x.Until, err = parseDateFlag(s.until, true); err != nil {
+			return nil, fatal("Error parsing -until", "error", err)
+		}
+	}
+	if x.FromRegex, err = compileFilterRegex(s.fromRegex); err != nil {
+		return nil, fatal("Error parsing -from-regex", "error", err)
+	}
+	if x.SubjectRegex, err = compileFilterRegex(s.subjectRegex); err != nil {
+		return nil, fatal("Error parsing -subject-regex", "error", err)
+	}
+	for _, header := range s.headers {
+		match, err := parseHeaderMatch(header)
+		if err != nil {
+			return nil, fatal("Error parsing -header", "error", err)
+		}
+		x.Headers = append(x.Headers, match)
+	}
+	if s.skipMessageIDs != "" {
+		if x.SkipIDs, err = readMessageIDs(s.skipMessageIDs); err != nil {
+			return nil, fatal("Error reading -skip-message-ids", "error", err)
+		}
+	}
+	if s.filter != "" {
+		if x.FilterExpr, err = extract.ParseFilterExpr(s.filter); err != nil {
+			return nil, fatal("Error parsing -filter", "error", err)
+		}
+	}
+	if s.rulesPath != "" {
+		if x.Rules, err = readRules(s.rulesPath); err != nil {
+			return nil, fatal("Error reading -rules", "error", err)
+		}
+	}
+
+	scanner := &extract.Scanner{Extractor: x, Workers: s.workers, IncludeTmp: s.includeTmp}
+	scanner.SkipTrashed, scanner.SkipDrafts, scanner.SeenOnly = s.skipTrashed, s.skipDrafts, s.seenOnly
+	if scanner.IncludeMailboxes, err = parseGlobs(s.includeMailboxes); err != nil {
+		return nil, fatal("Error parsing -include-mailbox", "error", err)
+	}
+	if scanner.ExcludeMailboxes, err = parseGlobs(s.excludeMailboxes); err != nil {
+		return nil, fatal("Error parsing -exclude-mailbox", "error", err)
+	}
+	return scanner, nil
+}
+
+// imapSource returns the IMAP account given with -imap, or nil.
+func (s *sourceFlags) imapSource() (*extract.IMAPSource, error) {
+	if s.imapURL == "" {
+		return nil, nil
+	}
+	src, err := extract.ParseIMAPURL(s.imapURL)
+	if err != nil {
+		return nil, fatal("Error parsing -imap", "error", err)
+	}
+	src.Recursive = s.imapRecursive
+	src.TLSConfig.InsecureSkipVerify = s.imapInsecure
+	if s.imapCAFile != "" {
+		if src.TLSConfig.RootCAs, err = loadCAFile(s.imapCAFile); err != nil {
+			return nil, fatal("Error loading -imap-ca-file", "error", err)
+		}
+	}
+	if s.imapTokenFile != "" {
+		if src.OAuth2Token, err = readSecret(s.imapTokenFile); err != nil {
+			return nil, fatal("Error reading -imap-oauth2-token-file", "error", err)
+		}
+	} else if s.imapPasswordFile != "" {
+		if src.Password, err = readSecret(s.imapPasswordFile); err != nil {
+			return nil, fatal("Error reading -imap-password-file", "error", err)
+		}
+	} else if password := os.Getenv("MAILDIR2PDF_IMAP_PASSWORD"); password != "" {
+		src.Password = password
+	}
+	return src, nil
+}
+
+// scan scans the maildir, mbox, MH, emlx, Thunderbird, PST, Takeout, notmuch
+// and IMAP sources once. Errors read as "<source>: <reason>".
+func (s *sourceFlags) scan(scanner *extract.Scanner, imapSource *extract.IMAPSource) error {
+	if s.maildirPath != "" {
+		if err := scanner.Scan(s.maildirPath); err != nil {
+			return fmt.Errorf("maildir: %v", err)
+		}
+	}
+	if s.mboxPath != "" {
+		if err := scanner.ScanMbox(s.mboxPath); err != nil {
+			return fmt.Errorf("mbox: %v", err)
+		}
+	}
+	if s.mhPath != "" {
+		if err := scanner.ScanMH(s.mhPath); err != nil {
+			return fmt.Errorf("MH: %v", err)
+		}
+	}
+	if s.emlxPath != "" {
+		if err := scanner.ScanEmlx(s.emlxPath); err != nil {
+			return fmt.Errorf("emlx: %v", err)
+		}
+	}
+	if s.thunderbirdPath != "" {
+		if err := scanner.ScanThunderbird(s.thunderbirdPath); err != nil {
+			return fmt.Errorf("Thunderbird: %v", err)
+		}
+	}
+	if s.pstPath != "" {
+		if err := scanner.ScanPST(s.pstPath); err != nil {
+			return fmt.Errorf("PST: %v", err)
+		}
+	}
+	if s.takeoutPath != "" {
+		if err := scanner.ScanTakeout(s.takeoutPath); err != nil {
+			return fmt.Errorf("Takeout: %v", err)
+		}
+	}
+	if s.notmuchQuery != "" {
+		if err := scanner.ScanNotmuch(s.notmuchQuery); err != nil {
+			return fmt.Errorf("notmuch: %v", err)
+		}
+	}
+	if imapSource != nil {
+		if err := scanner.ScanIMAP(imapSource); err != nil {
+			return fmt.Errorf("IMAP account: %v", err)
+		}
+	}
+	return nil
+}
+
+// outputFlags configure the remote backends -output can name instead of a
+// directory.
+type outputFlags struct {
+	s3Endpoint, s3Region          string
+	s3StorageClass, s3ContentType string
+	webdavPasswordFile            string
+	sftpIdentity                  string
+}
+
+func (o *outputFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.s3Endpoint, "s3-endpoint", "", "With an s3:// -output, URL of an S3-compatible server such as MinIO, instead of Amazon S3")
+	fs.StringVar(&o.s3Region, "s3-region", "", "With an s3:// -output, region of the bucket (default: $AWS_REGION, or us-east-1)")
+	fs.StringVar(&o.s3StorageClass, "s3-storage-class", "", "With an s3:// -output, storage class of uploaded files, e.g. STANDARD_IA (default: that of the bucket)")
+	fs.StringVar(&o.s3ContentType, "s3-content-type", "", "With an s3:// -output, Content-Type of every uploaded file, instead of its own")
+	fs.StringVar(&o.sftpIdentity, "sftp-identity", "", "With an sftp:// -output, private key to log in with, instead of those ssh tries by default")
+	fs.StringVar(&o.webdavPasswordFile, "webdav-password-file", "", "With a webdav:// -output, file containing the password of its user (default: $MAILDIR2PDF_WEBDAV_PASSWORD)")
+}
+
+// isRemote reports whether an -output names a remote backend rather than a
+// directory.
+func isRemote(output string) bool {
+	return strings.Contains(output, "://")
+}
+
+// open returns the remote backend named by an -output URL.
+func (o *outputFlags) open(output string) (extract.Remote, error) {
+	switch {
+	case strings.HasPrefix(output, "s3://"):
+		bucket, prefix, err := extract.ParseS3URL(output)
+		if err != nil {
+			return nil, err
+		}
+		s3 := &extract.S3{Bucket: bucket, Prefix: prefix, Endpoint: o.s3Endpoint, Region: o.s3Region,
+			StorageClass: o.s3StorageClass, ContentType: o.s3ContentType, Client: &http.Client{Timeout: 5 * time.Minute}}
+		if s3.Region == "" {
+			s3.Region = cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+		}
+		if s3.AccessKey, s3.SecretKey, s3.SessionToken, err = extract.S3Credentials(); err != nil {
+			return nil, fmt.Errorf("reading S3 credentials: %v", err)
+		}
+		return s3, nil
+	case strings.HasPrefix(output, "webdav://"), strings.HasPrefix(output, "webdav+http://"):
+		webdav, err := extract.NewWebDAV(output)
+		if err != nil {
+			return nil, err
+		}
+		webdav.Client = &http.Client{Timeout: 5 * time.Minute}
+		if o.webdavPasswordFile != "" {
+			if webdav.Password, err = readSecret(o.webdavPasswordFile); err != nil {
+				return nil, fmt.Errorf("reading -webdav-password-file: %v", err)
+			}
+		} else {
+			webdav.Password = os.Getenv("MAILDIR2PDF_WEBDAV_PASSWORD")
+		}
+		return webdav, nil
+	case strings.HasPrefix(output, "sftp://"):
+		if _, err := exec.LookPath("sftp"); err != nil {
+			return nil, fmt.Errorf("an sftp:// output requires the OpenSSH sftp command in the PATH")
+		}
+		sftp, err := extract.NewSFTP(output)
+		if err != nil {
+			return nil, err
+		}
+		sftp.Identity = o.sftpIdentity
+		return sftp, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported output; expected a directory, s3://BUCKET/PREFIX, webdav://USER@HOST/PATH or sftp://USER@HOST/PATH", output)
+}
+
+// writeFile writes data to target, which may be a file of a remote backend,
+// such as s3://BUCKET/manifest.json.
+func (o *outputFlags) writeFile(target string, data []byte) error {
+	if !isRemote(target) {
+		return os.WriteFile(target, data, 0644)
+	}
+	dir, name := path.Split(target)
+	remote, err := o.open(dir)
+	if err != nil {
+		return err
+	}
+	return remote.Put(name, bytes.NewReader(data), mime.TypeByExtension(path.Ext(name)))
+}
+
+// mailFlags configure the summary emailed with -mail-to.
+type mailFlags struct {
+	to, from             string
+	smtpServer, smtpUser string
+	smtpPasswordFile     string
+}
+
+func (m *mailFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&m.to, "mail-to", "", "Email the summary of the run to these comma-separated addresses")
+	fs.StringVar(&m.from, "mail-from", "", "With -mail-to, sender of the summary (default: maildir2pdf@HOSTNAME)")
+	fs.StringVar(&m.smtpServer, "smtp-server", "", "With -mail-to, HOST:PORT of the SMTP server to send through (default: the sendmail command)")
+	fs.StringVar(&m.smtpUser, "smtp-user", "", "With -smtp-server, user to authenticate as")
+	fs.StringVar(&m.smtpPasswordFile, "smtp-password-file", "", "With -smtp-user, file containing its password (default: $MAILDIR2PDF_SMTP_PASSWORD)")
+}
+
+// mailer returns the mailer -mail-to configures, or nil without it.
+func (m *mailFlags) mailer() (*summaryMailer, error) {
+	if m.to == "" {
+		if m.from != "" || m.smtpServer != "" || m.smtpUser != "" {
+			return nil, fmt.Errorf("-mail-from, -smtp-server and -smtp-user require -mail-to")
+		}
+		return nil, nil
+	}
+	mailer := &summaryMailer{from: m.from, server: m.smtpServer, user: m.smtpUser}
+	for _, to := range strings.Split(m.to, ",") {
+		if to = strings.TrimSpace(to); to == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(to); err != nil {
+			return nil, fmt.Errorf("-mail-to %s: %v", to, err)
+		}
+		mailer.to = append(mailer.to, to)
+	}
+	if mailer.from == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		mailer.from = "maildir2pdf@" + host
+	} else if _, err := mail.ParseAddress(mailer.from); err != nil {
+		return nil, fmt.Errorf("-mail-from %s: %v", mailer.from, err)
+	}
+	if m.smtpUser != "" {
+		if m.smtpServer == "" {
+			return nil, fmt.Errorf("-smtp-user requires -smtp-server")
+		}
+		if m.smtpPasswordFile != "" {
+			password, err := readSecret(m.smtpPasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading -smtp-password-file: %v", err)
+			}
+			mailer.password = password
+		} else {
+			mailer.password = os.Getenv("MAILDIR2PDF_SMTP_PASSWORD")
+		}
+	}
+	return mailer, nil
+}
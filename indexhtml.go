@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// htmlIndexName is the name of the page -index-html writes in the output
+// directory.
+const htmlIndexName = "index.html"
+
+// htmlIndexEntry is a saved file listed by -index-html. The entries are kept
+// in the page itself, so that each run adds to those of earlier runs.
+type htmlIndexEntry struct {
+	Path     string     `json:"path"` // relative to the output directory, with slashes
+	Date     *time.Time `json:"date,omitempty"`
+	From     string     `json:"from,omitempty"`
+	FromName string     `json:"from_name,omitempty"`
+	Subject  string     `json:"subject,omitempty"`
+	Filename string     `json:"filename"` // the original name of the attachment
+	Size     int64      `json:"size"`
+	Mailbox  string     `json:"mailbox,omitempty"`
+}
+
+// Link returns the URL of the file, relative to the page.
+func (e htmlIndexEntry) Link() string {
+	parts := strings.Split(e.Path, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// htmlIndex keeps the index.html page of the output directory up to date.
+type htmlIndex struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]htmlIndexEntry // by Path
+}
+
+// htmlIndexData matches the entries embedded in an index.html page.
+var htmlIndexData = regexp.MustCompile(`(?s)<script type="application/json" id="documents">(.*?)</script>`)
+
+// openHTMLIndex returns the index of dir, with the entries of its existing
+// index.html page, if any.
+func openHTMLIndex(dir string) (*htmlIndex, error) {
+	index := &htmlIndex{dir: dir, entries: make(map[string]htmlIndexEntry)}
+	page, err := os.ReadFile(filepath.Join(dir, htmlIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	match := htmlIndexData.FindSubmatch(page)
+	if match == nil {
+		return nil, fmt.Errorf("%s was not written by maildir2pdf", filepath.Join(dir, htmlIndexName))
+	}
+	var entries []htmlIndexEntry
+	if err := json.Unmarshal(match[1], &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, htmlIndexName), err)
+	}
+	for _, e := range entries {
+		index.entries[e.Path] = e
+	}
+	return index, nil
+}
+
+func (h *htmlIndex) saved(s *extract.Saved) {
+	// Duplicates were not saved, and quarantined files are elsewhere
+	if s.Path == "" || s.Quarantined != "" {
+		return
+	}
+	rel, err := filepath.Rel(h.dir, s.Path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+	email := s.Email
+	entry := htmlIndexEntry{
+		Path:     filepath.ToSlash(rel),
+		From:     email.From,
+		FromName: email.FromName,
+		Subject:  email.Subject,
+		Filename: s.Filename,
+		Size:     s.Size,
+		Mailbox:  email.Mailbox,
+	}
+	if !email.Date.IsZero() {
+		date := email.Date
+		entry.Date = &date
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[entry.Path] = entry
+}
+
+// write rewrites the page, leaving out files that no longer exist.
+func (h *htmlIndex) write() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var entries []htmlIndexEntry
+	for path, e := range h.entries {
+		if _, err := os.Stat(filepath.Join(h.dir, filepath.FromSlash(path))); err != nil {
+			delete(h.entries, path)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	// Newest first, as the page shows them until sorted otherwise
+	slices.SortFunc(entries, func(a, b htmlIndexEntry) int {
+		switch {
+		case a.Date == nil && b.Date == nil:
+		case a.Date == nil:
+			return 1
+		case b.Date == nil:
+			return -1
+		default:
+			if c := b.Date.Compare(*a.Date); c != 0 {
+				return c
+			}
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	if entries == nil {
+		entries = []htmlIndexEntry{}
+	}
+
+	// Marshalled JSON escapes <, > and &, so it cannot end the script early
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	var page bytes.Buffer
+	err = htmlIndexTemplate.Execute(&page, struct {
+		Entries []htmlIndexEntry
+		Data    template.JS
+		Updated time.Time
+	}{entries, template.JS(data), time.Now()})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(h.dir, "."+htmlIndexName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(page.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(h.dir, htmlIndexName))
+}
+
+var htmlIndexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"size": formatSize,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Documents</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 1.5em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { cursor: pointer; user-select: none; background: #f4f4f4; position: sticky; top: 0; }
+th[aria-sort=ascending]::after { content: " \25B2"; }
+th[aria-sort=descending]::after { content: " \25BC"; }
+td.size { text-align: right; white-space: nowrap; }
+td.date { white-space: nowrap; }
+tr:hover td { background: #fafafa; }
+input { font: inherit; padding: 0.3em; width: 20em; margin-bottom: 1em; }
+footer { margin-top: 1em; color: #777; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Documents</h1>
+<input type="search" id="filter" placeholder="Filter" aria-label="Filter">
+<table>
+<thead>
+<tr><th data-type="text" aria-sort="descending">Date</th><th data-type="text">Sender</th><th data-type="text">Subject</th><th data-type="text">Filename</th><th data-type="number">Size</th><th data-type="text">File</th></tr>
+</thead>
+<tbody>
+{{- range .Entries}}
+<tr><td class="date" data-sort="{{with .Date}}{{.Format "2006-01-02T15:04:05Z07:00"}}{{end}}">{{with .Date}}{{.Format "2006-01-02"}}{{end}}</td><td title="{{.From}}">{{if .FromName}}{{.FromName}}{{else}}{{.From}}{{end}}</td><td>{{.Subject}}</td><td>{{.Filename}}</td><td class="size" data-sort="{{.Size}}">{{size .Size}}</td><td><a href="{{.Link}}">{{.Path}}</a></td></tr>
+{{- end}}
+</tbody>
+</table>
+<footer>{{len .Entries}} documents, updated {{.Updated.Format "2006-01-02 15:04"}} by maildir2pdf</footer>
+<script type="application/json" id="documents">{{.Data}}</script>
+<script>
+(function () {
+	var tbody = document.querySelector("tbody");
+	var headers = document.querySelectorAll("th");
+	function value(row, i, type) {
+		var cell = row.cells[i];
+		var v = cell.hasAttribute("data-sort") ? cell.getAttribute("data-sort") : cell.textContent;
+		return type === "number" ? Number(v) : v.toLowerCase();
+	}
+	headers.forEach(function (th, i) {
+		th.addEventListener("click", function () {
+			var order = th.getAttribute("aria-sort") === "ascending" ? "descending" : "ascending";
+			headers.forEach(function (h) { h.removeAttribute("aria-sort"); });
+			th.setAttribute("aria-sort", order);
+			var type = th.getAttribute("data-type");
+			var rows = Array.prototype.slice.call(tbody.rows);
+			rows.sort(function (a, b) {
+				var x = value(a, i, type), y = value(b, i, type);
+				var c = x < y ? -1 : x > y ? 1 : 0;
+				return order === "ascending" ? c : -c;
+			});
+			rows.forEach(function (row) { tbody.appendChild(row); });
+		});
+	});
+	document.getElementById("filter").addEventListener("input", function () {
+		var words = this.value.toLowerCase().split(/\s+/).filter(Boolean);
+		Array.prototype.forEach.call(tbody.rows, function (row) {
+			var text = row.textContent.toLowerCase() + " " + row.cells[1].title.toLowerCase();
+			row.hidden = !words.every(function (w) { return text.indexOf(w) >= 0; });
+		});
+	});
+})();
+</script>
+</body>
+</html>
+`))
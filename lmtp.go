@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// lmtpServer accepts messages over LMTP, as the last step of delivery by an
+// MTA such as Postfix, and hands each to deliver once it has been accepted.
+// With forward set, each transaction is passed on unchanged to the LMTP
+// server there, such as Dovecot's, whose replies are the ones given, so
+// messages are only accepted once they have been delivered; otherwise, as
+// with -lmtp-discard, messages are accepted without being stored anywhere.
+type lmtpServer struct {
+	forward  string
+	hostname string
+	deliver  func(data []byte)
+}
+
+func newLMTPServer(forward string, deliver func(data []byte)) *lmtpServer {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return &lmtpServer{forward: forward, hostname: hostname, deliver: deliver}
+}
+
+// serve accepts LMTP sessions on addr until ctx is cancelled, then waits
+// for the messages being processed.
+func (l *lmtpServer) serve(ctx context.Context, addr string) error {
+	return serveSessions(ctx, "LMTP", addr, l.session)
+}
+
+// session runs an LMTP session on conn, as described in RFC 2033.
+func (l *lmtpServer) session(conn net.Conn) error {
+	text := textproto.NewConn(conn)
+	var next *lmtpClient
+	defer func() {
+		if next != nil {
+			next.close()
+		}
+	}()
+	var from string
+	var recipients []string
+	reset := func() {
+		from, recipients = "", nil
+	}
+
+	text.PrintfLine("220 %s LMTP maildir2pdf ready", l.hostname)
+	for {
+		conn.SetDeadline(time.Now().Add(sessionTimeout))
+		line, err := text.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			reset()
+			if next != nil {
+				if _, _, nextErr := next.command("RSET"); nextErr != nil {
+					next = l.dropNext(next, nextErr)
+				}
+			}
+			err = text.PrintfLine("250-%s\r\n250-8BITMIME\r\n250 ENHANCEDSTATUSCODES", l.hostname)
+
+		case "MAIL":
+			if from != "" {
+				err = text.PrintfLine("503 5.5.1 Nested MAIL command")
+				break
+			}
+			if !strings.HasPrefix(strings.ToUpper(arg), "FROM:") {
+				err = text.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+				break
+			}
+			if l.forward == "" {
+				from = arg
+				err = text.PrintfLine("250 2.1.0 Ok")
+				break
+			}
+			if next == nil {
+				if next, err = dialLMTP(l.forward, l.hostname); err != nil {
+					slog.Error("Error passing message on", "forward", l.forward, "error", err)
+					err = text.PrintfLine("451 4.4.1 Cannot reach the next LMTP server")
+					break
+				}
+			}
+			code, message, nextErr := next.command("MAIL %s", arg)
+			if nextErr != nil {
+				next = l.dropNext(next, nextErr)
+				err = text.PrintfLine("451 4.4.2 Lost the connection to the next LMTP server")
+				break
+			}
+			if code/100 == 2 {
+				from = arg
+			}
+			err = printResponse(text, code, message)
+
+		case "RCPT":
+			if from == "" {
+				err = text.PrintfLine("503 5.5.1 MAIL first")
+				break
+			}
+			if !strings.HasPrefix(strings.ToUpper(arg), "TO:") {
+				err = text.PrintfLine("501 5.5.4 Syntax: RCPT TO:<address>")
+				break
+			}
+			if l.forward == "" {
+				recipients = append(recipients, arg)
+				err = text.PrintfLine("250 2.1.5 Ok")
+				break
+			}
+			if next == nil {
+				err = text.PrintfLine("451 4.4.2 Lost the connection to the next LMTP server")
+				break
+			}
+			code, message, nextErr := next.command("RCPT %s", arg)
+			if nextErr != nil {
+				next = l.dropNext(next, nextErr)
+				reset()
+				err = text.PrintfLine("451 4.4.2 Lost the connection to the next LMTP server")
+				break
+			}
+			if code/100 == 2 {
+				recipients = append(recipients, arg)
+			}
+			err = printResponse(text, code, message)
+
+		case "DATA":
+			if len(recipients) == 0 {
+				err = text.PrintfLine("503 5.5.1 RCPT first")
+				break
+			}
+			if l.forward != "" && next == nil {
+				reset()
+				err = text.PrintfLine("451 4.4.2 Lost the connection to the next LMTP server")
+				break
+			}
+			if next != nil {
+				code, message, nextErr := next.command("DATA")
+				if nextErr != nil || code != 354 {
+					if nextErr != nil {
+						next = l.dropNext(next, nextErr)
+						code, message = 451, "4.4.2 Lost the connection to the next LMTP server"
+					}
+					reset()
+					err = printResponse(text, code, message)
+					break
+				}
+			}
+			if err = text.PrintfLine("354 Start mail input; end with <CRLF>.<CRLF>"); err != nil {
+				break
+			}
+			var data []byte
+			if data, err = text.ReadDotBytes(); err != nil {
+				break
+			}
+
+			// Replies, one per recipient, are given before the message is
+			// processed, so the MTA does not time out and deliver it twice
+			replies := make([]string, len(recipients))
+			for i := range replies {
+				replies[i] = "250 2.0.0 Ok"
+			}
+			if next != nil {
+				var nextErr error
+				if replies, nextErr = next.data(data, len(recipients)); nextErr != nil {
+					next = l.dropNext(next, nextErr)
+					replies = make([]string, len(recipients))
+					for i := range replies {
+						replies[i] = "451 4.4.2 Lost the connection to the next LMTP server"
+					}
+				}
+			}
+			for _, reply := range replies {
+				if err = text.PrintfLine("%s", reply); err != nil {
+					break
+				}
+			}
+			delivered := false
+			for _, reply := range replies {
+				delivered = delivered || strings.HasPrefix(reply, "2")
+			}
+			reset()
+			if delivered {
+				l.deliver(data)
+			}
+
+		case "RSET":
+			reset()
+			if next != nil {
+				if _, _, nextErr := next.command("RSET"); nextErr != nil {
+					next = l.dropNext(next, nextErr)
+				}
+			}
+			err = text.PrintfLine("250 2.0.0 Ok")
+
+		case "NOOP":
+			err = text.PrintfLine("250 2.0.0 Ok")
+
+		case "VRFY":
+			err = text.PrintfLine("252 2.5.0 Cannot VRFY user")
+
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return nil
+
+		default:
+			err = text.PrintfLine("500 5.5.2 Command not recognized")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dropNext closes the connection to the next LMTP server after an error,
+// so the next transaction opens a new one.
+func (l *lmtpServer) dropNext(next *lmtpClient, err error) *lmtpClient {
+	slog.Error("Error passing message on", "forward", l.forward, "error", err)
+	next.close()
+	return nil
+}
+
+// printResponse relays a response, of one or more lines, from the next
+// LMTP server.
+func printResponse(text *textproto.Conn, code int, message string) error {
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := text.PrintfLine("%d%s%s", code, sep, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lmtpClient is a session with the LMTP server messages are passed on to.
+type lmtpClient struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func dialLMTP(addr, hostname string) (*lmtpClient, error) {
+	network, address := socketAddress(addr)
+	conn, err := net.DialTimeout(network, address, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &lmtpClient{conn: conn, text: textproto.NewConn(conn)}
+	conn.SetDeadline(time.Now().Add(sessionTimeout))
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		c.close()
+		return nil, err
+	}
+	if _, _, err := c.command("LHLO %s", hostname); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// command sends a command and returns the response, whatever its code.
+func (c *lmtpClient) command(format string, args ...any) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(sessionTimeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(0)
+}
+
+// data sends a message after a DATA command was accepted, and returns the
+// reply for each of the n recipients.
+func (c *lmtpClient) data(message []byte, n int) ([]string, error) {
+	c.conn.SetDeadline(time.Now().Add(sessionTimeout))
+	w := c.text.DotWriter()
+	if _, err := w.Write(message); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	replies := make([]string, n)
+	for i := range replies {
+		code, message, err := c.text.ReadResponse(0)
+		if err != nil {
+			return nil, err
+		}
+		// Multi-line replies are rare after DATA; keep their last line
+		lines := strings.Split(message, "\n")
+		replies[i] = fmt.Sprintf("%d %s", code, lines[len(lines)-1])
+	}
+	return replies, nil
+}
+
+func (c *lmtpClient) close() {
+	c.text.PrintfLine("QUIT")
+	c.conn.Close()
+}
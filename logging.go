@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logFlags select how log messages are written: the least severe level
+// shown, and whether as text or as JSON lines for a log aggregator.
+type logFlags struct {
+	level, format string
+}
+
+func (l *logFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&l.level, "log-level", "info", "Least severe messages to log: debug, info, warn or error")
+	fs.StringVar(&l.format, "log-format", "text", "Format of log messages on standard error: text or json")
+}
+
+// setup makes the default logger, which the extract package also uses,
+// write to w as the flags select.
+func (l *logFlags) setup(w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.level)); err != nil {
+		return fatal("Error parsing -log-level", "error", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch l.format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return fatal("-log-format must be text or json")
+	}
+	return nil
+}
+
+// commandError is the error ending a command that could not proceed, with
+// the message and attributes main logs for it.
+type commandError struct {
+	msg  string
+	args []any
+}
+
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+// fatal returns the error ending a command that could not proceed, which
+// main logs before exiting with status 2, once the deferred calls of the
+// command have run.
+func fatal(msg string, args ...any) error {
+	return &commandError{msg: msg, args: args}
+}
+
+// exitStatus ends a command whose problems were already reported, such as a
+// run that met errors, with a status of its own.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+// exitWith returns the error ending a command with status, or nil for 0.
+func exitWith(status int) error {
+	if status == 0 {
+		return nil
+	}
+	return exitStatus(status)
+}
+
+// exit ends maildir2pdf after a command returned err.
+func exit(err error) {
+	var cmdErr *commandError
+	var status exitStatus
+	switch {
+	case err == nil:
+		os.Exit(0)
+	case errors.As(err, &status):
+		os.Exit(int(status))
+	case errors.As(err, &cmdErr):
+		slog.Error(cmdErr.msg, cmdErr.args...)
+	default:
+		slog.Error(err.Error())
+	}
+	os.Exit(2)
+}
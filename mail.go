@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// summaryMailer emails the summary of a run with -mail-to, through an SMTP
+// server, or the local sendmail command if none is given.
+type summaryMailer struct {
+	to       []string
+	from     string
+	server   string // HOST:PORT; port 465 is TLS from the start, others use STARTTLS if offered
+	user     string // for SMTP authentication, with password
+	password string
+}
+
+// send emails the summary r, which must be finished.
+func (m *summaryMailer) send(r *runSummary) error {
+	message := m.compose(r)
+	if m.server == "" {
+		return m.sendmail(message)
+	}
+	return m.smtp(message)
+}
+
+// compose returns the summary email, with the counts of the run, then the
+// files it saved and the errors it met.
+func (m *summaryMailer) compose(r *runSummary) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	host, _ := os.Hostname()
+
+	subject := fmt.Sprintf("maildir2pdf: %d extracted", r.Extracted)
+	if len(r.Errors) > 0 {
+		subject += fmt.Sprintf(", %d errors", len(r.Errors))
+	}
+	if host != "" {
+		subject += " on " + host
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Run from %s to %s (%s)\n\n", r.Started.Format(time.DateTime), r.Finished.Format(time.DateTime),
+		r.Finished.Sub(r.Started).Round(time.Second))
+	fmt.Fprintf(&body, "Mailboxes scanned:  %d\n", r.Mailboxes)
+	fmt.Fprintf(&body, "Messages:           %d (%d skipped, %d failed)\n", r.Messages, r.MessagesSkipped, r.Failures)
+	fmt.Fprintf(&body, "Attachments found:  %d\n", r.Attachments)
+	fmt.Fprintf(&body, "Extracted:          %d\n", r.Extracted)
+	fmt.Fprintf(&body, "Skipped by filter:  %d\n", r.Filtered)
+	fmt.Fprintf(&body, "Duplicates:         %d\n", r.Duplicates)
+	fmt.Fprintf(&body, "Quarantined:        %d\n", r.Quarantined)
+	fmt.Fprintf(&body, "Bytes written:      %d\n", r.BytesWritten)
+	if len(r.files) > 0 {
+		fmt.Fprintf(&body, "\nExtracted files:\n")
+		for _, path := range r.files {
+			fmt.Fprintf(&body, "  %s\n", path)
+		}
+	}
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(&body, "\nErrors:\n")
+		for _, err := range r.Errors {
+			fmt.Fprintf(&body, "  %s\n", err)
+		}
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", m.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&message, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&message)
+	qp.Write(bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n")))
+	qp.Close()
+	return message.Bytes()
+}
+
+// sendmail hands message to the sendmail command, which Postfix, Exim,
+// msmtp and others provide.
+func (m *summaryMailer) sendmail(message []byte) error {
+	path, err := exec.LookPath("sendmail")
+	if err != nil {
+		if path, err = exec.LookPath("/usr/sbin/sendmail"); err != nil {
+			return fmt.Errorf("no -smtp-server given, and no sendmail command found")
+		}
+	}
+	args := []string{"-i", "-f", addressOf(m.from), "--"}
+	for _, to := range m.to {
+		args = append(args, addressOf(to))
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(message)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (m *summaryMailer) smtp(message []byte) error {
+	host, port, err := net.SplitHostPort(m.server)
+	if err != nil {
+		return fmt.Errorf("-smtp-server %s is not HOST:PORT", m.server)
+	}
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: time.Minute}
+	if port == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.server, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", m.server)
+	}
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && port != "465" {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.user != "" {
+		// PlainAuth refuses to send the password unencrypted, but to localhost
+		if err := client.Auth(smtp.PlainAuth("", m.user, m.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(addressOf(m.from)); err != nil {
+		return err
+	}
+	for _, to := range m.to {
+		if err := client.Rcpt(addressOf(to)); err != nil {
+			return fmt.Errorf("%s: %v", to, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// addressOf returns the bare address of an address such as
+// "Me <me@example.com>".
+func addressOf(address string) string {
+	if a, err := mail.ParseAddress(address); err == nil {
+		return a.Address
+	}
+	return address
+}
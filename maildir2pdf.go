@@ -1,351 +1,1203 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"mime"
-	"mime/multipart"
-	"net/mail"
+	"log/slog"
+	"maps"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"maildir2pdf/extract"
 )
 
-func main() {
-	var maildirPath string
-	flag.StringVar(&maildirPath, "maildir", "", "Path to the maildir to scan")
-	flag.Parse()
+// errInterrupted is the cause of the cancellation of a run by a signal.
+var errInterrupted = errors.New("interrupted")
 
-	if maildirPath == "" {
-		log.Fatal("Please specify a maildir path using -maildir flag")
-	}
+// stoppedByError reports whether ctx was cancelled by an error, with
+// -strict, rather than by an interrupt.
+func stoppedByError(ctx context.Context) bool {
+	return ctx.Err() != nil && context.Cause(ctx) != errInterrupted
+}
 
-	if err := scanMaildir(maildirPath); err != nil {
-		log.Fatal("Error scanning maildir:", err)
-	}
+// resumeState is the state database -resume keeps in the output directory.
+const resumeState = ".maildir2pdf-state.db"
+
+// commands are the subcommands of maildir2pdf, each with its own flags.
+var commands = []struct {
+	name, summary string
+	run           func(args []string) error
+}{
+	{"extract", "Save the attachments of messages (the default command)", runExtract},
+	{"scan", "List the attachments extract would save, without saving them", runScan},
+	{"list", "List the files saved by earlier runs, from the -state database", runList},
+	{"stats", "Count the attachments of messages without extracting them, or summarize the -state database", runStats},
+	{"verify", "Check that the files saved by earlier runs are still intact", runVerify},
+	{"search", "Search the index built with extract -index", runSearch},
+	{"tui", "Choose the attachments to extract from a list on the terminal, then extract them", runTUI},
+	{"site", "Render a static website of the files listed in manifests", runSite},
 }
 
-func scanMaildir(maildirPath string) error {
-	mailboxes, err := discoverMailboxes(maildirPath)
-	if err != nil {
-		return fmt.Errorf("error discovering mailboxes: %v", err)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
 	}
-	
-	for _, mailbox := range mailboxes {
-		if err := scanSingleMailbox(mailbox.Path, mailbox.Name); err != nil {
-			log.Printf("Error scanning mailbox %s: %v", mailbox.Name, err)
+	for _, cmd := range commands {
+		if os.Args[1] == cmd.name {
+			exit(cmd.run(os.Args[2:]))
 		}
 	}
-	
-	return nil
+	if os.Args[1] == "help" {
+		usage()
+		return
+	}
+	// Without a command, the arguments are those of extract, as they were
+	// before there were commands
+	exit(runExtract(os.Args[1:]))
 }
 
-type Mailbox struct {
-	Name string
-	Path string
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [COMMAND] [FLAGS] [ARGS]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\nRun \"%s COMMAND -h\" for the flags of a command.\n", os.Args[0])
 }
 
-func discoverMailboxes(maildirPath string) ([]Mailbox, error) {
-	var mailboxes []Mailbox
-	
-	// Add the main inbox
-	if isValidMailbox(maildirPath) {
-		mailboxes = append(mailboxes, Mailbox{Name: "INBOX", Path: maildirPath})
+// newFlagSet returns the flag set of a command, whose usage message shows
+// synopsis after the command name.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", os.Args[0], name, synopsis)
+		fs.PrintDefaults()
 	}
-	
-	// Discover all subdirectories that are valid mailboxes
-	err := filepath.Walk(maildirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	return fs
+}
+
+// runExtract implements "maildir2pdf extract".
+func runExtract(args []string) error {
+	return runExtraction("extract", args)
+}
+
+// runExtraction implements extract, and tui, which is extract with the
+// attachments to save chosen on the terminal first.
+func runExtraction(name string, args []string) error {
+	interactive := name == "tui"
+	var sources sourceFlags
+	var outputs outputFlags
+	var mailing mailFlags
+	var profiles profileFlags
+	var outputDir string
+	var watch bool
+	var render bool
+	var combine bool
+	var metadata bool
+	var pdfa bool
+	var ocr bool
+	var archives bool
+	var archiveCommand string
+	var ocrLanguage string
+	var quarantineDir string
+	var rawErrorDir string
+	var pdfPasswordsFile string
+	var smimeKeyPath, smimePasswordFile string
+	var verifySignatures bool
+	var verifyDKIM bool
+	var eInvoices bool
+	var imagesToPDF bool
+	var convertOffice, officeCache string
+	var htmlRenderer string
+	var downloadDomains string
+	var decryptPDFs bool
+	var extractText bool
+	var xattrs bool
+	var saveSourceEML bool
+	var saveBody bool
+	var detach bool
+	var markKeyword string
+	var moveTo string
+	var checksums string
+	var store, storeSymlinks bool
+	var storeViews string
+	var organize string
+	var indexPath string
+	var paperlessURL, paperlessToken string
+	var mergeDir string
+	var daemon bool
+	var passthrough bool
+	var lmtpAddr, lmtpForward string
+	var lmtpDiscard bool
+	var milterAddr string
+	var interval time.Duration
+	var statusAddr string
+	var webAddr, webPasswordFile string
+	var metricsAddr, metricsTextfile string
+	var debounce time.Duration
+	var preserveFolders bool
+	var nameTemplate string
+	var datePrefix bool
+	var dedup bool
+	var statePath string
+	var force bool
+	var resume bool
+	var strict, keepGoing bool
+	var manifestPath string
+	var exportIDsPath string
+	var custodyPath, custodyKeyPath string
+	var indexHTML bool
+	var eventsPath string
+	var webhookURL, webhookPer string
+	var summaryPath string
+	var fsync bool
+	var quiet bool
+	fs := newFlagSet(name, "[FLAGS] [MESSAGE FILES]")
+	sources.register(fs)
+	outputs.register(fs)
+	mailing.register(fs)
+	fs.BoolVar(&watch, "watch", false, "Keep running after the initial scan and extract from messages as they are delivered to the maildir")
+	fs.DurationVar(&debounce, "debounce", extract.DefaultDebounce, "With -watch, how long to wait for deliveries to settle before processing them")
+	fs.BoolVar(&daemon, "daemon", false, "Keep running and rescan incrementally every -interval; requires -state")
+	fs.DurationVar(&interval, "interval", 15*time.Minute, "With -daemon, how often to rescan")
+	fs.BoolVar(&passthrough, "passthrough", false, "With -stdin, copy the message to standard output unchanged once processed, as a delivery filter, and exit with status 0 even if it could not be")
+	fs.StringVar(&lmtpAddr, "lmtp", "", "Keep running and accept messages over LMTP on this Unix socket or HOST:PORT, processing each as it is delivered; requires -lmtp-forward, or -lmtp-discard to accept messages without storing them")
+	fs.StringVar(&milterAddr, "milter", "", "Keep running as a milter on this Unix socket or HOST:PORT, for Postfix or Sendmail to hand each message they receive to")
+	fs.StringVar(&lmtpForward, "lmtp-forward", "", "With -lmtp, pass every message on unchanged to the LMTP server on this Unix socket or HOST:PORT, e.g. Dovecot's")
+	fs.BoolVar(&lmtpDiscard, "lmtp-discard", false, "With -lmtp, accept messages without passing them on, so they are not stored anywhere, e.g. for copies sent with always_bcc")
+	fs.StringVar(&statusAddr, "status-addr", "", "With -daemon, serve a JSON status report at http://ADDR/status, e.g. localhost:8080")
+	fs.StringVar(&webAddr, "web-addr", "", "With -daemon, serve a web interface at http://ADDR/ showing its configuration, runs and errors, starting runs, and listing the files saved to download, and a JSON API, e.g. localhost:8081")
+	fs.StringVar(&webPasswordFile, "web-password-file", "", "File containing the password the -web-addr interface asks for (default: $MAILDIR2PDF_WEB_PASSWORD)")
+	fs.StringVar(&metricsAddr, "metrics-addr", "", "With -daemon or -watch, serve Prometheus metrics at http://ADDR/metrics, e.g. localhost:9101")
+	fs.StringVar(&metricsTextfile, "metrics-textfile", "", "Write Prometheus metrics to this file for the node_exporter textfile collector at the end of each run")
+	fs.BoolVar(&render, "render", false, "Also save each message itself, with its headers, body and inline images, as a PDF")
+	fs.BoolVar(&combine, "combine-per-message", false, "Save each message as one PDF: its rendering followed by the pages of its PDF attachments")
+	fs.BoolVar(&metadata, "metadata", false, "Record the subject, sender, date and Message-ID of the email in the document information of saved PDFs")
+	fs.BoolVar(&pdfa, "pdfa", false, "Convert saved PDFs to PDF/A-3 with Ghostscript, embedding the original email")
+	fs.StringVar(&quarantineDir, "quarantine", "", "Check that saved PDFs are readable, and save those that are not to this directory instead")
+	fs.StringVar(&rawErrorDir, "save-raw-on-error", "", "Save attachments whose base64 or quoted-printable encoding cannot be decoded to this directory, as received, with a .txt file saying where they came from")
+	fs.StringVar(&pdfPasswordsFile, "pdf-passwords", "", "File of passwords, one per line, to try on encrypted PDFs")
+	fs.StringVar(&smimeKeyPath, "smime-key", "", "Decrypt S/MIME encrypted messages with the key and certificate in this PKCS #12 (.p12) or PEM file, using OpenSSL")
+	fs.StringVar(&smimePasswordFile, "smime-password-file", "", "File containing the password of the -smime-key file (default: $MAILDIR2PDF_SMIME_PASSWORD)")
+	fs.BoolVar(&verifySignatures, "verify-signatures", false, "Check the S/MIME signatures of signed messages with OpenSSL, and their PGP signatures with GnuPG, recording the result and signer in the manifest")
+	fs.BoolVar(&verifyDKIM, "verify-dkim", false, "Check the DKIM signatures of messages, looking up their keys in DNS, and record the result and signing domain in the manifest")
+	fs.BoolVar(&imagesToPDF, "images-to-pdf", false, "Save JPEG, PNG and TIFF attachments, such as photographed receipts, as PDFs, converting TIFF ones with tiff2pdf")
+	fs.StringVar(&convertOffice, "convert-office", "", "Save Word, Excel, PowerPoint, OpenDocument and RTF attachments as PDFs, converted by libreoffice, run headless, or by the Gotenberg server at this http:// or https:// URL")
+	fs.StringVar(&officeCache, "office-cache", "", "With -convert-office, directory keeping converted documents, so they are not converted again (default: maildir2pdf/office in the user cache directory)")
+	fs.StringVar(&htmlRenderer, "html-renderer", "", "Render the HTML bodies of messages matching render rules in -rules, such as e-tickets, to PDF with chrome (Chrome or Chromium, headless) or wkhtmltopdf")
+	fs.StringVar(&downloadDomains, "download-domains", "", "Comma-separated domains, e.g. billing.example.com, the only ones whose HTTPS links download rules in -rules may follow")
+	fs.BoolVar(&eInvoices, "e-invoices", false, "Save the ZUGFeRD or Factur-X invoice XML embedded in PDFs beside them, and extract invoice XML attached with them, linking the two in the manifest")
+	fs.BoolVar(&decryptPDFs, "decrypt-pdfs", false, "Save encrypted PDFs that can be opened without their encryption")
+	fs.BoolVar(&archives, "archives", false, "Also extract from zip, 7z and RAR archives attached to messages, unpacking 7z and RAR ones with 7z")
+	fs.StringVar(&archiveCommand, "archive-command", "", "With -archives, 7-Zip command unpacking 7z and RAR archives (default: the first of 7zz, 7z and 7za in the PATH)")
+	fs.BoolVar(&ocr, "ocr", false, "Make image-only PDFs searchable with OCRmyPDF, or Ghostscript and Tesseract")
+	fs.StringVar(&ocrLanguage, "ocr-lang", "eng", "Tesseract language codes for -ocr, e.g. eng+fra")
+	fs.BoolVar(&extractText, "extract-text", false, "Write the text of each saved PDF to a .txt file beside it, for indexing and grep")
+	fs.BoolVar(&xattrs, "xattrs", false, "Record the Message-ID, source path, sender and subject of the email in user.maildir2pdf.* extended attributes of saved files")
+	fs.BoolVar(&saveSourceEML, "save-source-eml", false, "Save a copy of the whole message beside each saved file, named after it with .eml appended")
+	fs.StringVar(&checksums, "checksums", "", "Record the SHA-256 of each saved file, for \"maildir2pdf verify\" or sha256sum -c: file for a .sha256 file beside each, sums for a SHA256SUMS file in each directory")
+	fs.StringVar(&markKeyword, "mark", "", "Add this maildir flag letter or Dovecot keyword, e.g. $PDFExtracted, to maildir messages once processed, and skip messages that have it")
+	fs.StringVar(&moveTo, "move-to", "", "Move maildir messages attachments were saved from to this folder of the -maildir, e.g. Archive/Processed, created if needed")
+	fs.BoolVar(&detach, "detach", false, "Replace the attachments saved from maildir messages with a short note saying where they were saved, rewriting the messages to shrink the maildir")
+	fs.BoolVar(&saveBody, "save-body", false, "Save the body of the message, as Markdown, beside each saved file, named after it with .md appended")
+	fs.StringVar(&indexPath, "index", "", "Add saved files, with the text of PDFs and details of their email, to this search index for \"maildir2pdf search\"")
+	fs.StringVar(&paperlessURL, "paperless-url", "", "Also upload saved PDFs to the paperless-ngx server at this URL, with their title, correspondent and date taken from the email")
+	fs.StringVar(&paperlessToken, "paperless-token", "", "API token for -paperless-url (default: $MAILDIR2PDF_PAPERLESS_TOKEN)")
+	fs.StringVar(&mergeDir, "merge-per-mailbox", "", "Also merge the PDFs saved from each mailbox, by message date, into one bookmarked PDF per mailbox in this directory")
+	fs.StringVar(&outputDir, "output", ".", "Directory to save extracted PDFs to, or s3://BUCKET/PREFIX, webdav://USER@HOST/PATH or sftp://USER@HOST/PATH to upload them")
+	fs.BoolVar(&store, "store", false, "Save each distinct file once, under OUTPUT/store by its SHA-256, and link it into the -store-views")
+	fs.StringVar(&storeViews, "store-views", "mailbox,date,sender", "With -store, comma-separated views to link saved files into, under OUTPUT/by-VIEW: mailbox, date and sender, or none")
+	fs.BoolVar(&storeSymlinks, "store-symlinks", false, "With -store, link views to the store with symbolic links instead of hard links")
+	fs.StringVar(&organize, "organize", "", "Also link saved files into OUTPUT/by-sender/DOMAIN and OUTPUT/by-year/YYYY: by-sender, by-year or both, comma-separated")
+	fs.BoolVar(&preserveFolders, "preserve-folders", false, "Save PDFs in subdirectories named after their mailbox")
+	fs.BoolVar(&dedup, "dedup", false, "Skip files whose content was already saved during this run or, with -state or -resume, by an earlier run whose file still exists")
+	fs.StringVar(&statePath, "state", "", "State database recording processed messages, for incremental runs")
+	fs.BoolVar(&force, "force", false, "Process messages already recorded in the state database")
+	fs.BoolVar(&strict, "strict", false, "Stop at the first error, such as a message that cannot be parsed or an attachment that cannot be saved, and exit with status 2")
+	fs.BoolVar(&keepGoing, "keep-going", true, "Log errors and carry on with the other messages, exiting with status 1 at the end; -keep-going=false is the same as -strict")
+	fs.BoolVar(&resume, "resume", false, "Record the messages processed in the output directory, and skip those an earlier run with -resume processed; shorthand for -state OUTPUT/"+resumeState)
+	fs.BoolVar(&quiet, "quiet", false, "Do not show a progress bar or list the files saved; errors and warnings are still logged")
+	fs.BoolVar(&fsync, "fsync", false, "Flush each extracted file to disk before giving it its final name")
+	fs.StringVar(&manifestPath, "manifest", "", "Write a JSON manifest of extracted attachments to this file")
+	fs.StringVar(&exportIDsPath, "export-message-ids", "", "Append the Message-ID of each message processed to this file, one per line, in the form -skip-message-ids reads")
+	fs.BoolVar(&indexHTML, "index-html", false, "Keep an index.html page in the output directory listing every file saved there, by date, sender, subject and filename, to browse the archive with a web browser")
+	fs.StringVar(&custodyPath, "custody", "", "Write a chain-of-custody manifest to this file, tying each saved file to the SHA-256 of the message it came from")
+	fs.StringVar(&custodyKeyPath, "custody-key", "", "Sign the -custody manifest with this Ed25519 private key (PEM), writing the signature beside it with .sig appended")
+	fs.StringVar(&summaryPath, "summary", "", "Also write the summary of the run logged at the end to this file, as JSON")
+	fs.StringVar(&webhookURL, "webhook", "", "POST a JSON description of each file saved, or of each run with -webhook-per run, to this URL")
+	fs.StringVar(&webhookPer, "webhook-per", "document", "With -webhook, call it per document saved, or per run")
+	fs.StringVar(&eventsPath, "events", "", "Write a JSON line to this file, or standard output for -, as each message is processed and each attachment saved or skipped")
+	fs.StringVar(&nameTemplate, "name-template", "", "Go text/template for output filenames, e.g. '{{.Date}}_{{.From}}.pdf'")
+	fs.BoolVar(&datePrefix, "date-prefix", false, "Start output filenames with the email date, as YYYY-MM-DD_, so they sort chronologically")
+	profiles.register(fs)
+	fs.Parse(args)
+	if interactive {
+		if err := sources.logging.setup(os.Stderr); err != nil {
 			return err
 		}
-		
-		// Skip symlinks
-		if info.Mode()&os.ModeSymlink != 0 {
-			if info.IsDir() {
-				return filepath.SkipDir
+		if profiles.selected() || daemon || watch || lmtpAddr != "" || milterAddr != "" || sources.stdin {
+			return fatal("tui cannot be combined with -profile, -all-profiles, -daemon, -watch, -lmtp, -milter or -stdin")
+		}
+		// They make files of their own, which tui cannot list to choose from
+		if render || combine || imagesToPDF || convertOffice != "" || htmlRenderer != "" || downloadDomains != "" {
+			return fatal("tui cannot be combined with -render, -combine, -images-to-pdf, -convert-office, -html-renderer or -download-domains")
+		}
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			return fatal("tui must be run on a terminal")
+		}
+	}
+	if profiles.selected() {
+		if err := sources.logging.setup(os.Stderr); err != nil {
+			return err
+		}
+		return profiles.run(fs, args)
+	}
+
+	files := fs.Args()
+	// Messages are received instead of scanned with -lmtp and -milter
+	receiving := lmtpAddr != "" || milterAddr != ""
+	if !receiving {
+		if err := sources.check(files); err != nil {
+			return err
+		}
+	} else {
+		if err := sources.logging.setup(os.Stderr); err != nil {
+			return err
+		}
+		if lmtpAddr != "" && milterAddr != "" {
+			return fatal("-lmtp cannot be combined with -milter")
+		}
+		if sources.given(files) {
+			return fatal("-lmtp and -milter cannot be combined with other sources of messages; they receive them")
+		}
+		if daemon || watch || mergeDir != "" || summaryPath != "" || mailing.to != "" {
+			return fatal("-lmtp and -milter cannot be combined with -daemon, -watch, -merge-per-mailbox, -summary or -mail-to")
+		}
+	}
+	if lmtpForward != "" && lmtpAddr == "" {
+		return fatal("-lmtp-forward requires -lmtp")
+	}
+	if lmtpDiscard && lmtpAddr == "" {
+		return fatal("-lmtp-discard requires -lmtp")
+	}
+	// Accepting messages without storing them loses mail unless they are
+	// copies, so it has to be asked for
+	if lmtpAddr != "" && lmtpForward == "" && !lmtpDiscard {
+		return fatal("-lmtp requires -lmtp-forward, or -lmtp-discard to accept messages without storing them")
+	}
+	if lmtpForward != "" && lmtpDiscard {
+		return fatal("-lmtp-forward cannot be combined with -lmtp-discard")
+	}
+	if passthrough {
+		if !sources.stdin {
+			return fatal("-passthrough requires -stdin")
+		}
+		if eventsPath == "-" {
+			return fatal("-passthrough cannot be combined with -events -, as the message is written to standard output")
+		}
+	}
+	strict = strict || !keepGoing
+
+	// Files for a remote -output are staged in a temporary directory, made
+	// below once the flags have all been checked
+	var remote extract.Remote
+	var err error
+	if isRemote(outputDir) {
+		if remote, err = outputs.open(outputDir); err != nil {
+			return fatal("Error configuring -output", "error", err)
+		}
+		if store || organize != "" || xattrs || mergeDir != "" || checksums == extract.ChecksumSums || indexHTML {
+			return fatal("A remote -output cannot be combined with -store, -organize, -xattrs, -merge-per-mailbox, -checksums sums or -index-html")
+		}
+		if resume && statePath == "" {
+			return fatal("-resume with a remote -output requires -state")
+		}
+	} else if outputDir, err = prepareOutputDir(outputDir); err != nil {
+		return fatal("Error preparing output directory", "error", err)
+	}
+
+	if watch && sources.maildirPath == "" {
+		return fatal("-watch requires -maildir")
+	}
+
+	if daemon {
+		if statePath == "" {
+			return fatal("-daemon requires -state, so each run only processes new mail")
+		}
+		if watch || sources.stdin || len(files) > 0 || mergeDir != "" || summaryPath != "" || mailing.to != "" {
+			return fatal("-daemon cannot be combined with -watch, -stdin, -merge-per-mailbox, -summary, -mail-to or message files")
+		}
+		if interval <= 0 {
+			return fatal("-interval must be positive")
+		}
+	}
+	var webPassword string
+	if webAddr != "" {
+		if !daemon {
+			return fatal("-web-addr requires -daemon")
+		}
+		webPassword = os.Getenv("MAILDIR2PDF_WEB_PASSWORD")
+		if webPasswordFile != "" {
+			if webPassword, err = readSecret(webPasswordFile); err != nil {
+				return fatal("Error reading -web-password-file", "error", err)
 			}
-			return nil
 		}
-		
-		if !info.IsDir() || path == maildirPath {
-			return nil
+		// Anyone who can reach it could download the files saved and start runs
+		if webPassword == "" && !loopbackAddr(webAddr) {
+			return fatal("-web-addr requires a password with -web-password-file or $MAILDIR2PDF_WEB_PASSWORD unless it listens on a loopback address", "addr", webAddr)
 		}
-		
-		if isValidMailbox(path) {
-			relPath, err := filepath.Rel(maildirPath, path)
-			if err != nil {
-				return err
-			}
-			
-			// Clean up mailbox name (remove leading dots, replace path separators)
-			name := strings.ReplaceAll(relPath, string(filepath.Separator), "/")
-			if strings.HasPrefix(name, ".") {
-				name = name[1:] // Remove leading dot
-			}
-			
-			mailboxes = append(mailboxes, Mailbox{Name: name, Path: path})
-		}
-		
-		return nil
-	})
-	
-	return mailboxes, err
-}
+	} else if webPasswordFile != "" {
+		return fatal("-web-password-file requires -web-addr")
+	}
 
-func isValidMailbox(path string) bool {
-	subdirs := []string{"cur", "new", "tmp"}
-	
-	for _, subdir := range subdirs {
-		dirPath := filepath.Join(path, subdir)
-		if _, err := os.Stat(dirPath); err == nil {
-			return true
+	mailer, err := mailing.mailer()
+	if err != nil {
+		return fatal("Error configuring -mail-to", "error", err)
+	}
+
+	if metricsAddr != "" && !daemon && !watch && !receiving {
+		return fatal("-metrics-addr requires -daemon, -watch, -lmtp or -milter; use -metrics-textfile for single runs")
+	}
+
+	var custodyKey ed25519.PrivateKey
+	if custodyKeyPath != "" {
+		if custodyPath == "" {
+			return fatal("-custody-key requires -custody")
+		}
+		if custodyKey, err = readSigningKey(custodyKeyPath); err != nil {
+			return fatal("Error reading -custody-key", "error", err)
 		}
 	}
-	
-	return false
-}
 
-func scanSingleMailbox(mailboxPath, mailboxName string) error {
-	subdirs := []string{"cur", "new", "tmp"}
-	
-	for _, subdir := range subdirs {
-		dirPath := filepath.Join(mailboxPath, subdir)
-		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-			continue
+	x := extract.NewExtractor(outputDir)
+	x.PreserveFolders, x.Dedup, x.Force, x.Fsync = preserveFolders, dedup, force, fsync
+	x.Render = render
+	x.Combine = combine
+	x.Metadata = metadata
+	x.DatePrefix = datePrefix
+	x.DecryptPDFs = decryptPDFs
+	x.ExtractText = extractText
+	x.Xattrs = xattrs
+	x.SaveSourceEML = saveSourceEML
+	x.SaveBody = saveBody
+	x.Detach = detach
+	if strings.ContainsAny(markKeyword, " \t\r\n") {
+		return fatal("-mark must be a flag letter or a keyword without spaces")
+	}
+	x.Mark = markKeyword
+	if moveTo != "" && sources.maildirPath == "" {
+		return fatal("-move-to requires -maildir")
+	}
+	x.HashMessages = custodyPath != ""
+	if store {
+		if preserveFolders {
+			return fatal("-store cannot be combined with -preserve-folders; the mailbox view serves the same purpose")
+		}
+		if dedup {
+			return fatal("-store cannot be combined with -dedup; the store already keeps each distinct file once")
+		}
+		if x.StoreViews, err = parseStoreViews(storeViews); err != nil {
+			return fatal("Error parsing -store-views", "error", err)
+		}
+		x.Store, x.StoreSymlinks = true, storeSymlinks
+	}
+	if organize != "" {
+		if store {
+			return fatal("-organize cannot be combined with -store, which makes its own views")
+		}
+		if x.Organize, err = parseOrganize(organize); err != nil {
+			return fatal("Error parsing -organize", "error", err)
+		}
+	}
+	switch checksums {
+	case "", extract.ChecksumFile, extract.ChecksumSums:
+		x.Checksums = checksums
+	default:
+		return fatal("-checksums must be file or sums")
+	}
+	if paperlessURL != "" {
+		if paperlessToken == "" {
+			paperlessToken = os.Getenv("MAILDIR2PDF_PAPERLESS_TOKEN")
 		}
-		
-		err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if paperlessToken == "" {
+			return fatal("-paperless-url requires -paperless-token or $MAILDIR2PDF_PAPERLESS_TOKEN")
+		}
+		x.Paperless = extract.NewPaperless(paperlessURL, paperlessToken)
+	} else if paperlessToken != "" {
+		return fatal("-paperless-token requires -paperless-url")
+	}
+	if smimeKeyPath != "" {
+		password := os.Getenv("MAILDIR2PDF_SMIME_PASSWORD")
+		if smimePasswordFile != "" {
+			if password, err = readSecret(smimePasswordFile); err != nil {
+				return fatal("Error reading -smime-password-file", "error", err)
+			}
+		}
+		if x.SMIME, err = extract.LoadSMIMEKey(smimeKeyPath, password); err != nil {
+			return fatal("Error reading -smime-key", "error", err)
+		}
+	} else if smimePasswordFile != "" {
+		return fatal("-smime-password-file requires -smime-key")
+	}
+	if verifySignatures {
+		if x.OpenSSL, err = exec.LookPath("openssl"); err != nil {
+			slog.Warn("OpenSSL is not in the PATH, so S/MIME signatures will be recorded as unverified")
+		}
+		if x.GPG, err = exec.LookPath("gpg"); err != nil {
+			slog.Warn("GnuPG (gpg) is not in the PATH, so PGP signatures will be recorded as unverified")
+		}
+		x.VerifySignatures = true
+	}
+	x.VerifyDKIM = verifyDKIM
+	x.EInvoices = eInvoices
+	if imagesToPDF {
+		if x.TIFF2PDF, err = exec.LookPath("tiff2pdf"); err != nil {
+			slog.Warn("tiff2pdf (from libtiff) is not in the PATH, so TIFF images will be skipped")
+		}
+		x.ImagesToPDF = true
+	}
+	switch {
+	case convertOffice == "libreoffice":
+		command, err := exec.LookPath("soffice")
+		if err != nil {
+			if command, err = exec.LookPath("libreoffice"); err != nil {
+				return fatal("-convert-office libreoffice requires LibreOffice (soffice) in the PATH")
+			}
+		}
+		x.Office = extract.NewLibreOffice(command)
+	case strings.HasPrefix(convertOffice, "http://") || strings.HasPrefix(convertOffice, "https://"):
+		x.Office = extract.NewGotenberg(convertOffice)
+	case convertOffice != "":
+		return fatal("-convert-office must be libreoffice or the URL of a Gotenberg server")
+	case officeCache != "":
+		return fatal("-office-cache requires -convert-office")
+	}
+	switch htmlRenderer {
+	case "":
+	case "chrome":
+		for _, command := range []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "chrome"} {
+			if path, err := exec.LookPath(command); err == nil {
+				x.HTMLRenderer = extract.NewChrome(path)
+				break
+			}
+		}
+		if x.HTMLRenderer == nil {
+			return fatal("-html-renderer chrome requires Chrome or Chromium in the PATH")
+		}
+	case "wkhtmltopdf":
+		command, err := exec.LookPath("wkhtmltopdf")
+		if err != nil {
+			return fatal("-html-renderer wkhtmltopdf requires wkhtmltopdf in the PATH")
+		}
+		x.HTMLRenderer = extract.NewWKHTMLToPDF(command)
+	default:
+		return fatal("-html-renderer must be chrome or wkhtmltopdf")
+	}
+	if x.Office != nil {
+		if officeCache == "" {
+			dir, err := os.UserCacheDir()
 			if err != nil {
-				return err
+				return fatal("Error finding the cache directory for -convert-office; set -office-cache", "error", err)
 			}
-			
-			// Skip symlinks
-			if info.Mode()&os.ModeSymlink != 0 {
-				if info.IsDir() {
-					return filepath.SkipDir
-				}
-				return nil
+			officeCache = filepath.Join(dir, "maildir2pdf", "office")
+		}
+		if err := os.MkdirAll(officeCache, 0755); err != nil {
+			return fatal("Error creating -office-cache directory", "error", err)
+		}
+		x.OfficeCache = officeCache
+	}
+	if pdfPasswordsFile != "" {
+		if x.PDFPasswords, err = readPasswords(pdfPasswordsFile); err != nil {
+			return fatal("Error reading -pdf-passwords", "error", err)
+		}
+		if x.PDFPasswords == nil {
+			x.PDFPasswords = []string{}
+		}
+	}
+	if rawErrorDir != "" {
+		if x.RawErrorDir, err = prepareOutputDir(rawErrorDir); err != nil {
+			return fatal("Error preparing -save-raw-on-error directory", "error", err)
+		}
+	}
+	if quarantineDir != "" {
+		if x.QuarantineDir, err = prepareOutputDir(quarantineDir); err != nil {
+			return fatal("Error preparing quarantine directory", "error", err)
+		}
+	}
+	if pdfa {
+		if x.Ghostscript, err = exec.LookPath("gs"); err != nil {
+			return fatal("-pdfa requires Ghostscript (gs) in the PATH")
+		}
+		x.PDFA = true
+	}
+	if archives {
+		commands := []string{"7zz", "7z", "7za"}
+		if archiveCommand != "" {
+			commands = []string{archiveCommand}
+		}
+		for _, command := range commands {
+			if x.SevenZip, err = exec.LookPath(command); err == nil {
+				break
 			}
-			
-			if !info.IsDir() {
-				return processEmailFile(path, mailboxName)
+		}
+		if x.SevenZip == "" {
+			if archiveCommand != "" {
+				return fatal("-archive-command was not found", "command", archiveCommand)
 			}
-			return nil
-		})
-		
+			slog.Warn("7-Zip (7zz, 7z or 7za) is not in the PATH, so 7z and RAR archives will be skipped")
+		}
+		x.Archives = true
+	} else if archiveCommand != "" {
+		return fatal("-archive-command requires -archives")
+	}
+	if ocr {
+		if _, err := exec.LookPath("ocrmypdf"); err != nil {
+			_, gsErr := exec.LookPath("gs")
+			_, tesseractErr := exec.LookPath("tesseract")
+			if gsErr != nil || tesseractErr != nil {
+				return fatal("-ocr requires OCRmyPDF (ocrmypdf), or Ghostscript (gs) and Tesseract (tesseract), in the PATH")
+			}
+		}
+		x.OCR, x.OCRLanguage = true, ocrLanguage
+	}
+	if nameTemplate != "" {
+		x.NameTemplate, err = extract.ParseNameTemplate(nameTemplate)
 		if err != nil {
-			return fmt.Errorf("error walking directory %s: %v", dirPath, err)
+			return fatal("Error parsing name template", "error", err)
+		}
+	}
+	if resume {
+		if force {
+			return fatal("-resume cannot be combined with -force")
+		}
+		if statePath == "" {
+			statePath = filepath.Join(outputDir, resumeState)
 		}
 	}
-	
-	return nil
-}
 
-func processEmailFile(filePath, mailboxName string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("error opening file %s: %v", filePath, err)
+	// A run that met errors or was interrupted exits with status 1, and one
+	// stopped by -strict with 2, once the deferred calls below have closed
+	// the databases
+	var exitCode int
+
+	if remote != nil {
+		staging, err := os.MkdirTemp("", "maildir2pdf-")
+		if err != nil {
+			return fatal("Error creating staging directory", "error", err)
+		}
+		defer os.RemoveAll(staging)
+		x.OutputDir, x.Remote = staging, remote
 	}
-	defer file.Close()
 
-	msg, err := mail.ReadMessage(file)
-	if err != nil {
-		return fmt.Errorf("error parsing email %s: %v", filePath, err)
+	if statePath != "" {
+		x.State, err = extract.OpenState(statePath)
+		if err != nil {
+			return fatal("Error opening state database", "error", err)
+		}
+		defer x.State.Close()
+	}
+	if indexPath != "" {
+		x.Index, err = extract.OpenSearchIndex(indexPath)
+		if err != nil {
+			return fatal("Error opening search index", "error", err)
+		}
+		defer x.Index.Close()
 	}
 
-	return extractPDFAttachments(msg, filePath, mailboxName)
-}
+	var choice *attachmentChoice
+	if interactive {
+		if choice, err = chooseAttachments(&sources, files, x); choice == nil {
+			return err
+		}
+	}
+
+	// The daemon and the LMTP and milter servers run until stopped, without
+	// a progress bar or a summary at the end
+	longRunning := daemon || receiving
 
-func extractPDFAttachments(msg *mail.Message, emailPath, mailboxName string) error {
-	// Parse email date
-	var emailTime time.Time
-	if dateStr := msg.Header.Get("Date"); dateStr != "" {
-		if parsedTime, err := mail.ParseDate(dateStr); err == nil {
-			emailTime = parsedTime
+	var status *daemonStatus
+	if daemon {
+		status = newDaemonStatus()
+	}
+
+	var merger *extract.MailboxMerger
+	if mergeDir != "" {
+		merger = extract.NewMailboxMerger()
+	}
+
+	var custody *custodyLog
+	if custodyPath != "" {
+		custody = newCustodyLog()
+	}
+
+	var htmlIdx *htmlIndex
+	if indexHTML {
+		if htmlIdx, err = openHTMLIndex(outputDir); err != nil {
+			return fatal("Error reading the -index-html page", "error", err)
 		}
 	}
 
-	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
-	if err != nil {
-		return nil
+	// The progress bar shares the terminal with log messages, so these
+	// erase it before being written.
+	var bar *progressBar
+	if !quiet && !longRunning && isTerminal(os.Stderr) {
+		bar = newProgressBar(os.Stderr)
+		defer bar.finish()
+		if err := sources.logging.setup(bar.writer(os.Stderr)); err != nil {
+			return err
+		}
 	}
 
-	if strings.HasPrefix(mediaType, "multipart/") {
-		boundary := params["boundary"]
-		if boundary == "" {
-			return nil
+	var events *eventStream
+	if eventsPath != "" {
+		stdout := io.Writer(os.Stdout)
+		if bar != nil {
+			stdout = bar.writer(os.Stdout)
+		}
+		var err error
+		if events, err = openEventStream(eventsPath, stdout); err != nil {
+			return fatal("Error creating -events file", "error", err)
 		}
+		defer func() {
+			if err := events.Close(); err != nil {
+				slog.Error("Error writing events", "error", err)
+			}
+		}()
+	}
 
-		reader := multipart.NewReader(msg.Body, boundary)
-		
-		for {
-			part, err := reader.NextPart()
-			if err == io.EOF {
-				break
+	var hook *webhook
+	if webhookURL != "" {
+		var err error
+		if hook, err = newWebhook(webhookURL, webhookPer); err != nil {
+			return fatal("Error configuring -webhook", "error", err)
+		}
+		defer hook.close()
+	}
+
+	// The daemon reports on its runs through -status-addr instead
+	var summary *runSummary
+	if !longRunning {
+		summary = newRunSummary()
+		x.OnMessage = func(email *extract.Email) {
+			summary.message(email)
+			if events != nil {
+				events.message(email)
 			}
-			if err != nil {
-				return fmt.Errorf("error reading multipart: %v", err)
+		}
+		x.OnSkipped = func(s *extract.Skipped) {
+			summary.skipped(s)
+			if events != nil {
+				events.skipped(s)
 			}
+		}
+	} else if events != nil {
+		x.OnMessage = events.message
+		x.OnSkipped = events.skipped
+	}
 
-			if err := processPart(part, emailPath, mailboxName, emailTime); err != nil {
-				log.Printf("Error processing part: %v", err)
+	var met *metrics
+	if metricsAddr != "" || metricsTextfile != "" {
+		met = newMetrics()
+		onMessage, onSkipped := x.OnMessage, x.OnSkipped
+		x.OnMessage = func(email *extract.Email) {
+			if onMessage != nil {
+				onMessage(email)
 			}
-			part.Close()
+			met.message(email)
+		}
+		x.OnSkipped = func(s *extract.Skipped) {
+			if onSkipped != nil {
+				onSkipped(s)
+			}
+			met.skipped(s)
+		}
+	}
+	writeMetrics := func() {
+		if metricsTextfile == "" {
+			return
+		}
+		if err := met.writeTextfile(metricsTextfile); err != nil {
+			slog.Error("Error writing -metrics-textfile", "error", err)
 		}
-	} else if mediaType == "application/pdf" {
-		encoding := msg.Header.Get("Content-Transfer-Encoding")
-		return savePDFAttachmentWithEncoding(msg.Body, "attachment.pdf", emailPath, mailboxName, encoding, emailTime)
 	}
 
-	return nil
-}
-
-func processPart(part *multipart.Part, emailPath, mailboxName string, emailTime time.Time) error {
-	contentType := part.Header.Get("Content-Type")
-	contentDisposition := part.Header.Get("Content-Disposition")
-	
-	if strings.Contains(contentType, "application/pdf") {
-		filename := extractFilename(contentDisposition, part.Header.Get("Content-Type"))
-		if filename == "" {
-			filename = "attachment.pdf"
-		}
-		
-		encoding := part.Header.Get("Content-Transfer-Encoding")
-		return savePDFAttachmentWithEncoding(part, filename, emailPath, mailboxName, encoding, emailTime)
-	}
-	
-	if strings.HasPrefix(contentType, "multipart/") {
-		mediaType, params, err := mime.ParseMediaType(contentType)
+	if exportIDsPath != "" {
+		file, err := os.OpenFile(exportIDsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			return err
+			return fatal("Error opening -export-message-ids file", "error", err)
 		}
-		
-		if strings.HasPrefix(mediaType, "multipart/") {
-			boundary := params["boundary"]
-			if boundary != "" {
-				reader := multipart.NewReader(part, boundary)
-				for {
-					subPart, err := reader.NextPart()
-					if err == io.EOF {
-						break
-					}
-					if err != nil {
-						return err
-					}
-					
-					processPart(subPart, emailPath, mailboxName, emailTime)
-					subPart.Close()
-				}
+		defer func() {
+			if err := file.Close(); err != nil {
+				slog.Error("Error writing Message-IDs", "error", err)
+			}
+		}()
+		var idMu sync.Mutex
+		onMessage := x.OnMessage
+		x.OnMessage = func(email *extract.Email) {
+			if onMessage != nil {
+				onMessage(email)
+			}
+			if email.MessageID == "" {
+				return
+			}
+			idMu.Lock()
+			defer idMu.Unlock()
+			if _, err := fmt.Fprintf(file, "<%s>\n", email.MessageID); err != nil {
+				slog.Error("Error writing Message-ID", "message_id", email.MessageID, "error", err)
 			}
 		}
 	}
-	
-	return nil
-}
 
-func extractFilename(contentDisposition, contentType string) string {
-	if contentDisposition != "" {
-		_, params, err := mime.ParseMediaType(contentDisposition)
-		if err == nil {
-			if filename := params["filename"]; filename != "" {
-				return filename
+	if detach {
+		onMessage := x.OnMessage
+		x.OnMessage = func(email *extract.Email) {
+			if onMessage != nil {
+				onMessage(email)
+			}
+			if email.Detached > 0 && !quiet {
+				slog.Info("Detached attachments", "path", email.Path, "mailbox", email.Mailbox, "count", email.Detached)
 			}
 		}
 	}
-	
-	if contentType != "" {
-		_, params, err := mime.ParseMediaType(contentType)
-		if err == nil {
-			if filename := params["name"]; filename != "" {
-				return filename
+
+	if choice != nil {
+		x.Filter = choice.filter
+		onMessage := x.OnMessage
+		x.OnMessage = func(email *extract.Email) {
+			if onMessage != nil {
+				onMessage(email)
 			}
+			choice.keys.done(email)
 		}
 	}
-	
-	return ""
-}
 
-func savePDFAttachmentWithEncoding(reader io.Reader, filename, emailPath, mailboxName, encoding string, emailTime time.Time) error {
-	data, err := io.ReadAll(reader)
+	var mu sync.Mutex
+	var manifest []ManifestEntry
+	x.OnSaved = func(s *extract.Saved) {
+		if bar != nil && s.DuplicateOf == "" {
+			bar.savedFile()
+		}
+		if status != nil {
+			status.recordSaved(s.DuplicateOf != "")
+		}
+		if merger != nil {
+			merger.Add(s)
+		}
+		if summary != nil {
+			summary.saved(s)
+		}
+		if events != nil {
+			events.saved(s)
+		}
+		if custody != nil {
+			custody.saved(s)
+		}
+		if htmlIdx != nil {
+			htmlIdx.saved(s)
+		}
+		if hook != nil {
+			hook.saved(s)
+		}
+		if met != nil {
+			met.saved(s)
+		}
+		source := s.Email.Path
+		switch {
+		case source != "":
+		case lmtpAddr != "":
+			source = "LMTP"
+		case milterAddr != "":
+			source = "milter"
+		default:
+			source = "standard input"
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if manifestPath != "" {
+			entry := newManifestEntry(s)
+			linkInvoice(manifest, entry)
+			manifest = append(manifest, entry)
+		}
+		if s.DuplicateOf != "" {
+			if !quiet {
+				slog.Info("Skipped duplicate", "filename", s.Filename, "type", s.MediaType, "source", source, "mailbox", s.Email.Mailbox,
+					"duplicate_of", s.DuplicateOf)
+			}
+			return
+		}
+		if s.Quarantined != "" {
+			slog.Warn("Quarantined", "path", s.Path, "type", s.MediaType, "reason", s.Quarantined, "source", source, "mailbox", s.Email.Mailbox)
+			return
+		}
+		if !quiet {
+			slog.Info("Saved", "path", s.Path, "type", s.MediaType, "source", source, "mailbox", s.Email.Mailbox)
+		}
+	}
+
+	// The first interrupt lets the messages in progress finish and the
+	// manifest and state be saved; a second one quits at once. With -strict,
+	// the first error stops the run the same way.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		slog.Warn("Interrupted, finishing the messages in progress; interrupt again to quit now")
+		cancel(errInterrupted)
+	}()
+
+	scanner, err := sources.configure(x)
 	if err != nil {
-		return fmt.Errorf("error reading attachment data: %v", err)
-	}
-
-	var decodedData []byte
-	switch strings.ToLower(strings.TrimSpace(encoding)) {
-	case "base64":
-		// Clean up base64 data by removing whitespace/newlines
-		cleanData := strings.ReplaceAll(string(data), "\n", "")
-		cleanData = strings.ReplaceAll(cleanData, "\r", "")
-		cleanData = strings.ReplaceAll(cleanData, " ", "")
-		
-		decodedData, err = base64.StdEncoding.DecodeString(cleanData)
+		return err
+	}
+	scanner.Context = ctx
+	if x.HTMLRenderer == nil && slices.ContainsFunc(x.Rules, func(r *extract.Rule) bool { return r.Render }) {
+		return fatal("-rules has render rules, which require -html-renderer")
+	}
+	if downloadDomains != "" {
+		if !slices.ContainsFunc(x.Rules, func(r *extract.Rule) bool { return r.Download != nil }) {
+			return fatal("-download-domains requires download rules in -rules")
+		}
+		x.Downloader = extract.NewDownloader(slices.Sorted(maps.Keys(parseList(downloadDomains))))
+	} else if slices.ContainsFunc(x.Rules, func(r *extract.Rule) bool { return r.Download != nil }) {
+		return fatal("-rules has download rules, which require -download-domains")
+	}
+	if moveTo != "" {
+		folder, err := extract.MaildirFolder(sources.maildirPath, moveTo)
 		if err != nil {
-			return fmt.Errorf("error decoding base64 data: %v", err)
+			return fatal("Error opening the -move-to folder", "error", err)
 		}
-	case "quoted-printable":
-		// Handle quoted-printable encoding if needed
-		decodedData = data
-	default:
-		// No encoding or binary
-		decodedData = data
+		x.MoveTo = folder.Path
+		// Messages already moved are not scanned again
+		scanner.ExcludeMailboxes = append(scanner.ExcludeMailboxes, quoteGlob(folder.Name))
+	}
+	if summary != nil {
+		scanner.OnMailbox = summary.mailbox
+	}
+	// Errors stopping a message come from the scanner, and those losing
+	// part of one from the extractor
+	reportError := func(err error, whole bool) {
+		if status != nil {
+			status.recordError(err)
+		}
+		if summary != nil {
+			if whole {
+				summary.failed(err)
+			} else {
+				summary.partFailed(err)
+			}
+		}
+		if events != nil {
+			events.scanError(err)
+		}
+		if hook != nil {
+			hook.failed(err)
+		}
+		if met != nil {
+			met.failed(err)
+		}
+		if strict {
+			cancel(err)
+		}
+	}
+	scanner.OnError = func(err error) { reportError(err, true) }
+	x.OnError = func(err error) { reportError(err, false) }
+	if bar != nil {
+		scanner.OnQueued = bar.queued
+		scanner.OnProcessed = bar.processed
 	}
 
-	cwd, err := os.Getwd()
+	imapSource, err := sources.imapSource()
 	if err != nil {
-		return fmt.Errorf("error getting current directory: %v", err)
+		return err
+	}
+	scanSources := func() error {
+		return sources.scan(scanner, imapSource)
 	}
 
-	filename = sanitizeFilename(filename)
-	outputPath := filepath.Join(cwd, filename)
-	
-	counter := 1
-	for {
-		if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-			break
+	saveManifest := func() error {
+		if manifestPath == "" {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		data, err := encodeManifest(manifest)
+		if err != nil {
+			return err
 		}
-		
-		ext := filepath.Ext(filename)
-		name := strings.TrimSuffix(filename, ext)
-		outputPath = filepath.Join(cwd, fmt.Sprintf("%s_%d%s", name, counter, ext))
-		counter++
+		return outputs.writeFile(manifestPath, data)
+	}
+	saveCustody := func() error {
+		if custody == nil {
+			return nil
+		}
+		return custody.write(custodyPath, custodyKey)
+	}
+	saveHTMLIndex := func() error {
+		if htmlIdx == nil {
+			return nil
+		}
+		return htmlIdx.write()
 	}
 
-	err = os.WriteFile(outputPath, decodedData, 0644)
-	if err != nil {
-		return fmt.Errorf("error writing PDF file %s: %v", outputPath, err)
+	if receiving {
+		if metricsAddr != "" {
+			go serveMetrics(ctx, metricsAddr, met)
+		}
+		// Each message is a run of its own, for -webhook-per run and the
+		// metrics, processed one at a time
+		var deliverMu sync.Mutex
+		deliver := func(data []byte) {
+			deliverMu.Lock()
+			defer deliverMu.Unlock()
+			if hook != nil {
+				hook.startRun()
+			}
+			if err := x.ExtractMessage(bytes.NewReader(data), "", "INBOX"); err != nil {
+				reportError(fmt.Errorf("processing delivered message: %v", err), true)
+			}
+			if err := saveManifest(); err != nil {
+				slog.Error("Error writing manifest", "error", err)
+			}
+			if err := saveCustody(); err != nil {
+				slog.Error("Error writing custody manifest", "error", err)
+			}
+			if err := saveHTMLIndex(); err != nil {
+				slog.Error("Error writing the -index-html page", "error", err)
+			}
+			if hook != nil {
+				hook.endRun(true)
+			}
+			if met != nil {
+				met.endRun()
+				writeMetrics()
+			}
+		}
+		if lmtpAddr != "" {
+			err = newLMTPServer(lmtpForward, deliver).serve(ctx, lmtpAddr)
+		} else {
+			err = newMilterServer(deliver).serve(ctx, milterAddr)
+		}
+		if err != nil {
+			return fatal("Error receiving messages", "error", err)
+		}
+		if stoppedByError(ctx) {
+			exitCode = 2
+		}
+		return exitWith(exitCode)
 	}
 
-	// Set file timestamp to email date if available
-	if !emailTime.IsZero() {
-		err = os.Chtimes(outputPath, emailTime, emailTime)
+	if daemon {
+		if statusAddr != "" {
+			go serveStatus(ctx, statusAddr, status)
+		}
+		if webAddr != "" {
+			ui := &webUI{status: status, state: x.State, password: webPassword, settings: []webSetting{
+				{"Sources", sources.describe()},
+				{"Output", []string{redactURL(outputDir)}},
+				{"State database", []string{statePath}},
+				{"Interval", []string{interval.String()}},
+			}}
+			if remote == nil {
+				ui.outputDir = outputDir
+			}
+			go serveWebUI(ctx, webAddr, ui)
+		}
+		if metricsAddr != "" {
+			go serveMetrics(ctx, metricsAddr, met)
+		}
+		runDaemon(ctx, interval, status, func() error {
+			if hook != nil {
+				hook.startRun()
+			}
+			err := scanSources()
+			if err := saveManifest(); err != nil {
+				slog.Error("Error writing manifest", "error", err)
+			}
+			if err := saveCustody(); err != nil {
+				slog.Error("Error writing custody manifest", "error", err)
+			}
+			if err := saveHTMLIndex(); err != nil {
+				slog.Error("Error writing the -index-html page", "error", err)
+			}
+			if hook != nil {
+				if err != nil {
+					hook.failed(err)
+				}
+				hook.endRun(true)
+			}
+			if met != nil {
+				if err != nil {
+					met.failed(err)
+				}
+				met.endRun()
+				writeMetrics()
+			}
+			return err
+		})
+		if stoppedByError(ctx) {
+			exitCode = 2
+		}
+		return exitWith(exitCode)
+	}
+
+	if err := scanSources(); err != nil {
+		return fatal("Error scanning", "error", err)
+	}
+	// Interrupting is how watching normally ends
+	stopped := ctx.Err() != nil
+	if watch && !stopped {
+		if bar != nil {
+			bar.finish()
+		}
+		if met != nil {
+			met.endRun()
+			writeMetrics()
+		}
+		if metricsAddr != "" {
+			go serveMetrics(ctx, metricsAddr, met)
+		}
+		// Rewritten regularly, so its age shows whether watching goes on
+		if metricsTextfile != "" {
+			go func() {
+				ticker := time.NewTicker(time.Minute)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						writeMetrics()
+					}
+				}
+			}()
+		}
+		if err := scanner.Watch(ctx, sources.maildirPath, debounce); err != nil {
+			return fatal("Error watching maildir", "error", err)
+		}
+	}
+	scanner.ScanFiles(files, "INBOX")
+	if sources.stdin && passthrough {
+		// The message is passed on even if it cannot be processed, so as
+		// not to hold up its delivery
+		data, err := io.ReadAll(os.Stdin)
 		if err != nil {
-			log.Printf("Warning: could not set timestamp for %s: %v", outputPath, err)
+			return fatal("Error reading standard input", "error", err)
+		}
+		if ctx.Err() == nil {
+			if err := x.ExtractMessage(bytes.NewReader(data), "", "INBOX"); err != nil {
+				reportError(fmt.Errorf("processing standard input: %v", err), true)
+			}
+		}
+		if _, err := os.Stdout.Write(data); err != nil {
+			return fatal("Error writing the message to standard output", "error", err)
 		}
+	} else if sources.stdin && ctx.Err() == nil {
+		if err := x.ExtractMessage(os.Stdin, "", "INBOX"); err != nil {
+			reportError(fmt.Errorf("processing standard input: %v", err), true)
+		}
+	}
+	if !watch || stoppedByError(ctx) {
+		stopped = ctx.Err() != nil
 	}
 
-	fmt.Printf("Saved PDF: %s (from %s in mailbox %s)\n", outputPath, emailPath, mailboxName)
-	return nil
+	if bar != nil {
+		bar.finish()
+	}
+	if err := saveManifest(); err != nil {
+		return fatal("Error writing manifest", "error", err)
+	}
+	if err := saveCustody(); err != nil {
+		return fatal("Error writing custody manifest", "error", err)
+	}
+	if err := saveHTMLIndex(); err != nil {
+		return fatal("Error writing the -index-html page", "error", err)
+	}
+	if stopped && merger != nil {
+		slog.Warn("Not merging PDFs, as the run was stopped early")
+	} else if merger != nil {
+		paths, err := merger.Write(mergeDir)
+		for _, path := range paths {
+			slog.Info("Saved merged PDF", "path", path)
+		}
+		if err != nil {
+			return fatal("Error merging PDFs", "error", err)
+		}
+	}
+	if err := summary.finish(summaryPath); err != nil {
+		return fatal("Error writing summary", "error", err)
+	}
+	if mailer != nil {
+		if err := mailer.send(summary); err != nil {
+			slog.Error("Error emailing summary", "error", err)
+		}
+	}
+	if hook != nil {
+		hook.endRun(false)
+	}
+	if met != nil {
+		if !watch {
+			met.endRun()
+		}
+		writeMetrics()
+	}
+	switch {
+	case stoppedByError(ctx):
+		slog.Error("Stopped at the first error, as -strict was given")
+		exitCode = 2
+	case stopped:
+		exitCode = 1
+		switch {
+		case resume:
+			slog.Warn("Run interrupted; run again with -resume to carry on")
+		case statePath != "":
+			slog.Warn("Run interrupted; run again with the same -state to carry on")
+		default:
+			slog.Warn("Run interrupted; use -state or -resume to be able to carry on where a run stopped")
+		}
+	case summary.errorCount() > 0:
+		exitCode = 1
+	}
+	if passthrough && exitCode == 1 {
+		exitCode = 0
+	}
+	return exitWith(exitCode)
 }
 
-func sanitizeFilename(filename string) string {
-	filename = strings.ReplaceAll(filename, "/", "_")
-	filename = strings.ReplaceAll(filename, "\\", "_")
-	filename = strings.ReplaceAll(filename, ":", "_")
-	filename = strings.ReplaceAll(filename, "*", "_")
-	filename = strings.ReplaceAll(filename, "?", "_")
-	filename = strings.ReplaceAll(filename, "\"", "_")
-	filename = strings.ReplaceAll(filename, "<", "_")
-	filename = strings.ReplaceAll(filename, ">", "_")
-	filename = strings.ReplaceAll(filename, "|", "_")
-	
-	if filename == "" {
-		filename = "attachment.pdf"
-	}
-	
-	return filename
+// prepareOutputDir resolves dir to an absolute path, creating it if needed,
+// and checks that files can actually be created in it.
+func prepareOutputDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	probe, err := os.CreateTemp(dir, ".maildir2pdf-")
+	if err != nil {
+		return "", fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	return dir, nil
 }
\ No newline at end of file
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// ManifestEntry describes one extracted attachment in the -manifest output.
+type ManifestEntry struct {
+	Output        string     `json:"output"`
+	OrigName      string     `json:"original_filename"`
+	Mailbox       string     `json:"mailbox"`
+	Source        string     `json:"source"`
+	MessageID     string     `json:"message_id,omitempty"`
+	From          string     `json:"from,omitempty"`
+	Subject       string     `json:"subject,omitempty"`
+	Date          *time.Time `json:"date,omitempty"`
+	Size          int64      `json:"size"`
+	SHA256        string     `json:"sha256"`
+	DuplicateOf   string     `json:"duplicate_of,omitempty"`
+	Quarantined   string     `json:"quarantined,omitempty"`
+	Encryption    string     `json:"encryption,omitempty"`
+	Signature     string     `json:"signature,omitempty"`
+	Signer        string     `json:"signer,omitempty"`
+	DKIM          string     `json:"dkim,omitempty"`
+	DKIMDomain    string     `json:"dkim_domain,omitempty"`
+	Text          string     `json:"text,omitempty"`
+	SourceEML     string     `json:"source_eml,omitempty"`
+	Body          string     `json:"body,omitempty"`
+	Paperless     string     `json:"paperless_task,omitempty"`
+	InvoiceXML    string     `json:"invoice_xml,omitempty"`
+	InvoicePDF    string     `json:"invoice_pdf,omitempty"`
+	InvoiceFormat string     `json:"invoice_format,omitempty"`
+	DownloadURL   string     `json:"download_url,omitempty"`
+}
+
+func newManifestEntry(s *extract.Saved) ManifestEntry {
+	email := s.Email
+	entry := ManifestEntry{
+		Output:        s.Path,
+		OrigName:      s.Filename,
+		Mailbox:       email.Mailbox,
+		Source:        email.Path,
+		MessageID:     email.MessageID,
+		From:          email.From,
+		Subject:       email.Subject,
+		Size:          s.Size,
+		SHA256:        s.SHA256,
+		DuplicateOf:   s.DuplicateOf,
+		Quarantined:   s.Quarantined,
+		Encryption:    s.Encryption,
+		Signature:     email.Signature,
+		Signer:        email.Signer,
+		DKIM:          email.DKIM,
+		DKIMDomain:    email.DKIMDomain,
+		Text:          s.TextPath,
+		SourceEML:     s.EMLPath,
+		Body:          s.BodyPath,
+		Paperless:     s.PaperlessTask,
+		InvoiceXML:    s.InvoiceXML,
+		InvoicePDF:    s.InvoicePDF,
+		InvoiceFormat: s.InvoiceFormat,
+		DownloadURL:   s.DownloadURL,
+	}
+	if !email.Date.IsZero() {
+		entry.Date = &email.Date
+	}
+	return entry
+}
+
+// linkInvoice completes the link between a PDF and an e-invoice XML
+// attachment of the same message in the entry for the one saved first,
+// entry being that of the second, which alone records it.
+func linkInvoice(entries []ManifestEntry, entry ManifestEntry) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		switch {
+		case entry.InvoicePDF != "" && entries[i].Output == entry.InvoicePDF && entries[i].InvoiceXML == "":
+			entries[i].InvoiceXML, entries[i].InvoiceFormat = entry.Output, entry.InvoiceFormat
+			return
+		case entry.InvoiceXML != "" && entries[i].Output == entry.InvoiceXML && entries[i].InvoicePDF == "":
+			entries[i].InvoicePDF = entry.Output
+			return
+		}
+	}
+}
+
+// readManifest reads the entries of a manifest encoded by encodeManifest.
+func readManifest(path string) ([]ManifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// encodeManifest returns the manifest entries as a JSON array.
+func encodeManifest(entries []ManifestEntry) ([]byte, error) {
+	if entries == nil {
+		entries = []ManifestEntry{}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
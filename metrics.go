@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// metrics counts what extract does over the life of the process, for
+// -metrics-addr and -metrics-textfile, in the Prometheus text format.
+type metrics struct {
+	mu sync.Mutex
+
+	messages      int64 // scanned, including those skipped
+	extracted     int64
+	duplicates    int64
+	errors        int64
+	bytesWritten  int64
+	runs          int64
+	lastRun       time.Time // when the last run, or the scan -watch starts with, ended
+	lastExtracted time.Time
+}
+
+func newMetrics() *metrics {
+	return &metrics{}
+}
+
+func (m *metrics) message(*extract.Email) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages++
+}
+
+func (m *metrics) skipped(s *extract.Skipped) {
+	if s.Attachment != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages++
+}
+
+func (m *metrics) saved(s *extract.Saved) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case s.DuplicateOf != "":
+		m.duplicates++
+	case s.Quarantined != "":
+		m.bytesWritten += s.Size
+	default:
+		m.extracted++
+		m.bytesWritten += s.Size
+		m.lastExtracted = time.Now()
+	}
+}
+
+func (m *metrics) failed(error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors++
+}
+
+func (m *metrics) endRun() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs++
+	m.lastRun = time.Now()
+}
+
+// encode returns the metrics in the Prometheus text exposition format.
+func (m *metrics) encode() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b bytes.Buffer
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+	}
+	metric("maildir2pdf_messages_scanned_total", "counter", "Messages processed or skipped.", m.messages)
+	metric("maildir2pdf_attachments_extracted_total", "counter", "Attachments saved, not counting duplicates or those quarantined.", m.extracted)
+	metric("maildir2pdf_duplicates_total", "counter", "Attachments not saved again, as -dedup found the same content.", m.duplicates)
+	metric("maildir2pdf_errors_total", "counter", "Errors losing a message or part of one.", m.errors)
+	metric("maildir2pdf_bytes_written_total", "counter", "Bytes of attachments saved.", m.bytesWritten)
+	metric("maildir2pdf_runs_total", "counter", "Runs completed.", m.runs)
+	metric("maildir2pdf_last_run_timestamp_seconds", "gauge", "When the last run ended, or 0 before the first.", timestamp(m.lastRun))
+	metric("maildir2pdf_last_extracted_timestamp_seconds", "gauge", "When an attachment was last saved, or 0 if none was.", timestamp(m.lastExtracted))
+	return b.Bytes()
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.encode())
+}
+
+// writeTextfile writes the metrics to path for the node_exporter textfile
+// collector, which must never see a partial file, so it is written under a
+// temporary name and renamed.
+func (m *metrics) writeTextfile(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".maildir2pdf-metrics-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(m.encode())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// serveMetrics serves the metrics at /metrics on addr until ctx is
+// cancelled.
+func serveMetrics(ctx context.Context, addr string, m *metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Error serving metrics", "addr", addr, "error", err)
+	}
+}
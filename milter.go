@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Commands of the milter protocol, sent by the MTA.
+const (
+	milterOptNeg   = 'O' // negotiate the version, actions and protocol
+	milterMacro    = 'D' // macros for the next command; no reply
+	milterConnect  = 'C'
+	milterHelo     = 'H'
+	milterMail     = 'M'
+	milterRcpt     = 'R'
+	milterData     = 'T'
+	milterHeader   = 'L' // NAME\0VALUE\0
+	milterEOH      = 'N'
+	milterBody     = 'B' // a chunk of the body
+	milterEOB      = 'E' // end of the message
+	milterAbort    = 'A' // the message was abandoned; the session goes on
+	milterUnknown  = 'U'
+	milterQuit     = 'Q'
+	milterQuitNC   = 'K' // quit, but a new connection follows on the socket
+	milterContinue = 'c' // reply: carry on with the message
+)
+
+// Protocol flags of the negotiation, telling the MTA to leave out the
+// commands maildir2pdf has no use for.
+const (
+	milterNoConnect = 0x1
+	milterNoHelo    = 0x2
+	milterNoMail    = 0x4
+	milterNoRcpt    = 0x8
+	milterNoUnknown = 0x100
+	milterNoData    = 0x200
+)
+
+// milterVersion is the version of the milter protocol spoken, that of
+// Sendmail 8.14 and Postfix 2.6 onwards.
+const milterVersion = 6
+
+// milterMaxPacket bounds the packets accepted, well above the 64 KB body
+// chunks MTAs send.
+const milterMaxPacket = 1 << 20
+
+// milterServer is a milter, which Postfix or Sendmail hand every message
+// they receive to, along with its headers and body, before queueing it. It
+// never changes nor rejects messages, but hands each to deliver once the
+// MTA has finished sending it.
+type milterServer struct {
+	deliver func(data []byte)
+}
+
+func newMilterServer(deliver func(data []byte)) *milterServer {
+	return &milterServer{deliver: deliver}
+}
+
+// serve accepts milter connections on addr until ctx is cancelled, then
+// waits for the messages being processed.
+func (m *milterServer) serve(ctx context.Context, addr string) error {
+	return serveSessions(ctx, "milter", addr, m.session)
+}
+
+// session runs a milter session on conn, which may carry several messages.
+func (m *milterServer) session(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	var message bytes.Buffer
+	for {
+		conn.SetDeadline(time.Now().Add(sessionTimeout))
+		command, data, err := readMilterPacket(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch command {
+		case milterOptNeg:
+			if len(data) < 12 {
+				return fmt.Errorf("short option negotiation")
+			}
+			version := binary.BigEndian.Uint32(data[0:4])
+			protocol := binary.BigEndian.Uint32(data[8:12])
+			if version < 2 {
+				return fmt.Errorf("milter protocol version %d is not supported", version)
+			}
+			// Of the steps the MTA offers to leave out, those of no use
+			reply := make([]byte, 12)
+			binary.BigEndian.PutUint32(reply[0:4], min(version, milterVersion))
+			binary.BigEndian.PutUint32(reply[4:8], 0) // no changes to messages
+			binary.BigEndian.PutUint32(reply[8:12], protocol&(milterNoConnect|milterNoHelo|milterNoMail|milterNoRcpt|milterNoUnknown|milterNoData))
+			err = writeMilterPacket(conn, milterOptNeg, reply)
+
+		case milterMacro:
+			// Macros need no reply
+
+		case milterHeader:
+			name, rest, _ := bytes.Cut(data, []byte{0})
+			value, _, _ := bytes.Cut(rest, []byte{0})
+			message.Write(name)
+			message.WriteString(": ")
+			message.Write(value)
+			message.WriteString("\r\n")
+			err = writeMilterPacket(conn, milterContinue, nil)
+
+		case milterEOH:
+			message.WriteString("\r\n")
+			err = writeMilterPacket(conn, milterContinue, nil)
+
+		case milterBody:
+			message.Write(data)
+			err = writeMilterPacket(conn, milterContinue, nil)
+
+		case milterEOB:
+			// The message goes on its way before it is processed, so the MTA
+			// does not time out waiting
+			data := bytes.Clone(message.Bytes())
+			message.Reset()
+			if err = writeMilterPacket(conn, milterContinue, nil); err == nil {
+				m.deliver(data)
+			}
+
+		case milterAbort:
+			message.Reset()
+
+		case milterQuit:
+			return nil
+
+		case milterQuitNC:
+			message.Reset()
+
+		case milterConnect, milterHelo, milterMail, milterRcpt, milterData, milterUnknown:
+			err = writeMilterPacket(conn, milterContinue, nil)
+
+		default:
+			return fmt.Errorf("unknown milter command %q", command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readMilterPacket reads a packet: its length, on 4 bytes, then the command
+// and its data.
+func readMilterPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > milterMaxPacket {
+		return 0, nil, fmt.Errorf("milter packet of %d bytes", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func writeMilterPacket(w io.Writer, command byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = command
+	copy(packet[5:], data)
+	_, err := w.Write(packet)
+	return err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// profileFlags select named profiles, sets of extract flags such as the
+// maildir, output and filters of one mail account, from a profiles file:
+//
+//	# Flags before the first profile apply to all of them
+//	state = ~/.maildir2pdf.db
+//
+//	[personal]
+//	maildir = ~/Mail/personal
+//	output = ~/Documents/Personal
+//
+//	[work]
+//	maildir = ~/Mail/work
+//	output = ~/Documents/Work
+//	include-mailbox = INBOX,Invoices
+//	seen-only
+//
+// Each line is a flag, without its leading dash, and its value if it takes
+// one; a leading ~/ is replaced by the home directory.
+type profileFlags struct {
+	path  string
+	names string
+	all   bool
+}
+
+// profileFlagNames are the flags selecting profiles, which cannot be given
+// in them.
+var profileFlagNames = []string{"profiles", "profile", "all-profiles"}
+
+func (p *profileFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&p.path, "profiles", "", "File of named profiles of flags for -profile and -all-profiles (default: maildir2pdf/profiles in the user configuration directory, e.g. ~/.config)")
+	fs.StringVar(&p.names, "profile", "", "Run once with the flags of each of these comma-separated profiles of the -profiles file, followed by those given on the command line")
+	fs.BoolVar(&p.all, "all-profiles", false, "Run once with the flags of each profile of the -profiles file in turn, followed by those given on the command line")
+}
+
+// selected reports whether -profile or -all-profiles was given.
+func (p *profileFlags) selected() bool {
+	return p.names != "" || p.all
+}
+
+// profile is a named set of flags from a profiles file.
+type profile struct {
+	name string
+	args []string
+}
+
+// run runs extract once for each selected profile, one after the other,
+// with the profile's flags followed by args, the command line, less the
+// profile flags, then ends with the highest status of the runs.
+func (p *profileFlags) run(fs *flag.FlagSet, args []string) error {
+	path := p.path
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return fatal("Error finding the -profiles file", "error", err)
+		}
+		path = filepath.Join(dir, "maildir2pdf", "profiles")
+	}
+	profiles, err := readProfiles(path)
+	if err != nil {
+		return fatal("Error reading -profiles", "error", err)
+	}
+	if p.names != "" {
+		var selected []profile
+		for _, name := range strings.Split(p.names, ",") {
+			name = strings.TrimSpace(name)
+			i := slices.IndexFunc(profiles, func(prof profile) bool { return prof.name == name })
+			if i < 0 {
+				return fatal("No such profile", "profile", name, "profiles", path)
+			}
+			selected = append(selected, profiles[i])
+		}
+		profiles = selected
+	}
+	if len(profiles) == 0 {
+		return fatal("No profiles", "profiles", path)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fatal("Error finding the maildir2pdf executable", "error", err)
+	}
+	args = withoutProfileFlags(fs, args)
+
+	// The run in progress, in the same process group, gets the signals of
+	// the terminal or service manager itself, and finishes cleanly; no more
+	// are started
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	exitCode := 0
+	for _, prof := range profiles {
+		slog.Info("Running profile", "profile", prof.name)
+		cmd := exec.Command(exe, append(append([]string{"extract"}, prof.args...), args...)...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			slog.Error("Profile failed", "profile", prof.name, "status", exitErr.ExitCode())
+			exitCode = max(exitCode, exitErr.ExitCode(), 1)
+		case err != nil:
+			slog.Error("Profile failed", "profile", prof.name, "error", err)
+			exitCode = 2
+		}
+		select {
+		case <-signals:
+			slog.Warn("Interrupted, not running the remaining profiles")
+			return exitStatus(max(exitCode, 1))
+		default:
+		}
+	}
+	return exitWith(exitCode)
+}
+
+// readProfiles reads a profiles file, described at profileFlags.
+func readProfiles(path string) ([]profile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var common []string
+	var profiles []profile
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" || strings.Contains(name, ",") {
+				return nil, fmt.Errorf("line %d: invalid profile name %q", n, name)
+			}
+			if slices.ContainsFunc(profiles, func(prof profile) bool { return prof.name == name }) {
+				return nil, fmt.Errorf("line %d: profile %s given twice", n, name)
+			}
+			profiles = append(profiles, profile{name: name, args: slices.Clone(common)})
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(line, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d: expected a flag, as name = value, or a profile, as [name]", n)
+		}
+		if slices.Contains(profileFlagNames, name) {
+			return nil, fmt.Errorf("line %d: -%s cannot be given in a profile", n, name)
+		}
+		arg := "-" + name
+		if hasValue {
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			if strings.HasPrefix(value, "~/") {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					return nil, err
+				}
+				value = filepath.Join(home, value[2:])
+			}
+			arg += "=" + value
+		}
+		if len(profiles) == 0 {
+			common = append(common, arg)
+		} else {
+			profiles[len(profiles)-1].args = append(profiles[len(profiles)-1].args, arg)
+		}
+	}
+	return profiles, scanner.Err()
+}
+
+// withoutProfileFlags returns the command line args, parsed by fs, without
+// the flags selecting profiles.
+func withoutProfileFlags(fs *flag.FlagSet, args []string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			// The message files named follow the flags
+			return append(kept, args[i:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		takesValue := false
+		if f := fs.Lookup(name); f != nil && !hasValue {
+			boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+			takesValue = !ok || !boolFlag.IsBoolFlag()
+		}
+		if slices.Contains(profileFlagNames, name) {
+			if takesValue {
+				i++
+			}
+			continue
+		}
+		kept = append(kept, arg)
+		if takesValue && i+1 < len(args) {
+			i++
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressBar reports on a terminal how far a run has got: messages
+// processed out of those found, the rate, files saved and the time left.
+// It is redrawn a few times a second on the last line of out.
+type progressBar struct {
+	mu    sync.Mutex
+	out   io.Writer
+	start time.Time
+	total int
+	done  int
+	saved int
+	drawn bool
+
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	p := &progressBar{out: out, start: time.Now(), stop: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.draw()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progressBar) queued(n int) {
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+func (p *progressBar) processed() {
+	p.mu.Lock()
+	p.done++
+	p.mu.Unlock()
+}
+
+func (p *progressBar) savedFile() {
+	p.mu.Lock()
+	p.saved++
+	p.mu.Unlock()
+}
+
+// finish stops redrawing and erases the bar. It may be called more than
+// once.
+func (p *progressBar) finish() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.stopped
+	p.mu.Lock()
+	p.erase()
+	p.mu.Unlock()
+}
+
+// erase clears the bar, so other output can take its line; the next tick
+// draws it again below.
+func (p *progressBar) erase() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+func (p *progressBar) draw() {
+	elapsed := time.Since(p.start)
+	rate := float64(p.done) / elapsed.Seconds()
+
+	var b strings.Builder
+	b.WriteString("\r\033[K")
+	if p.total > 0 {
+		done := min(p.done, p.total)
+		const width = 30
+		filled := width * done / p.total
+		fmt.Fprintf(&b, "[%s%s] %3d%% %d/%d messages", strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+			100*done/p.total, p.done, p.total)
+	} else {
+		fmt.Fprintf(&b, "%d messages", p.done)
+	}
+	fmt.Fprintf(&b, ", %.1f/s, %d saved", rate, p.saved)
+	if p.total > p.done && p.done > 0 {
+		left := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		fmt.Fprintf(&b, ", ETA %s", left.Round(time.Second))
+	}
+	fmt.Fprint(p.out, b.String())
+	p.drawn = true
+}
+
+// writer returns a writer to w that erases the bar before each write, for
+// output sharing the terminal with it.
+func (p *progressBar) writer(w io.Writer) io.Writer {
+	return writerFunc(func(b []byte) (int, error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.erase()
+		return w.Write(b)
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
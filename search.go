@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"maildir2pdf/extract"
+)
+
+// runSearch implements "maildir2pdf search", which looks up files in an
+// index built with -index.
+func runSearch(args []string) error {
+	var indexPath string
+	var limit int
+	fs := newFlagSet("search", "-index FILE [-limit N] WORDS...")
+	fs.StringVar(&indexPath, "index", "", "Search index built by extracting with -index")
+	fs.IntVar(&limit, "limit", 20, "Maximum number of results to show")
+	fs.Parse(args)
+
+	if indexPath == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	// Opening would create an empty index for a mistyped path
+	if _, err := os.Stat(indexPath); err != nil {
+		return fatal("Error opening search index", "error", err)
+	}
+	index, err := extract.OpenSearchIndex(indexPath)
+	if err != nil {
+		return fatal("Error opening search index", "error", err)
+	}
+	defer index.Close()
+
+	results, err := index.Search(strings.Join(fs.Args(), " "), limit)
+	if err != nil {
+		return fatal("Error searching", "error", err)
+	}
+	for _, r := range results {
+		fmt.Println(r.Output)
+		date := "undated"
+		if !r.Date.IsZero() {
+			date = r.Date.Format("2006-01-02")
+		}
+		fmt.Printf("    %s, from %s: %s\n", date, r.From, r.Subject)
+		fmt.Printf("    in %s (mailbox %s)\n", r.Source, r.Mailbox)
+		if snippet := strings.Join(strings.Fields(r.Snippet), " "); snippet != "" {
+			fmt.Printf("    %s\n", snippet)
+		}
+	}
+	if len(results) == 0 {
+		fmt.Println("No matches")
+	}
+	return nil
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// siteDocument is a saved file shown by the site command.
+type siteDocument struct {
+	ManifestEntry
+	ID     string // names its page, from its output path
+	Href   string // of the file, relative to the site
+	Thumb  string // of its thumbnail, relative to the site, if any
+	Kind   string // "pdf", "image" or "other", for how it is previewed
+	Year   string // of its email, or "undated"
+	Sender string // domain of the sender, as sitePageName makes it, or "unknown"
+}
+
+// sitePage is a page of documents, by year or sender.
+type sitePage struct {
+	Name      string // e.g. 2023 or acme.com
+	File      string // e.g. year-2023.html
+	Documents []*siteDocument
+}
+
+// runSite implements "maildir2pdf site", which renders the files listed in
+// manifests as a static website.
+func runSite(args []string) error {
+	var outputDir, title string
+	var thumbnails, copyFiles bool
+	fs := newFlagSet("site", "-output DIR [FLAGS] MANIFEST...")
+	fs.StringVar(&outputDir, "output", "", "Directory to write the site to, created if needed")
+	fs.StringVar(&title, "title", "Mail archive", "Title of the site")
+	fs.BoolVar(&thumbnails, "thumbnails", false, "Show a thumbnail of the first page of each PDF, rendered with Ghostscript")
+	fs.BoolVar(&copyFiles, "copy", false, "Copy the documents into the site, under files/, so that it can be moved or served on its own")
+	fs.Parse(args)
+	if outputDir == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	var gs string
+	if thumbnails {
+		var err error
+		if gs, err = exec.LookPath("gs"); err != nil {
+			return fatal("-thumbnails requires Ghostscript (gs) in the PATH")
+		}
+	}
+	dir, err := filepath.Abs(outputDir)
+	if err != nil {
+		return fatal("Error preparing -output", "error", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fatal("Error preparing -output", "error", err)
+	}
+
+	// Files saved again by later runs are listed by their last manifest
+	byPath := make(map[string]*siteDocument)
+	var missing int
+	for _, manifestPath := range fs.Args() {
+		entries, err := readManifest(manifestPath)
+		if err != nil {
+			return fatal("Error reading manifest", "error", err)
+		}
+		for _, e := range entries {
+			if e.Output == "" || e.Quarantined != "" {
+				continue
+			}
+			path, err := filepath.Abs(e.Output)
+			if err != nil {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				missing++
+				continue
+			}
+			byPath[path] = newSiteDocument(e, path)
+		}
+	}
+	if missing > 0 {
+		slog.Warn("Leaving out files that no longer exist", "count", missing)
+	}
+
+	docs := make([]*siteDocument, 0, len(byPath))
+	for path, doc := range byPath {
+		if copyFiles {
+			if doc.Href, err = copySiteFile(dir, doc, path); err != nil {
+				return fatal("Error copying document", "path", path, "error", err)
+			}
+		} else {
+			doc.Href = siteLink(dir, path)
+		}
+		if doc.Kind == "image" {
+			doc.Thumb = doc.Href
+		} else if thumbnails && doc.Kind == "pdf" {
+			if doc.Thumb, err = siteThumbnail(gs, dir, doc, path); err != nil {
+				slog.Warn("Could not render thumbnail", "path", path, "error", err)
+			}
+		}
+		docs = append(docs, doc)
+	}
+	slices.SortFunc(docs, func(a, b *siteDocument) int {
+		switch {
+		case a.Date == nil && b.Date == nil:
+		case a.Date == nil:
+			return 1
+		case b.Date == nil:
+			return -1
+		default:
+			if c := b.Date.Compare(*a.Date); c != 0 {
+				return c
+			}
+		}
+		return strings.Compare(a.Href, b.Href)
+	})
+
+	if err := writeSite(dir, title, docs); err != nil {
+		return fatal("Error writing site", "error", err)
+	}
+	fmt.Printf("Wrote %d documents to %s\n", len(docs), filepath.Join(dir, "index.html"))
+	return nil
+}
+
+func newSiteDocument(e ManifestEntry, path string) *siteDocument {
+	sum := sha256.Sum256([]byte(path))
+	doc := &siteDocument{ManifestEntry: e, ID: hex.EncodeToString(sum[:8]), Year: "undated", Sender: "unknown", Kind: "other"}
+	if e.Date != nil {
+		doc.Year = e.Date.Format("2006")
+	}
+	if _, domain, ok := strings.Cut(e.From, "@"); ok && domain != "" {
+		doc.Sender = sitePageName(domain)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pdf":
+		doc.Kind = "pdf"
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		doc.Kind = "image"
+	}
+	return doc
+}
+
+// siteLink returns the URL of the file at path relative to the site in
+// dir, or a file: URL where it has none.
+func siteLink(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// copySiteFile copies a document into files/ID/ under the site, linking it
+// rather than copying it where the file system allows, and returns its link.
+func copySiteFile(dir string, doc *siteDocument, path string) (string, error) {
+	target := filepath.Join(dir, "files", doc.ID, filepath.Base(path))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(target); err != nil {
+		if err := os.Link(path, target); err != nil {
+			if err := copyFile(path, target); err != nil {
+				return "", err
+			}
+		}
+	}
+	return siteLink(dir, target), nil
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	return out.Close()
+}
+
+// siteThumbnail renders the first page of a PDF as thumbs/ID.png under the
+// site with Ghostscript, unless it already has, and returns its link.
+func siteThumbnail(gs, dir string, doc *siteDocument, path string) (string, error) {
+	thumb := filepath.Join(dir, "thumbs", doc.ID+".png")
+	link := "thumbs/" + doc.ID + ".png"
+	source, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(thumb); err == nil && !info.ModTime().Before(source.ModTime()) {
+		return link, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(thumb), 0755); err != nil {
+		return "", err
+	}
+	// 24 dpi makes an A4 page about 200 pixels wide
+	cmd := exec.Command(gs, "-q", "-dBATCH", "-dNOPAUSE", "-dSAFER", "-sDEVICE=png16m", "-r24",
+		"-dFirstPage=1", "-dLastPage=1", "-sOutputFile="+thumb, path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(thumb)
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return link, nil
+}
+
+// writeSite writes the pages of the site, with the data of its search box,
+// and removes the pages of documents no longer in it.
+func writeSite(dir, title string, docs []*siteDocument) error {
+	years := groupSitePages(docs, "year-", func(d *siteDocument) string { return d.Year })
+	// Newest years first, and the undated last
+	slices.SortFunc(years, func(a, b *sitePage) int {
+		if a.Name == "undated" || b.Name == "undated" {
+			return strings.Compare(a.Name, b.Name)
+		}
+		return strings.Compare(b.Name, a.Name)
+	})
+	senders := groupSitePages(docs, "sender-", func(d *siteDocument) string { return d.Sender })
+	// Most documents first
+	slices.SortStableFunc(senders, func(a, b *sitePage) int { return len(b.Documents) - len(a.Documents) })
+
+	written := make(map[string]bool)
+	write := func(name, page string, data any) error {
+		written[name] = true
+		file, err := os.CreateTemp(dir, "."+name+".*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		err = siteTemplates.ExecuteTemplate(file, page, data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(file.Name(), 0644); err != nil {
+			return err
+		}
+		return os.Rename(file.Name(), filepath.Join(dir, name))
+	}
+	type pageData struct {
+		Title   string
+		Heading string
+		Page    *sitePage
+		Doc     *siteDocument
+		Years   []*sitePage
+		Senders []*sitePage
+		Recent  []*siteDocument
+		Total   int
+		Updated time.Time
+	}
+	base := pageData{Title: title, Years: years, Senders: senders, Total: len(docs), Updated: time.Now()}
+
+	index := base
+	index.Recent = docs[:min(len(docs), 25)]
+	if err := write("index.html", "index", index); err != nil {
+		return err
+	}
+	for _, pages := range [][]*sitePage{years, senders} {
+		for _, p := range pages {
+			data := base
+			data.Heading, data.Page = p.Name, p
+			if err := write(p.File, "list", data); err != nil {
+				return err
+			}
+		}
+	}
+	for _, doc := range docs {
+		data := base
+		data.Heading, data.Doc = doc.Subject, doc
+		if data.Heading == "" {
+			data.Heading = doc.OrigName
+		}
+		if err := write("doc-"+doc.ID+".html", "document", data); err != nil {
+			return err
+		}
+	}
+
+	// The search box reads the documents from a script rather than with
+	// fetch, which browsers refuse for pages opened from the disk
+	type searchEntry struct {
+		ID       string `json:"id"`
+		Date     string `json:"date,omitempty"`
+		From     string `json:"from,omitempty"`
+		Subject  string `json:"subject,omitempty"`
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	entries := make([]searchEntry, 0, len(docs))
+	for _, doc := range docs {
+		entry := searchEntry{ID: doc.ID, From: doc.From, Subject: doc.Subject, Filename: doc.OrigName, Size: doc.Size}
+		if doc.Date != nil {
+			entry.Date = doc.Date.Format("2006-01-02")
+		}
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	static := map[string]string{
+		"documents.js": "var documents = " + string(data) + ";\n",
+		"site.js":      siteScript,
+		"style.css":    siteStyle,
+	}
+	for name, content := range static {
+		written[name] = true
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	// Pages of documents, years and senders that are gone
+	for _, pattern := range []string{"doc-*.html", "year-*.html", "sender-*.html"} {
+		old, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range old {
+			if !written[filepath.Base(path)] {
+				os.Remove(path)
+			}
+		}
+	}
+	return nil
+}
+
+// groupSitePages groups documents into pages by key, named prefix and the
+// key, in the order of the documents within each.
+func groupSitePages(docs []*siteDocument, prefix string, key func(*siteDocument) string) []*sitePage {
+	var pages []*sitePage
+	byName := make(map[string]*sitePage)
+	for _, doc := range docs {
+		name := key(doc)
+		p, ok := byName[name]
+		if !ok {
+			p = &sitePage{Name: name, File: prefix + sitePageName(name) + ".html"}
+			byName[name] = p
+			pages = append(pages, p)
+		}
+		p.Documents = append(p.Documents, doc)
+	}
+	return pages
+}
+
+// sitePageName makes a key safe to use in a filename.
+func sitePageName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+}
+
+var siteTemplates = template.Must(template.New("site").Funcs(template.FuncMap{
+	"size": formatSize,
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Heading}}{{.Heading}} - {{end}}{{.Title}}</title>
+<link rel="stylesheet" href="style.css">
+</head>
+<body>
+<header><a href="index.html">{{.Title}}</a></header>
+<main>
+{{end}}
+
+{{define "footer"}}</main>
+<footer>{{.Total}} documents, updated {{.Updated.Format "2006-01-02 15:04"}} by maildir2pdf</footer>
+<script src="site.js"></script>
+</body>
+</html>
+{{end}}
+
+{{define "table"}}<table class="sortable">
+<thead>
+<tr><th></th><th data-type="text">Date</th><th data-type="text">Sender</th><th data-type="text">Subject</th><th data-type="text">Filename</th><th data-type="number">Size</th></tr>
+</thead>
+<tbody>
+{{- range .}}
+<tr><td class="thumb">{{if .Thumb}}<a href="doc-{{.ID}}.html"><img src="{{.Thumb}}" alt="" loading="lazy"></a>{{end}}</td><td class="date" data-sort="{{with .Date}}{{.Format "2006-01-02T15:04:05Z07:00"}}{{end}}">{{with .Date}}{{.Format "2006-01-02"}}{{end}}</td><td title="{{.From}}"><a href="sender-{{.Sender}}.html">{{.From}}</a></td><td><a href="doc-{{.ID}}.html">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a></td><td>{{.OrigName}}</td><td class="size" data-sort="{{.Size}}">{{size .Size}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+<h1>{{.Title}}</h1>
+<input type="search" id="search" placeholder="Search subjects, senders and filenames" aria-label="Search">
+<table id="results" hidden>
+<thead><tr><th>Date</th><th>Sender</th><th>Subject</th><th>Filename</th></tr></thead>
+<tbody></tbody>
+</table>
+<div id="browse">
+<section>
+<h2>By year</h2>
+<ul class="groups">
+{{- range .Years}}
+<li><a href="{{.File}}">{{.Name}}</a> <span>{{len .Documents}}</span></li>
+{{- end}}
+</ul>
+</section>
+<section>
+<h2>By sender</h2>
+<ul class="groups">
+{{- range .Senders}}
+<li><a href="{{.File}}">{{.Name}}</a> <span>{{len .Documents}}</span></li>
+{{- end}}
+</ul>
+</section>
+<section>
+<h2>Latest</h2>
+{{template "table" .Recent}}
+</section>
+</div>
+<script src="documents.js"></script>
+{{template "footer" .}}{{end}}
+
+{{define "list"}}{{template "header" .}}
+<h1>{{.Page.Name}} <span>{{len .Page.Documents}} documents</span></h1>
+{{template "table" .Page.Documents}}
+{{template "footer" .}}{{end}}
+
+{{define "document"}}{{template "header" .}}
+{{with .Doc}}
+<h1>{{if .Subject}}{{.Subject}}{{else}}{{.OrigName}}{{end}}</h1>
+<dl>
+<dt>From</dt><dd>{{.From}} (<a href="sender-{{.Sender}}.html">{{.Sender}}</a>)</dd>
+<dt>Date</dt><dd>{{with .Date}}{{.Format "Mon, 2 Jan 2006 15:04"}}{{else}}undated{{end}} (<a href="year-{{.Year}}.html">{{.Year}}</a>)</dd>
+<dt>File</dt><dd><a href="{{.Href}}">{{.OrigName}}</a>, {{size .Size}}</dd>
+<dt>Mailbox</dt><dd>{{.Mailbox}}</dd>
+{{- if .MessageID}}
+<dt>Message-ID</dt><dd>{{.MessageID}}</dd>
+{{- end}}
+<dt>SHA-256</dt><dd><code>{{.SHA256}}</code></dd>
+</dl>
+{{if eq .Kind "pdf"}}<object class="preview" data="{{.Href}}" type="application/pdf"><p><a href="{{.Href}}">Open {{.OrigName}}</a></p></object>
+{{else if eq .Kind "image"}}<img class="preview" src="{{.Href}}" alt="{{.OrigName}}">
+{{end}}
+{{end}}
+{{template "footer" .}}{{end}}
+`))
+
+const siteStyle = `body { font-family: system-ui, sans-serif; margin: 0; color: #222; }
+header { background: #333; padding: 0.6em 1.5em; }
+header a { color: #fff; text-decoration: none; font-weight: bold; }
+main { margin: 1.5em; }
+footer { margin: 1.5em; color: #777; font-size: 0.9em; }
+h1 span { color: #777; font-size: 0.6em; font-weight: normal; }
+a { color: #0645ad; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+table.sortable th[data-type] { cursor: pointer; user-select: none; }
+th[aria-sort=ascending]::after { content: " \25B2"; }
+th[aria-sort=descending]::after { content: " \25BC"; }
+td.size { text-align: right; white-space: nowrap; }
+td.date { white-space: nowrap; }
+td.thumb img { max-width: 60px; max-height: 85px; border: 1px solid #ccc; }
+ul.groups { list-style: none; padding: 0; columns: 14em; }
+ul.groups span { color: #777; }
+input[type=search] { font: inherit; padding: 0.4em; width: 100%; max-width: 40em; margin-bottom: 1em; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 0.3em 1em; }
+dt { font-weight: bold; }
+dd { margin: 0; word-break: break-all; }
+.preview { width: 100%; height: 80vh; border: 1px solid #ccc; object-fit: contain; }
+`
+
+const siteScript = `(function () {
+	document.querySelectorAll("table.sortable").forEach(function (table) {
+		var tbody = table.tBodies[0];
+		var headers = table.querySelectorAll("th");
+		headers.forEach(function (th, i) {
+			var type = th.getAttribute("data-type");
+			if (!type) {
+				return;
+			}
+			th.addEventListener("click", function () {
+				var order = th.getAttribute("aria-sort") === "ascending" ? "descending" : "ascending";
+				headers.forEach(function (h) { h.removeAttribute("aria-sort"); });
+				th.setAttribute("aria-sort", order);
+				var rows = Array.prototype.slice.call(tbody.rows);
+				rows.sort(function (a, b) {
+					var x = value(a.cells[i], type), y = value(b.cells[i], type);
+					var c = x < y ? -1 : x > y ? 1 : 0;
+					return order === "ascending" ? c : -c;
+				});
+				rows.forEach(function (row) { tbody.appendChild(row); });
+			});
+		});
+	});
+	function value(cell, type) {
+		var v = cell.hasAttribute("data-sort") ? cell.getAttribute("data-sort") : cell.textContent;
+		return type === "number" ? Number(v) : v.toLowerCase();
+	}
+
+	var search = document.getElementById("search");
+	if (!search || typeof documents === "undefined") {
+		return;
+	}
+	var results = document.getElementById("results");
+	var browse = document.getElementById("browse");
+	function cell(row, text, href) {
+		var td = row.insertCell();
+		if (href) {
+			var a = document.createElement("a");
+			a.href = href;
+			a.textContent = text;
+			td.appendChild(a);
+		} else {
+			td.textContent = text;
+		}
+	}
+	search.addEventListener("input", function () {
+		var words = search.value.toLowerCase().split(/\s+/).filter(Boolean);
+		results.hidden = words.length === 0;
+		browse.hidden = words.length > 0;
+		var tbody = results.tBodies[0];
+		tbody.textContent = "";
+		if (words.length === 0) {
+			return;
+		}
+		var shown = 0;
+		for (var i = 0; i < documents.length && shown < 200; i++) {
+			var d = documents[i];
+			var text = [d.date, d.from, d.subject, d.filename].join(" ").toLowerCase();
+			if (!words.every(function (w) { return text.indexOf(w) >= 0; })) {
+				continue;
+			}
+			var row = tbody.insertRow();
+			cell(row, d.date || "");
+			cell(row, d.from || "");
+			cell(row, d.subject || "(no subject)", "doc-" + d.id + ".html");
+			cell(row, d.filename);
+			shown++;
+		}
+	});
+})();
+`
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"maildir2pdf/extract"
+)
+
+// sizeBuckets are the upper bounds of the attachment size histogram.
+var sizeBuckets = []int64{10 << 10, 100 << 10, 1 << 20, 10 << 20}
+
+// tally counts attachments and their total size.
+type tally struct {
+	count int
+	bytes int64
+}
+
+func (t *tally) add(size int64) {
+	t.count++
+	t.bytes += size
+}
+
+// scanStats implements "maildir2pdf stats" without -state: it scans the
+// sources without saving anything, and prints the attachments found per
+// mailbox, the top senders of PDFs and a histogram of attachment sizes, to
+// help plan storage before extracting.
+func scanStats(sources *sourceFlags, files []string, top int) error {
+	var mu sync.Mutex
+	var messages int
+	var all, pdfs tally
+	byMailbox := make(map[string]*tally)
+	bySender := make(map[string]*tally)
+	histogram := make([]int, len(sizeBuckets)+1)
+
+	x := extract.NewExtractor("")
+	x.OnMessage = func(*extract.Email) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages++
+	}
+	x.Handler = func(a *extract.Attachment, content io.Reader) error {
+		size, err := io.Copy(io.Discard, content)
+		if err != nil {
+			return fmt.Errorf("error reading attachment %s: %v", a.Filename, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		all.add(size)
+		if byMailbox[a.Email.Mailbox] == nil {
+			byMailbox[a.Email.Mailbox] = &tally{}
+		}
+		byMailbox[a.Email.Mailbox].add(size)
+		if a.MediaType == "application/pdf" {
+			pdfs.add(size)
+			sender := strings.ToLower(a.Email.From)
+			if sender == "" {
+				sender = "(unknown)"
+			}
+			if bySender[sender] == nil {
+				bySender[sender] = &tally{}
+			}
+			bySender[sender].add(size)
+		}
+		bucket := sort.Search(len(sizeBuckets), func(i int) bool { return size < sizeBuckets[i] })
+		histogram[bucket]++
+		return nil
+	}
+	if err := dryRun(sources, files, x); err != nil {
+		return err
+	}
+
+	fmt.Printf("Messages scanned: %d\n", messages)
+	fmt.Printf("Attachments: %d (%s)\n", all.count, formatSize(all.bytes))
+	fmt.Printf("PDFs: %d (%s)\n", pdfs.count, formatSize(pdfs.bytes))
+
+	if len(byMailbox) > 0 {
+		fmt.Println("Attachments by mailbox:")
+	}
+	for _, mailbox := range sortedKeys(byMailbox) {
+		t := byMailbox[mailbox]
+		fmt.Printf("  %s: %d (%s)\n", mailbox, t.count, formatSize(t.bytes))
+	}
+
+	senders := sortedKeys(bySender)
+	sort.SliceStable(senders, func(i, j int) bool { return bySender[senders[i]].count > bySender[senders[j]].count })
+	if len(senders) > top {
+		senders = senders[:max(top, 0)]
+	}
+	if len(senders) > 0 {
+		fmt.Println("Top senders of PDFs:")
+	}
+	for _, sender := range senders {
+		t := bySender[sender]
+		fmt.Printf("  %s: %d (%s)\n", sender, t.count, formatSize(t.bytes))
+	}
+
+	if all.count == 0 {
+		return nil
+	}
+	fmt.Println("Attachment sizes:")
+	most := 0
+	for _, n := range histogram {
+		most = max(most, n)
+	}
+	for i, n := range histogram {
+		var label string
+		switch {
+		case i == 0:
+			label = "< " + formatSize(sizeBuckets[0])
+		case i == len(sizeBuckets):
+			label = ">= " + formatSize(sizeBuckets[i-1])
+		default:
+			label = formatSize(sizeBuckets[i-1]) + " - " + formatSize(sizeBuckets[i])
+		}
+		line := fmt.Sprintf("  %-15s %6d %s", label, n, strings.Repeat("#", (40*n+most-1)/most))
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	return nil
+}
+
+// formatSize formats a number of bytes with binary units, e.g. "1.5 MB".
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if value == float64(int64(value)) {
+		return fmt.Sprintf("%d %cB", int64(value), units[unit])
+	}
+	return fmt.Sprintf("%.1f %cB", value, units[unit])
+}
+
+func sortedKeys(m map[string]*tally) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// runSummary tallies what a run of extract did, for the summary logged at
+// the end and written by -summary.
+type runSummary struct {
+	mu        sync.Mutex
+	mailboxes map[string]bool
+
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	Elapsed         float64   `json:"elapsed_seconds"`
+	Mailboxes       int       `json:"mailboxes_scanned"`
+	Messages        int       `json:"messages_parsed"`
+	MessagesSkipped int       `json:"messages_skipped"` // by date, headers or state
+	Failures        int       `json:"parse_failures"`
+	Attachments     int       `json:"attachments_found"`
+	Extracted       int       `json:"extracted"`
+	Filtered        int       `json:"skipped_by_filter"` // by -dispositions, -name-glob, -filter or a skip rule
+	Duplicates      int       `json:"duplicates"`
+	Quarantined     int       `json:"quarantined"`
+	BytesWritten    int64     `json:"bytes_written"`
+	Errors          []string  `json:"errors,omitempty"` // including those that only lost part of a message
+
+	files []string // extracted, for -mail-to
+}
+
+// maxReportedErrors is how many errors the summary logs; -summary has all.
+const maxReportedErrors = 100
+
+func newRunSummary() *runSummary {
+	return &runSummary{Started: time.Now(), mailboxes: make(map[string]bool)}
+}
+
+func (r *runSummary) mailbox(m extract.Mailbox) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mailboxes[m.Name] = true
+}
+
+func (r *runSummary) message(email *extract.Email) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mailboxes[email.Mailbox] = true
+	r.Messages++
+}
+
+func (r *runSummary) skipped(s *extract.Skipped) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mailboxes[s.Email.Mailbox] = true
+	if s.Attachment == nil {
+		r.Messages++
+		r.MessagesSkipped++
+	} else {
+		r.Attachments++
+		r.Filtered++
+	}
+}
+
+func (r *runSummary) saved(s *extract.Saved) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Attachments++
+	switch {
+	case s.DuplicateOf != "":
+		r.Duplicates++
+	case s.Quarantined != "":
+		r.Quarantined++
+		r.BytesWritten += s.Size
+	default:
+		r.Extracted++
+		r.BytesWritten += s.Size
+		r.files = append(r.files, s.Path)
+	}
+}
+
+// failed records an error that stopped a message being processed.
+func (r *runSummary) failed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failures++
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// partFailed records an error that lost part of a message.
+func (r *runSummary) partFailed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, err.Error())
+}
+
+func (r *runSummary) errorCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Errors)
+}
+
+// finish stops the clock, logs the summary, followed by the errors met
+// along the way, and if path is set, writes it there as JSON.
+func (r *runSummary) finish(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+	r.Elapsed = r.Finished.Sub(r.Started).Round(time.Millisecond).Seconds()
+	r.Mailboxes = len(r.mailboxes)
+
+	slog.Info("Summary", "mailboxes", r.Mailboxes, "messages", r.Messages, "messages_skipped", r.MessagesSkipped,
+		"failures", r.Failures, "attachments", r.Attachments, "extracted", r.Extracted, "filtered", r.Filtered,
+		"duplicates", r.Duplicates, "quarantined", r.Quarantined, "bytes", r.BytesWritten,
+		"elapsed", r.Finished.Sub(r.Started).Round(time.Millisecond))
+	if len(r.Errors) > 0 {
+		slog.Error("Run finished with errors", "count", len(r.Errors))
+		for _, err := range r.Errors[:min(len(r.Errors), maxReportedErrors)] {
+			slog.Error("Error during the run", "error", err)
+		}
+		if len(r.Errors) > maxReportedErrors {
+			slog.Error("More errors not listed; -summary records them all", "count", len(r.Errors)-maxReportedErrors)
+		}
+	}
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// runTUI implements "maildir2pdf tui", which takes the flags of extract but
+// lists the attachments it would save on the terminal first, for the user
+// to choose those it extracts.
+func runTUI(args []string) error {
+	return runExtraction("tui", args)
+}
+
+// attachmentKeys names the attachments an Extractor selects, so that those
+// chosen from one scan are recognized when scanning the same messages again:
+// by the message, the filename, and how many attachments of the message had
+// that name before.
+type attachmentKeys struct {
+	mu     sync.Mutex
+	emails map[*extract.Email]*emailKeys
+}
+
+type emailKeys struct {
+	names map[string]int
+	keys  map[*extract.Attachment]string
+}
+
+func newAttachmentKeys() *attachmentKeys {
+	return &attachmentKeys{emails: make(map[*extract.Email]*emailKeys)}
+}
+
+// key names a, which must be called once for each attachment of a message,
+// in order, as Filter is.
+func (k *attachmentKeys) key(a *extract.Attachment) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	e := k.emails[a.Email]
+	if e == nil {
+		e = &emailKeys{names: make(map[string]int), keys: make(map[*extract.Attachment]string)}
+		k.emails[a.Email] = e
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d", a.Email.Mailbox, a.Email.Path, a.Filename, e.names[a.Filename])
+	e.names[a.Filename]++
+	e.keys[a] = key
+	return key
+}
+
+// lookup returns the name key gave a.
+func (k *attachmentKeys) lookup(a *extract.Attachment) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if e := k.emails[a.Email]; e != nil {
+		return e.keys[a]
+	}
+	return ""
+}
+
+// done forgets the attachments of a message once it has been processed.
+func (k *attachmentKeys) done(email *extract.Email) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.emails, email)
+}
+
+// attachmentChoice is the attachments chosen for extraction with tui.
+type attachmentChoice struct {
+	chosen map[string]bool // by attachmentKeys key
+	keys   *attachmentKeys
+}
+
+// filter is the Filter of the Extractor saving the chosen attachments.
+func (c *attachmentChoice) filter(a *extract.Attachment) bool {
+	return c.chosen[c.keys.key(a)]
+}
+
+// tuiCandidate is an attachment listed by tui.
+type tuiCandidate struct {
+	key       string
+	path      string
+	mailbox   string
+	date      time.Time
+	from      string
+	fromName  string
+	subject   string
+	filename  string
+	mediaType string
+	size      int64
+	selected  bool
+}
+
+// chooseAttachments scans the sources for the attachments x would save, as
+// scan does, and lets the user choose those to extract on the terminal. It
+// returns nil if none were chosen.
+func chooseAttachments(sources *sourceFlags, files []string, x *extract.Extractor) (*attachmentChoice, error) {
+	// The options finding more attachments in messages are those of x;
+	// those making files of their own are not available with tui
+	probe := extract.NewExtractor("")
+	probe.Archives, probe.SevenZip, probe.SMIME, probe.EInvoices = x.Archives, x.SevenZip, x.SMIME, x.EInvoices
+	keys := newAttachmentKeys()
+	probe.Filter = func(a *extract.Attachment) bool {
+		// Messages recorded in the state database are skipped by the run
+		if x.State != nil && !x.Force {
+			if seen, err := x.State.Seen(a.Email); err == nil && seen {
+				return false
+			}
+		}
+		keys.key(a)
+		return true
+	}
+	var mu sync.Mutex
+	var candidates []*tuiCandidate
+	probe.Handler = func(a *extract.Attachment, content io.Reader) error {
+		size, err := io.Copy(io.Discard, content)
+		if err != nil {
+			return fmt.Errorf("error reading attachment %s: %v", a.Filename, err)
+		}
+		email := a.Email
+		mu.Lock()
+		defer mu.Unlock()
+		candidates = append(candidates, &tuiCandidate{
+			key:       keys.lookup(a),
+			path:      email.Path,
+			mailbox:   email.Mailbox,
+			date:      email.Date,
+			from:      email.From,
+			fromName:  email.FromName,
+			subject:   email.Subject,
+			filename:  a.Filename,
+			mediaType: a.MediaType,
+			size:      size,
+		})
+		return nil
+	}
+	probe.OnMessage = keys.done
+
+	slog.Info("Scanning for attachments to choose from")
+	if err := dryRun(sources, files, probe); err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		fmt.Println("No attachments found")
+		return nil, nil
+	}
+	// Workers finish messages in any order
+	slices.SortFunc(candidates, func(a, b *tuiCandidate) int {
+		if c := a.date.Compare(b.date); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+
+	b := &tuiBrowser{items: candidates}
+	ok, err := b.run(os.Stdin, os.Stdout)
+	if err != nil {
+		return nil, fatal("Error running terminal interface", "error", err)
+	}
+	choice := &attachmentChoice{chosen: make(map[string]bool), keys: newAttachmentKeys()}
+	for _, c := range candidates {
+		if c.selected {
+			choice.chosen[c.key] = true
+		}
+	}
+	if !ok || len(choice.chosen) == 0 {
+		fmt.Println("Nothing chosen, nothing extracted")
+		return nil, nil
+	}
+	return choice, nil
+}
+
+// tuiBrowser is the terminal interface of tui: a list of attachments, with
+// the details of the one under the cursor below it.
+type tuiBrowser struct {
+	items   []*tuiCandidate
+	cursor  int
+	top     int // first item shown
+	width   int
+	height  int
+	message string // shown instead of the keys until the next one
+}
+
+// tuiDetailLines is the number of lines showing the details of the
+// attachment under the cursor.
+const tuiDetailLines = 5
+
+// run shows the list on the terminal until the user asks to extract the
+// selection, which it reports as true, or quits.
+func (b *tuiBrowser) run(in, out *os.File) (bool, error) {
+	restore, err := makeRaw(in)
+	if err != nil {
+		return false, err
+	}
+	defer restore()
+	if b.width, b.height, err = terminalSize(out); err != nil {
+		return false, err
+	}
+	// The alternate screen leaves the terminal as it was on the way out
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- bytes.Clone(buf[:n])
+		}
+	}()
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+	defer signal.Stop(resized)
+
+	for {
+		b.draw(out)
+		select {
+		case <-resized:
+			if width, height, err := terminalSize(out); err == nil {
+				b.width, b.height = width, height
+			}
+		case data, ok := <-keys:
+			if !ok {
+				return false, nil
+			}
+			for _, key := range parseKeys(data) {
+				if done, extract := b.handle(key); done {
+					return extract, nil
+				}
+			}
+		}
+	}
+}
+
+// parseKeys returns the names of the keys read from the terminal, such as
+// "up" or "q".
+func parseKeys(data []byte) []string {
+	sequences := []struct{ seq, key string }{
+		{"\x1b[A", "up"}, {"\x1bOA", "up"},
+		{"\x1b[B", "down"}, {"\x1bOB", "down"},
+		{"\x1b[5~", "pgup"}, {"\x1b[6~", "pgdn"},
+		{"\x1b[H", "home"}, {"\x1bOH", "home"}, {"\x1b[1~", "home"},
+		{"\x1b[F", "end"}, {"\x1bOF", "end"}, {"\x1b[4~", "end"},
+	}
+	var keys []string
+	for s := string(data); s != ""; {
+		if s[0] == '\x1b' {
+			i := slices.IndexFunc(sequences, func(e struct{ seq, key string }) bool { return strings.HasPrefix(s, e.seq) })
+			if i >= 0 {
+				keys = append(keys, sequences[i].key)
+				s = s[len(sequences[i].seq):]
+				continue
+			}
+			if len(s) == 1 {
+				keys = append(keys, "esc")
+				break
+			}
+			// Other sequences, such as those of function keys, are ignored
+			if end := strings.IndexFunc(s[1:], func(r rune) bool { return r >= '@' && r <= '~' && r != '[' && r != 'O' }); end >= 0 {
+				s = s[end+2:]
+			} else {
+				s = ""
+			}
+			continue
+		}
+		switch s[0] {
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		case 3:
+			keys = append(keys, "ctrl-c")
+		default:
+			keys = append(keys, s[:1])
+		}
+		s = s[1:]
+	}
+	return keys
+}
+
+// handle acts on a key, reporting whether the browser is done, and if so
+// whether to extract the selection.
+func (b *tuiBrowser) handle(key string) (done, extract bool) {
+	b.message = ""
+	page := max(1, b.listHeight()-1)
+	switch key {
+	case "up", "k":
+		b.cursor--
+	case "down", "j":
+		b.cursor++
+	case "pgup":
+		b.cursor -= page
+	case "pgdn":
+		b.cursor += page
+	case "home", "g":
+		b.cursor = 0
+	case "end", "G":
+		b.cursor = len(b.items) - 1
+	case " ":
+		b.items[b.cursor].selected = !b.items[b.cursor].selected
+		b.cursor++
+	case "a":
+		// Selects all, unless all are selected already
+		all := !slices.ContainsFunc(b.items, func(c *tuiCandidate) bool { return !c.selected })
+		for _, c := range b.items {
+			c.selected = !all
+		}
+	case "enter", "x":
+		if !slices.ContainsFunc(b.items, func(c *tuiCandidate) bool { return c.selected }) {
+			b.message = "Nothing selected: select attachments with space, or quit with q"
+			break
+		}
+		return true, true
+	case "q", "esc", "ctrl-c":
+		return true, false
+	}
+	b.cursor = max(0, min(b.cursor, len(b.items)-1))
+	return false, false
+}
+
+// listHeight returns the number of lines listing attachments, below the
+// title and above the details and the keys.
+func (b *tuiBrowser) listHeight() int {
+	return max(1, b.height-tuiDetailLines-3)
+}
+
+func (b *tuiBrowser) draw(out io.Writer) {
+	height := b.listHeight()
+	if b.cursor < b.top {
+		b.top = b.cursor
+	} else if b.cursor >= b.top+height {
+		b.top = b.cursor - height + 1
+	}
+
+	var selected int
+	var size int64
+	for _, c := range b.items {
+		if c.selected {
+			selected++
+			size += c.size
+		}
+	}
+	var screen strings.Builder
+	line := func(s string) {
+		// Raw mode leaves newlines alone, so each line returns the cursor too
+		if screen.Len() > 0 {
+			screen.WriteString("\r\n")
+		}
+		screen.WriteString("\x1b[2K" + s)
+	}
+	screen.WriteString("\x1b[H")
+	line("\x1b[7m" + tuiFit(fmt.Sprintf(" maildir2pdf: %d attachments, %d selected (%s)", len(b.items), selected, formatSize(size)), b.width) + "\x1b[0m")
+
+	// Checkbox, date, sender, filename and size, the sender taking a third
+	// of the room left
+	room := max(b.width-29, 10)
+	senderWidth := room / 3
+	for i := b.top; i < b.top+height; i++ {
+		if i >= len(b.items) {
+			line("")
+			continue
+		}
+		c := b.items[i]
+		box := "[ ]"
+		if c.selected {
+			box = "[x]"
+		}
+		date := "undated"
+		if !c.date.IsZero() {
+			date = c.date.Format("2006-01-02")
+		}
+		sender := c.from
+		if c.fromName != "" {
+			sender = c.fromName
+		}
+		row := fmt.Sprintf("%s %-10s  %s  %s  %9s", box, date, tuiFit(sender, senderWidth), tuiFit(c.filename, room-senderWidth), formatSize(c.size))
+		if i == b.cursor {
+			row = "\x1b[7m" + tuiFit(row, b.width) + "\x1b[0m"
+		} else {
+			row = tuiFit(row, b.width)
+		}
+		line(row)
+	}
+
+	line(strings.Repeat("─", max(b.width, 0)))
+	c := b.items[b.cursor]
+	from := c.from
+	if c.fromName != "" {
+		from = fmt.Sprintf("%s <%s>", c.fromName, c.from)
+	}
+	date := "none"
+	if !c.date.IsZero() {
+		date = c.date.Format("Mon, 2 Jan 2006 15:04 -0700")
+	}
+	line(tuiFit("Subject: "+c.subject, b.width))
+	line(tuiFit("From:    "+from, b.width))
+	line(tuiFit("Date:    "+date, b.width))
+	line(tuiFit(fmt.Sprintf("File:    %s, %s, %s", c.filename, c.mediaType, formatSize(c.size)), b.width))
+	line(tuiFit("Message: "+c.path+" in "+c.mailbox, b.width))
+
+	help := b.message
+	if help == "" {
+		help = "↑/↓ move  space select  a all/none  enter extract selected  q quit"
+	}
+	line("\x1b[7m" + tuiFit(" "+help, b.width) + "\x1b[0m")
+	io.WriteString(out, screen.String())
+}
+
+// tuiFit pads or truncates s to width characters, replacing control
+// characters, which could move the cursor.
+func tuiFit(s string, width int) string {
+	runes := []rune(strings.Map(func(r rune) rune {
+		if r < ' ' || r >= 0x7f && r < 0xa0 {
+			return '?'
+		}
+		return r
+	}, s))
+	if len(runes) > width {
+		if width < 1 {
+			return ""
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	return string(runes) + strings.Repeat(" ", width-len(runes))
+}
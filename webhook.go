@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// Values of -webhook-per.
+const (
+	webhookPerDocument = "document" // a "saved" Event for each file saved
+	webhookPerRun      = "run"      // a webhookRun at the end of each run
+)
+
+// webhookRun is posted by -webhook-per run when a run ends.
+type webhookRun struct {
+	Event      string    `json:"event"` // "run"
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Saved      int       `json:"saved"`
+	Duplicates int       `json:"duplicates"`
+	Files      []Event   `json:"files"` // the "saved" event of each file saved
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// webhook posts JSON to the -webhook URL as files are saved or runs end.
+// Requests are sent one at a time, in the background, so that a slow
+// endpoint does not hold up extraction; close waits for those queued.
+type webhook struct {
+	url    string
+	perRun bool
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+
+	mu  sync.Mutex
+	run webhookRun
+}
+
+// webhookAttempts is how many times a request is tried before giving up,
+// waiting a little longer after each failure.
+const webhookAttempts = 3
+
+func newWebhook(url, per string) (*webhook, error) {
+	if per != webhookPerDocument && per != webhookPerRun {
+		return nil, fmt.Errorf("-webhook-per must be %s or %s", webhookPerDocument, webhookPerRun)
+	}
+	w := &webhook{
+		url:    url,
+		perRun: per == webhookPerRun,
+		client: &http.Client{Timeout: 30 * time.Second},
+		queue:  make(chan []byte, 100),
+		done:   make(chan struct{}),
+	}
+	w.startRun()
+	go w.send()
+	return w, nil
+}
+
+func (w *webhook) send() {
+	defer close(w.done)
+	for payload := range w.queue {
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = w.post(payload); err == nil {
+				break
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			slog.Error("Error calling webhook", "url", w.url, "error", err)
+		}
+	}
+}
+
+func (w *webhook) post(payload []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhook) enqueue(v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Error encoding webhook payload", "error", err)
+		return
+	}
+	w.queue <- payload
+}
+
+func (w *webhook) saved(s *extract.Saved) {
+	if s.Quarantined != "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if s.DuplicateOf != "" {
+		w.run.Duplicates++
+		return
+	}
+	ev := emailEvent("saved", s.Email)
+	ev.Time = s.Time
+	ev.OrigName = s.Filename
+	ev.Output = s.Path
+	ev.Size = s.Size
+	ev.SHA256 = s.SHA256
+	w.run.Saved++
+	if w.perRun {
+		w.run.Files = append(w.run.Files, ev)
+	} else {
+		w.enqueue(ev)
+	}
+}
+
+func (w *webhook) failed(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.run.Errors = append(w.run.Errors, err.Error())
+}
+
+func (w *webhook) startRun() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.run = webhookRun{Event: "run", Started: time.Now(), Files: []Event{}}
+}
+
+// endRun posts the run with -webhook-per run, unless quiet is set and it
+// neither saved anything nor met errors, as for most runs of the daemon.
+func (w *webhook) endRun(quiet bool) {
+	if !w.perRun {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if quiet && w.run.Saved == 0 && len(w.run.Errors) == 0 {
+		return
+	}
+	w.run.Finished = time.Now()
+	w.enqueue(&w.run)
+}
+
+// close waits for the requests queued to be sent.
+func (w *webhook) close() {
+	close(w.queue)
+	<-w.done
+}
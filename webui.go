@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"maildir2pdf/extract"
+)
+
+// webPageSize is the number of files listed per page by the web interface.
+const webPageSize = 100
+
+// webUI is the web interface of the daemon, served with -web-addr: its
+// configuration, how its runs went and their errors, a button starting a
+// run, and the files saved, to download.
+type webUI struct {
+	status    *daemonStatus
+	state     *extract.StateDB
+	settings  []webSetting // the configuration shown
+	outputDir string       // files under it can be downloaded; empty for a remote -output
+	password  string       // asked for with HTTP basic authentication, if set
+}
+
+// webSetting is a line of the configuration shown by the web interface.
+type webSetting struct {
+	Name   string
+	Values []string
+}
+
+// webFile is a file saved by the daemon, or an earlier run, as listed by the
+// web interface.
+type webFile struct {
+	extract.Recorded
+	ID   string // from its message and part; see documentID
+	Name string // of the file, without its directory
+	Kept bool   // it can still be downloaded
+}
+
+// documentID identifies a saved file in the URLs of the web interface by
+// the key of its message and its part, so that it can be looked up.
+func documentID(r extract.Recorded) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(r.Key)) + "." + strconv.Itoa(r.Part)
+}
+
+// handler returns the handler serving the interface.
+func (ui *webUI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", ui.serveHome)
+	mux.HandleFunc("POST /run", ui.serveRun)
+	mux.HandleFunc("GET /files", ui.serveFiles)
+	mux.HandleFunc("GET /files/{id}", ui.serveFile)
+	ui.registerAPI(mux)
+	return ui.authenticate(mux)
+}
+
+// authenticate asks for the password, if there is one, and turns away
+// requests that may come from other sites: without a password, those for
+// a host name other than a loopback one, as a DNS rebinding attack would
+// make, and posts not marked by the browser as coming from the interface
+// itself.
+func (ui *webUI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ui.password != "" {
+			_, password, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(ui.password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="maildir2pdf", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		} else if !loopbackHost(r.Host) {
+			http.Error(w, "Host not allowed", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost && !sameOrigin(r) {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether r comes from the interface itself, as its
+// Origin header or, failing that, its Sec-Fetch-Site header says. Requests
+// with neither are refused, so that clients other than browsers must set
+// one of them.
+func sameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	return r.Header.Get("Sec-Fetch-Site") == "same-origin"
+}
+
+func (ui *webUI) serveHome(w http.ResponseWriter, r *http.Request) {
+	ui.status.mu.Lock()
+	status := struct {
+		Running     bool
+		Runs        int
+		Started     time.Time
+		NextRun     *time.Time
+		Total       runCounts
+		LastError   string
+		LastErrorAt *time.Time
+	}{ui.status.Running, ui.status.Runs, ui.status.Started, ui.status.NextRun, ui.status.Total,
+		ui.status.LastError, ui.status.LastErrorAt}
+	ui.status.mu.Unlock()
+
+	ui.render(w, "home", map[string]any{
+		"Settings":  ui.settings,
+		"Status":    status,
+		"Runs":      ui.status.recentRuns(),
+		"Requested": r.URL.Query().Get("requested"),
+	})
+}
+
+func (ui *webUI) serveRun(w http.ResponseWriter, r *http.Request) {
+	id := ui.status.requestRun()
+	slog.Info("Run requested through the web interface", "run", id, "remote", r.RemoteAddr)
+	http.Redirect(w, r, "/?requested="+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// files returns the files recorded in the state database that match
+// filter, newest first, and how many match in all.
+func (ui *webUI) files(filter extract.RecordedFilter) ([]webFile, int, error) {
+	recorded, total, err := ui.state.SearchRecorded(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	files := make([]webFile, 0, len(recorded))
+	for _, r := range recorded {
+		files = append(files, ui.webFile(r))
+	}
+	return files, total, nil
+}
+
+// file returns the file with the given ID.
+func (ui *webUI) file(id string) (webFile, bool, error) {
+	i := strings.LastIndexByte(id, '.')
+	if i < 0 {
+		return webFile{}, false, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(id[:i])
+	if err != nil {
+		return webFile{}, false, nil
+	}
+	part, err := strconv.Atoi(id[i+1:])
+	if err != nil {
+		return webFile{}, false, nil
+	}
+	r, found, err := ui.state.RecordedPart(string(key), part)
+	if err != nil || !found {
+		return webFile{}, false, err
+	}
+	return ui.webFile(r), true, nil
+}
+
+func (ui *webUI) webFile(r extract.Recorded) webFile {
+	return webFile{Recorded: r, ID: documentID(r), Name: filepath.Base(r.Output), Kept: ui.local(r.Output) != ""}
+}
+
+// local returns output if it is a file under the output directory that
+// still exists, or "".
+func (ui *webUI) local(output string) string {
+	if ui.outputDir == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(ui.outputDir, output)
+	if err != nil || !filepath.IsLocal(rel) {
+		return ""
+	}
+	if info, err := os.Stat(output); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return output
+}
+
+func (ui *webUI) serveFiles(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	page = max(1, page)
+	filter := extract.RecordedFilter{Words: strings.Fields(query), Limit: webPageSize, Offset: (page - 1) * webPageSize}
+	shown, count, err := ui.files(filter)
+	pages := max(1, (count+webPageSize-1)/webPageSize)
+	if err == nil && page > pages {
+		// Past the end, as when files were removed: show the last page
+		page = pages
+		filter.Offset = (page - 1) * webPageSize
+		shown, count, err = ui.files(filter)
+	}
+	if err != nil {
+		slog.Error("Error reading the state database", "error", err)
+		http.Error(w, "Error reading the state database", http.StatusInternalServerError)
+		return
+	}
+
+	link := func(page int) string {
+		v := url.Values{"page": {strconv.Itoa(page)}}
+		if query != "" {
+			v.Set("q", query)
+		}
+		return "/files?" + v.Encode()
+	}
+	data := map[string]any{"Files": shown, "Query": query, "Count": count, "Page": page, "Pages": pages}
+	if page > 1 {
+		data["Previous"] = link(page - 1)
+	}
+	if page < pages {
+		data["Next"] = link(page + 1)
+	}
+	ui.render(w, "files", data)
+}
+
+func (ui *webUI) serveFile(w http.ResponseWriter, r *http.Request) {
+	f, found, err := ui.file(r.PathValue("id"))
+	if err != nil {
+		slog.Error("Error reading the state database", "error", err)
+		http.Error(w, "Error reading the state database", http.StatusInternalServerError)
+		return
+	}
+	if !found || !f.Kept {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(f.Output)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// PDFs and images are shown by the browser, and other files downloaded,
+	// as HTML saved from a message must not run as part of the interface
+	disposition := "attachment"
+	switch strings.ToLower(filepath.Ext(f.Name)) {
+	case ".pdf", ".jpg", ".jpeg", ".png", ".gif":
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": f.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, f.Name, info.ModTime(), file)
+}
+
+func (ui *webUI) render(w http.ResponseWriter, page string, data map[string]any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webTemplates.ExecuteTemplate(w, page, data); err != nil {
+		slog.Error("Error rendering web page", "page", page, "error", err)
+	}
+}
+
+// serveWebUI serves the web interface on addr until ctx is cancelled.
+func serveWebUI(ctx context.Context, addr string, ui *webUI) {
+	server := &http.Server{Addr: addr, Handler: ui.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Error serving the web interface", "addr", addr, "error", err)
+	}
+}
+
+// redactURL hides the password of a URL given as a remote -output, and
+// leaves local paths as they are.
+func redactURL(location string) string {
+	if u, err := url.Parse(location); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return location
+}
+
+// loopbackAddr reports whether addr, as given to -web-addr, only listens
+// on the loopback interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loopbackHost reports whether host, as in the Host header of a request,
+// names the loopback interface.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+var webTemplates = template.Must(template.New("web").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+	"duration": func(run daemonRun) string {
+		if run.End == nil {
+			return "running"
+		}
+		if took := run.End.Sub(run.Start); took >= time.Second {
+			return took.Round(time.Second).String()
+		}
+		return "under a second"
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>maildir2pdf</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; color: #222; }
+nav { background: #333; padding: 0.6em 1.5em; }
+nav a { color: #fff; text-decoration: none; margin-right: 1.5em; }
+main { margin: 1.5em; max-width: 70em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+td.number { text-align: right; }
+.error { color: #b00; }
+.notice { background: #eef6ee; padding: 0.6em; }
+button { font: inherit; padding: 0.4em 1.2em; }
+input[type=search] { font: inherit; padding: 0.3em; width: 20em; }
+</style>
+</head>
+<body>
+<nav><a href="/">Status</a><a href="/files">Files</a></nav>
+<main>
+{{end}}
+
+{{define "footer"}}</main>
+</body>
+</html>
+{{end}}
+
+{{define "home"}}{{template "header"}}
+<h1>maildir2pdf</h1>
+{{with .Requested}}<p class="notice">Run {{.}} was requested; it starts as soon as the one in progress, if any, ends.</p>{{end}}
+{{with .Status}}
+<p>{{if .Running}}<strong>Running</strong>.{{else}}Waiting{{with .NextRun}}; next run at {{time .}}{{end}}.{{end}}
+{{.Runs}} runs since {{time .Started}}: {{.Total.Saved}} files saved, {{.Total.Duplicates}} duplicates, {{.Total.Errors}} errors.</p>
+{{if .LastError}}<p class="error">Last error{{with .LastErrorAt}} at {{time .}}{{end}}: {{.LastError}}</p>{{end}}
+{{end}}
+<form method="post" action="/run"><button type="submit">Scan now</button></form>
+
+<h2>Configuration</h2>
+<table>
+{{- range .Settings}}
+<tr><th>{{.Name}}</th><td>{{range $i, $v := .Values}}{{if $i}}<br>{{end}}{{$v}}{{end}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Runs</h2>
+{{if .Runs}}<table>
+<tr><th>Run</th><th>Started</th><th>Took</th><th>Trigger</th><th>Saved</th><th>Duplicates</th><th>Errors</th></tr>
+{{- range .Runs}}
+<tr><td>{{.ID}}</td><td>{{time .Start}}</td><td>{{duration .}}</td><td>{{.Trigger}}</td><td class="number">{{.Saved}}</td><td class="number">{{.Duplicates}}</td><td class="number">{{.Errors}}</td></tr>
+{{- if .ErrorMessages}}
+<tr><td></td><td colspan="6"><details><summary class="error">{{len .ErrorMessages}} errors</summary><ul>{{range .ErrorMessages}}<li>{{.}}</li>{{end}}</ul></details></td></tr>
+{{- end}}
+{{- end}}
+</table>
+{{else}}<p>No runs yet.</p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "files"}}{{template "header"}}
+<h1>Files</h1>
+<form method="get" action="/files"><input type="search" name="q" value="{{.Query}}" placeholder="Filename or mailbox" aria-label="Search"> <button type="submit">Search</button></form>
+<p>{{.Count}} files{{if gt .Pages 1}}, page {{.Page}} of {{.Pages}}{{end}}.</p>
+<table>
+<tr><th>Saved</th><th>File</th><th>Mailbox</th></tr>
+{{- range .Files}}
+<tr><td>{{time .SavedAt}}</td><td>{{if .Kept}}<a href="/files/{{.ID}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td><td>{{.Mailbox}}</td></tr>
+{{- end}}
+</table>
+<p>{{with .Previous}}<a href="{{.}}">Previous</a> {{end}}{{with .Next}}<a href="{{.}}">Next</a>{{end}}</p>
+{{template "footer"}}{{end}}
+`))